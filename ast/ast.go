@@ -39,6 +39,20 @@ type File struct {
 	Comments   []*Comment
 	Imports    []*ImportStmt
 	Directives []string
+
+	// Types are the interfaces and type aliases. They are not compiled
+	// but are kept to generate declarations.
+	Types []*TypeDecl
+
+	// TypeImports are the imports of type definition files.
+	TypeImports []*ImportStmt
+}
+
+// TypeDecl is an interface or a type alias with its source code.
+type TypeDecl struct {
+	Pos      Position
+	Exported bool
+	Code     string
 }
 
 func (f *File) AddDirective(directive string) error {
@@ -295,6 +309,10 @@ type FuncDeclStmt struct {
 	Anonymous bool
 	Comment   *Comment
 
+	// the type annotations as they are written in the source
+	TypeParams string
+	ReturnType string
+
 	// a Object value means that it is a method of that object
 	ReceiverType string
 }
@@ -306,11 +324,13 @@ func (i *FuncDeclStmt) declNode() {}
 func (i *FuncDeclStmt) stmtNode() {}
 
 type VarDeclStmt struct {
-	Pos             Position
-	Name            string
-	Value           Expr
-	Exported        bool
-	IsEnum          bool
+	Pos      Position
+	Name     string
+	Value    Expr
+	Exported bool
+	IsEnum   bool
+	IsConst  bool
+	Type     string // the type annotation as it is written in the source
 }
 
 func (i *VarDeclStmt) Position() Position {
@@ -448,7 +468,6 @@ type NewInstanceExpr struct {
 	Lparen Position
 	Args   []Expr
 	Rparen Position
-	Spread bool // if the last argument has a spread operator
 }
 
 func (i *NewInstanceExpr) Position() Position {
@@ -461,7 +480,6 @@ type CallExpr struct {
 	Lparen Position
 	Args   []Expr
 	Rparen Position
-	Spread bool // if the last argument has a spread operator
 }
 
 func (i *CallExpr) Position() Position {
@@ -469,6 +487,18 @@ func (i *CallExpr) Position() Position {
 }
 func (i *CallExpr) exprNode() {}
 
+// SpreadExpr expands the values of an array or an iterable in a call or
+// an array literal, or the keys of a map in a map literal: ...values
+type SpreadExpr struct {
+	Pos   Position
+	Value Expr
+}
+
+func (i *SpreadExpr) Position() Position {
+	return i.Pos
+}
+func (i *SpreadExpr) exprNode() {}
+
 type SelectorExpr struct {
 	X   Expr       // expression
 	Sel *IdentExpr // field selector
@@ -492,7 +522,7 @@ func (i *IndexExpr) Position() Position {
 func (i *IndexExpr) exprNode() {}
 
 type KeyValue struct {
-	Key   string
+	Key   string // empty if the value is a *SpreadExpr
 	Value Expr
 }
 
@@ -555,6 +585,8 @@ type Arguments struct {
 }
 
 type Field struct {
-	Pos  Position
-	Name string
+	Pos      Position
+	Name     string
+	Optional bool
+	Type     string // the type annotation as it is written in the source
 }
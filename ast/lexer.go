@@ -69,6 +69,7 @@ const (
 	FLOAT  // 123.45
 	RUNE   // 'a'
 	STRING // "abc"
+	REGEX  // /abc/i
 
 	// Operators and delimiters
 	ADD // +
@@ -239,6 +240,9 @@ func (l *Lexer) Run() error {
 			return nil
 		}
 
+		// the token is at the position of its first character
+		start := l.Pos
+
 		var buf bytes.Buffer
 
 		switch {
@@ -342,6 +346,16 @@ func (l *Lexer) Run() error {
 					token.Str = string(c)
 				}
 			case '/':
+				if l.regexAllowed() && l.peek() != '/' && l.peek() != '*' {
+					token.Type = REGEX
+					err := l.readRegex(&buf)
+					token.Str = buf.String()
+					if err != nil {
+						return err
+					}
+					break
+				}
+
 				switch l.peek() {
 				case '=':
 					token.Type = DIV_ASSIGN
@@ -353,6 +367,10 @@ func (l *Lexer) Run() error {
 					if strings.HasPrefix(str, directive) {
 						token.Type = DIRECTIVE
 						str = str[len(directive):]
+					} else if d := strings.TrimSpace(str); strings.HasPrefix(d, "[define ") && strings.HasSuffix(d, "]") {
+						// defines can also be written as: // [define DEBUG]
+						token.Type = DIRECTIVE
+						str = d[1 : len(d)-1]
 					} else {
 						token.Type = COMMENT
 					}
@@ -498,7 +516,7 @@ func (l *Lexer) Run() error {
 			}
 		}
 
-		l.addToken(token)
+		l.addToken(token, start)
 	}
 }
 
@@ -536,9 +554,8 @@ func (l *Lexer) readNumber(c byte, buf *bytes.Buffer, token *Token) error {
 	return nil
 }
 
-func (l *Lexer) addToken(t *Token) {
-	t.Pos = l.Pos
-	t.Pos.Column-- // base 0 for consistency with line nums
+func (l *Lexer) addToken(t *Token, pos Position) {
+	t.Pos = pos // the column is in base 1 like the line
 	l.Tokens = append(l.Tokens, t)
 }
 
@@ -611,6 +628,57 @@ func (l *Lexer) readString(quote byte, b *bytes.Buffer) error {
 	return nil
 }
 
+// regexAllowed returns true if a slash starts a regex literal instead of
+// a division: after an operand, like a number or a closing parenthesis,
+// it is a division.
+func (l *Lexer) regexAllowed() bool {
+	for i := len(l.Tokens) - 1; i >= 0; i-- {
+		switch l.Tokens[i].Type {
+		case COMMENT, MULTILINE_COMMENT, DIRECTIVE:
+			continue
+		case IDENT, INT, HEX, FLOAT, RUNE, STRING, REGEX, RPAREN, RBRACK, RBRACE,
+			TRUE, FALSE, NULL, UNDEFINED, INC, DEC:
+			return false
+		default:
+			return true
+		}
+	}
+	return true
+}
+
+// readRegex reads a literal like /[a-z]+/i including the slashes and the flags.
+func (l *Lexer) readRegex(b *bytes.Buffer) error {
+	b.WriteByte('/')
+
+	var class bool
+	for {
+		c := l.next()
+		switch c {
+		case '\n', '\r', eof:
+			return l.error(b.String(), "unterminated regex")
+		case '\\':
+			b.WriteByte(c)
+			c = l.next()
+			if c == '\n' || c == '\r' || c == eof {
+				return l.error(b.String(), "unterminated regex")
+			}
+		case '[':
+			class = true
+		case ']':
+			class = false
+		case '/':
+			if !class {
+				b.WriteByte(c)
+				for isIdent(l.peek(), 1) {
+					b.WriteByte(l.next())
+				}
+				return nil
+			}
+		}
+		b.WriteByte(c)
+	}
+}
+
 func (l *Lexer) readComment(b *bytes.Buffer) error {
 	l.next()
 
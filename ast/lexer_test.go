@@ -99,6 +99,8 @@ func TestLex(t *testing.T) {
 		{"\"bar \\n  foo\"", []Type{STRING}},
 		{"`xxxxx \n  qqqqq`", []Type{STRING}},
 		{"//gt: foo", []Type{DIRECTIVE}},
+		{"// [define DEBUG]", []Type{DIRECTIVE}},
+		{"// [x]", []Type{COMMENT}},
 		{`a := 0 // bla bla bla
 		  // this is a comment
 		  b := 0`, []Type{IDENT, DECL, INT, COMMENT,
@@ -108,6 +110,11 @@ func TestLex(t *testing.T) {
 		  */
 		  b := 0`, []Type{MULTILINE_COMMENT, IDENT, DECL, INT}},
 		{"1 /* foo */ 2", []Type{INT, MULTILINE_COMMENT, INT}},
+		{"a / b / 2", []Type{IDENT, DIV, IDENT, DIV, INT}},
+		{"(a) / 2", []Type{LPAREN, IDENT, RPAREN, DIV, INT}},
+		{"x = /a[/]b\\/c/gi.test(s)", []Type{IDENT, ASSIGN, REGEX, PERIOD, IDENT, LPAREN, IDENT, RPAREN}},
+		{"f(/=/, 1)", []Type{IDENT, LPAREN, REGEX, COMMA, INT, RPAREN}},
+		{"return /a/ /* foo */ / 2", []Type{RETURN, REGEX, MULTILINE_COMMENT, DIV, INT}},
 	}
 
 	for i, d := range data {
@@ -117,6 +124,22 @@ func TestLex(t *testing.T) {
 	}
 }
 
+func TestLexRegex(t *testing.T) {
+	l := New(strings.NewReader(`/a[/]\/b/gi`), "")
+	if err := l.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if k := l.Tokens[0]; k.Type != REGEX || k.Str != `/a[/]\/b/gi` {
+		t.Fatal(k)
+	}
+
+	l = New(strings.NewReader("/abc\n/"), "")
+	if err := l.Run(); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
 func test(s string, types []Type) error {
 	l := New(strings.NewReader(s), "")
 
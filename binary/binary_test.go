@@ -2,8 +2,15 @@ package binary
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+	"strings"
 	"testing"
 
+	"github.com/gtlang/filesystem"
 	"github.com/gtlang/gt/core"
 )
 
@@ -63,6 +70,49 @@ func TestBinaryResources(t *testing.T) {
 	}
 }
 
+func TestBinarySources(t *testing.T) {
+	p := compile(t, `
+		function main() {
+			return 1 / 0
+		}
+	`)
+
+	var buf bytes.Buffer
+	if err := Write(&buf, p, WithSources()); err != nil {
+		t.Fatal("Write: " + err.Error())
+	}
+
+	withSources, err := Read(&buf)
+	if err != nil {
+		t.Fatal("Read: " + err.Error())
+	}
+
+	_, err = core.NewVM(withSources).Run()
+	if err == nil || !strings.Contains(err.Error(), "line 3:11\n    \t\t\treturn 1 / 0\n") {
+		t.Fatal(err)
+	}
+
+	// the sources are not written by default
+	buf.Reset()
+	if err := Write(&buf, p); err != nil {
+		t.Fatal("Write: " + err.Error())
+	}
+
+	stripped, err := Read(&buf)
+	if err != nil {
+		t.Fatal("Read: " + err.Error())
+	}
+
+	if stripped.Sources != nil {
+		t.Fatal("expected the sources to be stripped")
+	}
+
+	_, err = core.NewVM(stripped).Run()
+	if err == nil || strings.Contains(err.Error(), "return 1 / 0") {
+		t.Fatal(err)
+	}
+}
+
 func TestBinaryNativeLib(t *testing.T) {
 	core.AddNativeFunc(core.NativeFunction{
 		Name:      "math.square",
@@ -93,6 +143,34 @@ func TestBinaryNativeLib(t *testing.T) {
 	assertValue(t, 4, p)
 }
 
+func TestRegexConstant(t *testing.T) {
+	p := compile(t, `
+		function main() { 
+			return /(\d+)-(?P<b>\d+)/i.replace("1-2 3-4", "${b}-$1")
+		}
+	`)
+
+	var buf bytes.Buffer
+
+	if err := Write(&buf, p); err != nil {
+		t.Fatal("Write: " + err.Error())
+	}
+
+	p, err := Read(&buf)
+	if err != nil {
+		t.Fatal("Read: " + err.Error())
+	}
+
+	v, err := core.NewVM(p).Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v.ToString() != "2-1 3-4" {
+		t.Fatal(v)
+	}
+}
+
 func TestConstants(t *testing.T) {
 	p := compile(t, `
 		function main() { 
@@ -143,6 +221,342 @@ func TestConstants(t *testing.T) {
 	}
 }
 
+func TestBinarySigned(t *testing.T) {
+	p := compile(t, `
+		function main() { 
+			return 2 + 3
+		}
+	`)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []crypto.Signer{rsaKey, edKey} {
+		var buf bytes.Buffer
+		if err := WriteSigned(&buf, p, key); err != nil {
+			t.Fatal("Write: " + err.Error())
+		}
+
+		trust, err := NewTrustPolicy(key.Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// without a policy the signature is ignored
+		if _, err := Load(buf.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+
+		signed, err := Load(buf.Bytes(), WithTrustPolicy(trust))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertValue(t, 5, signed)
+	}
+}
+
+func TestBinarySignedRefused(t *testing.T) {
+	p := compile(t, `
+		function main() { 
+			return 12345678
+		}
+	`)
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trust, err := NewTrustPolicy(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := Write(&buf, p); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Load(buf.Bytes(), WithTrustPolicy(trust)); err != ErrUnsigned {
+		t.Fatalf("expected ErrUnsigned, got %v", err)
+	}
+
+	buf.Reset()
+	if err := WriteSigned(&buf, p, other); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Load(buf.Bytes(), WithTrustPolicy(trust)); err != ErrInvalidSignature {
+		t.Fatalf("expected ErrInvalidSignature, got %v", err)
+	}
+
+	buf.Reset()
+	if err := WriteSigned(&buf, p, key); err != nil {
+		t.Fatal(err)
+	}
+
+	// tamper the constant
+	b := buf.Bytes()
+	i := bytes.Index(b, []byte{0, 0, 0, 0, 0, 0xBC, 0x61, 0x4E})
+	if i == -1 {
+		t.Fatal("constant not found")
+	}
+	b[i+7]++
+
+	if _, err := Load(b, WithTrustPolicy(trust)); err != ErrInvalidSignature {
+		t.Fatalf("expected ErrInvalidSignature, got %v", err)
+	}
+
+	tampered, err := Load(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertValue(t, 12345679, tampered)
+}
+
+func TestBinaryEncrypted(t *testing.T) {
+	p := compile(t, `
+		//gt: permissions trusted
+		function main() { 
+			return "secret" + 1
+		}
+	`)
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := Write(&buf, p, WithEncryptionKey(key)); err != nil {
+		t.Fatal("Write: " + err.Error())
+	}
+
+	if bytes.Contains(buf.Bytes(), []byte("secret")) {
+		t.Fatal("the content is not encrypted")
+	}
+
+	p2, err := Load(buf.Bytes(), WithDecryptionKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertValue(t, "secret1", p2)
+
+	p3, err := Load(buf.Bytes(), WithKeyProvider(func(directives map[string]string) ([]byte, error) {
+		if directives["permissions"] != "trusted" {
+			t.Fatalf("invalid directives: %v", directives)
+		}
+		return key, nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertValue(t, "secret1", p3)
+}
+
+func TestBinaryEncryptedRefused(t *testing.T) {
+	p := compile(t, `
+		function main() { 
+			return 2 + 3
+		}
+	`)
+
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := Write(&buf, p, WithEncryptionKey(key)); err != nil {
+		t.Fatal("Write: " + err.Error())
+	}
+
+	if _, err := Load(buf.Bytes()); err != ErrNoKey {
+		t.Fatalf("expected ErrNoKey, got %v", err)
+	}
+
+	other := make([]byte, 16)
+	if _, err := Load(buf.Bytes(), WithDecryptionKey(other)); err != ErrDecrypt {
+		t.Fatalf("expected ErrDecrypt, got %v", err)
+	}
+
+	b := buf.Bytes()
+	b[len(b)-20]++
+	if _, err := Load(b, WithDecryptionKey(key)); err != ErrDecrypt {
+		t.Fatalf("expected ErrDecrypt, got %v", err)
+	}
+}
+
+func TestBinarySignedBeforeDecoding(t *testing.T) {
+	p := compile(t, `
+		function main() { 
+			return 1
+		}
+	`)
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trust, err := NewTrustPolicy(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteSigned(&buf, p, key); err != nil {
+		t.Fatal(err)
+	}
+
+	// corrupt the body so decoding it fails
+	b := buf.Bytes()
+	for i := 40; i < 48; i++ {
+		b[i] = 0xFF
+	}
+
+	if _, err := Load(b, WithTrustPolicy(trust)); err != ErrInvalidSignature {
+		t.Fatalf("expected ErrInvalidSignature, got %v", err)
+	}
+
+	if _, err := Load([]byte("garbage"), WithTrustPolicy(trust)); err != ErrUnsigned {
+		t.Fatalf("expected ErrUnsigned, got %v", err)
+	}
+}
+
+func TestBinarySignedEncrypted(t *testing.T) {
+	p := compile(t, `
+		function main() { 
+			return 2 + 3
+		}
+	`)
+
+	_, signKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := Write(&buf, p, WithSigner(signKey), WithEncryptionKey(key)); err != nil {
+		t.Fatal("Write: " + err.Error())
+	}
+
+	trust, err := NewTrustPolicy(signKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p2, err := Load(buf.Bytes(), WithTrustPolicy(trust), WithDecryptionKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertValue(t, 5, p2)
+}
+
+func TestBinaryVerify(t *testing.T) {
+	p := compile(t, `
+		function main() { 
+			let a = 2
+			return a + 3
+		}
+	`)
+
+	f, _ := p.Function("main")
+	f.MaxRegIndex = 0
+
+	var buf bytes.Buffer
+	if err := Write(&buf, p); err != nil {
+		t.Fatal("Write: " + err.Error())
+	}
+
+	_, err := Read(&buf)
+	if _, ok := err.(*core.VerifyError); !ok {
+		t.Fatalf("expected a VerifyError, got %v", err)
+	}
+}
+
+func TestCache(t *testing.T) {
+	fs := filesystem.NewVirtualFS()
+	fs.WritePath("main.ts", []byte(`
+		import * as foo from "foo"
+
+		function main() {
+			return foo.bar
+		}
+	`))
+
+	fs.WritePath("foo.ts", []byte(`
+		export const bar = 3
+	`))
+
+	cacheFS := filesystem.NewVirtualFS()
+	c := NewCache(cacheFS, "/cache")
+
+	p, err := c.Compile(fs, "main.ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertValue(t, 3, p)
+
+	// replace the cached binary to check that it is used
+	key, err := hashFiles(fs, []string{mustAbs(t, fs, "main.ts"), mustAbs(t, fs, "foo.ts")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := Write(&buf, compile(t, `function main() { return 10 }`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := cacheFS.WritePath(c.programPath(key), buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err = c.Compile(fs, "main.ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertValue(t, 10, p)
+
+	// changing an imported file invalidates the cache
+	fs.WritePath("foo.ts", []byte(`
+		export const bar = 4
+	`))
+
+	p, err = c.Compile(fs, "main.ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertValue(t, 4, p)
+}
+
+func mustAbs(t *testing.T, fs filesystem.FS, name string) string {
+	abs, err := fs.Abs(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return abs
+}
+
 func compile(t *testing.T, code string) *core.Program {
 	p, err := core.CompileStr(code)
 	if err != nil {
@@ -168,3 +582,37 @@ func assertValue(t *testing.T, expected interface{}, p *core.Program) {
 		t.Fatalf("Expected %v %T, got %v %T", expected, expected, ret, ret)
 	}
 }
+
+func TestSplitSignature(t *testing.T) {
+	content := []byte("content")
+
+	// a signature that contains the header of a shorter signature section
+	sig := make([]byte, 64)
+	binary.BigEndian.PutUint64(sig[40:], uint64(newSection(section_signature, 16)))
+
+	var buf bytes.Buffer
+	buf.Write(content)
+	writeSection(&buf, section_signature, len(sig))
+	buf.Write(sig)
+	writeSection(&buf, section_EOF, len(sig))
+
+	c, s, err := splitSignature(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(c, content) {
+		t.Fatalf("invalid content %q", c)
+	}
+
+	if !bytes.Equal(s, sig) {
+		t.Fatalf("invalid signature %v", s)
+	}
+
+	// the size in the EOF section doesn't match the signature section
+	b := buf.Bytes()
+	binary.BigEndian.PutUint64(b[len(b)-sectionSize:], uint64(newSection(section_EOF, 20)))
+	if _, _, err := splitSignature(b); err != ErrInvalidSignature {
+		t.Fatalf("expected ErrInvalidSignature, got %v", err)
+	}
+}
@@ -0,0 +1,165 @@
+package binary
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/gtlang/filesystem"
+	"github.com/gtlang/gt/core"
+)
+
+// Cache stores compiled programs so they are only compiled again when
+// any of their source files or the compiler change.
+//
+// For each main file it stores an index with the list of files of the
+// program and the binary keyed by the hash of the content of all of them.
+type Cache struct {
+	fs  filesystem.FS
+	dir string
+}
+
+func NewCache(fs filesystem.FS, dir string) *Cache {
+	return &Cache{fs: fs, dir: dir}
+}
+
+// Compile returns the cached program if none of its files have changed
+// or compiles it and stores the result.
+func (c *Cache) Compile(fs filesystem.FS, file string) (*core.Program, error) {
+	abs, err := fs.Abs(file)
+	if err != nil {
+		return nil, err
+	}
+
+	index := c.indexPath(abs)
+
+	if p := c.load(fs, index); p != nil {
+		return p, nil
+	}
+
+	p, err := core.Compile(fs, abs)
+	if err != nil {
+		return nil, err
+	}
+
+	// a failure to write the cache must not prevent running the program
+	c.store(fs, index, abs, p)
+
+	return p, nil
+}
+
+func (c *Cache) load(fs filesystem.FS, index string) *core.Program {
+	b, err := filesystem.ReadAll(c.fs, index)
+	if err != nil {
+		return nil
+	}
+
+	files := strings.Split(string(b), "\n")
+
+	key, err := hashFiles(fs, files)
+	if err != nil {
+		return nil
+	}
+
+	b, err = filesystem.ReadAll(c.fs, c.programPath(key))
+	if err != nil {
+		return nil
+	}
+
+	p, err := Load(b)
+	if err != nil {
+		return nil
+	}
+
+	// the sources are not stored in the cache
+	p.LoadSources(fs)
+	return p
+}
+
+func (c *Cache) store(fs filesystem.FS, index, main string, p *core.Program) error {
+	files := []string{main}
+	for _, f := range p.Files {
+		if f != "" && f != main {
+			files = append(files, f)
+		}
+	}
+
+	key, err := hashFiles(fs, files)
+	if err != nil {
+		return err
+	}
+
+	if err := c.fs.MkdirAll(c.dir); err != nil {
+		return err
+	}
+
+	// remove the binary of the previous version
+	if b, err := filesystem.ReadAll(c.fs, index); err == nil {
+		if old, err := hashFiles(fs, strings.Split(string(b), "\n")); err == nil && old != key {
+			c.fs.RemoveAll(c.programPath(old))
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := Write(&buf, p); err != nil {
+		return err
+	}
+
+	if err := c.write(c.programPath(key), buf.Bytes()); err != nil {
+		return err
+	}
+
+	return c.write(index, []byte(strings.Join(files, "\n")))
+}
+
+func (c *Cache) write(name string, b []byte) error {
+	f, err := c.fs.OpenForWrite(name)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		c.fs.RemoveAll(name)
+		return err
+	}
+
+	return f.Close()
+}
+
+// indexPath is the file with the list of source files of the program.
+func (c *Cache) indexPath(main string) string {
+	h := sha256.Sum256([]byte(main))
+	return path.Join(c.dir, hex.EncodeToString(h[:])+".idx")
+}
+
+func (c *Cache) programPath(key string) string {
+	return path.Join(c.dir, key+".gt")
+}
+
+// hashFiles returns the hash of the compiler version and the name and
+// content of all the files.
+func hashFiles(fs filesystem.FS, files []string) (string, error) {
+	h := sha256.New()
+	io.WriteString(h, header)
+	h.Write([]byte{0})
+	io.WriteString(h, core.CompilerVersion)
+
+	for _, name := range files {
+		b, err := filesystem.ReadAll(fs, name)
+		if err != nil {
+			return "", err
+		}
+
+		sum := sha256.Sum256(b)
+		h.Write([]byte{0})
+		io.WriteString(h, name)
+		h.Write([]byte{0})
+		h.Write(sum[:])
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,80 @@
+package binary
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+var ErrDecrypt = errors.New("error decrypting the program: invalid key or corrupted data")
+var ErrNoKey = errors.New("the program is encrypted and no key was provided")
+
+// KeyProvider returns the AES key to decrypt a program. It receives the
+// directives of the program, that are not encrypted, so the key can
+// be chosen for each program.
+type KeyProvider func(directives map[string]string) ([]byte, error)
+
+// encrypt seals data with AES-GCM. The nonce is prepended to the result.
+func encrypt(key, data, additional []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, data, additional), nil
+}
+
+func decrypt(key, data, additional []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	n := gcm.NonceSize()
+	if len(data) < n {
+		return nil, ErrDecrypt
+	}
+
+	b, err := gcm.Open(nil, data[:n], data[n:], additional)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+
+	return b, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %v", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// directivesData returns the directives in a stable form to authenticate
+// them with the encrypted sections because they are stored in clear.
+func directivesData(directives map[string]string) []byte {
+	keys := make([]string, 0, len(directives))
+	for k := range directives {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b []byte
+	for _, k := range keys {
+		b = append(b, k...)
+		b = append(b, 0)
+		b = append(b, directives[k]...)
+		b = append(b, 0)
+	}
+	return b
+}
@@ -2,6 +2,7 @@ package binary
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -12,13 +13,71 @@ import (
 
 var ErrInvalidHeader = errors.New("invalid header")
 
-func Load(b []byte) (*core.Program, error) {
+// ReadOption configures how a program is decoded.
+type ReadOption func(*readOptions)
+
+type readOptions struct {
+	trust *TrustPolicy
+	keys  KeyProvider
+}
+
+// WithTrustPolicy refuses programs that are not signed by one of the
+// keys of the policy. A nil policy accepts any program.
+func WithTrustPolicy(t *TrustPolicy) ReadOption {
+	return func(o *readOptions) {
+		o.trust = t
+	}
+}
+
+// WithDecryptionKey sets the AES key to read encrypted programs.
+func WithDecryptionKey(key []byte) ReadOption {
+	return func(o *readOptions) {
+		o.keys = func(map[string]string) ([]byte, error) {
+			return key, nil
+		}
+	}
+}
+
+// WithKeyProvider sets a function that returns the AES key to read encrypted programs.
+func WithKeyProvider(f KeyProvider) ReadOption {
+	return func(o *readOptions) {
+		o.keys = f
+	}
+}
+
+func Load(b []byte, opts ...ReadOption) (*core.Program, error) {
 	r := bytes.NewReader(b)
-	return Read(r)
+	return Read(r, opts...)
 }
 
-func Read(r io.Reader) (*core.Program, error) {
+func Read(in io.Reader, opts ...ReadOption) (*core.Program, error) {
+	o := &readOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	if o.trust != nil {
+		// check the signature before decoding the untrusted content
+		b, err := io.ReadAll(io.LimitReader(in, maxSignedSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(b) > maxSignedSize {
+			return nil, fmt.Errorf("the program is larger than %d bytes", maxSignedSize)
+		}
+		content, signature, err := splitSignature(b)
+		if err != nil {
+			return nil, err
+		}
+		digest := sha256.Sum256(content)
+		if err := o.trust.verify(digest[:], signature); err != nil {
+			return nil, err
+		}
+		in = bytes.NewReader(b)
+	}
+
 	p := &core.Program{}
+	r := in
 
 	iKey, err := readInt32(r)
 	if err != nil {
@@ -39,29 +98,83 @@ func Read(r io.Reader) (*core.Program, error) {
 		return nil, err
 	}
 
-	if err := readFunctions(r, key, p); err != nil {
+	body, err := readBody(r, p, o)
+	if err != nil {
 		return nil, err
 	}
 
-	if p.Constants, err = readConstants(r, key); err != nil {
+	if err := readFunctions(body, key, p); err != nil {
 		return nil, err
 	}
 
-	if p.Files, err = readFiles(r, key); err != nil {
+	if p.Constants, err = readConstants(body, key); err != nil {
 		return nil, err
 	}
 
-	if p.Resources, err = readResources(r, key); err != nil {
+	if p.Files, err = readFiles(body, key); err != nil {
 		return nil, err
 	}
 
-	if err = readEOF(r); err != nil {
+	if p.Resources, err = readResources(body, key); err != nil {
+		return nil, err
+	}
+
+	if p.Sources, err = readSources(body, key); err != nil {
+		return nil, err
+	}
+
+	// the signature was already verified if there is a trust policy
+	if _, err := readSignature(in); err != nil {
+		return nil, err
+	}
+
+	// the file can be crafted to make the VM panic
+	if err := core.Verify(p); err != nil {
 		return nil, err
 	}
 
 	return p, nil
 }
 
+// readBody returns the reader for the functions, constants, files, resources and sources,
+// decrypting them if the program is encrypted.
+func readBody(r io.Reader, p *core.Program, o *readOptions) (io.Reader, error) {
+	var b [8]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return nil, fmt.Errorf("error reading section: %v", err)
+	}
+
+	t, v := section(binary.BigEndian.Uint64(b[:])).values()
+	if t != section_encrypted {
+		// put back the section header
+		return io.MultiReader(bytes.NewReader(b[:]), r), nil
+	}
+
+	if o.keys == nil {
+		return nil, ErrNoKey
+	}
+
+	encryptionKey, err := o.keys(p.Directives)
+	if err != nil {
+		return nil, err
+	}
+	if encryptionKey == nil {
+		return nil, ErrNoKey
+	}
+
+	data := make([]byte, v)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	plain, err := decrypt(encryptionKey, data, directivesData(p.Directives))
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader(plain), nil
+}
+
 func unxor(b []byte, key byte) {
 	for i, j := range b {
 		b[i] = j ^ key
@@ -254,7 +367,11 @@ func readPositions(r io.Reader) ([]core.Position, error) {
 		if err != nil {
 			return nil, err
 		}
-		positions = append(positions, core.Position{File: file, Line: line})
+		column, err := readInt32(r)
+		if err != nil {
+			return nil, err
+		}
+		positions = append(positions, core.Position{File: file, Line: line, Column: column})
 	}
 
 	return positions, nil
@@ -434,6 +551,18 @@ func readConstants(r io.Reader, key byte) ([]core.Value, error) {
 			}
 			constants = append(constants, core.NewRune(rune(i)))
 
+		case section_kRegex:
+			p := make([]byte, v)
+			if _, err := io.ReadFull(r, p); err != nil {
+				return nil, err
+			}
+			unxor(p, key)
+			k, err := core.ParseRegex(string(p))
+			if err != nil {
+				return nil, err
+			}
+			constants = append(constants, core.NewObject(k))
+
 		default:
 			panic(fmt.Sprintf("Invalid constant type: %v", t))
 
@@ -492,6 +621,106 @@ func readResources(r io.Reader, key byte) (map[string][]byte, error) {
 	return resources, nil
 }
 
+func readSources(r io.Reader, key byte) (map[string][]byte, error) {
+	s, err := readSection(r)
+	if err != nil {
+		return nil, err
+	}
+	t, v := s.values()
+	if t != section_sources {
+		return nil, fmt.Errorf("invalid section, expected %v, got %v", section_sources, t)
+	}
+
+	if v == 0 {
+		return nil, nil
+	}
+
+	sources := make(map[string][]byte, v)
+
+	for i, l := 0, int(v); i < l; i++ {
+		k, err := readString(r, key)
+		if err != nil {
+			return nil, err
+		}
+		v, err := readBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		sources[k] = v
+	}
+
+	return sources, nil
+}
+
+// maxSignedSize is the largest program that is read to verify its signature.
+const maxSignedSize = 1 << 30
+
+// maxSignatureSize is larger than the signatures of the supported keys.
+const maxSignatureSize = 4096
+
+// sectionSize is the size of the header of a section.
+const sectionSize = 8
+
+// splitSignature returns the signed content and the signature reading the
+// trailer of the program: the optional signature section and the EOF
+// section, which holds the size of the signature. The signature is nil if
+// it is not signed.
+func splitSignature(b []byte) (content, signature []byte, err error) {
+	end := len(b) - sectionSize
+	if end < 0 {
+		return b, nil, nil
+	}
+
+	t, size := section(binary.BigEndian.Uint64(b[end:])).values()
+	if t != section_EOF || size == 0 {
+		return b, nil, nil
+	}
+
+	start := int64(end) - size - sectionSize
+	if size > maxSignatureSize || start < 0 {
+		return nil, nil, ErrInvalidSignature
+	}
+
+	t, v := section(binary.BigEndian.Uint64(b[start:])).values()
+	if t != section_signature || v != size {
+		return nil, nil, ErrInvalidSignature
+	}
+
+	return b[:start], b[start+sectionSize : end], nil
+}
+
+// readSignature reads the optional signature and the end of the program.
+func readSignature(r io.Reader) ([]byte, error) {
+	s, err := readSection(r)
+	if err != nil {
+		return nil, err
+	}
+
+	t, v := s.values()
+	switch t {
+	case section_EOF:
+		return nil, nil
+	case section_signature:
+	default:
+		return nil, fmt.Errorf("invalid section, expected %v, got %v", section_EOF, t)
+	}
+
+	if v > maxSignatureSize {
+		return nil, ErrInvalidSignature
+	}
+
+	signature := make([]byte, v)
+	if err := binary.Read(r, binary.BigEndian, &signature); err != nil {
+		return nil, err
+	}
+
+	if err := readEOF(r); err != nil {
+		return nil, err
+	}
+
+	return signature, nil
+}
+
 func readEOF(r io.Reader) error {
 	s, err := readSection(r)
 	if err != nil {
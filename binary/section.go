@@ -2,7 +2,7 @@
 
 package binary
 
-const header = "GT VM 1"
+const header = "GT VM 2"
 
 type SectionType int
 
@@ -29,6 +29,9 @@ const (
 	section_kUndefined
 	section_kRune
 	section_EOF
+	section_signature
+	section_encrypted
+	section_kRegex
 )
 
 type section uint64
@@ -30,11 +30,14 @@ func _() {
 	_ = x[section_kUndefined-19]
 	_ = x[section_kRune-20]
 	_ = x[section_EOF-21]
+	_ = x[section_signature-22]
+	_ = x[section_encrypted-23]
+	_ = x[section_kRegex-24]
 }
 
-const _SectionType_name = "section_directivessection_buildsection_functionssection_dynamicCallssection_registerssection_instructionssection_constantssection_positionssection_filessection_resourcessection_sourcessection_sourceLinessection_stringsection_bytessection_kIntsection_kFloatsection_kBoolsection_kStringsection_kNullsection_kUndefinedsection_kRunesection_EOF"
+const _SectionType_name = "section_directivessection_buildsection_functionssection_dynamicCallssection_registerssection_instructionssection_constantssection_positionssection_filessection_resourcessection_sourcessection_sourceLinessection_stringsection_bytessection_kIntsection_kFloatsection_kBoolsection_kStringsection_kNullsection_kUndefinedsection_kRunesection_EOFsection_signaturesection_encryptedsection_kRegex"
 
-var _SectionType_index = [...]uint16{0, 18, 31, 48, 68, 85, 105, 122, 139, 152, 169, 184, 203, 217, 230, 242, 256, 269, 284, 297, 315, 328, 339}
+var _SectionType_index = [...]uint16{0, 18, 31, 48, 68, 85, 105, 122, 139, 152, 169, 184, 203, 217, 230, 242, 256, 269, 284, 297, 315, 328, 339, 356, 373, 387}
 
 func (i SectionType) String() string {
 	if i < 0 || i >= SectionType(len(_SectionType_index)-1) {
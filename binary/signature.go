@@ -0,0 +1,97 @@
+package binary
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+var ErrUnsigned = errors.New("the program is not signed")
+var ErrInvalidSignature = errors.New("invalid program signature")
+
+// TrustPolicy is the set of public keys that are allowed to sign programs.
+// When a policy is passed to Read, unsigned programs and programs signed
+// by any other key are refused.
+type TrustPolicy struct {
+	keys []crypto.PublicKey
+}
+
+func NewTrustPolicy(keys ...crypto.PublicKey) (*TrustPolicy, error) {
+	t := &TrustPolicy{}
+	for _, k := range keys {
+		if err := t.AddKey(k); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// AddKey adds a RSA or Ed25519 public key to the trusted set.
+func (t *TrustPolicy) AddKey(key crypto.PublicKey) error {
+	switch key.(type) {
+	case *rsa.PublicKey, ed25519.PublicKey:
+		t.keys = append(t.keys, key)
+		return nil
+	default:
+		return fmt.Errorf("unsupported public key type %T", key)
+	}
+}
+
+// AddPEM adds a PEM encoded PKIX public key to the trusted set.
+func (t *TrustPolicy) AddPEM(b []byte) error {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return fmt.Errorf("error decoding public key")
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("error parsing public key: %v", err)
+	}
+
+	return t.AddKey(key)
+}
+
+// Keys returns the trusted public keys.
+func (t *TrustPolicy) Keys() []crypto.PublicKey {
+	return t.keys
+}
+
+func (t *TrustPolicy) verify(digest, signature []byte) error {
+	if signature == nil {
+		return ErrUnsigned
+	}
+
+	for _, k := range t.keys {
+		switch key := k.(type) {
+		case *rsa.PublicKey:
+			if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest, signature) == nil {
+				return nil
+			}
+		case ed25519.PublicKey:
+			if ed25519.Verify(key, digest, signature) {
+				return nil
+			}
+		}
+	}
+
+	return ErrInvalidSignature
+}
+
+// sign signs the SHA-256 digest of the program. Ed25519 keys sign
+// the digest itself as the message.
+func sign(key crypto.Signer, digest []byte) ([]byte, error) {
+	switch key.Public().(type) {
+	case *rsa.PublicKey:
+		return key.Sign(rand.Reader, digest, crypto.SHA256)
+	case ed25519.PublicKey:
+		return key.Sign(rand.Reader, digest, crypto.Hash(0))
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+}
@@ -1,6 +1,9 @@
 package binary
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -9,9 +12,52 @@ import (
 	"github.com/gtlang/gt/core"
 )
 
-func Write(w io.Writer, p *core.Program) error {
+// WriteOption configures how a program is encoded.
+type WriteOption func(*writeOptions)
+
+type writeOptions struct {
+	signer        crypto.Signer
+	encryptionKey []byte
+	sources       bool
+}
+
+// WithSigner appends a signature of the program content made
+// with a RSA or Ed25519 private key.
+func WithSigner(signer crypto.Signer) WriteOption {
+	return func(o *writeOptions) {
+		o.signer = signer
+	}
+}
+
+// WithEncryptionKey encrypts the functions, constants, files, resources and sources
+// with AES-GCM. The key must be 16, 24 or 32 bytes long.
+func WithEncryptionKey(key []byte) WriteOption {
+	return func(o *writeOptions) {
+		o.encryptionKey = key
+	}
+}
+
+// WithSources includes the code of the files to show it in the stack
+// traces. Without it the sources are not written because anyone that
+// has the binary could read them.
+func WithSources() WriteOption {
+	return func(o *writeOptions) {
+		o.sources = true
+	}
+}
+
+func Write(out io.Writer, p *core.Program, opts ...WriteOption) error {
+	o := &writeOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
 	key := byte(5 + rand.Intn(255-5))
 
+	// everything before the signature section is part of the digest
+	h := sha256.New()
+	w := io.MultiWriter(out, h)
+
 	if err := binary.Write(w, binary.BigEndian, int32(key)); err != nil {
 		return err
 	}
@@ -24,6 +70,40 @@ func Write(w io.Writer, p *core.Program) error {
 		return err
 	}
 
+	if o.encryptionKey == nil {
+		if err := writeBody(w, p, key, o.sources); err != nil {
+			return err
+		}
+	} else {
+		if err := writeEncryptedBody(w, p, key, o.encryptionKey, o.sources); err != nil {
+			return err
+		}
+	}
+
+	var size int
+	if o.signer != nil {
+		n, err := writeSignature(out, o.signer, h.Sum(nil))
+		if err != nil {
+			return err
+		}
+		size = n
+	}
+
+	// the size of the signature lets the reader find it from the end
+	if err := writeSection(out, section_EOF, size); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// WriteSigned writes the program followed by a signature of its content
+// made with a RSA or Ed25519 private key.
+func WriteSigned(w io.Writer, p *core.Program, signer crypto.Signer) error {
+	return Write(w, p, WithSigner(signer))
+}
+
+func writeBody(w io.Writer, p *core.Program, key byte, sources bool) error {
 	if err := writeFunctions(w, p.Functions, key); err != nil {
 		return err
 	}
@@ -40,13 +120,54 @@ func Write(w io.Writer, p *core.Program) error {
 		return err
 	}
 
-	if err := writeSection(w, section_EOF, 0); err != nil {
+	var src map[string][]byte
+	if sources {
+		src = p.Sources
+	}
+
+	if err := writeSources(w, src, key); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func writeEncryptedBody(w io.Writer, p *core.Program, key byte, encryptionKey []byte, sources bool) error {
+	var buf bytes.Buffer
+	if err := writeBody(&buf, p, key, sources); err != nil {
+		return err
+	}
+
+	b, err := encrypt(encryptionKey, buf.Bytes(), directivesData(p.Directives))
+	if err != nil {
 		return err
 	}
 
+	if err := writeSection(w, section_encrypted, len(b)); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, b); err != nil {
+		return err
+	}
 	return nil
 }
 
+// writeSignature writes the signature section and returns the size of the signature.
+func writeSignature(w io.Writer, signer crypto.Signer, digest []byte) (int, error) {
+	sig, err := sign(signer, digest)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := writeSection(w, section_signature, len(sig)); err != nil {
+		return 0, err
+	}
+	if err := binary.Write(w, binary.BigEndian, sig); err != nil {
+		return 0, err
+	}
+	return len(sig), nil
+}
+
 func writeResources(w io.Writer, resources map[string][]byte, key byte) error {
 	if err := writeSection(w, section_resources, len(resources)); err != nil {
 		return err
@@ -64,6 +185,23 @@ func writeResources(w io.Writer, resources map[string][]byte, key byte) error {
 	return nil
 }
 
+func writeSources(w io.Writer, sources map[string][]byte, key byte) error {
+	if err := writeSection(w, section_sources, len(sources)); err != nil {
+		return err
+	}
+
+	for k, v := range sources {
+		if err := writeString(w, k, key); err != nil {
+			return err
+		}
+		if err := writeBytes(w, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func writeFiles(w io.Writer, files []string, key byte) error {
 	if err := writeSection(w, section_files, len(files)); err != nil {
 		return err
@@ -135,6 +273,20 @@ func writeConstants(w io.Writer, constants []core.Value, key byte) error {
 				return err
 			}
 
+		case core.Object:
+			r, ok := k.ToObject().(*core.Regex)
+			if !ok {
+				return fmt.Errorf("invalid constant type: %v", k.TypeName())
+			}
+			b := []byte(r.String())
+			xor(b, key)
+			if err := writeSection(w, section_kRegex, len(b)); err != nil {
+				return err
+			}
+			if err := binary.Write(w, binary.BigEndian, b); err != nil {
+				return err
+			}
+
 		default:
 			return fmt.Errorf("invalid constant type: %v", k.Type)
 		}
@@ -242,6 +394,9 @@ func writePositions(w io.Writer, positions []core.Position) error {
 		if err := binary.Write(w, binary.BigEndian, int32(pos.Line)); err != nil {
 			return err
 		}
+		if err := binary.Write(w, binary.BigEndian, int32(pos.Column)); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -0,0 +1,746 @@
+package core
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Disassemble writes the program in a textual form that Assemble can
+// read back without losing information:
+//
+//	.directive "permissions" "trusted"
+//	.file "main.ts"
+//	.function 1 "main" args=0 regs=2 kind=user
+//	  .register "a" 0 0 3
+//	  0     LDK      0L     0K     --   @0:3:4
+//	  1     RET      0L     --     --
+//	.end
+//	.constant int 3
+//
+// Native functions are referenced by name, like strings.split(), because
+// their indexes depend on the libraries linked in the binary.
+func Disassemble(w io.Writer, p *Program) error {
+	b := bufio.NewWriter(w)
+
+	keys := make([]string, 0, len(p.Directives))
+	for k := range p.Directives {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(b, ".directive %s %s\n", strconv.Quote(k), strconv.Quote(p.Directives[k]))
+	}
+
+	for _, f := range p.Files {
+		fmt.Fprintf(b, ".file %s\n", strconv.Quote(f))
+	}
+
+	keys = keys[:0]
+	for k := range p.Resources {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(b, ".resource %s %s\n", strconv.Quote(k), base64.StdEncoding.EncodeToString(p.Resources[k]))
+	}
+
+	keys = keys[:0]
+	for k := range p.Sources {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(b, ".source %s %s\n", strconv.Quote(k), base64.StdEncoding.EncodeToString(p.Sources[k]))
+	}
+
+	for _, c := range p.Classes {
+		fmt.Fprintf(b, "\n.class %s%s\n", strconv.Quote(c.Name), asmFlag(c.Exported, "exported"))
+		for _, f := range c.Fields {
+			fmt.Fprintf(b, "  .field %s%s\n", strconv.Quote(f.Name), asmFlag(f.Exported, "exported"))
+		}
+		for _, i := range c.Functions {
+			fmt.Fprintf(b, "  .method %d\n", i)
+		}
+		fmt.Fprint(b, ".end\n")
+	}
+
+	for _, f := range p.Functions {
+		disassembleFunction(b, f)
+	}
+
+	if len(p.Constants) > 0 {
+		fmt.Fprint(b, "\n")
+	}
+	for i, k := range p.Constants {
+		s, err := asmConstant(k)
+		if err != nil {
+			return fmt.Errorf("constant %d: %v", i, err)
+		}
+		fmt.Fprintf(b, ".constant %s   ; %dK\n", s, i)
+	}
+
+	return b.Flush()
+}
+
+func disassembleFunction(w io.Writer, f *Function) {
+	fmt.Fprintf(w, "\n.function %d %s args=%d regs=%d kind=%s%s%s%s%s\n",
+		f.Index,
+		strconv.Quote(f.Name),
+		f.Arguments,
+		f.MaxRegIndex,
+		asmFunctionKinds[f.Kind],
+		asmFlag(f.Variadic, "variadic"),
+		asmFlag(f.Exported, "exported"),
+		asmFlag(f.IsClass, "class"),
+		asmFlag(f.IsGlobal, "global"))
+
+	for _, r := range f.Registers {
+		fmt.Fprintf(w, "  .register %s\n", asmRegister(r))
+	}
+
+	for _, r := range f.Closures {
+		fmt.Fprintf(w, "  .closure %s\n", asmRegister(r))
+	}
+
+	for i, instr := range f.Instructions {
+		op := strings.ToUpper(instr.Opcode.String()[3:])
+		fmt.Fprintf(w, "  %-5d %s %6s %6s %6s", i, op, asmAddress(instr.A), asmAddress(instr.B), asmAddress(instr.C))
+		if i < len(f.Positions) {
+			pos := f.Positions[i]
+			fmt.Fprintf(w, "   @%d:%d:%d", pos.File, pos.Line, pos.Column)
+		}
+		fmt.Fprint(w, "\n")
+	}
+
+	// positions without instruction
+	for i := len(f.Instructions); i < len(f.Positions); i++ {
+		pos := f.Positions[i]
+		fmt.Fprintf(w, "  .position @%d:%d:%d\n", pos.File, pos.Line, pos.Column)
+	}
+
+	fmt.Fprint(w, ".end\n")
+}
+
+var asmFunctionKinds = map[FunctionKind]string{
+	User:   "user",
+	Init:   "init",
+	Main:   "main",
+	Global: "global",
+}
+
+func asmFlag(v bool, name string) string {
+	if v {
+		return " " + name
+	}
+	return ""
+}
+
+func asmRegister(r *Register) string {
+	return fmt.Sprintf("%s %d %d %d%s%s",
+		strconv.Quote(r.Name),
+		r.Index,
+		r.StartPC,
+		r.EndPC,
+		asmFlag(r.Exported, "exported"),
+		asmFlag(r.Module != "", "module="+strconv.Quote(r.Module)))
+}
+
+func asmAddress(a *Address) string {
+	if a.Kind == AddrNativeFunc && int(a.Value) < len(allNativeFuncs) {
+		return allNativeFuncs[a.Value].Name + "()"
+	}
+	return a.String()
+}
+
+func asmConstant(k Value) (string, error) {
+	switch k.Type {
+	case Int:
+		return "int " + strconv.FormatInt(k.ToInt(), 10), nil
+	case Float:
+		return "float " + strconv.FormatFloat(k.ToFloat(), 'g', -1, 64), nil
+	case Bool:
+		return "bool " + strconv.FormatBool(k.ToBool()), nil
+	case String:
+		return "string " + strconv.Quote(k.ToString()), nil
+	case Rune:
+		return "rune " + strconv.QuoteRune(k.ToRune()), nil
+	case Null:
+		return "null", nil
+	case Undefined:
+		return "undefined", nil
+	case Object:
+		if r, ok := k.ToObject().(*Regex); ok {
+			return "regex " + strconv.Quote(r.String()), nil
+		}
+		return "", fmt.Errorf("invalid constant type %s", k.TypeName())
+	default:
+		return "", fmt.Errorf("invalid constant type %v", k.Type)
+	}
+}
+
+// Assemble reads a program in the format written by Disassemble.
+// The instruction numbers at the start of the line are optional.
+func Assemble(r io.Reader) (*Program, error) {
+	a := &assembler{
+		p:   &Program{},
+		ops: make(map[string]Opcode),
+	}
+
+	for op := op_ldk; op <= op_spr; op++ {
+		a.ops[strings.ToUpper(op.String()[3:])] = op
+	}
+
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), 64*1024*1024)
+
+	for s.Scan() {
+		a.line++
+		tokens, err := asmTokens(s.Text())
+		if err != nil {
+			return nil, a.errorf("%v", err)
+		}
+		if len(tokens) == 0 {
+			continue
+		}
+		if err := a.parseLine(tokens); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	if a.function != nil || a.class != nil {
+		return nil, a.errorf("missing .end")
+	}
+
+	for i, f := range a.p.Functions {
+		if f.Index != i {
+			return nil, fmt.Errorf("function %s: expected index %d, got %d", f.Name, i, f.Index)
+		}
+	}
+
+	return a.p, nil
+}
+
+type assembler struct {
+	p        *Program
+	ops      map[string]Opcode
+	line     int
+	function *Function
+	class    *Class
+}
+
+func (a *assembler) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("line %d: %s", a.line, fmt.Sprintf(format, args...))
+}
+
+func (a *assembler) parseLine(tokens []string) error {
+	switch tokens[0] {
+	case ".directive":
+		if len(tokens) != 3 {
+			return a.errorf("expected .directive name value")
+		}
+		name, err := a.unquote(tokens[1])
+		if err != nil {
+			return err
+		}
+		value, err := a.unquote(tokens[2])
+		if err != nil {
+			return err
+		}
+		if a.p.Directives == nil {
+			a.p.Directives = make(map[string]string)
+		}
+		a.p.Directives[name] = value
+
+	case ".file":
+		if len(tokens) != 2 {
+			return a.errorf("expected .file name")
+		}
+		name, err := a.unquote(tokens[1])
+		if err != nil {
+			return err
+		}
+		a.p.Files = append(a.p.Files, name)
+
+	case ".resource":
+		if len(tokens) != 3 {
+			return a.errorf("expected .resource name data")
+		}
+		name, err := a.unquote(tokens[1])
+		if err != nil {
+			return err
+		}
+		b, err := base64.StdEncoding.DecodeString(tokens[2])
+		if err != nil {
+			return a.errorf("invalid resource: %v", err)
+		}
+		if a.p.Resources == nil {
+			a.p.Resources = make(map[string][]byte)
+		}
+		a.p.Resources[name] = b
+
+	case ".source":
+		if len(tokens) != 3 {
+			return a.errorf("expected .source file data")
+		}
+		name, err := a.unquote(tokens[1])
+		if err != nil {
+			return err
+		}
+		b, err := base64.StdEncoding.DecodeString(tokens[2])
+		if err != nil {
+			return a.errorf("invalid source: %v", err)
+		}
+		if a.p.Sources == nil {
+			a.p.Sources = make(map[string][]byte)
+		}
+		a.p.Sources[name] = b
+
+	case ".class":
+		return a.parseClass(tokens)
+
+	case ".field":
+		if a.class == nil || len(tokens) < 2 {
+			return a.errorf("unexpected .field")
+		}
+		name, err := a.unquote(tokens[1])
+		if err != nil {
+			return err
+		}
+		f := &Field{Name: name}
+		for _, t := range tokens[2:] {
+			if t != "exported" {
+				return a.errorf("invalid field attribute %s", t)
+			}
+			f.Exported = true
+		}
+		a.class.Fields = append(a.class.Fields, f)
+
+	case ".method":
+		if a.class == nil || len(tokens) != 2 {
+			return a.errorf("unexpected .method")
+		}
+		i, err := a.atoi(tokens[1])
+		if err != nil {
+			return err
+		}
+		a.class.Functions = append(a.class.Functions, i)
+
+	case ".function":
+		return a.parseFunction(tokens)
+
+	case ".register", ".closure":
+		if a.function == nil {
+			return a.errorf("unexpected %s", tokens[0])
+		}
+		r, err := a.parseRegister(tokens[1:])
+		if err != nil {
+			return err
+		}
+		if tokens[0] == ".register" {
+			a.function.Registers = append(a.function.Registers, r)
+		} else {
+			a.function.Closures = append(a.function.Closures, r)
+		}
+
+	case ".position":
+		if a.function == nil || len(tokens) != 2 {
+			return a.errorf("unexpected .position")
+		}
+		pos, err := a.parsePosition(tokens[1])
+		if err != nil {
+			return err
+		}
+		a.function.Positions = append(a.function.Positions, pos)
+
+	case ".constant":
+		if len(tokens) < 2 {
+			return a.errorf("expected .constant type value")
+		}
+		k, err := a.parseConstant(tokens[1:])
+		if err != nil {
+			return err
+		}
+		a.p.Constants = append(a.p.Constants, k)
+
+	case ".end":
+		if a.function == nil && a.class == nil {
+			return a.errorf("unexpected .end")
+		}
+		a.function = nil
+		a.class = nil
+
+	default:
+		return a.parseInstruction(tokens)
+	}
+
+	return nil
+}
+
+func (a *assembler) parseClass(tokens []string) error {
+	if a.function != nil || a.class != nil || len(tokens) < 2 {
+		return a.errorf("unexpected .class")
+	}
+
+	name, err := a.unquote(tokens[1])
+	if err != nil {
+		return err
+	}
+
+	c := &Class{Name: name}
+	for _, t := range tokens[2:] {
+		if t != "exported" {
+			return a.errorf("invalid class attribute %s", t)
+		}
+		c.Exported = true
+	}
+
+	a.p.Classes = append(a.p.Classes, c)
+	a.class = c
+	return nil
+}
+
+func (a *assembler) parseFunction(tokens []string) error {
+	if a.function != nil || a.class != nil || len(tokens) < 3 {
+		return a.errorf("unexpected .function")
+	}
+
+	index, err := a.atoi(tokens[1])
+	if err != nil {
+		return err
+	}
+
+	name, err := a.unquote(tokens[2])
+	if err != nil {
+		return err
+	}
+
+	f := &Function{Index: index, Name: name}
+
+	for _, t := range tokens[3:] {
+		switch {
+		case t == "variadic":
+			f.Variadic = true
+		case t == "exported":
+			f.Exported = true
+		case t == "class":
+			f.IsClass = true
+		case t == "global":
+			f.IsGlobal = true
+		case strings.HasPrefix(t, "args="):
+			if f.Arguments, err = a.atoi(t[5:]); err != nil {
+				return err
+			}
+		case strings.HasPrefix(t, "regs="):
+			if f.MaxRegIndex, err = a.atoi(t[5:]); err != nil {
+				return err
+			}
+		case strings.HasPrefix(t, "kind="):
+			found := false
+			for k, v := range asmFunctionKinds {
+				if v == t[5:] {
+					f.Kind = k
+					found = true
+				}
+			}
+			if !found {
+				return a.errorf("invalid function kind %s", t[5:])
+			}
+		default:
+			return a.errorf("invalid function attribute %s", t)
+		}
+	}
+
+	a.p.Functions = append(a.p.Functions, f)
+	a.function = f
+	return nil
+}
+
+func (a *assembler) parseRegister(tokens []string) (*Register, error) {
+	if len(tokens) < 4 {
+		return nil, a.errorf("expected register name index start end")
+	}
+
+	name, err := a.unquote(tokens[0])
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Register{Name: name}
+
+	if r.Index, err = a.atoi(tokens[1]); err != nil {
+		return nil, err
+	}
+	if r.StartPC, err = a.atoi(tokens[2]); err != nil {
+		return nil, err
+	}
+	if r.EndPC, err = a.atoi(tokens[3]); err != nil {
+		return nil, err
+	}
+
+	for _, t := range tokens[4:] {
+		switch {
+		case t == "exported":
+			r.Exported = true
+		case strings.HasPrefix(t, "module="):
+			if r.Module, err = a.unquote(t[7:]); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, a.errorf("invalid register attribute %s", t)
+		}
+	}
+
+	return r, nil
+}
+
+func (a *assembler) parseInstruction(tokens []string) error {
+	f := a.function
+	if f == nil {
+		return a.errorf("instruction outside of a function: %s", tokens[0])
+	}
+
+	// the instruction number is optional
+	if _, err := strconv.Atoi(tokens[0]); err == nil {
+		tokens = tokens[1:]
+	}
+
+	if len(tokens) == 0 {
+		return a.errorf("expected an instruction")
+	}
+
+	op, ok := a.ops[strings.ToUpper(tokens[0])]
+	if !ok {
+		return a.errorf("invalid opcode %s", tokens[0])
+	}
+
+	instr := &Instruction{Opcode: op, A: Void, B: Void, C: Void}
+	addresses := []**Address{&instr.A, &instr.B, &instr.C}
+
+	i := 0
+	for _, t := range tokens[1:] {
+		if strings.HasPrefix(t, "@") {
+			pos, err := a.parsePosition(t)
+			if err != nil {
+				return err
+			}
+			if len(f.Positions) != len(f.Instructions) {
+				return a.errorf("missing positions of previous instructions")
+			}
+			f.Positions = append(f.Positions, pos)
+			continue
+		}
+
+		if i == len(addresses) {
+			return a.errorf("too many operands")
+		}
+
+		addr, err := a.parseAddress(t)
+		if err != nil {
+			return err
+		}
+		*addresses[i] = addr
+		i++
+	}
+
+	f.Instructions = append(f.Instructions, instr)
+	return nil
+}
+
+func (a *assembler) parseAddress(s string) (*Address, error) {
+	if s == "--" {
+		return Void, nil
+	}
+
+	if strings.HasSuffix(s, "()") {
+		f, ok := NativeFuncFromName(s[:len(s)-2])
+		if !ok {
+			return nil, a.errorf("invalid native function %s", s)
+		}
+		return NewAddress(AddrNativeFunc, f.Index), nil
+	}
+
+	if len(s) < 2 {
+		return nil, a.errorf("invalid address %s", s)
+	}
+
+	var kind AddressKind
+	switch s[len(s)-1] {
+	case 'F':
+		kind = AddrFunc
+	case 'N':
+		kind = AddrNativeFunc
+	case 'K':
+		kind = AddrConstant
+	case 'G':
+		kind = AddrGlobal
+	case 'L':
+		kind = AddrLocal
+	case 'C':
+		kind = AddrClosure
+	case 'D':
+		kind = AddrData
+	case 'U':
+		kind = AddrUnresolved
+	case 'T':
+		kind = AddrClass
+	default:
+		return nil, a.errorf("invalid address %s", s)
+	}
+
+	v, err := strconv.ParseInt(s[:len(s)-1], 10, 32)
+	if err != nil {
+		return nil, a.errorf("invalid address %s", s)
+	}
+
+	return NewAddress(kind, int(v)), nil
+}
+
+func (a *assembler) parsePosition(s string) (Position, error) {
+	var pos Position
+
+	parts := strings.Split(strings.TrimPrefix(s, "@"), ":")
+	if len(parts) != 3 {
+		return pos, a.errorf("invalid position %s", s)
+	}
+
+	var err error
+	if pos.File, err = a.atoi(parts[0]); err != nil {
+		return pos, err
+	}
+	if pos.Line, err = a.atoi(parts[1]); err != nil {
+		return pos, err
+	}
+	if pos.Column, err = a.atoi(parts[2]); err != nil {
+		return pos, err
+	}
+
+	return pos, nil
+}
+
+func (a *assembler) parseConstant(tokens []string) (Value, error) {
+	switch tokens[0] {
+	case "null":
+		return NullValue, nil
+	case "undefined":
+		return UndefinedValue, nil
+	}
+
+	if len(tokens) != 2 {
+		return NullValue, a.errorf("expected .constant type value")
+	}
+
+	s := tokens[1]
+
+	switch tokens[0] {
+	case "int":
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return NullValue, a.errorf("invalid int %s", s)
+		}
+		return NewInt64(i), nil
+	case "float":
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return NullValue, a.errorf("invalid float %s", s)
+		}
+		return NewFloat(f), nil
+	case "bool":
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return NullValue, a.errorf("invalid bool %s", s)
+		}
+		return NewBool(b), nil
+	case "string":
+		v, err := a.unquote(s)
+		if err != nil {
+			return NullValue, err
+		}
+		return NewString(v), nil
+	case "rune":
+		v, err := a.unquote(s)
+		if err != nil {
+			return NullValue, err
+		}
+		r := []rune(v)
+		if len(r) != 1 {
+			return NullValue, a.errorf("invalid rune %s", s)
+		}
+		return NewRune(r[0]), nil
+	case "regex":
+		v, err := a.unquote(s)
+		if err != nil {
+			return NullValue, err
+		}
+		r, err := ParseRegex(v)
+		if err != nil {
+			return NullValue, a.errorf("%v", err)
+		}
+		return NewObject(r), nil
+	default:
+		return NullValue, a.errorf("invalid constant type %s", tokens[0])
+	}
+}
+
+func (a *assembler) atoi(s string) (int, error) {
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, a.errorf("invalid number %s", s)
+	}
+	return i, nil
+}
+
+func (a *assembler) unquote(s string) (string, error) {
+	v, err := strconv.Unquote(s)
+	if err != nil {
+		return "", a.errorf("invalid string %s", s)
+	}
+	return v, nil
+}
+
+// asmTokens splits a line by spaces. Quoted strings are a single
+// token and everything after a ';' is a comment.
+func asmTokens(line string) ([]string, error) {
+	var tokens []string
+
+	for i := 0; i < len(line); {
+		c := line[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+
+		case c == ';':
+			return tokens, nil
+
+		default:
+			start := i
+			for i < len(line) && line[i] != ' ' && line[i] != '\t' && line[i] != '\r' {
+				if q := line[i]; q == '"' || q == '\'' {
+					// skip to the closing quote
+					i++
+					for i < len(line) && line[i] != q {
+						if line[i] == '\\' {
+							i++
+						}
+						i++
+					}
+					if i >= len(line) {
+						return nil, fmt.Errorf("unterminated string")
+					}
+				}
+				i++
+			}
+			tokens = append(tokens, line[start:i])
+		}
+	}
+
+	return tokens, nil
+}
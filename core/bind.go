@@ -0,0 +1,770 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Go values are exposed to the scripts with reflection. Exported fields
+// and methods are accessible with the first letter in lower case, or
+// the leading acronym, like URL or ID. The `gt` struct tag sets another
+// name and "-" hides the field.
+
+var (
+	valueType = reflect.TypeOf(Value{})
+	errorType = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+var bindMutex sync.RWMutex
+var boundTypes = make(map[reflect.Type]*boundType)
+var converters = make(map[reflect.Type]Converter)
+var declaredTypes = make(map[reflect.Type]bool)
+
+// Converter converts a Go type that has its own representation in the VM,
+// like time.Time.
+type Converter struct {
+	TypeName  string // the TypeScript type
+	ToValue   func(v reflect.Value) (Value, error)
+	FromValue func(v Value) (reflect.Value, error)
+}
+
+// RegisterConverter sets how values of type t are converted.
+func RegisterConverter(t reflect.Type, c Converter) {
+	bindMutex.Lock()
+	converters[t] = c
+	bindMutex.Unlock()
+}
+
+// Bind exposes a Go value to the scripts as a property of a namespace
+// like native properties, so the name must be qualified: "app.config".
+// Pointers to structs are shared with the scripts. Other values are copied
+// every time they are read so a VM can't modify the value that others see.
+func Bind(name string, v interface{}) {
+	i := strings.IndexByte(name, '.')
+	if i <= 0 || i != strings.LastIndexByte(name, '.') {
+		panic(fmt.Sprintf("invalid bind name %s: expected namespace.name", name))
+	}
+
+	rv := reflect.ValueOf(v)
+
+	if _, err := toValue(rv); err != nil {
+		panic(fmt.Sprintf("error binding %s: %v", name, err))
+	}
+
+	AddNativeFunc(NativeFunction{
+		Name: "->" + name,
+		Function: func(this Value, args []Value, vm *VM) (Value, error) {
+			return toValue(rv)
+		},
+	})
+
+	dts := declareTypes(rv.Type())
+
+	dts += fmt.Sprintf("declare namespace %s {\n    export const %s: %s\n}\n",
+		name[:i], name[i+1:], tsType(rv.Type()))
+
+	typeDefs = append(typeDefs, dts)
+}
+
+// BindType generates the declarations of T and the types that it uses
+// so natives can return them to the scripts.
+func BindType[T any]() {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	if dts := declareTypes(t); dts != "" {
+		typeDefs = append(typeDefs, dts)
+	}
+}
+
+// boundType caches the members of a struct type.
+type boundType struct {
+	name    string
+	fields  map[string][]int
+	methods map[string]int // index in the method set of the pointer
+	order   []string       // fields in declaration order
+}
+
+func getBoundType(t reflect.Type) *boundType {
+	bindMutex.RLock()
+	b, ok := boundTypes[t]
+	bindMutex.RUnlock()
+	if ok {
+		return b
+	}
+
+	b = &boundType{
+		name:    t.Name(),
+		fields:  make(map[string][]int),
+		methods: make(map[string]int),
+	}
+
+	if b.name == "" {
+		b.name = "object"
+	}
+
+	for _, f := range reflect.VisibleFields(t) {
+		if !f.IsExported() || f.Anonymous {
+			continue
+		}
+		name := memberName(f.Name, f.Tag.Get("gt"))
+		if name == "" {
+			continue
+		}
+		if _, ok := b.fields[name]; !ok {
+			b.order = append(b.order, name)
+		}
+		b.fields[name] = f.Index
+	}
+
+	pt := reflect.PtrTo(t)
+	for i := 0; i < pt.NumMethod(); i++ {
+		b.methods[memberName(pt.Method(i).Name, "")] = i
+	}
+
+	bindMutex.Lock()
+	boundTypes[t] = b
+	bindMutex.Unlock()
+
+	return b
+}
+
+// memberName returns the name of a field or method for the scripts.
+func memberName(goName, tag string) string {
+	if tag != "" {
+		if tag == "-" {
+			return ""
+		}
+		return tag
+	}
+
+	r := []rune(goName)
+
+	n := 0
+	for n < len(r) && unicode.IsUpper(r[n]) {
+		n++
+	}
+
+	// keep the last upper case letter of an acronym: URLPath -> urlPath
+	if n > 1 && n < len(r) {
+		n--
+	}
+
+	for i := 0; i < n; i++ {
+		r[i] = unicode.ToLower(r[i])
+	}
+
+	return string(r)
+}
+
+// boundObject is a pointer to a struct exposed to the scripts.
+type boundObject struct {
+	v reflect.Value
+	t *boundType
+}
+
+func newBoundObject(v reflect.Value) *boundObject {
+	return &boundObject{v: v, t: getBoundType(v.Type().Elem())}
+}
+
+func (o *boundObject) Type() string {
+	return o.t.name
+}
+
+func (o *boundObject) Export(recursionLevel int) interface{} {
+	return o.v.Interface()
+}
+
+func (o *boundObject) GetProperty(name string, vm *VM) (Value, error) {
+	i, ok := o.t.fields[name]
+	if !ok {
+		return UndefinedValue, nil
+	}
+
+	f := o.v.Elem().FieldByIndex(i)
+
+	// nested structs are shared so their fields can be modified
+	if f.Kind() == reflect.Struct && f.CanAddr() {
+		if _, ok := getConverter(f.Type()); !ok {
+			return NewObject(newBoundObject(f.Addr())), nil
+		}
+	}
+
+	return toValue(f)
+}
+
+func (o *boundObject) SetProperty(name string, v Value, vm *VM) error {
+	i, ok := o.t.fields[name]
+	if !ok {
+		return fmt.Errorf("undefined property %s in %s", name, o.t.name)
+	}
+
+	f := o.v.Elem().FieldByIndex(i)
+
+	x, err := fromValue(v, f.Type())
+	if err != nil {
+		return fmt.Errorf("%s.%s: %v", o.t.name, name, err)
+	}
+
+	f.Set(x)
+	return nil
+}
+
+func (o *boundObject) GetMethod(name string) NativeMethod {
+	i, ok := o.t.methods[name]
+	if !ok {
+		return nil
+	}
+
+	m := o.v.Method(i)
+	return func(args []Value, vm *VM) (Value, error) {
+		return callBound(m, args)
+	}
+}
+
+// callBound converts the arguments and calls a Go function. If the
+// last result is an error it is returned as the error of the call.
+func callBound(fn reflect.Value, args []Value) (Value, error) {
+	t := fn.Type()
+	numIn := t.NumIn()
+
+	if t.IsVariadic() {
+		if len(args) < numIn-1 {
+			return NullValue, fmt.Errorf("expected at least %d arguments, got %d", numIn-1, len(args))
+		}
+	} else if len(args) != numIn {
+		return NullValue, fmt.Errorf("expected %d arguments, got %d", numIn, len(args))
+	}
+
+	in := make([]reflect.Value, len(args))
+	for i, a := range args {
+		var pt reflect.Type
+		if t.IsVariadic() && i >= numIn-1 {
+			pt = t.In(numIn - 1).Elem()
+		} else {
+			pt = t.In(i)
+		}
+
+		v, err := fromValue(a, pt)
+		if err != nil {
+			return NullValue, fmt.Errorf("argument %d: %v", i+1, err)
+		}
+		in[i] = v
+	}
+
+	out := fn.Call(in)
+
+	if n := len(out); n > 0 && t.Out(n-1) == errorType {
+		if err := out[n-1]; !err.IsNil() {
+			return NullValue, err.Interface().(error)
+		}
+		out = out[:n-1]
+	}
+
+	switch len(out) {
+	case 0:
+		return NullValue, nil
+	case 1:
+		return toValue(out[0])
+	default:
+		values := make([]Value, len(out))
+		for i, o := range out {
+			v, err := toValue(o)
+			if err != nil {
+				return NullValue, err
+			}
+			values[i] = v
+		}
+		return NewArrayValues(values), nil
+	}
+}
+
+func getConverter(t reflect.Type) (Converter, bool) {
+	bindMutex.RLock()
+	c, ok := converters[t]
+	bindMutex.RUnlock()
+	return c, ok
+}
+
+// toValue converts a Go value to a VM value.
+func toValue(v reflect.Value) (Value, error) {
+	if !v.IsValid() {
+		return NullValue, nil
+	}
+
+	t := v.Type()
+
+	if t == valueType {
+		return v.Interface().(Value), nil
+	}
+
+	if c, ok := getConverter(t); ok {
+		return c.ToValue(v)
+	}
+
+	if t == errorType {
+		if v.IsNil() {
+			return NullValue, nil
+		}
+		return NewObject(Error{message: v.Interface().(error).Error()}), nil
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return NewBool(v.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return NewInt64(v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u := v.Uint()
+		if u > math.MaxInt64 {
+			return NullValue, fmt.Errorf("%d overflows int64", u)
+		}
+		return NewInt64(int64(u)), nil
+	case reflect.Float32, reflect.Float64:
+		return NewFloat(v.Float()), nil
+	case reflect.String:
+		return NewString(v.String()), nil
+	case reflect.Slice:
+		if v.IsNil() {
+			return NullValue, nil
+		}
+		if t.Elem().Kind() == reflect.Uint8 {
+			return NewBytes(append([]byte(nil), v.Bytes()...)), nil
+		}
+		return toArray(v)
+	case reflect.Array:
+		return toArray(v)
+	case reflect.Map:
+		if v.IsNil() {
+			return NullValue, nil
+		}
+		if t.Key().Kind() != reflect.String {
+			return NullValue, fmt.Errorf("unsupported map key type %v", t.Key())
+		}
+		m := make(map[string]Value, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			x, err := toValue(iter.Value())
+			if err != nil {
+				return NullValue, err
+			}
+			m[iter.Key().String()] = x
+		}
+		return NewMapValues(m), nil
+	case reflect.Struct:
+		// copy it to get a pointer to a value that is not shared
+		p := reflect.New(t)
+		p.Elem().Set(v)
+		return NewObject(newBoundObject(p)), nil
+	case reflect.Ptr:
+		if v.IsNil() {
+			return NullValue, nil
+		}
+		if t.Elem().Kind() == reflect.Struct {
+			if _, ok := getConverter(t.Elem()); !ok {
+				return NewObject(newBoundObject(v)), nil
+			}
+		}
+		return toValue(v.Elem())
+	case reflect.Interface:
+		if v.IsNil() {
+			return NullValue, nil
+		}
+		return toValue(v.Elem())
+	default:
+		return NullValue, fmt.Errorf("unsupported type %v", t)
+	}
+}
+
+func toArray(v reflect.Value) (Value, error) {
+	values := make([]Value, v.Len())
+	for i := range values {
+		x, err := toValue(v.Index(i))
+		if err != nil {
+			return NullValue, err
+		}
+		values[i] = x
+	}
+	return NewArrayValues(values), nil
+}
+
+// fromValue converts a VM value to a Go value of type t.
+func fromValue(v Value, t reflect.Type) (reflect.Value, error) {
+	if t == valueType {
+		return reflect.ValueOf(v), nil
+	}
+
+	if c, ok := getConverter(t); ok {
+		return c.FromValue(v)
+	}
+
+	if v.Type == Object {
+		if o, ok := v.ToObject().(*boundObject); ok {
+			switch {
+			case o.v.Type() == t:
+				return o.v, nil
+			case o.v.Type().Elem() == t:
+				return o.v.Elem(), nil
+			}
+		}
+	}
+
+	if t == errorType {
+		switch v.Type {
+		case Null, Undefined:
+			return reflect.Zero(t), nil
+		case String:
+			return reflect.ValueOf(errors.New(v.ToString())), nil
+		case Object:
+			if e, ok := v.ToObject().(Error); ok {
+				return reflect.ValueOf(errors.New(e.Message())), nil
+			}
+		}
+		return reflect.Value{}, convertError(v, t)
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		if v.Type != Bool {
+			return reflect.Value{}, convertError(v, t)
+		}
+		return reflect.ValueOf(v.ToBool()).Convert(t), nil
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := toInt(v, t)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		x := reflect.New(t).Elem()
+		if x.OverflowInt(i) {
+			return reflect.Value{}, fmt.Errorf("%d overflows %v", i, t)
+		}
+		x.SetInt(i)
+		return x, nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		i, err := toInt(v, t)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		x := reflect.New(t).Elem()
+		if i < 0 || x.OverflowUint(uint64(i)) {
+			return reflect.Value{}, fmt.Errorf("%d overflows %v", i, t)
+		}
+		x.SetUint(uint64(i))
+		return x, nil
+
+	case reflect.Float32, reflect.Float64:
+		switch v.Type {
+		case Int, Float:
+			return reflect.ValueOf(v.ToFloat()).Convert(t), nil
+		}
+		return reflect.Value{}, convertError(v, t)
+
+	case reflect.String:
+		switch v.Type {
+		case String, Rune:
+			return reflect.ValueOf(v.ToString()).Convert(t), nil
+		}
+		return reflect.Value{}, convertError(v, t)
+
+	case reflect.Slice:
+		switch v.Type {
+		case Null, Undefined:
+			return reflect.Zero(t), nil
+		case Bytes, String:
+			if t.Elem().Kind() == reflect.Uint8 {
+				return reflect.ValueOf(v.ToBytes()).Convert(t), nil
+			}
+		case Array:
+			a := v.ToArray()
+			s := reflect.MakeSlice(t, len(a), len(a))
+			for i, item := range a {
+				x, err := fromValue(item, t.Elem())
+				if err != nil {
+					return reflect.Value{}, fmt.Errorf("[%d]: %v", i, err)
+				}
+				s.Index(i).Set(x)
+			}
+			return s, nil
+		}
+		return reflect.Value{}, convertError(v, t)
+
+	case reflect.Array:
+		if v.Type != Array {
+			return reflect.Value{}, convertError(v, t)
+		}
+		a := v.ToArray()
+		if len(a) != t.Len() {
+			return reflect.Value{}, fmt.Errorf("expected %d items, got %d", t.Len(), len(a))
+		}
+		s := reflect.New(t).Elem()
+		for i, item := range a {
+			x, err := fromValue(item, t.Elem())
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("[%d]: %v", i, err)
+			}
+			s.Index(i).Set(x)
+		}
+		return s, nil
+
+	case reflect.Map:
+		switch v.Type {
+		case Null, Undefined:
+			return reflect.Zero(t), nil
+		case Map:
+		default:
+			return reflect.Value{}, convertError(v, t)
+		}
+		if t.Key().Kind() != reflect.String {
+			return reflect.Value{}, fmt.Errorf("unsupported map key type %v", t.Key())
+		}
+		m := v.ToMap()
+		m.Mutex.RLock()
+		defer m.Mutex.RUnlock()
+		x := reflect.MakeMapWithSize(t, len(m.Map))
+		for k, item := range m.Map {
+			y, err := fromValue(item, t.Elem())
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("%s: %v", k, err)
+			}
+			x.SetMapIndex(reflect.ValueOf(k).Convert(t.Key()), y)
+		}
+		return x, nil
+
+	case reflect.Struct:
+		if v.Type != Map {
+			return reflect.Value{}, convertError(v, t)
+		}
+		return structFromMap(v.ToMap(), t)
+
+	case reflect.Ptr:
+		switch v.Type {
+		case Null, Undefined:
+			return reflect.Zero(t), nil
+		}
+		x, err := fromValue(v, t.Elem())
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		p := reflect.New(t.Elem())
+		p.Elem().Set(x)
+		return p, nil
+
+	case reflect.Interface:
+		switch v.Type {
+		case Null, Undefined:
+			return reflect.Zero(t), nil
+		}
+		var x reflect.Value
+		if o, ok := v.ToObjectOrNil().(*boundObject); ok {
+			x = o.v
+		} else if v.Type == Object {
+			x = reflect.ValueOf(v.ToObject())
+		} else {
+			x = reflect.ValueOf(v.Export(0))
+		}
+		if !x.Type().AssignableTo(t) {
+			return reflect.Value{}, convertError(v, t)
+		}
+		return x, nil
+
+	default:
+		return reflect.Value{}, fmt.Errorf("unsupported type %v", t)
+	}
+}
+
+func toInt(v Value, t reflect.Type) (int64, error) {
+	switch v.Type {
+	case Int:
+		return v.ToInt(), nil
+	case Float:
+		f := v.ToFloat()
+		if f != float64(int64(f)) {
+			return 0, fmt.Errorf("%v is not an integer", f)
+		}
+		return int64(f), nil
+	case Rune:
+		return int64(v.ToRune()), nil
+	}
+	return 0, convertError(v, t)
+}
+
+func structFromMap(m *MapValue, t reflect.Type) (reflect.Value, error) {
+	b := getBoundType(t)
+	x := reflect.New(t).Elem()
+
+	m.Mutex.RLock()
+	defer m.Mutex.RUnlock()
+
+	for k, item := range m.Map {
+		i, ok := b.fields[k]
+		if !ok {
+			return reflect.Value{}, fmt.Errorf("undefined property %s in %s", k, b.name)
+		}
+		f := x.FieldByIndex(i)
+		y, err := fromValue(item, f.Type())
+		if err != nil {
+			return reflect.Value{}, fmt.Errorf("%s: %v", k, err)
+		}
+		f.Set(y)
+	}
+
+	return x, nil
+}
+
+func convertError(v Value, t reflect.Type) error {
+	return fmt.Errorf("can't convert %s to %v", v.TypeName(), t)
+}
+
+// declareTypes returns the TypeScript declarations of the structs
+// used by t that have not been declared yet.
+func declareTypes(t reflect.Type) string {
+	var b strings.Builder
+	declareType(t, &b)
+	return b.String()
+}
+
+func declareType(t reflect.Type, b *strings.Builder) {
+	if _, ok := getConverter(t); ok {
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+		declareType(t.Elem(), b)
+		return
+	case reflect.Struct:
+	default:
+		return
+	}
+
+	if t.Name() == "" {
+		return
+	}
+
+	bindMutex.Lock()
+	declared := declaredTypes[t]
+	declaredTypes[t] = true
+	bindMutex.Unlock()
+
+	if declared {
+		return
+	}
+
+	bt := getBoundType(t)
+
+	var members []string
+	var used []reflect.Type
+
+	for _, name := range bt.order {
+		f := t.FieldByIndex(bt.fields[name])
+		members = append(members, fmt.Sprintf("%s: %s", name, tsType(f.Type)))
+		used = append(used, f.Type)
+	}
+
+	pt := reflect.PtrTo(t)
+
+	var methods []string
+	for name, i := range bt.methods {
+		mt := pt.Method(i).Type
+		methods = append(methods, name+tsSignature(mt, 1))
+		for j := 1; j < mt.NumIn(); j++ {
+			used = append(used, mt.In(j))
+		}
+		for j := 0; j < mt.NumOut(); j++ {
+			used = append(used, mt.Out(j))
+		}
+	}
+	sort.Strings(methods)
+
+	fmt.Fprintf(b, "declare interface %s {\n", bt.name)
+	for _, m := range append(members, methods...) {
+		fmt.Fprintf(b, "    %s\n", m)
+	}
+	b.WriteString("}\n\n")
+
+	for _, u := range used {
+		declareType(u, b)
+	}
+}
+
+// tsSignature returns the TypeScript signature of a function
+// skipping the first arguments, like the receiver.
+func tsSignature(t reflect.Type, skip int) string {
+	var params []string
+	for i := skip; i < t.NumIn(); i++ {
+		name := "a" + strconv.Itoa(i-skip+1)
+		if t.IsVariadic() && i == t.NumIn()-1 {
+			params = append(params, "..."+name+": "+tsType(t.In(i)))
+		} else {
+			params = append(params, name+": "+tsType(t.In(i)))
+		}
+	}
+
+	var results []string
+	for i := 0; i < t.NumOut(); i++ {
+		if i == t.NumOut()-1 && t.Out(i) == errorType {
+			break
+		}
+		results = append(results, tsType(t.Out(i)))
+	}
+
+	var ret string
+	switch len(results) {
+	case 0:
+		ret = "void"
+	case 1:
+		ret = results[0]
+	default:
+		ret = "any[]"
+	}
+
+	return "(" + strings.Join(params, ", ") + "): " + ret
+}
+
+// tsType returns the TypeScript type of a Go type.
+func tsType(t reflect.Type) string {
+	if c, ok := getConverter(t); ok {
+		return c.TypeName
+	}
+
+	switch t {
+	case valueType:
+		return "any"
+	case errorType:
+		return "errors.Error"
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.String:
+		return "string"
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "byte[]"
+		}
+		return tsType(t.Elem()) + "[]"
+	case reflect.Map:
+		return "{ [key: string]: " + tsType(t.Elem()) + " }"
+	case reflect.Ptr:
+		return tsType(t.Elem())
+	case reflect.Struct:
+		if t.Name() == "" {
+			return "any"
+		}
+		return t.Name()
+	default:
+		return "any"
+	}
+}
@@ -11,16 +11,14 @@ import (
 	"github.com/gtlang/gt/parser"
 )
 
+// CompilerVersion must change every time the compiler output changes
+// so cached programs are compiled again.
+const CompilerVersion = "8"
+
 var builtinFuncs = []string{"go", "defer", "panic", "T"}
 
 func Compile(fs filesystem.FS, path string) (*Program, error) {
-	a, err := parser.Parse(fs, path)
-	if err != nil {
-		return nil, err
-	}
-
-	c := NewCompiler()
-	return c.Compile(a)
+	return CompileWithDefines(fs, path, nil)
 }
 
 func CompileStr(code string) (*Program, error) {
@@ -30,7 +28,14 @@ func CompileStr(code string) (*Program, error) {
 	}
 
 	c := NewCompiler()
-	return c.Compile(a)
+	p, err := c.Compile(a)
+	if err != nil {
+		return nil, err
+	}
+
+	p.Sources = map[string][]byte{"": []byte(code)}
+	c.removeEliminatedSources()
+	return p, nil
 }
 
 func AddBuiltinFunc(name string) {
@@ -138,9 +143,20 @@ type compiler struct {
 	module          string // the module being compiled
 	functions       map[string]*functionInfo
 	builtinFuncs    []string
+	enums           map[string]*enumInfo
+	eliminated      []*ast.BlockStmt // blocks removed by constant conditions
+
+	// Defines are the compile-time constants read as __DEFINE__.NAME
+	Defines map[string]Value
 }
 
 func (c *compiler) Compile(ast *ast.Module) (*Program, error) {
+	if err := c.addDefines(ast); err != nil {
+		return nil, err
+	}
+
+	c.addEnums(ast)
+
 	for path, m := range ast.Modules {
 		c.module = path
 		if err := c.compileFile(m); err != nil {
@@ -175,6 +191,11 @@ func (c *compiler) Compile(ast *ast.Module) (*Program, error) {
 func (c *compiler) compileFile(file *ast.File) error {
 	c.imports = file.Imports
 
+	// register the file even if all its code is eliminated
+	if c.program.FileIndex(file.Path) == -1 {
+		c.program.Files = append(c.program.Files, file.Path)
+	}
+
 	if err := addDirectives(c.program, file); err != nil {
 		return err
 	}
@@ -287,6 +308,12 @@ func (c *compiler) compileVarDeclStmt(t *ast.VarDeclStmt) error {
 
 	i := c.newRegister(name, t.Exported)
 
+	if t.IsEnum && c.currentFunc == c.globalFunc {
+		if e, ok := c.enums[c.registerName(name)]; ok {
+			e.register = i
+		}
+	}
+
 	// the right hand is a expression
 	if _, err := c.compileExpr(t.Value, i); err != nil {
 		return err
@@ -651,15 +678,14 @@ func (c *compiler) compileForInOfStmt(t *ast.ForStmt, in bool) error {
 	// this is the key variable
 	key := c.newRegister(dec.Name, false)
 
-	// create a temp array with the keys/index or values
-	items := c.newTempRegister()
-
-	if in {
-		c.emit(op_key, items, rng, Void, dec.Pos)
-	} else {
-		c.emit(op_val, items, rng, Void, dec.Pos)
+	if !in {
+		return c.compileForOfBody(t, key, rng, dec.Pos)
 	}
 
+	// create a temp array with the keys/index
+	items := c.newTempRegister()
+	c.emit(op_key, items, rng, Void, dec.Pos)
+
 	// get the length of the keys/index
 	iLen := c.newTempRegister()
 	c.emit(op_len, iLen, items, Void, ast.Position{})
@@ -716,6 +742,48 @@ func (c *compiler) compileForInOfStmt(t *ast.ForStmt, in bool) error {
 	return nil
 }
 
+// compileForOfBody iterates the values with an iterator so they are
+// consumed lazily.
+func (c *compiler) compileForOfBody(t *ast.ForStmt, value, rng *Address, pos ast.Position) error {
+	it := c.newTempRegister()
+	c.emit(op_itr, it, rng, Void, pos)
+
+	// the register that will hold if there is a value
+	ok := c.newTempRegister()
+
+	// this is start point where it needs to return each iteration
+	loopStart := c.pc()
+	t.SetContinuePC(loopStart)
+
+	// get the next value
+	c.emit(op_nxt, value, it, ok, pos)
+
+	bodyStart := c.pc()
+
+	// conditional jump: test R(A) and jump R(B) instructions. R(C)=1 means jump if false
+	loopBrk := c.emit(op_tjp, ok, Void, NewAddress(AddrData, 1), ast.Position{})
+
+	// the body of the loop
+	if err := c.compileBlockStmt(t.Body); err != nil {
+		return err
+	}
+
+	// jump back to iterate
+	steps := NewAddress(AddrData, c.pc()-loopStart)
+	c.emit(op_jpb, steps, Void, Void, ast.Position{})
+
+	bodyEnd := c.pc()
+	t.SetBreakPC(bodyEnd)
+
+	// set the offset to jump when there are no more values
+	loopBrk.B = NewAddress(AddrData, bodyEnd-bodyStart-1)
+
+	c.closeScope()
+	c.closeBranch()
+
+	return nil
+}
+
 // del tipo "for next() {}"
 func (c *compiler) compileWhileStmt(t *ast.WhileStmt) error {
 	c.openBranch(t)
@@ -1087,6 +1155,15 @@ func (c *compiler) compileCaseBlock(t *ast.SwitchStmt, block *ast.CaseBlock, jum
 }
 
 func (c *compiler) compileIfStmt(t *ast.IfStmt) error {
+	t = c.foldIfStmt(t)
+
+	if len(t.IfBlocks) == 0 {
+		if t.Else != nil {
+			return c.compileBlockStmt(t.Else)
+		}
+		return nil
+	}
+
 	if len(t.IfBlocks) == 1 && t.Else == nil {
 		// produce simpler code if there are no elses
 		return c.compileIfBlockStmt(t)
@@ -1182,6 +1259,9 @@ func (c *compiler) compileExpr(t ast.Expr, dest *Address) (*Address, error) {
 		return c.compileMapDeclExpr(t, dest)
 	case *ast.ArrayDeclExpr:
 		return c.compileArrayDeclExpr(t, dest)
+
+	case *ast.SpreadExpr:
+		return Void, newError(t.Pos, "Unexpected spread operator")
 	case *ast.IndexExpr:
 		return c.compileIndexExpr(t, dest)
 	case *ast.SelectorExpr:
@@ -1206,6 +1286,7 @@ func (c *compiler) compileFuncDeclExpr(t *ast.FuncDeclExpr, dest *Address) (*Add
 		Name:      fmt.Sprintf("@lambda_%d", i),
 		Anonymous: true,
 		Args:      t.Args,
+		Variadic:  t.Variadic,
 		Body:      t.Body,
 	}
 
@@ -1436,6 +1517,16 @@ func (c *compiler) compileMapDeclExpr(t *ast.MapDeclExpr, dest *Address) (*Addre
 	c.emit(op_map, dest, NewAddress(AddrData, len(t.List)), Void, t.Pos)
 
 	for _, kv := range t.List {
+		// copy the keys of the spread map in order
+		if sp, ok := kv.Value.(*ast.SpreadExpr); ok {
+			exp, err := c.compileExpr(sp.Value, Void)
+			if err != nil {
+				return Void, err
+			}
+			c.emit(op_spr, dest, exp, Void, sp.Pos)
+			continue
+		}
+
 		// the key is a constant
 		k := c.program.addConstant(NewString(kv.Key))
 
@@ -1478,6 +1569,13 @@ func (c *compiler) compileArrayDeclExpr(t *ast.ArrayDeclExpr, dest *Address) (*A
 		dest = c.newTempRegister()
 	}
 
+	if hasSpread(t.List) {
+		if err := c.compileSpreadArray(t.List, dest, t.Pos); err != nil {
+			return Void, err
+		}
+		return dest, nil
+	}
+
 	c.emit(op_arr, dest, NewAddress(AddrData, len(t.List)), Void, t.Pos)
 
 	for i, kv := range t.List {
@@ -1500,7 +1598,8 @@ func (c *compiler) compileNewInstanceExpr(t *ast.NewInstanceExpr, dest *Address)
 
 	switch tp := t.Name.(type) {
 	case *ast.IdentExpr:
-		addr = c.program.addConstant(NewString(tp.Name))
+		// the classes of a module are prefixed
+		addr = c.program.addConstant(NewString(c.registerName(tp.Name)))
 
 	case *ast.SelectorExpr:
 		ident, ok := tp.X.(*ast.IdentExpr)
@@ -1523,7 +1622,7 @@ func (c *compiler) compileNewInstanceExpr(t *ast.NewInstanceExpr, dest *Address)
 		dest = c.newTempRegister()
 	}
 
-	if !t.Spread && len(t.Args) == 1 {
+	if len(t.Args) == 1 && !hasSpread(t.Args) {
 		exp, err := c.compileExpr(t.Args[0], Void)
 		if err != nil {
 			return Void, err
@@ -1534,7 +1633,7 @@ func (c *compiler) compileNewInstanceExpr(t *ast.NewInstanceExpr, dest *Address)
 		return dest, nil
 	}
 
-	args, err := c.compileCallArgs(t.Args, t.Spread)
+	args, err := c.compileCallArgs(t.Args)
 	if err != nil {
 		return Void, err
 	}
@@ -1764,6 +1863,19 @@ func (c *compiler) compileUnaryConstantExpr(operator ast.Type, t *ast.ConstantEx
 }
 
 func (c *compiler) compileSelectorExpr(t *ast.SelectorExpr, dest *Address) (*Address, error) {
+	// compile-time defines and enum members are inlined
+	if v, ok := c.defineValue(t); ok {
+		k := c.program.addConstant(v)
+		if dest != Void {
+			c.emit(op_ldk, dest, k, Void, t.Position())
+		}
+		return k, nil
+	}
+
+	if k, ok := c.enumMember(t); ok {
+		return c.compileConstantExpr(&ast.ConstantExpr{Pos: t.Position(), Kind: k.Kind, Value: k.Value}, dest)
+	}
+
 	// check if is a module call
 	ident, ok := t.X.(*ast.IdentExpr)
 	if ok {
@@ -1882,7 +1994,7 @@ func (c *compiler) compileCallExpr(t *ast.CallExpr, dest *Address, retVal bool)
 		dest = c.newTempRegister()
 	}
 
-	if !t.Spread && len(t.Args) == 1 {
+	if len(t.Args) == 1 && !hasSpread(t.Args) {
 		exp, err := c.compileExpr(t.Args[0], Void)
 		if err != nil {
 			return Void, err
@@ -1893,7 +2005,7 @@ func (c *compiler) compileCallExpr(t *ast.CallExpr, dest *Address, retVal bool)
 		return dest, nil
 	}
 
-	args, err := c.compileCallArgs(t.Args, t.Spread)
+	args, err := c.compileCallArgs(t.Args)
 	if err != nil {
 		return Void, err
 	}
@@ -1904,13 +2016,21 @@ func (c *compiler) compileCallExpr(t *ast.CallExpr, dest *Address, retVal bool)
 }
 
 // compile the arguments of a function call.
-func (c *compiler) compileCallArgs(params []ast.Expr, spreadArg bool) (*Address, error) {
+func (c *compiler) compileCallArgs(params []ast.Expr) (*Address, error) {
 	ln := len(params)
 	if ln == 0 {
 		return Void, nil
 	}
 
 	dest := c.newTempRegister()
+
+	if hasSpread(params) {
+		if err := c.compileSpreadArray(params, dest, params[0].Position()); err != nil {
+			return Void, err
+		}
+		return dest, nil
+	}
+
 	c.emit(op_arr, dest, NewAddress(AddrData, ln), Void, params[0].Position())
 
 	for i, p := range params {
@@ -1922,12 +2042,49 @@ func (c *compiler) compileCallArgs(params []ast.Expr, spreadArg bool) (*Address,
 		c.emit(op_set, dest, NewAddress(AddrData, i), exp, p.Position())
 	}
 
-	if spreadArg {
-		// concat the last arg if is spread
-		c.emit(op_spa, dest, Void, Void, params[ln-1].Position())
+	return dest, nil
+}
+
+// compileSpreadArray builds an array with spread values like [a, ...b, c].
+// The array is created with the capacity for the values that are not spread
+// and each spread appends all its values at once.
+func (c *compiler) compileSpreadArray(values []ast.Expr, dest *Address, pos ast.Position) error {
+	var size int
+	for _, v := range values {
+		if _, ok := v.(*ast.SpreadExpr); !ok {
+			size++
+		}
 	}
 
-	return dest, nil
+	c.emit(op_arr, dest, NewAddress(AddrData, 0), NewAddress(AddrData, size), pos)
+
+	for _, v := range values {
+		if s, ok := v.(*ast.SpreadExpr); ok {
+			exp, err := c.compileExpr(s.Value, Void)
+			if err != nil {
+				return err
+			}
+			c.emit(op_spr, dest, exp, Void, s.Pos)
+			continue
+		}
+
+		exp, err := c.compileExpr(v, Void)
+		if err != nil {
+			return err
+		}
+		c.emit(op_apd, dest, exp, Void, v.Position())
+	}
+
+	return nil
+}
+
+func hasSpread(values []ast.Expr) bool {
+	for _, v := range values {
+		if _, ok := v.(*ast.SpreadExpr); ok {
+			return true
+		}
+	}
+	return false
 }
 
 func (c *compiler) compileClassDeclStmt(t *ast.ClassDeclStmt) error {
@@ -2069,43 +2226,60 @@ func (c *compiler) compileConstantExpr(t *ast.ConstantExpr, dest *Address) (*Add
 }
 
 func (c *compiler) newConstant(t *ast.ConstantExpr) (*Address, error) {
-	p := c.program
+	if t.Kind == ast.REGEX {
+		r, err := ParseRegex(t.Value)
+		if err != nil {
+			return Void, newError(t.Pos, "Invalid regex %s: %v", t.Value, err)
+		}
+		return c.program.addConstant(NewObject(r)), nil
+	}
+
+	v, err := constantValue(t)
+	if err != nil {
+		return Void, err
+	}
+
+	return c.program.addConstant(v), nil
+}
 
+// constantValue converts a literal to a value. Regex literals are objects
+// that are created by newConstant.
+func constantValue(t *ast.ConstantExpr) (Value, error) {
 	switch t.Kind {
 	case ast.INT:
 		n, err := strconv.ParseInt(t.Value, 10, 64)
 		if err != nil {
-			return Void, newError(t.Pos, "Invalid int value %s", t.Value)
+			return NullValue, newError(t.Pos, "Invalid int value %s", t.Value)
 		}
-		return p.addConstant(NewInt64(n)), nil
+		return NewInt64(n), nil
 
 	case ast.FLOAT:
 		n, err := strconv.ParseFloat(t.Value, 64)
 		if err != nil {
-			return Void, newError(t.Pos, "Invalid float value %s", t.Value)
+			return NullValue, newError(t.Pos, "Invalid float value %s", t.Value)
 		}
-		return p.addConstant(NewFloat(n)), nil
+		return NewFloat(n), nil
 
 	case ast.STRING:
-		return p.addConstant(NewString(t.Value)), nil
+		return NewString(t.Value), nil
 
 	case ast.TRUE:
-		return p.addConstant(TrueValue), nil
+		return TrueValue, nil
 
 	case ast.FALSE:
-		return p.addConstant(FalseValue), nil
+		return FalseValue, nil
 
 	case ast.NULL:
-		return p.addConstant(NullValue), nil
+		return NullValue, nil
 
 	case ast.RUNE:
-		return p.addConstant(NewRune(rune(t.Value[0]))), nil
+		return NewRune(rune(t.Value[0])), nil
 
 	case ast.UNDEFINED:
-		return p.addConstant(UndefinedValue), nil
+		return UndefinedValue, nil
 
 	default:
-		return Void, newError(t.Pos, "Invalid type %s", t.Value)
+		return NullValue, newError(t.Pos, "Invalid type %s", t.Value)
 	}
 }
 
@@ -2242,13 +2416,16 @@ func (c *compiler) findRegister(name string, fi *functionInfo) (*Address, error)
 	}
 
 	// search classes
-	for _, cl := range c.program.Classes {
+	for i, cl := range c.program.Classes {
+		if globalName == cl.Name {
+			// a class of the same module
+			return NewAddress(AddrClass, i), nil
+		}
 		if name == cl.Name {
 			if !cl.Exported {
 				return Void, fmt.Errorf("%s is not exported", name)
 			}
-			k := c.program.addConstant(NewString(name))
-			return k, nil
+			return NewAddress(AddrClass, i), nil
 		}
 	}
 
@@ -0,0 +1,552 @@
+package core
+
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// ToValue and Value.Decode convert between Go values and plain script
+// values following the rules of encoding/json: structs are maps keyed by
+// the json tag of their fields, values that implement encoding.TextMarshaler
+// are strings and nil pointers, slices and maps are null.
+//
+// Types with a registered Converter, like time.Time, use it instead.
+
+var (
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+var jsonFields = make(map[reflect.Type][]jsonField)
+
+type jsonField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+// DecodeError is returned by Value.Decode with the path of the value
+// that couldn't be decoded, like "address.lines[2]".
+type DecodeError struct {
+	Path string
+	Err  error
+}
+
+func (e *DecodeError) Error() string {
+	if e.Path == "" {
+		return e.Err.Error()
+	}
+	return e.Path + ": " + e.Err.Error()
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// ToValue converts a Go value to a script value.
+func ToValue(v interface{}) (Value, error) {
+	return marshalValue(reflect.ValueOf(v), "")
+}
+
+// Decode stores the value in the value pointed to by dst.
+func (v Value) Decode(dst interface{}) error {
+	rv := reflect.ValueOf(dst)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("decode: expected a non nil pointer, got %T", dst)
+	}
+	return decodeValue(v, rv.Elem(), "")
+}
+
+func marshalValue(v reflect.Value, path string) (Value, error) {
+	if !v.IsValid() {
+		return NullValue, nil
+	}
+
+	t := v.Type()
+
+	if t == valueType {
+		return v.Interface().(Value), nil
+	}
+
+	if c, ok := getConverter(t); ok {
+		return c.ToValue(v)
+	}
+
+	if t == errorType {
+		if v.IsNil() {
+			return NullValue, nil
+		}
+		return NewObject(Error{message: v.Interface().(error).Error()}), nil
+	}
+
+	if t.Kind() != reflect.Ptr && t.Kind() != reflect.Interface && t.Implements(textMarshalerType) {
+		return marshalText(v, path)
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return NewBool(v.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return NewInt64(v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return NewInt64(int64(v.Uint())), nil
+	case reflect.Float32, reflect.Float64:
+		return NewFloat(v.Float()), nil
+	case reflect.String:
+		return NewString(v.String()), nil
+
+	case reflect.Slice:
+		if v.IsNil() {
+			return NullValue, nil
+		}
+		if t.Elem().Kind() == reflect.Uint8 {
+			return NewBytes(v.Bytes()), nil
+		}
+		fallthrough
+	case reflect.Array:
+		values := make([]Value, v.Len())
+		for i := range values {
+			x, err := marshalValue(v.Index(i), path+"["+strconv.Itoa(i)+"]")
+			if err != nil {
+				return NullValue, err
+			}
+			values[i] = x
+		}
+		return NewArrayValues(values), nil
+
+	case reflect.Map:
+		if v.IsNil() {
+			return NullValue, nil
+		}
+		m := make(map[string]Value, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			k, err := mapKey(iter.Key())
+			if err != nil {
+				return NullValue, pathError(path, err)
+			}
+			x, err := marshalValue(iter.Value(), joinPath(path, k))
+			if err != nil {
+				return NullValue, err
+			}
+			m[k] = x
+		}
+		return NewMapValues(m), nil
+
+	case reflect.Struct:
+		fields := getJSONFields(t)
+		m := make(map[string]Value, len(fields))
+		for _, f := range fields {
+			fv, err := v.FieldByIndexErr(f.index)
+			if err != nil {
+				continue // a nil embedded pointer
+			}
+			if f.omitEmpty && isEmptyValue(fv) {
+				continue
+			}
+			x, err := marshalValue(fv, joinPath(path, f.name))
+			if err != nil {
+				return NullValue, err
+			}
+			m[f.name] = x
+		}
+		return NewMapValues(m), nil
+
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return NullValue, nil
+		}
+		return marshalValue(v.Elem(), path)
+
+	default:
+		return NullValue, pathError(path, fmt.Errorf("unsupported type %v", t))
+	}
+}
+
+func marshalText(v reflect.Value, path string) (Value, error) {
+	b, err := v.Interface().(encoding.TextMarshaler).MarshalText()
+	if err != nil {
+		return NullValue, pathError(path, err)
+	}
+	return NewString(string(b)), nil
+}
+
+// mapKey converts a map key to string like encoding/json.
+func mapKey(k reflect.Value) (string, error) {
+	if k.Kind() == reflect.String {
+		return k.String(), nil
+	}
+
+	if tm, ok := k.Interface().(encoding.TextMarshaler); ok {
+		if k.Kind() == reflect.Ptr && k.IsNil() {
+			return "", nil
+		}
+		b, err := tm.MarshalText()
+		return string(b), err
+	}
+
+	switch k.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(k.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(k.Uint(), 10), nil
+	}
+
+	return "", fmt.Errorf("unsupported map key type %v", k.Type())
+}
+
+func decodeValue(v Value, dst reflect.Value, path string) error {
+	t := dst.Type()
+
+	if t == valueType {
+		dst.Set(reflect.ValueOf(v))
+		return nil
+	}
+
+	if c, ok := getConverter(t); ok {
+		if v.Type == Null || v.Type == Undefined {
+			return nil
+		}
+		x, err := c.FromValue(v)
+		if err != nil {
+			return &DecodeError{path, err}
+		}
+		dst.Set(x)
+		return nil
+	}
+
+	// like encoding/json null only changes pointers, interfaces, maps and slices
+	if v.Type == Null || v.Type == Undefined {
+		switch t.Kind() {
+		case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice:
+			dst.Set(reflect.Zero(t))
+		}
+		return nil
+	}
+
+	if t.Kind() == reflect.Ptr {
+		if dst.IsNil() {
+			dst.Set(reflect.New(t.Elem()))
+		}
+		return decodeValue(v, dst.Elem(), path)
+	}
+
+	if t == errorType {
+		switch v.Type {
+		case String:
+			dst.Set(reflect.ValueOf(fmt.Errorf("%s", v.ToString())))
+			return nil
+		case Object:
+			if e, ok := v.ToObject().(Error); ok {
+				dst.Set(reflect.ValueOf(fmt.Errorf("%s", e.Message())))
+				return nil
+			}
+		}
+		return &DecodeError{path, convertError(v, t)}
+	}
+
+	if v.Type == String && t.Kind() != reflect.String && reflect.PtrTo(t).Implements(textUnmarshalerType) {
+		u := dst.Addr().Interface().(encoding.TextUnmarshaler)
+		if err := u.UnmarshalText([]byte(v.ToString())); err != nil {
+			return &DecodeError{path, err}
+		}
+		return nil
+	}
+
+	switch t.Kind() {
+	case reflect.Interface:
+		if t.NumMethod() != 0 {
+			x := reflect.ValueOf(v.ToObjectOrNil())
+			if v.Type != Object || !x.IsValid() || !x.Type().AssignableTo(t) {
+				return &DecodeError{path, convertError(v, t)}
+			}
+			dst.Set(x)
+			return nil
+		}
+		if x := v.Export(0); x != nil {
+			dst.Set(reflect.ValueOf(x))
+		} else {
+			dst.Set(reflect.Zero(t))
+		}
+		return nil
+
+	case reflect.Struct:
+		if v.Type == Object {
+			if o, ok := v.ToObject().(*boundObject); ok && o.v.Type().Elem() == t {
+				dst.Set(o.v.Elem())
+				return nil
+			}
+		}
+		if v.Type != Map {
+			return &DecodeError{path, convertError(v, t)}
+		}
+		return decodeStruct(v.ToMap(), dst, path)
+
+	case reflect.Map:
+		if v.Type != Map {
+			return &DecodeError{path, convertError(v, t)}
+		}
+		return decodeMap(v.ToMap(), dst, path)
+
+	case reflect.Slice:
+		switch v.Type {
+		case Bytes, String:
+			if t.Elem().Kind() == reflect.Uint8 {
+				dst.SetBytes(append([]byte(nil), v.ToBytes()...))
+				return nil
+			}
+		case Array:
+			a := v.ToArray()
+			s := reflect.MakeSlice(t, len(a), len(a))
+			for i, item := range a {
+				if err := decodeValue(item, s.Index(i), path+"["+strconv.Itoa(i)+"]"); err != nil {
+					return err
+				}
+			}
+			dst.Set(s)
+			return nil
+		}
+		return &DecodeError{path, convertError(v, t)}
+
+	case reflect.Array:
+		if v.Type != Array {
+			return &DecodeError{path, convertError(v, t)}
+		}
+		a := v.ToArray()
+		for i := 0; i < dst.Len(); i++ {
+			if i >= len(a) {
+				dst.Index(i).Set(reflect.Zero(t.Elem()))
+				continue
+			}
+			if err := decodeValue(a[i], dst.Index(i), path+"["+strconv.Itoa(i)+"]"); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	x, err := fromValue(v, t)
+	if err != nil {
+		return &DecodeError{path, err}
+	}
+	dst.Set(x)
+	return nil
+}
+
+func decodeStruct(m *MapValue, dst reflect.Value, path string) error {
+	fields := getJSONFields(dst.Type())
+
+	m.Mutex.RLock()
+	defer m.Mutex.RUnlock()
+
+	for k, item := range m.Map {
+		f := findJSONField(fields, k)
+		if f == nil {
+			continue // unknown keys are ignored
+		}
+
+		fv, err := fieldByIndexAlloc(dst, f.index)
+		if err != nil {
+			return &DecodeError{joinPath(path, k), err}
+		}
+
+		if err := decodeValue(item, fv, joinPath(path, k)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func decodeMap(m *MapValue, dst reflect.Value, path string) error {
+	t := dst.Type()
+
+	if dst.IsNil() {
+		dst.Set(reflect.MakeMap(t))
+	}
+
+	m.Mutex.RLock()
+	defer m.Mutex.RUnlock()
+
+	for k, item := range m.Map {
+		key, err := decodeMapKey(k, t.Key())
+		if err != nil {
+			return &DecodeError{joinPath(path, k), err}
+		}
+
+		x := reflect.New(t.Elem()).Elem()
+		if err := decodeValue(item, x, joinPath(path, k)); err != nil {
+			return err
+		}
+
+		dst.SetMapIndex(key, x)
+	}
+
+	return nil
+}
+
+func decodeMapKey(k string, t reflect.Type) (reflect.Value, error) {
+	if reflect.PtrTo(t).Implements(textUnmarshalerType) {
+		x := reflect.New(t)
+		if err := x.Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(k)); err != nil {
+			return reflect.Value{}, err
+		}
+		return x.Elem(), nil
+	}
+
+	x := reflect.New(t).Elem()
+
+	switch t.Kind() {
+	case reflect.String:
+		x.SetString(k)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(k, 10, 64)
+		if err != nil || x.OverflowInt(i) {
+			return reflect.Value{}, fmt.Errorf("invalid key for %v", t)
+		}
+		x.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		i, err := strconv.ParseUint(k, 10, 64)
+		if err != nil || x.OverflowUint(i) {
+			return reflect.Value{}, fmt.Errorf("invalid key for %v", t)
+		}
+		x.SetUint(i)
+	default:
+		return reflect.Value{}, fmt.Errorf("unsupported map key type %v", t)
+	}
+
+	return x, nil
+}
+
+// fieldByIndexAlloc returns the field allocating nil embedded pointers.
+func fieldByIndexAlloc(v reflect.Value, index []int) (reflect.Value, error) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !v.CanSet() {
+					return reflect.Value{}, fmt.Errorf("can't set embedded pointer to unexported struct %v", v.Type().Elem())
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, nil
+}
+
+// findJSONField returns the field with the exact name or else
+// a case insensitive match like encoding/json.
+func findJSONField(fields []jsonField, name string) *jsonField {
+	for i := range fields {
+		if fields[i].name == name {
+			return &fields[i]
+		}
+	}
+	for i := range fields {
+		if strings.EqualFold(fields[i].name, name) {
+			return &fields[i]
+		}
+	}
+	return nil
+}
+
+func getJSONFields(t reflect.Type) []jsonField {
+	bindMutex.RLock()
+	fields, ok := jsonFields[t]
+	bindMutex.RUnlock()
+	if ok {
+		return fields
+	}
+
+	depths := make(map[string]int)
+
+	for _, f := range reflect.VisibleFields(t) {
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(tag, ",")
+
+		if f.Anonymous {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			// the fields of embedded structs are promoted
+			if name == "" && ft.Kind() == reflect.Struct {
+				continue
+			}
+		}
+
+		if !f.IsExported() {
+			continue
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+
+		// the shallower field hides the others like in Go
+		if d, ok := depths[name]; ok {
+			if d <= len(f.Index) {
+				continue
+			}
+			for i := range fields {
+				if fields[i].name == name {
+					fields = append(fields[:i], fields[i+1:]...)
+					break
+				}
+			}
+		}
+		depths[name] = len(f.Index)
+
+		fields = append(fields, jsonField{
+			name:      name,
+			index:     f.Index,
+			omitEmpty: strings.Contains(","+opts+",", ",omitempty,"),
+		})
+	}
+
+	bindMutex.Lock()
+	jsonFields[t] = fields
+	bindMutex.Unlock()
+
+	return fields
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+func pathError(path string, err error) error {
+	if path == "" {
+		return err
+	}
+	return fmt.Errorf("%s: %w", path, err)
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
@@ -0,0 +1,560 @@
+package core
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Decimal is an exact decimal number for amounts of money, where floats
+// accumulate rounding errors. Adding, subtracting and multiplying are
+// exact. Dividing rounds the result to the places of the DecimalContext.
+//
+// Decimals are immutable so they can be shared between VMs.
+type Decimal struct {
+	coef  *big.Int // the value is coef * 10^-scale
+	scale int
+}
+
+// RoundingMode sets how the digits that don't fit are discarded.
+type RoundingMode int
+
+const (
+	RoundHalfUp   RoundingMode = iota // away from zero if it is half way
+	RoundHalfEven                     // to the even neighbour if it is half way
+	RoundHalfDown                     // towards zero if it is half way
+	RoundUp                           // away from zero
+	RoundDown                         // towards zero
+	RoundCeiling                      // towards positive infinity
+	RoundFloor                        // towards negative infinity
+)
+
+var roundingModes = []string{"halfUp", "halfEven", "halfDown", "up", "down", "ceiling", "floor"}
+
+func (m RoundingMode) String() string {
+	if m < 0 || int(m) >= len(roundingModes) {
+		return fmt.Sprintf("RoundingMode(%d)", m)
+	}
+	return roundingModes[m]
+}
+
+// ParseRoundingMode returns the mode by its name, like "halfEven".
+func ParseRoundingMode(s string) (RoundingMode, error) {
+	for i, name := range roundingModes {
+		if name == s {
+			return RoundingMode(i), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid rounding mode %q", s)
+}
+
+// DecimalContext sets the precision of the divisions.
+type DecimalContext struct {
+	Places   int // the digits after the point
+	Rounding RoundingMode
+}
+
+// DefaultDecimalContext is used when VM.Decimals is nil.
+var DefaultDecimalContext = DecimalContext{Places: 16, Rounding: RoundHalfUp}
+
+func (vm *VM) decimalContext() DecimalContext {
+	if vm.Decimals != nil {
+		return *vm.Decimals
+	}
+	return DefaultDecimalContext
+}
+
+// MaxDecimalPlaces and MaxDecimalDigits limit the size of the numbers
+// that scripts can create. The operations that exceed them fail.
+const (
+	MaxDecimalPlaces = 1000
+	MaxDecimalDigits = 2000
+)
+
+// the bits of a coefficient with MaxDecimalDigits digits
+var maxDecimalBits = int(math.Ceil(MaxDecimalDigits * math.Log2(10)))
+
+var bigTen = big.NewInt(10)
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(bigTen, big.NewInt(int64(n)), nil)
+}
+
+// NewDecimal returns coef * 10^-scale, so NewDecimal(150, 2) is 1.50.
+func NewDecimal(coef int64, scale int) *Decimal {
+	d := &Decimal{coef: big.NewInt(coef), scale: scale}
+	if scale < 0 {
+		d.coef.Mul(d.coef, pow10(-scale))
+		d.scale = 0
+	}
+	return d
+}
+
+// NewDecimalFromFloat converts the shortest representation of f,
+// so 0.1 is exactly 0.1.
+func NewDecimalFromFloat(f float64) (*Decimal, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, fmt.Errorf("can't convert %v to decimal", f)
+	}
+	return ParseDecimal(strconv.FormatFloat(f, 'f', -1, 64))
+}
+
+// ParseDecimal parses numbers like "-1234.50" or "1.5e3".
+func ParseDecimal(s string) (*Decimal, error) {
+	str := strings.TrimSpace(s)
+
+	var exp int
+	if i := strings.IndexAny(str, "eE"); i != -1 {
+		e, err := strconv.Atoi(str[i+1:])
+		if err != nil || e > MaxDecimalPlaces || e < -MaxDecimalPlaces {
+			return nil, fmt.Errorf("invalid decimal %q", s)
+		}
+		exp = e
+		str = str[:i]
+	}
+
+	var neg bool
+	if str != "" && (str[0] == '-' || str[0] == '+') {
+		neg = str[0] == '-'
+		str = str[1:]
+	}
+
+	digits := str
+	var scale int
+	if i := strings.IndexByte(str, '.'); i != -1 {
+		digits = str[:i] + str[i+1:]
+		scale = len(str) - i - 1
+	}
+
+	if digits == "" {
+		return nil, fmt.Errorf("invalid decimal %q", s)
+	}
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return nil, fmt.Errorf("invalid decimal %q", s)
+		}
+	}
+
+	coef, _ := new(big.Int).SetString(digits, 10)
+	if neg {
+		coef.Neg(coef)
+	}
+
+	d := &Decimal{coef: coef, scale: scale - exp}
+	if d.scale > MaxDecimalPlaces || len(digits)-d.scale > MaxDecimalDigits {
+		return nil, fmt.Errorf("invalid decimal %q: out of range", s)
+	}
+	if d.scale < 0 {
+		d.coef.Mul(d.coef, pow10(-d.scale))
+		d.scale = 0
+	}
+	return d.check()
+}
+
+// ToDecimal converts ints, floats, strings and decimals.
+func ToDecimal(v Value) (*Decimal, error) {
+	switch v.Type {
+	case Int:
+		return NewDecimal(v.ToInt(), 0), nil
+	case Float:
+		return NewDecimalFromFloat(v.ToFloat())
+	case String:
+		return ParseDecimal(v.ToString())
+	case Object:
+		if d, ok := v.ToObject().(*Decimal); ok {
+			return d, nil
+		}
+	}
+	return nil, fmt.Errorf("can't convert %s to decimal", v.TypeName())
+}
+
+func (d *Decimal) Type() string {
+	return "decimal"
+}
+
+// Scale returns the number of digits after the point.
+func (d *Decimal) Scale() int {
+	return d.scale
+}
+
+// Sign returns -1, 0 or 1.
+func (d *Decimal) Sign() int {
+	return d.coef.Sign()
+}
+
+func (d *Decimal) String() string {
+	s := new(big.Int).Abs(d.coef).String()
+
+	if d.scale > 0 {
+		if len(s) <= d.scale {
+			s = strings.Repeat("0", d.scale-len(s)+1) + s
+		}
+		s = s[:len(s)-d.scale] + "." + s[len(s)-d.scale:]
+	}
+
+	if d.coef.Sign() < 0 {
+		return "-" + s
+	}
+	return s
+}
+
+// StringFixed returns the number rounded half up to places decimals.
+func (d *Decimal) StringFixed(places int) string {
+	return d.Round(places, RoundHalfUp).String()
+}
+
+func (d *Decimal) Float64() float64 {
+	f, _ := strconv.ParseFloat(d.String(), 64)
+	return f
+}
+
+// Int64 returns the integer part or an error if it doesn't fit in an int64.
+func (d *Decimal) Int64() (int64, error) {
+	i := new(big.Int).Quo(d.coef, pow10(d.scale))
+	if !i.IsInt64() {
+		return 0, fmt.Errorf("the decimal %s overflows int64", d.String())
+	}
+	return i.Int64(), nil
+}
+
+// MarshalJSON writes decimals as strings to not lose precision.
+func (d *Decimal) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(d.String())), nil
+}
+
+// Value lets decimals be passed as parameters to databases.
+func (d *Decimal) Value() (driver.Value, error) {
+	return d.String(), nil
+}
+
+// rescale returns the coefficient with scale digits after the point.
+// The scale must be greater or equal than the scale of d.
+func (d *Decimal) rescale(scale int) *big.Int {
+	if scale == d.scale {
+		return d.coef
+	}
+	return new(big.Int).Mul(d.coef, pow10(scale-d.scale))
+}
+
+func maxScale(a, b *Decimal) int {
+	if a.scale > b.scale {
+		return a.scale
+	}
+	return b.scale
+}
+
+// check returns an error if d exceeds MaxDecimalPlaces or MaxDecimalDigits.
+func (d *Decimal) check() (*Decimal, error) {
+	if d.scale > MaxDecimalPlaces {
+		return nil, fmt.Errorf("decimal out of range: more than %d places", MaxDecimalPlaces)
+	}
+	if d.coef.BitLen() > maxDecimalBits {
+		return nil, fmt.Errorf("decimal out of range: more than %d digits", MaxDecimalDigits)
+	}
+	return d, nil
+}
+
+func (d *Decimal) Add(o *Decimal) (*Decimal, error) {
+	scale := maxScale(d, o)
+	return (&Decimal{coef: new(big.Int).Add(d.rescale(scale), o.rescale(scale)), scale: scale}).check()
+}
+
+func (d *Decimal) Sub(o *Decimal) (*Decimal, error) {
+	scale := maxScale(d, o)
+	return (&Decimal{coef: new(big.Int).Sub(d.rescale(scale), o.rescale(scale)), scale: scale}).check()
+}
+
+func (d *Decimal) Mul(o *Decimal) (*Decimal, error) {
+	if d.scale+o.scale > MaxDecimalPlaces {
+		return nil, fmt.Errorf("decimal out of range: more than %d places", MaxDecimalPlaces)
+	}
+	return (&Decimal{coef: new(big.Int).Mul(d.coef, o.coef), scale: d.scale + o.scale}).check()
+}
+
+// Div returns d / o rounded to places decimals.
+func (d *Decimal) Div(o *Decimal, places int, mode RoundingMode) (*Decimal, error) {
+	if o.coef.Sign() == 0 {
+		return nil, fmt.Errorf("Attempt to divide by zero")
+	}
+
+	// d.coef * 10^(o.scale + places - d.scale) / o.coef
+	num := new(big.Int).Set(d.coef)
+	den := new(big.Int).Set(o.coef)
+	if e := o.scale + places - d.scale; e >= 0 {
+		num.Mul(num, pow10(e))
+	} else {
+		den.Mul(den, pow10(-e))
+	}
+
+	return (&Decimal{coef: roundQuo(num, den, mode), scale: places}).check()
+}
+
+// Mod returns the remainder of d / o with the sign of d.
+func (d *Decimal) Mod(o *Decimal) (*Decimal, error) {
+	if o.coef.Sign() == 0 {
+		return nil, fmt.Errorf("Attempt to divide by zero")
+	}
+	scale := maxScale(d, o)
+	return (&Decimal{coef: new(big.Int).Rem(d.rescale(scale), o.rescale(scale)), scale: scale}).check()
+}
+
+func (d *Decimal) Neg() *Decimal {
+	return &Decimal{coef: new(big.Int).Neg(d.coef), scale: d.scale}
+}
+
+func (d *Decimal) Abs() *Decimal {
+	return &Decimal{coef: new(big.Int).Abs(d.coef), scale: d.scale}
+}
+
+// Cmp returns -1, 0 or 1 if d is less, equal or greater than o.
+func (d *Decimal) Cmp(o *Decimal) int {
+	scale := maxScale(d, o)
+	return d.rescale(scale).Cmp(o.rescale(scale))
+}
+
+// Round returns d with exactly places digits after the point.
+func (d *Decimal) Round(places int, mode RoundingMode) *Decimal {
+	if places >= d.scale {
+		return &Decimal{coef: d.rescale(places), scale: places}
+	}
+	return &Decimal{coef: roundQuo(d.coef, pow10(d.scale-places), mode), scale: places}
+}
+
+// roundQuo returns num / den rounded with the mode.
+func roundQuo(num, den *big.Int, mode RoundingMode) *big.Int {
+	q, r := new(big.Int).QuoRem(num, den, new(big.Int))
+	if r.Sign() == 0 {
+		return q
+	}
+
+	// the sign of the result
+	sign := num.Sign() * den.Sign()
+
+	var up bool // away from zero
+	switch mode {
+	case RoundUp:
+		up = true
+	case RoundDown:
+		up = false
+	case RoundCeiling:
+		up = sign > 0
+	case RoundFloor:
+		up = sign < 0
+	default:
+		// compare the remainder with the half
+		half := new(big.Int).Abs(r)
+		half.Mul(half, big.NewInt(2))
+		switch half.Cmp(new(big.Int).Abs(den)) {
+		case 1:
+			up = true
+		case 0:
+			switch mode {
+			case RoundHalfUp:
+				up = true
+			case RoundHalfEven:
+				up = q.Bit(0) == 1
+			}
+		}
+	}
+
+	if up {
+		q.Add(q, big.NewInt(int64(sign)))
+	}
+	return q
+}
+
+// Equal compares the value with ints, floats and decimals.
+func (d *Decimal) Equal(v Value) bool {
+	switch v.Type {
+	case Int, Float, Object:
+		o, err := ToDecimal(v)
+		if err != nil {
+			return false
+		}
+		return d.Cmp(o) == 0
+	}
+	return false
+}
+
+// Operate implements the arithmetic operators. Ints and floats are
+// converted to decimals and strings are concatenated.
+func (d *Decimal) Operate(op string, a, b Value, vm *VM) (Value, error) {
+	if op == "+" && (a.Type == String || b.Type == String) {
+		return NewString(a.String() + b.String()), nil
+	}
+
+	if a.Type == String || b.Type == String {
+		return NullValue, fmt.Errorf("Invalid operation on %s and %s", a.TypeName(), b.TypeName())
+	}
+
+	x, err := ToDecimal(a)
+	if err != nil {
+		return NullValue, err
+	}
+	y, err := ToDecimal(b)
+	if err != nil {
+		return NullValue, err
+	}
+
+	var r *Decimal
+
+	switch op {
+	case "+":
+		r, err = x.Add(y)
+	case "-":
+		r, err = x.Sub(y)
+	case "*":
+		r, err = x.Mul(y)
+	case "/":
+		c := vm.decimalContext()
+		r, err = x.Div(y, c.Places, c.Rounding)
+	case "%":
+		r, err = x.Mod(y)
+	case "<":
+		return NewBool(x.Cmp(y) < 0), nil
+	case "<=":
+		return NewBool(x.Cmp(y) <= 0), nil
+	default:
+		return NullValue, fmt.Errorf("Invalid operation %s on decimals", op)
+	}
+
+	if err != nil {
+		return NullValue, err
+	}
+	return NewObject(r), nil
+}
+
+func (d *Decimal) GetMethod(name string) NativeMethod {
+	switch name {
+	case "round":
+		return d.round
+	case "div":
+		return d.div
+	case "abs":
+		return d.abs
+	case "cmp":
+		return d.cmp
+	case "toFloat":
+		return d.toFloat
+	case "toInt":
+		return d.toInt
+	case "toString":
+		return d.toString
+	}
+	return nil
+}
+
+func (d *Decimal) round(args []Value, vm *VM) (Value, error) {
+	if len(args) == 0 || len(args) > 2 || args[0].Type != Int {
+		return NullValue, fmt.Errorf("expected the number of places and an optional rounding mode")
+	}
+	places, err := placesArg(args[0])
+	if err != nil {
+		return NullValue, err
+	}
+	mode, err := roundingArg(args, 1, vm)
+	if err != nil {
+		return NullValue, err
+	}
+	r, err := d.Round(places, mode).check()
+	if err != nil {
+		return NullValue, err
+	}
+	return NewObject(r), nil
+}
+
+func (d *Decimal) div(args []Value, vm *VM) (Value, error) {
+	if len(args) == 0 || len(args) > 3 {
+		return NullValue, fmt.Errorf("expected 1 to 3 arguments, got %d", len(args))
+	}
+
+	o, err := ToDecimal(args[0])
+	if err != nil {
+		return NullValue, err
+	}
+
+	c := vm.decimalContext()
+	if len(args) > 1 {
+		if c.Places, err = placesArg(args[1]); err != nil {
+			return NullValue, err
+		}
+	}
+	if c.Rounding, err = roundingArg(args, 2, vm); err != nil {
+		return NullValue, err
+	}
+
+	r, err := d.Div(o, c.Places, c.Rounding)
+	if err != nil {
+		return NullValue, err
+	}
+	return NewObject(r), nil
+}
+
+// placesArg validates the number of digits after the point.
+func placesArg(v Value) (int, error) {
+	if v.Type != Int {
+		return 0, fmt.Errorf("expected the number of places to be int, got %s", v.TypeName())
+	}
+	places := v.ToInt()
+	if places < 0 || places > MaxDecimalPlaces {
+		return 0, fmt.Errorf("invalid number of places: %d", places)
+	}
+	return int(places), nil
+}
+
+// roundingArg returns the rounding mode of the optional argument i.
+func roundingArg(args []Value, i int, vm *VM) (RoundingMode, error) {
+	if len(args) <= i {
+		return vm.decimalContext().Rounding, nil
+	}
+	if args[i].Type != String {
+		return 0, fmt.Errorf("expected argument %d to be a string, got %s", i+1, args[i].TypeName())
+	}
+	return ParseRoundingMode(args[i].ToString())
+}
+
+func (d *Decimal) abs(args []Value, vm *VM) (Value, error) {
+	if len(args) != 0 {
+		return NullValue, fmt.Errorf("expected 0 arguments, got %d", len(args))
+	}
+	return NewObject(d.Abs()), nil
+}
+
+func (d *Decimal) cmp(args []Value, vm *VM) (Value, error) {
+	if len(args) != 1 {
+		return NullValue, fmt.Errorf("expected 1 argument, got %d", len(args))
+	}
+	o, err := ToDecimal(args[0])
+	if err != nil {
+		return NullValue, err
+	}
+	return NewInt(d.Cmp(o)), nil
+}
+
+func (d *Decimal) toFloat(args []Value, vm *VM) (Value, error) {
+	if len(args) != 0 {
+		return NullValue, fmt.Errorf("expected 0 arguments, got %d", len(args))
+	}
+	return NewFloat(d.Float64()), nil
+}
+
+func (d *Decimal) toInt(args []Value, vm *VM) (Value, error) {
+	if len(args) != 0 {
+		return NullValue, fmt.Errorf("expected 0 arguments, got %d", len(args))
+	}
+	i, err := d.Int64()
+	if err != nil {
+		return NullValue, err
+	}
+	return NewInt64(i), nil
+}
+
+func (d *Decimal) toString(args []Value, vm *VM) (Value, error) {
+	if len(args) != 0 {
+		return NullValue, fmt.Errorf("expected 0 arguments, got %d", len(args))
+	}
+	return NewString(d.String()), nil
+}
@@ -0,0 +1,410 @@
+package core
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gtlang/filesystem"
+	"github.com/gtlang/gt/ast"
+	"github.com/gtlang/gt/parser"
+)
+
+// defineIdent is the object that gives access to the compile-time defines.
+const defineIdent = "__DEFINE__"
+
+// CompileWithDefines compiles the program with compile-time constants
+// that are read as __DEFINE__.NAME. They take precedence over the ones
+// declared with the define directive.
+func CompileWithDefines(fs filesystem.FS, path string, defines map[string]Value) (*Program, error) {
+	a, err := parser.Parse(fs, path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := NewCompiler()
+	c.Defines = defines
+
+	p, err := c.Compile(a)
+	if err != nil {
+		return nil, err
+	}
+
+	p.LoadSources(fs)
+	c.removeEliminatedSources()
+	return p, nil
+}
+
+// ParseDefine parses a define like "DEBUG=true". Without a value it is true.
+// Values are bools, ints, floats or otherwise strings.
+func ParseDefine(s string) (string, Value, error) {
+	name, value, hasValue := strings.Cut(s, "=")
+	name = strings.TrimSpace(name)
+
+	if !isIdent(name) {
+		return "", NullValue, fmt.Errorf("invalid define name: %q", name)
+	}
+
+	if !hasValue {
+		return name, TrueValue, nil
+	}
+
+	return name, parseDefineValue(strings.TrimSpace(value)), nil
+}
+
+func parseDefineValue(s string) Value {
+	switch s {
+	case "true":
+		return TrueValue
+	case "false":
+		return FalseValue
+	}
+
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return NewInt64(i)
+	}
+
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return NewFloat(f)
+	}
+
+	if u, err := strconv.Unquote(s); err == nil {
+		return NewString(u)
+	}
+
+	return NewString(s)
+}
+
+func isIdent(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		switch {
+		case c == '_', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case i > 0 && c >= '0' && c <= '9':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// addDefines adds the defines declared in the directives of the files:
+//
+//	//gt: define DEBUG LEVEL=2
+//
+// The ones passed to the compiler are not overwritten.
+func (c *compiler) addDefines(m *ast.Module) error {
+	if c.Defines == nil {
+		c.Defines = make(map[string]Value)
+	}
+
+	fromDirectives := make(map[string]Value)
+
+	files := make([]*ast.File, 0, len(m.Modules)+1)
+	for _, f := range m.Modules {
+		files = append(files, f)
+	}
+	files = append(files, m.File)
+
+	for _, f := range files {
+		for _, d := range f.Directives {
+			key, value, _ := strings.Cut(d, " ")
+			if key != "define" {
+				continue
+			}
+
+			for _, s := range strings.Fields(value) {
+				name, v, err := ParseDefine(s)
+				if err != nil {
+					return fmt.Errorf("%s: %w", f.Path, err)
+				}
+
+				if _, ok := c.Defines[name]; ok {
+					continue
+				}
+
+				if old, ok := fromDirectives[name]; ok && !old.StrictEquals(v) {
+					return fmt.Errorf("%s: conflicting values for define %s", f.Path, name)
+				}
+
+				fromDirectives[name] = v
+			}
+		}
+	}
+
+	for k, v := range fromDirectives {
+		c.Defines[k] = v
+	}
+
+	return nil
+}
+
+// enumInfo are the members of a top level enum to inline them.
+type enumInfo struct {
+	exported bool
+	members  map[string]*ast.ConstantExpr
+	register *Address // set when the enum is compiled
+}
+
+// addEnums registers the top level enums of all the files before compiling
+// so members of enums of other modules can be inlined too.
+func (c *compiler) addEnums(m *ast.Module) {
+	c.enums = make(map[string]*enumInfo)
+
+	for path, f := range m.Modules {
+		c.addFileEnums(path, f)
+	}
+	c.addFileEnums("", m.File)
+}
+
+func (c *compiler) addFileEnums(module string, f *ast.File) {
+	for _, s := range f.Stms {
+		v, ok := s.(*ast.VarDeclStmt)
+		if !ok || !v.IsEnum {
+			continue
+		}
+
+		decl, ok := v.Value.(*ast.MapDeclExpr)
+		if !ok {
+			continue
+		}
+
+		e := &enumInfo{
+			exported: v.Exported,
+			members:  make(map[string]*ast.ConstantExpr, len(decl.List)),
+		}
+
+		for _, kv := range decl.List {
+			if k, ok := kv.Value.(*ast.ConstantExpr); ok {
+				e.members[kv.Key] = k
+			}
+		}
+
+		name := v.Name
+		if module != "" {
+			name = module + "." + name
+		}
+		c.enums[name] = e
+	}
+}
+
+// enumMember returns the member of an enum like Color.Red or mod.Color.Red
+// if it can be inlined. It can't if a variable shadows the enum or the module.
+func (c *compiler) enumMember(t *ast.SelectorExpr) (*ast.ConstantExpr, bool) {
+	var e *enumInfo
+
+	switch x := t.X.(type) {
+	case *ast.IdentExpr:
+		e = c.enums[c.registerName(x.Name)]
+		if e == nil || e.register == nil {
+			return nil, false
+		}
+
+		addr, err := c.findRegister(x.Name, c.currentFunc)
+		if err != nil || *addr != *e.register {
+			return nil, false
+		}
+
+	case *ast.SelectorExpr:
+		mod, ok := x.X.(*ast.IdentExpr)
+		if !ok {
+			return nil, false
+		}
+
+		var path string
+		for _, imp := range c.imports {
+			if imp.Alias == mod.Name {
+				path = imp.AbsPath
+				break
+			}
+		}
+		if path == "" {
+			return nil, false
+		}
+
+		if addr, err := c.findRegister(mod.Name, c.currentFunc); err != nil || addr != Void {
+			return nil, false
+		}
+
+		e = c.enums[path+"."+x.Sel.Name]
+		if e == nil || !e.exported {
+			return nil, false
+		}
+
+	default:
+		return nil, false
+	}
+
+	k, ok := e.members[t.Sel.Name]
+	return k, ok
+}
+
+// defineValue returns the value of __DEFINE__.NAME. It is undefined
+// if NAME is not defined.
+func (c *compiler) defineValue(t *ast.SelectorExpr) (Value, bool) {
+	ident, ok := t.X.(*ast.IdentExpr)
+	if !ok || ident.Name != defineIdent {
+		return NullValue, false
+	}
+
+	v, ok := c.Defines[t.Sel.Name]
+	if !ok {
+		return UndefinedValue, true
+	}
+	return v, true
+}
+
+// constValue evaluates expressions that only depend on literals, defines
+// and enum members. ok is false if the value is only known at runtime.
+func (c *compiler) constValue(e ast.Expr) (Value, bool) {
+	switch t := e.(type) {
+	case *ast.ConstantExpr:
+		if t.Kind == ast.REGEX {
+			return NullValue, false
+		}
+		v, err := constantValue(t)
+		if err != nil {
+			return NullValue, false
+		}
+		return v, true
+
+	case *ast.SelectorExpr:
+		if v, ok := c.defineValue(t); ok {
+			return v, true
+		}
+		if k, ok := c.enumMember(t); ok {
+			return c.constValue(k)
+		}
+
+	case *ast.UnaryExpr:
+		if t.Operator == ast.NOT {
+			if v, ok := c.constValue(t.Operand); ok {
+				return NewBool(!isTrue(v)), true
+			}
+		}
+
+	case *ast.BinaryExpr:
+		left, ok := c.constValue(t.Left)
+		if !ok {
+			return NullValue, false
+		}
+
+		switch t.Operator {
+		case ast.LAND:
+			// the right side is not evaluated if the left is false
+			if !isTrue(left) {
+				return FalseValue, true
+			}
+		case ast.LOR:
+			if isTrue(left) {
+				return TrueValue, true
+			}
+		}
+
+		right, ok := c.constValue(t.Right)
+		if !ok {
+			return NullValue, false
+		}
+
+		switch t.Operator {
+		case ast.LAND, ast.LOR:
+			return NewBool(isTrue(right)), true
+		case ast.EQL:
+			return NewBool(left.Equals(right)), true
+		case ast.NEQ:
+			return NewBool(!left.Equals(right)), true
+		case ast.SEQ:
+			return NewBool(left.StrictEquals(right)), true
+		case ast.SNE:
+			return NewBool(!left.StrictEquals(right)), true
+		}
+	}
+
+	return NullValue, false
+}
+
+// foldIfStmt removes the branches with a constant condition. False branches
+// are eliminated and a true one becomes the else, eliminating the rest.
+func (c *compiler) foldIfStmt(t *ast.IfStmt) *ast.IfStmt {
+	folded := &ast.IfStmt{Pos: t.Pos}
+
+	for i, b := range t.IfBlocks {
+		v, ok := c.constValue(b.Condition)
+		if !ok {
+			folded.IfBlocks = append(folded.IfBlocks, b)
+			continue
+		}
+
+		if !isTrue(v) {
+			c.eliminated = append(c.eliminated, b.Body)
+			continue
+		}
+
+		folded.Else = b.Body
+		for _, rest := range t.IfBlocks[i+1:] {
+			c.eliminated = append(c.eliminated, rest.Body)
+		}
+		if t.Else != nil {
+			c.eliminated = append(c.eliminated, t.Else)
+		}
+		return folded
+	}
+
+	folded.Else = t.Else
+	return folded
+}
+
+// removeEliminatedSources blanks the code of the eliminated blocks in
+// the sources so it is not included in the program.
+func (c *compiler) removeEliminatedSources() {
+	p := c.program
+	if p.Sources == nil {
+		return
+	}
+
+	for _, b := range c.eliminated {
+		src, ok := p.Sources[b.Lbrace.FileName]
+		if !ok {
+			continue
+		}
+		p.Sources[b.Lbrace.FileName] = blankSource(src, b.Lbrace, b.Rbrace)
+	}
+
+	p.sourceLines = nil
+}
+
+// blankSource replaces with spaces the code between the positions, excluding
+// them, and keeps the line breaks so the rest of the positions don't change.
+func blankSource(src []byte, from, to ast.Position) []byte {
+	b := make([]byte, len(src))
+	copy(b, src)
+
+	line, col := 1, 0
+	for i := 0; i < len(b); i++ {
+		switch b[i] {
+		case '\r':
+			if i+1 < len(b) && b[i+1] == '\n' {
+				continue
+			}
+			line++
+			col = 0
+			continue
+		case '\n':
+			line++
+			col = 0
+			continue
+		}
+
+		col++
+
+		after := line > from.Line || line == from.Line && col > from.Column
+		before := line < to.Line || line == to.Line && col < to.Column
+		if after && before {
+			b[i] = ' '
+		}
+	}
+
+	return b
+}
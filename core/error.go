@@ -3,7 +3,9 @@ package core
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"reflect"
 	"runtime"
 	"strconv"
 	"strings"
@@ -13,15 +15,146 @@ func NewPublicError(msg string) Error {
 	return Error{message: msg, public: true}
 }
 
+// NewCodeError returns an error with a machine-readable code
+// that scripts can check with errors.is.
+func NewCodeError(code, msg string) Error {
+	return Error{code: code, message: msg}
+}
+
 type Error struct {
 	pc          int
 	message     string
 	public      bool
+	code        string
+	data        Value
+	value       Value // the value thrown if it is not an error, like an instance
+	cause       error // the Go error returned by a native
 	instruction *Instruction
 	stacktrace  []TraceLine
+	callers     *callerStack // the callers already in the stacktrace
 	wraped      []Error
 }
 
+// Coder is implemented by errors that have a machine-readable code.
+type Coder interface {
+	Code() string
+}
+
+var errorCodes = make(map[error]string)
+
+// RegisterErrorCode assigns a code to a Go error, like fs.ErrNotExist,
+// so errors.is can match it when a native returns it or wraps it with %w.
+// It must be called on init.
+func RegisterErrorCode(err error, code string) {
+	errorCodes[err] = code
+}
+
+// ErrorCode returns the first code found in the chain of the error.
+func ErrorCode(err error) string {
+	var code string
+	walkErrors(err, func(e error) bool {
+		code = codeOf(e)
+		return code != ""
+	})
+	return code
+}
+
+// HasErrorCode reports whether any error in the chain has the code.
+func HasErrorCode(err error, code string) bool {
+	return walkErrors(err, func(e error) bool {
+		return codeOf(e) == code
+	})
+}
+
+// codeOf returns the code of the error without unwrapping it.
+func codeOf(err error) string {
+	if c, ok := err.(Coder); ok && c.Code() != "" {
+		return c.Code()
+	}
+
+	// only look up the kinds that can be hashed without panicking: a
+	// comparable struct can still hold an unhashable value in an interface.
+	switch reflect.TypeOf(err).Kind() {
+	case reflect.Ptr, reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return errorCodes[err]
+	}
+	return ""
+}
+
+// walkErrors calls fn with each error of the chain until it returns true.
+func walkErrors(err error, fn func(error) bool) bool {
+	for err != nil {
+		if fn(err) {
+			return true
+		}
+
+		switch t := err.(type) {
+		case interface{ Unwrap() []error }:
+			for _, e := range t.Unwrap() {
+				if walkErrors(e, fn) {
+					return true
+				}
+			}
+			return false
+		case interface{ Unwrap() error }:
+			err = t.Unwrap()
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// FindThrown returns the instance of the class thrown by the error or by
+// any error in its chain. The class is a class value, compared by identity,
+// or the qualified name of the class.
+func FindThrown(err error, class Value) (Value, bool) {
+	var v Value
+	found := walkErrors(err, func(e error) bool {
+		t, ok := e.(Error)
+		if !ok || t.value.Type != Object {
+			return false
+		}
+		i, ok := t.value.ToObject().(*instance)
+		if !ok || !i.isClass(class) {
+			return false
+		}
+		v = t.value
+		return true
+	})
+	return v, found
+}
+
+// thrownError returns the error for a value that is not an error.
+// An instance can set the message and the code with its fields.
+func thrownError(v Value, vm *VM) Error {
+	e := vm.NewError("%s", v.String())
+	e.value = v
+
+	if i, ok := v.ToObjectOrNil().(*instance); ok {
+		i.RLock()
+		if m, ok := i.iMap["message"]; ok && m.Type == String {
+			e.message = m.ToString()
+		}
+		if c, ok := i.iMap["code"]; ok && c.Type == String {
+			e.code = c.ToString()
+		}
+		i.RUnlock()
+	}
+
+	return e
+}
+
+// causeError converts the Go error wrapped by an error.
+func causeError(err error) Error {
+	if e, ok := err.(Error); ok {
+		return e
+	}
+	return Error{message: err.Error(), code: codeOf(err), cause: errors.Unwrap(err)}
+}
+
 func (e *Error) Wrap(inner Error) {
 	if e.public && inner.public {
 		e.message += ": " + inner.message
@@ -34,6 +167,37 @@ func (e Error) Public() bool {
 	return e.public
 }
 
+// Code returns the code of the error. Use ErrorCode to search the chain.
+func (e Error) Code() string {
+	return e.code
+}
+
+func (e *Error) SetCode(code string) {
+	e.code = code
+}
+
+// Data returns the value attached to the error.
+func (e Error) Data() Value {
+	return e.data
+}
+
+func (e *Error) SetData(v Value) {
+	e.data = v
+}
+
+// Unwrap returns the Go error returned by the native and
+// the wrapped errors so they work with errors.Is and errors.As.
+func (e Error) Unwrap() []error {
+	errs := make([]error, 0, len(e.wraped)+1)
+	if e.cause != nil {
+		errs = append(errs, e.cause)
+	}
+	for _, w := range e.wraped {
+		errs = append(errs, w)
+	}
+	return errs
+}
+
 func (e *Error) SetPublic(v bool) {
 	e.public = v
 }
@@ -47,11 +211,21 @@ func (e Error) Error() string {
 
 	fmt.Fprintf(b, "%s\n", e.message)
 
+	first := true
 	for _, s := range e.stacktrace {
+		if s.Boundary != "" {
+			fmt.Fprintf(b, " -- %s --\n", s.Boundary)
+		}
 		if s.Function == "" || s.Line == 0 {
 			continue // this is an empty position
 		}
 		fmt.Fprintf(b, " -> %s\n", s.String())
+
+		// show the code where the error happened
+		if first {
+			b.WriteString(s.Snippet())
+			first = false
+		}
 	}
 
 	for _, inner := range e.wraped {
@@ -65,6 +239,9 @@ func (e Error) Stack() string {
 	var b = &bytes.Buffer{}
 
 	for _, s := range e.stacktrace {
+		if s.Boundary != "" {
+			fmt.Fprintf(b, " -- %s --\n", s.Boundary)
+		}
 		if s.Function == "" && s.File == "" && s.Line == 0 {
 			continue // this is an empty position
 		}
@@ -101,6 +278,23 @@ func (e Error) GetProperty(name string, vm *VM) (Value, error) {
 		return NewBool(e.public), nil
 	case "message":
 		return NewString(e.message), nil
+	case "code":
+		if e.code == "" {
+			return NewString(ErrorCode(e)), nil
+		}
+		return NewString(e.code), nil
+	case "data":
+		return e.data, nil
+	case "value":
+		return e.value, nil
+	case "cause":
+		if len(e.wraped) > 0 {
+			return NewObject(e.wraped[0]), nil
+		}
+		if e.cause != nil {
+			return NewObject(causeError(e.cause)), nil
+		}
+		return NullValue, nil
 	case "pc":
 		return NewInt(e.pc), nil
 	case "stackTrace":
@@ -119,11 +313,20 @@ func (e Error) GetMethod(name string) NativeMethod {
 }
 
 func (e Error) MarshalJSON() ([]byte, error) {
+	var data *Value
+	if !e.data.IsNil() {
+		data = &e.data
+	}
+
 	return json.Marshal(&struct {
 		Message    string
+		Code       string `json:",omitempty"`
+		Data       *Value `json:",omitempty"`
 		StackTrace []string
 	}{
 		Message:    e.message,
+		Code:       e.code,
+		Data:       data,
 		StackTrace: e.stackLines(),
 	})
 }
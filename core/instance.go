@@ -18,6 +18,39 @@ type instance struct {
 	iMap    map[string]Value
 	class   string
 	program *Program
+	global  bool // if it escaped the function that created it
+}
+
+// classValue is a class used as a value, like errors.as(e, NotFound).
+type classValue struct {
+	program *Program
+	class   *Class
+}
+
+func (c *classValue) Type() string {
+	return "class"
+}
+
+func (c *classValue) String() string {
+	return c.class.Name
+}
+
+// className returns the name of the class of a value used with new:
+// a class or its name.
+func className(v Value) string {
+	if c, ok := v.ToObjectOrNil().(*classValue); ok {
+		return c.class.Name
+	}
+	return v.ToString()
+}
+
+// isClass returns true if the instance is of the class: a class
+// value of the same program or the name of the class.
+func (i *instance) isClass(class Value) bool {
+	if c, ok := class.ToObjectOrNil().(*classValue); ok {
+		return i.program == c.program && i.class == c.class.Name
+	}
+	return class.Type == String && i.class == class.ToString()
 }
 
 func (i *instance) String() string {
@@ -51,6 +84,17 @@ func (i *instance) GetProperty(name string, vm *VM) (Value, error) {
 	return v, nil
 }
 
+// hasMember returns true if the class has a method or the instance a field with the name.
+func (i *instance) hasMember(name string) bool {
+	if _, ok := i.program.Function(i.methodName(name)); ok {
+		return true
+	}
+	i.RLock()
+	_, ok := i.iMap[name]
+	i.RUnlock()
+	return ok
+}
+
 func (i *instance) SetProperty(name string, v Value, vm *VM) error {
 	i.Lock()
 	i.iMap[name] = v
@@ -0,0 +1,276 @@
+package core
+
+import (
+	"context"
+	"fmt"
+)
+
+// An isolate is a VM that doesn't share any value with the VM that
+// created it so both can run in parallel without synchronization.
+// Values passed between them must be copied with CopyValue.
+
+// Isolate returns a VM that runs the same program with a copy of the
+// globals and a copy of values to pass to it, like the function to run
+// and its arguments. The execution is canceled when ctx is done.
+func (vm *VM) Isolate(ctx context.Context, values ...Value) (*VM, []Value, error) {
+	c := &copier{refs: make(map[interface{}]interface{}), funcs: true}
+
+	globals, err := c.copyValues(vm.Globals())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	copies := make([]Value, len(values))
+	for i, v := range values {
+		x, err := c.copy(v)
+		if err != nil {
+			return nil, nil, err
+		}
+		copies[i] = x
+	}
+
+	m := vm.Clone(vm.Program, globals)
+	m.ctx = ctx
+	return m, copies, nil
+}
+
+// CopyValue returns a deep copy of v that can be passed to another VM.
+// Arrays, maps, instances and Copyable objects are copied keeping the
+// references between them. Other native objects are not copied: they are
+// passed as they are and must be safe to use from several goroutines.
+// Functions and methods can't be copied because the other VM can run a
+// different program.
+func CopyValue(v Value) (Value, error) {
+	c := &copier{refs: make(map[interface{}]interface{})}
+	return c.copy(v)
+}
+
+// CopyError converts err to an Error that can be passed to another VM.
+// The data and the values thrown are copied with CopyValue, or dropped
+// if they can't be copied.
+func CopyError(err error) Error {
+	e, ok := err.(Error)
+	if !ok {
+		return Error{message: err.Error(), code: codeOf(err), cause: err}
+	}
+
+	e.data = copyOrNull(e.data)
+	e.value = copyOrNull(e.value)
+
+	if e.cause != nil {
+		if _, ok := e.cause.(Error); ok {
+			e.cause = CopyError(e.cause)
+		}
+	}
+
+	if e.wraped != nil {
+		wraped := make([]Error, len(e.wraped))
+		for i, w := range e.wraped {
+			wraped[i] = CopyError(w)
+		}
+		e.wraped = wraped
+	}
+
+	return e
+}
+
+func copyOrNull(v Value) Value {
+	x, err := CopyValue(v)
+	if err != nil {
+		return NullValue
+	}
+	return x
+}
+
+// Copyable is implemented by native objects that hold values of the VM,
+// like collections, so they are copied when passed to another VM.
+// Copy returns a new object with the values copied with fn.
+type Copyable interface {
+	Copy(fn func(Value) (Value, error)) (interface{}, error)
+}
+
+type copier struct {
+	refs  map[interface{}]interface{} // the copies of arrays, maps and closures
+	funcs bool                        // if functions can be copied
+}
+
+func (c *copier) copy(v Value) (Value, error) {
+	switch v.Type {
+	case Null, Undefined, Int, Float, Bool, String, Rune:
+		return v, nil
+
+	case Bytes:
+		b := v.ToBytes()
+		return NewBytes(append(make([]byte, 0, len(b)), b...)), nil
+
+	case Array:
+		a := v.ToArrayObject()
+		if r, ok := c.refs[a]; ok {
+			return Value{Type: Array, object: r}, nil
+		}
+		n := &NewArrayObject{Array: make([]Value, len(a.Array))}
+		c.refs[a] = n
+		for i, item := range a.Array {
+			x, err := c.copy(item)
+			if err != nil {
+				return NullValue, err
+			}
+			n.Array[i] = x
+		}
+		return Value{Type: Array, object: n}, nil
+
+	case Map:
+		m := v.ToMap()
+		if r, ok := c.refs[m]; ok {
+			return Value{Type: Map, object: r}, nil
+		}
+		n := newMapValue(make(map[string]Value, len(m.Map)))
+		c.refs[m] = n
+
+		m.Mutex.RLock()
+		defer m.Mutex.RUnlock()
+
+		for _, k := range m.Keys() {
+			x, err := c.copy(m.Map[k])
+			if err != nil {
+				return NullValue, err
+			}
+			n.Set(k, x)
+		}
+		return Value{Type: Map, object: n}, nil
+
+	case Func, NativeFunc:
+		if !c.funcs {
+			return NullValue, fmt.Errorf("values of type %s can't be copied", v.TypeName())
+		}
+		return v, nil
+
+	case Object:
+		return c.copyObject(v)
+
+	default:
+		return NullValue, fmt.Errorf("values of type %s can't be copied", v.TypeName())
+	}
+}
+
+func (c *copier) copyObject(v Value) (Value, error) {
+	switch t := v.ToObject().(type) {
+	case Closure:
+		if !c.funcs {
+			return NullValue, fmt.Errorf("values of type %s can't be copied", v.TypeName())
+		}
+		closures := make([]*closureRegister, len(t.closures))
+		for i, r := range t.closures {
+			x, err := c.copyClosureRegister(r)
+			if err != nil {
+				return NullValue, err
+			}
+			closures[i] = x
+		}
+		return NewObject(Closure{funcIndex: t.funcIndex, closures: closures}), nil
+
+	case method:
+		if !c.funcs {
+			return NullValue, fmt.Errorf("values of type %s can't be copied", v.TypeName())
+		}
+		this, err := c.copy(t.this)
+		if err != nil {
+			return NullValue, err
+		}
+		return NewObject(method{this: this, fn: t.fn}), nil
+
+	case nativePrototype:
+		// the natives are the same in all the VMs
+		this, err := c.copy(t.this)
+		if err != nil {
+			return NullValue, err
+		}
+		return NewObject(nativePrototype{this: this, fn: t.fn}), nil
+
+	case *instance:
+		if r, ok := c.refs[t]; ok {
+			return NewObject(r), nil
+		}
+		n := &instance{iMap: make(map[string]Value), class: t.class, program: t.program}
+		c.refs[t] = n
+
+		t.RLock()
+		defer t.RUnlock()
+
+		for k, f := range t.iMap {
+			x, err := c.copy(f)
+			if err != nil {
+				return NullValue, err
+			}
+			n.iMap[k] = x
+		}
+		return NewObject(n), nil
+
+	case *valuesIterator:
+		a, err := c.copy(Value{Type: Array, object: t.array})
+		if err != nil {
+			return NullValue, err
+		}
+		return NewObject(&valuesIterator{array: a.ToArrayObject(), length: t.length, index: t.index}), nil
+
+	case Copyable:
+		if r, ok := c.refs[t]; ok {
+			if r == nil {
+				return NullValue, fmt.Errorf("values of type %s that contain themselves can't be copied", v.TypeName())
+			}
+			return NewObject(r), nil
+		}
+		c.refs[t] = nil
+		x, err := t.Copy(c.copy)
+		if err != nil {
+			return NullValue, err
+		}
+		c.refs[t] = x
+		return NewObject(x), nil
+
+	case Iterator:
+		return NullValue, fmt.Errorf("values of type %s can't be copied", v.TypeName())
+
+	default:
+		return v, nil
+	}
+}
+
+func (c *copier) copyValues(values []Value) ([]Value, error) {
+	if len(values) == 0 {
+		return make([]Value, len(values)), nil
+	}
+
+	// the registers of a frame are shared by the closures that capture them
+	if r, ok := c.refs[&values[0]]; ok {
+		return r.([]Value), nil
+	}
+
+	n := make([]Value, len(values))
+	c.refs[&values[0]] = n
+
+	for i, v := range values {
+		x, err := c.copy(v)
+		if err != nil {
+			return nil, err
+		}
+		n[i] = x
+	}
+	return n, nil
+}
+
+func (c *copier) copyClosureRegister(r *closureRegister) (*closureRegister, error) {
+	if x, ok := c.refs[r]; ok {
+		return x.(*closureRegister), nil
+	}
+
+	n := &closureRegister{register: r.register}
+	c.refs[r] = n
+
+	values, err := c.copyValues(r.values)
+	if err != nil {
+		return nil, err
+	}
+	n.values = values
+	return n, nil
+}
@@ -0,0 +1,238 @@
+package core
+
+import (
+	"fmt"
+)
+
+// The iterator protocol lets for...of loops, spread arguments and the
+// array helpers consume values one by one without loading them in memory.
+//
+// A class is iterable if it has an iterator() method that returns an
+// object with a next() method. next() returns { value, done }:
+//
+//	class Range {
+//	    iterator() {
+//	        let i = 0
+//	        return { next: () => i < 10 ? { value: i++ } : { done: true } }
+//	    }
+//	}
+//
+// Natives implement Iterable.
+
+// Iterator produces the values of a collection one by one.
+type Iterator interface {
+	// Next returns the next value or false if there are no more.
+	Next() (Value, bool, error)
+}
+
+// Iterable is implemented by natives that can be iterated lazily,
+// like a database reader.
+type Iterable interface {
+	Iterator() (Iterator, error)
+}
+
+// Iterator returns an iterator for the values of arrays, maps, bytes,
+// enumerables and iterables. Null and undefined have no values.
+func (vm *VM) Iterator(v Value) (Iterator, error) {
+	switch v.Type {
+	case Null, Undefined:
+		return &valuesIterator{array: &NewArrayObject{}}, nil
+
+	case Array:
+		a := v.ToArrayObject()
+		return &valuesIterator{array: a, length: len(a.Array)}, nil
+
+	case Bytes:
+		b := v.ToBytes()
+		values := make([]Value, len(b))
+		for i, v := range b {
+			values[i] = NewInt(int(v))
+		}
+		return newValuesIterator(values), nil
+
+	case Map:
+		m := v.ToMap()
+		m.Mutex.RLock()
+		values := make([]Value, 0, len(m.Map))
+		for _, k := range m.Keys() {
+			values = append(values, m.Map[k])
+		}
+		m.Mutex.RUnlock()
+		return newValuesIterator(values), nil
+
+	case Object:
+		switch t := v.ToObject().(type) {
+		case Iterator:
+			return t, nil
+
+		case Iterable:
+			return t.Iterator()
+
+		case Enumerable:
+			values, err := t.Values()
+			if err != nil {
+				return nil, fmt.Errorf("Enumerable error: %v", err)
+			}
+			return newValuesIterator(values), nil
+
+		case *instance:
+			if it, ok, err := vm.instanceIterator(t); ok || err != nil {
+				return it, err
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("Expected a enumerable, got %v", v.TypeName())
+}
+
+// iterable returns true if the object can be iterated like an array.
+func (vm *VM) iterable(obj interface{}) bool {
+	switch t := obj.(type) {
+	case Enumerable, Iterable, Iterator:
+		return true
+	case *instance:
+		_, ok := t.program.Function(t.methodName("iterator"))
+		return ok
+	}
+	return false
+}
+
+// valuesIterator iterates the values of an array. The values added
+// while iterating are not iterated.
+type valuesIterator struct {
+	array  *NewArrayObject
+	length int
+	index  int
+}
+
+func newValuesIterator(values []Value) *valuesIterator {
+	return &valuesIterator{array: &NewArrayObject{Array: values}, length: len(values)}
+}
+
+func (it *valuesIterator) Type() string {
+	return "Iterator"
+}
+
+func (it *valuesIterator) Next() (Value, bool, error) {
+	// the array can be shorter if items are removed while iterating
+	if it.index >= it.length || it.index >= len(it.array.Array) {
+		return NullValue, false, nil
+	}
+	v := it.array.Array[it.index]
+	it.index++
+	return v, true, nil
+}
+
+// scriptIterator calls the next method of an iterator defined in the program.
+type scriptIterator struct {
+	vm   *VM
+	next Value
+}
+
+func (it *scriptIterator) Type() string {
+	return "Iterator"
+}
+
+func (it *scriptIterator) Next() (Value, bool, error) {
+	r, err := it.vm.runValue(it.next)
+	if err != nil {
+		return NullValue, false, err
+	}
+
+	done, err := member(r, "done", it.vm)
+	if err != nil {
+		return NullValue, false, err
+	}
+	if isTrue(done) {
+		return NullValue, false, nil
+	}
+
+	v, err := member(r, "value", it.vm)
+	if err != nil {
+		return NullValue, false, err
+	}
+	return v, true, nil
+}
+
+// instanceIterator calls the iterator method of the instance if the class has it.
+func (vm *VM) instanceIterator(i *instance) (Iterator, bool, error) {
+	f, ok := i.program.Function(i.methodName("iterator"))
+	if !ok {
+		return nil, false, nil
+	}
+	if i.program != vm.Program {
+		return nil, true, fmt.Errorf("can't call a method of an object from a different program")
+	}
+
+	it, err := vm.runValue(NewObject(method{fn: f.Index, this: NewObject(i)}))
+	if err != nil {
+		return nil, true, err
+	}
+
+	next, err := member(it, "next", vm)
+	if err != nil {
+		return nil, true, err
+	}
+	if next.IsNil() {
+		return nil, true, fmt.Errorf("the iterator of %s has no next method", i.class)
+	}
+
+	return &scriptIterator{vm: vm, next: next}, true, nil
+}
+
+// runValue calls a function, closure or method.
+func (vm *VM) runValue(fn Value, args ...Value) (Value, error) {
+	switch fn.Type {
+	case Func:
+		return vm.RunFuncIndex(fn.ToFunction(), args...)
+
+	case Object:
+		switch t := fn.ToObject().(type) {
+		case Closure:
+			return vm.RunClosure(t, args...)
+		case method:
+			f := vm.Program.Functions[t.fn]
+			return vm.runMethod(f, t.this, args...)
+		case NativeMethod:
+			return t(args, vm)
+		}
+	}
+
+	return NullValue, fmt.Errorf("expected a function, got %s", fn.TypeName())
+}
+
+// member returns the value of a key of a map or a property of an object.
+func member(v Value, name string, vm *VM) (Value, error) {
+	switch v.Type {
+	case Map:
+		m := v.ToMap()
+		m.Mutex.RLock()
+		r, ok := m.Map[name]
+		m.Mutex.RUnlock()
+		if !ok {
+			return UndefinedValue, nil
+		}
+		return r, nil
+
+	case Object:
+		if g, ok := v.ToObject().(PropertyGetter); ok {
+			return g.GetProperty(name, vm)
+		}
+	}
+
+	return NullValue, fmt.Errorf("expected an object, got %s", v.TypeName())
+}
+
+// isTrue converts the value to a bool like the conditions of the program.
+func isTrue(v Value) bool {
+	switch v.Type {
+	case Bool:
+		return v.ToBool()
+	case Int:
+		return v.ToInt() != 0
+	case Float:
+		return v.ToFloat() != 0
+	default:
+		return !v.IsNilOrEmpty()
+	}
+}
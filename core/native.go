@@ -1,6 +1,7 @@
 package core
 
 import (
+	"fmt"
 	"strings"
 )
 
@@ -53,6 +54,41 @@ func RegisterLib(funcs []NativeFunction, dts string) {
 	}
 }
 
+// SetNative replaces a native function or property only for this VM and
+// the VMs cloned from it. It is used to mock natives in tests and to
+// restrict them in sandboxes.
+func (vm *VM) SetNative(f NativeFunction) error {
+	existing, ok := nativeByName(f.Name)
+	if !ok {
+		return fmt.Errorf("native function %s not found", f.Name)
+	}
+
+	f.Name = existing.Name
+	f.Index = existing.Index
+
+	if vm.natives == nil {
+		vm.natives = make(map[int]NativeFunction)
+	}
+	vm.natives[f.Index] = f
+	return nil
+}
+
+// ResetNative removes the override of a native set with SetNative.
+func (vm *VM) ResetNative(name string) {
+	if f, ok := nativeByName(name); ok {
+		delete(vm.natives, f.Index)
+	}
+}
+
+// nativeByName returns the function or else the property with the name.
+func nativeByName(name string) (NativeFunction, bool) {
+	if f, ok := allNativeMap[name]; ok {
+		return f, true
+	}
+	f, ok := allNativeMap["->"+name]
+	return f, ok
+}
+
 func NativeFuncFromIndex(i int) NativeFunction {
 	return allNativeFuncs[i]
 }
@@ -112,10 +148,45 @@ declare namespace errors {
     export function wrap(msg: string, inner: Error): Error
     export function public(msg: string, inner?: Error | string): Error
 
+    /**
+     * Creates an error with a machine-readable code like "notFound".
+     */
+    export function newError(code: string, msg?: string, data?: any): Error
+
+    /**
+     * Reports whether the error or any error in its chain has the code.
+     */
+    export function is(err: Error, code: string): boolean
+
+    /**
+     * Returns the instance of the class thrown by the error or
+     * any error in its chain. A thrown instance can set the message
+     * and the code of the error with its message and code fields.
+     *
+     * Pass the class, like errors.as(e, users.NotFound). It is compared
+     * by identity so a class with the same name in another program doesn't
+     * match. A string matches any class with that name, and the names of
+     * the classes of a module are prefixed with the module.
+     */
+    export function as<T>(err: Error, cls: { new(...args: any[]): T } | string): T | null
+
     export interface Error {
         type: string
         public: boolean
         message: string
+        /**
+         * The code of the error or the first one in its chain.
+         */
+        code: string
+        data: any
+        /**
+         * The value thrown if it was not an error.
+         */
+        value: any
+        /**
+         * The wrapped error or the error returned by a native.
+         */
+        cause: Error | null
         pc: number
         stackTrace: string
         toString(): string
@@ -28,14 +28,14 @@ const (
 	op_bnt               // A := ~B  bitwise not
 	op_new               // create a new instance of a class: A class type, B retAddress, C argsAddress
 	op_nes               // create a new instance of a class with a single arg: A class type, B retAddress, C argsAddress
-	op_arr               // create a new array:  A array, B size
+	op_arr               // create a new array:  A array, B size, C optional capacity
 	op_map               // create a new map:  A map, B size
 	op_key               // get the keys of a map or the indexes of an array: A := keys(B)
 	op_val               // get the values of a map or array: A := values(B)
 	op_len               // get the length of an array: A := len(B)
 	op_get               // get array index or map key: A dest, B source C index or key
 	op_set               // set array index or map key: A array or Map, B index or key, C value
-	op_spa               // spread last index of array A
+	op_spa               // spread last index of array A. Not emitted anymore: use op_spr
 	op_jmp               // jump A positions
 	op_jpb               // jump back A positions
 	op_ejp               // jump if A and B are equal C instructions.
@@ -58,6 +58,10 @@ const (
 	op_cen               // catch-end: set the last catch body as ended. It is only emmited if there is no finally
 	op_fen               // finally-end: set the last finally body as ended.
 	op_trx               // try exit: a continue inside try/catch inside a loop for example
+	op_itr               // get an iterator for the values of B: A := iterator(B)
+	op_nxt               // get the next value of the iterator B: A := next(B), C := true if there was a value
+	op_apd               // append B to the array A
+	op_spr               // spread B: append its values to the array A or copy its keys to the map A
 )
 
 const (
@@ -218,6 +222,18 @@ func exec(i *Instruction, vm *VM) int {
 	case op_trx:
 		return exec_trx(vm)
 
+	case op_itr:
+		return exec_itr(i, vm)
+
+	case op_nxt:
+		return exec_nxt(i, vm)
+
+	case op_apd:
+		return exec_apd(i, vm)
+
+	case op_spr:
+		return exec_spr(i, vm)
+
 	default:
 		panic(fmt.Sprintf("Invalid opcode: %v", i))
 	}
@@ -270,6 +286,11 @@ func exec_ldk(instr *Instruction, vm *VM) int {
 func exec_add(instr *Instruction, vm *VM) int {
 	lh := vm.get(instr.B)
 	rh := vm.get(instr.C)
+
+	if lh.Type == Object || rh.Type == Object {
+		return exec_operand("+", instr, vm, lh, rh)
+	}
+
 	switch lh.Type {
 	case Int:
 		switch rh.Type {
@@ -280,10 +301,7 @@ func exec_add(instr *Instruction, vm *VM) int {
 		case Rune:
 			vm.set(instr.A, NewRune(lh.ToRune()+rh.ToRune()))
 		case String:
-			err := vm.AddAllocations(lh.Size())
-			if err == nil {
-				err = vm.AddAllocations(rh.Size())
-			}
+			err := vm.CheckAllocations(lh.Size() + rh.Size())
 			if err != nil {
 				if vm.handle(err) {
 					return vm_continue
@@ -306,10 +324,7 @@ func exec_add(instr *Instruction, vm *VM) int {
 		case Rune:
 			vm.set(instr.A, NewRune(lh.ToRune()+rh.ToRune()))
 		case String:
-			err := vm.AddAllocations(lh.Size())
-			if err == nil {
-				err = vm.AddAllocations(rh.Size())
-			}
+			err := vm.CheckAllocations(lh.Size() + rh.Size())
 			if err != nil {
 				if vm.handle(err) {
 					return vm_continue
@@ -330,10 +345,7 @@ func exec_add(instr *Instruction, vm *VM) int {
 		case Rune, Int:
 			vm.set(instr.A, NewRune(lh.ToRune()+rh.ToRune()))
 		case String:
-			err := vm.AddAllocations(lh.Size())
-			if err == nil {
-				err = vm.AddAllocations(rh.Size())
-			}
+			err := vm.CheckAllocations(lh.Size() + rh.Size())
 			if err != nil {
 				if vm.handle(err) {
 					return vm_continue
@@ -363,10 +375,7 @@ func exec_add(instr *Instruction, vm *VM) int {
 	case String:
 		switch rh.Type {
 		case String, Int, Float, Bool, Rune:
-			err := vm.AddAllocations(lh.Size())
-			if err == nil {
-				err = vm.AddAllocations(rh.Size())
-			}
+			err := vm.CheckAllocations(lh.Size() + rh.Size())
 			if err != nil {
 				if vm.handle((err)) {
 					return vm_continue
@@ -422,6 +431,11 @@ func exec_add(instr *Instruction, vm *VM) int {
 func exec_sub(instr *Instruction, vm *VM) int {
 	lh := vm.get(instr.B)
 	rh := vm.get(instr.C)
+
+	if lh.Type == Object || rh.Type == Object {
+		return exec_operand("-", instr, vm, lh, rh)
+	}
+
 	switch lh.Type {
 	case Int:
 		switch rh.Type {
@@ -511,6 +525,11 @@ func exec_sub(instr *Instruction, vm *VM) int {
 func exec_mul(instr *Instruction, vm *VM) int {
 	lh := vm.get(instr.B)
 	rh := vm.get(instr.C)
+
+	if lh.Type == Object || rh.Type == Object {
+		return exec_operand("*", instr, vm, lh, rh)
+	}
+
 	switch lh.Type {
 	case Int:
 		switch rh.Type {
@@ -560,6 +579,37 @@ func exec_mul(instr *Instruction, vm *VM) int {
 	return vm_next
 }
 
+// exec_operand runs an operator implemented by a native object: A := B op C
+func exec_operand(op string, instr *Instruction, vm *VM, lh, rh Value) int {
+	var o Operand
+	if lh.Type == Object {
+		o, _ = lh.ToObject().(Operand)
+	}
+	if o == nil && rh.Type == Object {
+		o, _ = rh.ToObject().(Operand)
+	}
+
+	if o == nil {
+		if vm.handle(vm.NewError("Invalid operation on %v and %v", lh.Type, rh.Type)) {
+			return vm_continue
+		} else {
+			return vm_exit
+		}
+	}
+
+	v, err := o.Operate(op, lh, rh, vm)
+	if err != nil {
+		if vm.handle(vm.WrapError(err)) {
+			return vm_continue
+		} else {
+			return vm_exit
+		}
+	}
+
+	vm.set(instr.A, v)
+	return vm_next
+}
+
 func exec_bor(instr *Instruction, vm *VM) int {
 	lh := vm.get(instr.B)
 	rh := vm.get(instr.C)
@@ -689,6 +739,10 @@ func exec_div(instr *Instruction, vm *VM) int {
 	lh := vm.get(instr.B)
 	rh := vm.get(instr.C)
 
+	if lh.Type == Object || rh.Type == Object {
+		return exec_operand("/", instr, vm, lh, rh)
+	}
+
 	if lh.Type == Rune || rh.Type == Rune {
 		switch lh.Type {
 		case Int, Rune:
@@ -745,6 +799,11 @@ func exec_div(instr *Instruction, vm *VM) int {
 func exec_mod(instr *Instruction, vm *VM) int {
 	lh := vm.get(instr.B)
 	rh := vm.get(instr.C)
+
+	if lh.Type == Object || rh.Type == Object {
+		return exec_operand("%", instr, vm, lh, rh)
+	}
+
 	switch lh.Type {
 	case Float:
 		if vm.handle((vm.NewError("Invalid operation on %v and %v", lh.Type, rh.Type))) {
@@ -801,6 +860,9 @@ func exec_bnt(instr *Instruction, vm *VM) int {
 
 func exec_unm(instr *Instruction, vm *VM) int {
 	lh := vm.get(instr.B)
+	if lh.Type == Object {
+		return exec_operand("-", instr, vm, NewInt(0), lh)
+	}
 	switch lh.Type {
 	case Int:
 		vm.set(instr.A, NewInt64(lh.ToInt()*-1))
@@ -836,6 +898,9 @@ func exec_not(instr *Instruction, vm *VM) int {
 
 func exec_inc(instr *Instruction, vm *VM) int {
 	lh := vm.get(instr.A)
+	if lh.Type == Object {
+		return exec_operand("+", instr, vm, lh, NewInt(1))
+	}
 	switch lh.Type {
 	case Int:
 		vm.set(instr.A, NewInt64(lh.ToInt()+1))
@@ -853,6 +918,9 @@ func exec_inc(instr *Instruction, vm *VM) int {
 
 func exec_dec(instr *Instruction, vm *VM) int {
 	lh := vm.get(instr.A)
+	if lh.Type == Object {
+		return exec_operand("-", instr, vm, lh, NewInt(1))
+	}
 	switch lh.Type {
 	case Int:
 		vm.set(instr.A, NewInt64(lh.ToInt()-1))
@@ -872,6 +940,11 @@ func exec_lst(instr *Instruction, vm *VM) int {
 	lh := vm.get(instr.B)
 
 	rh := vm.get(instr.C)
+
+	if lh.Type == Object || rh.Type == Object {
+		return exec_operand("<", instr, vm, lh, rh)
+	}
+
 	switch lh.Type {
 	case Int:
 		switch rh.Type {
@@ -954,6 +1027,11 @@ func exec_lst(instr *Instruction, vm *VM) int {
 func exec_lse(instr *Instruction, vm *VM) int {
 	lh := vm.get(instr.B)
 	rh := vm.get(instr.C)
+
+	if lh.Type == Object || rh.Type == Object {
+		return exec_operand("<=", instr, vm, lh, rh)
+	}
+
 	switch lh.Type {
 	case Int:
 		switch rh.Type {
@@ -1064,6 +1142,15 @@ func exec_sne(instr *Instruction, vm *VM) int {
 }
 
 func exec_arr(instr *Instruction, vm *VM) int {
+	if instr.C.Kind == AddrData {
+		size := int(instr.B.Value)
+		capacity := int(instr.C.Value)
+		if capacity < size {
+			capacity = size
+		}
+		vm.set(instr.A, NewArrayValues(make([]Value, size, capacity)))
+		return vm_next
+	}
 	vm.set(instr.A, NewArray(int(instr.B.Value)))
 	return vm_next
 }
@@ -1079,7 +1166,6 @@ func exec_get(instr *Instruction, vm *VM) int {
 		if vm.handle((err)) {
 			return vm_continue
 		} else {
-			vm.Error = err
 			return vm_exit
 		}
 	}
@@ -1093,7 +1179,6 @@ func exec_set(instr *Instruction, vm *VM) int {
 		if vm.handle((err)) {
 			return vm_continue
 		} else {
-			vm.Error = err
 			return vm_exit
 		}
 	}
@@ -1124,6 +1209,25 @@ func exec_spa(instr *Instruction, vm *VM) int {
 	case Array:
 		n := append(va[:ln-1], last.ToArrayObject().Array...)
 		vm.set(instr.A, NewArrayValues(n))
+	case Object:
+		n := va[:ln-1]
+		it, err := vm.Iterator(last)
+		for err == nil {
+			var v Value
+			var ok bool
+			if v, ok, err = it.Next(); !ok {
+				break
+			}
+			n = append(n, v)
+		}
+		if err != nil {
+			if vm.handle(vm.WrapError(err)) {
+				return vm_continue
+			} else {
+				return vm_exit
+			}
+		}
+		vm.set(instr.A, NewArrayValues(n))
 	default:
 		if vm.handle((vm.NewError("Expected array, got %v", last.TypeName()))) {
 			return vm_continue
@@ -1138,6 +1242,9 @@ func exec_spa(instr *Instruction, vm *VM) int {
 func exec_key(instr *Instruction, vm *VM) int {
 	// gets the keys of a map or the indexes of an array: A := keys(B)
 	bv := vm.get(instr.B)
+	if vm.Races != nil {
+		vm.raceValue(bv, false)
+	}
 	switch bv.Type {
 	case Null:
 		// allow to iterate if not initialize (set an empty array)
@@ -1153,12 +1260,10 @@ func exec_key(instr *Instruction, vm *VM) int {
 	case Map:
 		m := bv.ToMap()
 		m.Mutex.RLock()
-		s := m.Map
-		values := make([]Value, len(s))
-		i := 0
-		for k := range s {
+		keys := m.Keys()
+		values := make([]Value, len(keys))
+		for i, k := range keys {
 			values[i] = NewString(k)
-			i++
 		}
 		m.Mutex.RUnlock()
 		vm.set(instr.A, NewArrayValues(values))
@@ -1191,6 +1296,9 @@ func exec_key(instr *Instruction, vm *VM) int {
 func exec_val(instr *Instruction, vm *VM) int {
 	// gets the values of a map or array: A := values(B)
 	bv := vm.get(instr.B)
+	if vm.Races != nil {
+		vm.raceValue(bv, false)
+	}
 	switch bv.Type {
 
 	case Null, Undefined:
@@ -1212,12 +1320,10 @@ func exec_val(instr *Instruction, vm *VM) int {
 	case Map:
 		m := bv.ToMap()
 		m.Mutex.RLock()
-		s := m.Map
-		values := make([]Value, len(s))
-		i := 0
-		for _, v := range s {
-			values[i] = v
-			i++
+		keys := m.Keys()
+		values := make([]Value, len(keys))
+		for i, k := range keys {
+			values[i] = m.Map[k]
 		}
 		m.Mutex.RUnlock()
 		vm.set(instr.A, NewArrayValues(values))
@@ -1250,8 +1356,59 @@ func exec_val(instr *Instruction, vm *VM) int {
 	return vm_next
 }
 
+func exec_itr(instr *Instruction, vm *VM) int {
+	// gets an iterator for the values of a collection: A := iterator(B)
+	bv := vm.get(instr.B)
+	if vm.Races != nil {
+		vm.raceValue(bv, false)
+	}
+
+	it, err := vm.Iterator(bv)
+	if err != nil {
+		if vm.handle(vm.WrapError(err)) {
+			return vm_continue
+		} else {
+			return vm_exit
+		}
+	}
+
+	vm.set(instr.A, NewObject(it))
+	return vm_next
+}
+
+func exec_nxt(instr *Instruction, vm *VM) int {
+	// gets the next value of an iterator: A := next(B), C := true if there was a value
+	bv := vm.get(instr.B)
+	it, ok := bv.ToObjectOrNil().(Iterator)
+	if !ok {
+		if vm.handle(vm.NewError("Expected an iterator, got %v", bv.TypeName())) {
+			return vm_continue
+		} else {
+			return vm_exit
+		}
+	}
+
+	v, ok, err := it.Next()
+	if err != nil {
+		if vm.handle(vm.WrapError(err)) {
+			return vm_continue
+		} else {
+			return vm_exit
+		}
+	}
+
+	if ok {
+		vm.set(instr.A, v)
+	}
+	vm.set(instr.C, NewBool(ok))
+	return vm_next
+}
+
 func exec_len(instr *Instruction, vm *VM) int {
 	bv := vm.get(instr.B)
+	if vm.Races != nil {
+		vm.raceValue(bv, false)
+	}
 	switch bv.Type {
 	case Array:
 		vm.set(instr.A, NewInt(len(bv.ToArray())))
@@ -1308,7 +1465,7 @@ func exec_trw(instr *Instruction, vm *VM) int {
 	}
 
 	if err == nil {
-		err = vm.NewError(v.String())
+		err = thrownError(v, vm)
 	}
 
 	// check if is inside a catch to discard it.
@@ -1497,7 +1654,7 @@ func exec_clo(vm *VM) int {
 func exec_new(instr *Instruction, vm *VM) int {
 	// A class type, B retAddress, C argsAddress
 
-	class := vm.get(instr.A).ToString()
+	class := className(vm.get(instr.A))
 
 	var args []Value
 	if instr.C != Void {
@@ -1520,7 +1677,7 @@ func exec_new(instr *Instruction, vm *VM) int {
 func exec_nes(instr *Instruction, vm *VM) int {
 	// A class type, B retAddress, C argsAddress
 
-	class := vm.get(instr.A).ToString()
+	class := className(vm.get(instr.A))
 
 	args := []Value{vm.get(instr.C)}
 
@@ -1578,6 +1735,7 @@ func exec_ret(instr *Instruction, vm *VM) int {
 	// which is handled in the main run loop
 	if vm.fp > 0 {
 		vm.runFinalizables(currentFrame)
+		vm.release(currentFrame)
 	}
 
 	var retValue Value
@@ -1622,3 +1780,136 @@ func exec_ret(instr *Instruction, vm *VM) int {
 
 	return vm_continue
 }
+
+func exec_apd(instr *Instruction, vm *VM) int {
+	// appends a value to an array: A array, B value
+	av := vm.get(instr.A)
+	bv := vm.get(instr.B)
+	if vm.Races != nil {
+		vm.raceValue(av, true)
+	}
+
+	if av.Type != Array {
+		if vm.handle(vm.NewError("Expected array, got %v", av.TypeName())) {
+			return vm_continue
+		} else {
+			return vm_exit
+		}
+	}
+
+	if err := vm.allocateAt(instr.A, av, bv.Size(), bv); err != nil {
+		if vm.handle(err) {
+			return vm_continue
+		} else {
+			return vm_exit
+		}
+	}
+
+	a := av.ToArrayObject()
+	a.Array = append(a.Array, bv)
+	return vm_next
+}
+
+func exec_spr(instr *Instruction, vm *VM) int {
+	// spreads B into A: appends the values to an array or copies the keys to a map
+	av := vm.get(instr.A)
+	bv := vm.get(instr.B)
+	if vm.Races != nil {
+		vm.raceValue(av, true)
+		vm.raceValue(bv, false)
+	}
+
+	var err error
+	switch av.Type {
+	case Array:
+		err = vm.spreadArray(instr.A, av, bv)
+	case Map:
+		err = vm.spreadMap(instr.A, av, bv)
+	default:
+		err = fmt.Errorf("Expected array or map, got %v", av.TypeName())
+	}
+
+	if err != nil {
+		if vm.handle(vm.WrapError(err)) {
+			return vm_continue
+		} else {
+			return vm_exit
+		}
+	}
+	return vm_next
+}
+
+// spreadArray appends the values of an array or an iterable.
+func (vm *VM) spreadArray(dst *Address, av, v Value) error {
+	a := av.ToArrayObject()
+	switch v.Type {
+	case Null, Undefined:
+		return nil
+
+	case Array:
+		items := v.ToArrayObject().Array
+		if err := vm.allocateAt(dst, av, v.Size(), items...); err != nil {
+			return err
+		}
+		a.Array = append(a.Array, items...)
+		return nil
+	}
+
+	it, err := vm.Iterator(v)
+	if err != nil {
+		return err
+	}
+
+	for {
+		item, ok, err := it.Next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+		if err := vm.allocateAt(dst, av, item.Size(), item); err != nil {
+			return err
+		}
+		a.Array = append(a.Array, item)
+	}
+}
+
+// spreadMap copies the keys of a map in order. The ones that
+// already exist are overwritten.
+func (vm *VM) spreadMap(dst *Address, av, v Value) error {
+	m := av.ToMap()
+	switch v.Type {
+	case Null, Undefined:
+		return nil
+
+	case Map:
+		if err := vm.allocateAt(dst, av, v.Size()); err != nil {
+			return err
+		}
+
+		src := v.ToMap()
+		if src == m {
+			return nil
+		}
+
+		src.Mutex.RLock()
+		defer src.Mutex.RUnlock()
+
+		m.Mutex.Lock()
+		defer m.Mutex.Unlock()
+
+		for _, k := range src.Keys() {
+			v := src.Map[k]
+			if m.global {
+				if err := vm.escape(v); err != nil {
+					return err
+				}
+			}
+			m.Set(k, v)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("Expected a map, got %v", v.TypeName())
+}
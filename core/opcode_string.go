@@ -58,11 +58,15 @@ func _() {
 	_ = x[op_cen-47]
 	_ = x[op_fen-48]
 	_ = x[op_trx-49]
+	_ = x[op_itr-50]
+	_ = x[op_nxt-51]
+	_ = x[op_apd-52]
+	_ = x[op_spr-53]
 }
 
-const _Opcode_name = "op_ldkop_movop_mobop_addop_subop_mulop_divop_modop_borop_andop_xorop_lshop_rshop_incop_decop_unmop_notop_bntop_newop_nesop_arrop_mapop_keyop_valop_lenop_getop_setop_spaop_jmpop_jpbop_ejpop_djpop_tjpop_eqlop_neqop_seqop_sneop_lstop_lseop_calop_casop_rnpop_retop_cloop_trwop_tryop_treop_cenop_fenop_trx"
+const _Opcode_name = "op_ldkop_movop_mobop_addop_subop_mulop_divop_modop_borop_andop_xorop_lshop_rshop_incop_decop_unmop_notop_bntop_newop_nesop_arrop_mapop_keyop_valop_lenop_getop_setop_spaop_jmpop_jpbop_ejpop_djpop_tjpop_eqlop_neqop_seqop_sneop_lstop_lseop_calop_casop_rnpop_retop_cloop_trwop_tryop_treop_cenop_fenop_trxop_itrop_nxtop_apdop_spr"
 
-var _Opcode_index = [...]uint16{0, 6, 12, 18, 24, 30, 36, 42, 48, 54, 60, 66, 72, 78, 84, 90, 96, 102, 108, 114, 120, 126, 132, 138, 144, 150, 156, 162, 168, 174, 180, 186, 192, 198, 204, 210, 216, 222, 228, 234, 240, 246, 252, 258, 264, 270, 276, 282, 288, 294, 300}
+var _Opcode_index = [...]uint16{0, 6, 12, 18, 24, 30, 36, 42, 48, 54, 60, 66, 72, 78, 84, 90, 96, 102, 108, 114, 120, 126, 132, 138, 144, 150, 156, 162, 168, 174, 180, 186, 192, 198, 204, 210, 216, 222, 228, 234, 240, 246, 252, 258, 264, 270, 276, 282, 288, 294, 300, 306, 312, 318, 324}
 
 func (i Opcode) String() string {
 	if i >= Opcode(len(_Opcode_index)-1) {
@@ -83,11 +87,12 @@ func _() {
 	_ = x[AddrNativeFunc-6]
 	_ = x[AddrData-7]
 	_ = x[AddrUnresolved-8]
+	_ = x[AddrClass-9]
 }
 
-const _AddressKind_name = "AddrVoidAddrLocalAddrGlobalAddrConstantAddrClosureAddrFuncAddrNativeFuncAddrDataAddrUnresolved"
+const _AddressKind_name = "AddrVoidAddrLocalAddrGlobalAddrConstantAddrClosureAddrFuncAddrNativeFuncAddrDataAddrUnresolvedAddrClass"
 
-var _AddressKind_index = [...]uint8{0, 8, 17, 27, 39, 50, 58, 72, 80, 94}
+var _AddressKind_index = [...]uint8{0, 8, 17, 27, 39, 50, 58, 72, 80, 94, 103}
 
 func (i AddressKind) String() string {
 	if i >= AddressKind(len(_AddressKind_index)-1) {
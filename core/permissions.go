@@ -0,0 +1,150 @@
+package core
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// Capabilities are permissions scoped to a resource with the
+// form kind:action:pattern, for example:
+//
+//	net:dial:api.internal:443
+//	fs:read:/data/reports/*
+//	sql:db:tenant_*
+//
+// In the pattern * matches any sequence of characters. A permission
+// without pattern, like net:dial, grants the action for any resource.
+
+// maxAuditEntries is the number of denied checks that a VM keeps.
+const maxAuditEntries = 100
+
+// AuditEntry is a denied capability check.
+type AuditEntry struct {
+	Time       time.Time
+	Capability string
+	Resource   string
+	Stacktrace []string
+}
+
+// PermissionNames returns the sorted permissions and capabilities
+// declared by the program.
+func (p *Program) PermissionNames() []string {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.Permissions == nil {
+		p.initPermissions()
+	}
+
+	names := make([]string, 0, len(p.Permissions))
+	for k := range p.Permissions {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// HasCapability returns true if the program is trusted, has the capability
+// for any resource or has a capability with a pattern that matches the resource.
+func (p *Program) HasCapability(capability, resource string) bool {
+	if p.HasPermission(capability) {
+		return true
+	}
+
+	prefix := capability + ":"
+
+	p.Lock()
+	defer p.Unlock()
+
+	for k := range p.Permissions {
+		if strings.HasPrefix(k, prefix) && matchPattern(k[len(prefix):], resource) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HasScope returns true if the program declares any capability of the kind.
+// Natives that were not restricted before capabilities existed, like the
+// file system, only check them when the program declares its scope.
+func (p *Program) HasScope(kind string) bool {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.Permissions == nil {
+		p.initPermissions()
+	}
+
+	prefix := kind + ":"
+	for k := range p.Permissions {
+		if strings.HasPrefix(k, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HasCapability is like Program.HasCapability but trusted VMs have all
+// the capabilities. Denied checks are added to the audit log.
+func (vm *VM) HasCapability(capability, resource string) bool {
+	if vm.Trusted || vm.Program.HasCapability(capability, resource) {
+		return true
+	}
+
+	e := AuditEntry{
+		Time:       time.Now(),
+		Capability: capability,
+		Resource:   resource,
+		Stacktrace: vm.Stacktrace(),
+	}
+
+	if len(vm.auditLog) == maxAuditEntries {
+		copy(vm.auditLog, vm.auditLog[1:])
+		vm.auditLog = vm.auditLog[:maxAuditEntries-1]
+	}
+	vm.auditLog = append(vm.auditLog, e)
+
+	if vm.Audit != nil {
+		vm.Audit(e)
+	}
+
+	return false
+}
+
+// AuditLog returns the last denied capability checks.
+func (vm *VM) AuditLog() []AuditEntry {
+	return vm.auditLog
+}
+
+// matchPattern reports whether s matches the pattern where
+// * matches any sequence of characters.
+func matchPattern(pattern, s string) bool {
+	for {
+		i := strings.IndexByte(pattern, '*')
+		if i == -1 {
+			return pattern == s
+		}
+
+		if !strings.HasPrefix(s, pattern[:i]) {
+			return false
+		}
+
+		s = s[i:]
+		pattern = pattern[i+1:]
+
+		if pattern == "" {
+			return true
+		}
+
+		// try every position for the rest of the pattern
+		for j := 0; j <= len(s); j++ {
+			if matchPattern(pattern, s[j:]) {
+				return true
+			}
+		}
+		return false
+	}
+}
@@ -9,6 +9,9 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"unicode/utf8"
+
+	"github.com/gtlang/filesystem"
 )
 
 type AddressKind byte
@@ -23,6 +26,7 @@ const (
 	AddrNativeFunc
 	AddrData
 	AddrUnresolved
+	AddrClass
 )
 
 type Address struct {
@@ -56,6 +60,8 @@ func (r *Address) String() string {
 		return fmt.Sprintf("%dD", r.Value)
 	case AddrUnresolved:
 		return fmt.Sprintf("%dU", r.Value)
+	case AddrClass:
+		return fmt.Sprintf("%dT", r.Value)
 	case AddrVoid:
 		return "--"
 	default:
@@ -147,8 +153,14 @@ type Program struct {
 	Permissions map[string]bool
 	Resources   map[string][]byte
 
-	kSize   int // the memory for all constants
-	funcMap map[string]*Function
+	// Sources has the code of the files to show it in the stack traces.
+	// It is optional and removed by Strip.
+	Sources map[string][]byte
+
+	kSize       int // the memory for all constants
+	funcMap     map[string]*Function
+	sourceLines map[string][]string
+	classValues []Value
 }
 
 func (p *Program) HasPermission(name string) bool {
@@ -200,6 +212,9 @@ func (p *Program) addConstant(v Value) *Address {
 }
 
 func (p *Program) Strip() {
+	p.Sources = nil
+	p.sourceLines = nil
+
 	for i := range p.Functions {
 		f := p.Functions[i]
 		if strings.Contains(f.Name, ".prototype.") {
@@ -227,29 +242,85 @@ func (p *Program) FileIndex(file string) int {
 }
 
 func (p *Program) ToTraceLine(f *Function, pc int) TraceLine {
+	pos, ok := f.position(pc)
+	if !ok {
+		return TraceLine{Function: f.Name}
+	}
+
+	var file string
+	if len(p.Files) > 0 {
+		file = p.Files[pos.File]
+	}
+
+	return TraceLine{
+		Function: f.Name,
+		File:     file,
+		Line:     pos.Line,
+		Column:   pos.Column,
+		Source:   p.sourceLine(file, pos.Line),
+	}
+}
+
+// position returns the position in the code of the instruction.
+func (f *Function) position(pc int) (Position, bool) {
 	ln := len(f.Positions)
 
 	if ln == 0 || ln <= pc {
-		return TraceLine{Function: f.Name}
+		return Position{}, false
 	}
 
 	// Instructions that have an empty position belong to the last source line in code.
-	var file string
-	var pos Position
-	for {
-		pos = f.Positions[pc]
-		if pc > 0 && pos.Line == 0 { // pos.Line is in base 1 so this is an empty position
-			pc--
+	for pc > 0 && f.Positions[pc].Line == 0 { // Line is in base 1 so this is an empty position
+		pc--
+	}
+
+	return f.Positions[pc], true
+}
+
+// LoadSources reads the code of the files of the program.
+// The files that can't be read are ignored.
+func (p *Program) LoadSources(fs filesystem.FS) {
+	for _, file := range p.Files {
+		if file == "" {
+			continue
+		}
+		b, err := filesystem.ReadAll(fs, file)
+		if err != nil {
 			continue
 		}
+		if p.Sources == nil {
+			p.Sources = make(map[string][]byte)
+		}
+		p.Sources[file] = b
+	}
+}
 
-		if len(p.Files) > 0 {
-			file = p.Files[pos.File]
+// sourceLine returns the line of code of the file if the program has the sources.
+func (p *Program) sourceLine(file string, line int) string {
+	if p.Sources == nil || line < 1 {
+		return ""
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	lines, ok := p.sourceLines[file]
+	if !ok {
+		src, ok := p.Sources[file]
+		if !ok {
+			return ""
+		}
+		lines = strings.Split(string(src), "\n")
+		if p.sourceLines == nil {
+			p.sourceLines = make(map[string][]string)
 		}
-		break
+		p.sourceLines[file] = lines
 	}
 
-	return TraceLine{Function: f.Name, File: file, Line: pos.Line}
+	if line > len(lines) {
+		return ""
+	}
+	return strings.TrimRight(lines[line-1], "\r")
 }
 
 func (p *Program) Function(name string) (*Function, bool) {
@@ -266,6 +337,21 @@ func (p *Program) Function(name string) (*Function, bool) {
 	return f, ok
 }
 
+// classValue returns the value of a class. It is always the same
+// so the class can be compared with ==.
+func (p *Program) classValue(index int) Value {
+	p.Lock()
+	if p.classValues == nil {
+		p.classValues = make([]Value, len(p.Classes))
+		for i, c := range p.Classes {
+			p.classValues[i] = NewObject(&classValue{program: p, class: c})
+		}
+	}
+	v := p.classValues[index]
+	p.Unlock()
+	return v
+}
+
 func (p *Program) AddDirective(name string, value string) {
 	v, ok := p.Directives[name]
 	if ok {
@@ -279,6 +365,14 @@ type TraceLine struct {
 	Function string
 	File     string
 	Line     int
+	Column   int
+
+	// Source is the line of code if the program has the sources.
+	Source string
+
+	// Boundary is set in the first line of the stack of the VM that
+	// started the one that has the rest of the lines, like "go".
+	Boundary string
 }
 
 func (p TraceLine) String() string {
@@ -295,6 +389,36 @@ func (p TraceLine) String() string {
 		fmt.Fprintf(&buf, "%s:%d", p.File, p.Line)
 	}
 
+	if p.Line > 0 && p.Column > 0 {
+		fmt.Fprintf(&buf, ":%d", p.Column)
+	}
+
+	return buf.String()
+}
+
+// Snippet returns the line of code with a caret under the column
+// or an empty string if there is no source.
+func (p TraceLine) Snippet() string {
+	if p.Source == "" {
+		return ""
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("    ")
+	buf.WriteString(p.Source)
+	buf.WriteString("\n    ")
+
+	// keep the tabs to align the caret
+	for i := 0; i < p.Column-1 && i < len(p.Source); i++ {
+		switch c := p.Source[i]; {
+		case c == '\t':
+			buf.WriteByte('\t')
+		case utf8.RuneStart(c):
+			buf.WriteByte(' ')
+		}
+	}
+
+	buf.WriteString("^\n")
 	return buf.String()
 }
 
@@ -302,6 +426,11 @@ func (p TraceLine) SameLine(o TraceLine) bool {
 	return p.File == o.File && p.Line == o.Line
 }
 
+// samePosition compares the lines ignoring the boundary.
+func (p TraceLine) samePosition(o TraceLine) bool {
+	return p.Function == o.Function && p.File == o.File && p.Line == o.Line && p.Column == o.Column
+}
+
 type Position struct {
 	File   int
 	Line   int
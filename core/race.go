@@ -0,0 +1,373 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// The race detector tracks the accesses to the values that goroutines,
+// the VMs cloned to run async code, can share: the global registers,
+// the registers captured by closures and arrays and maps.
+//
+// Each goroutine has a vector clock. An access races with a previous one
+// of another goroutine if it doesn't happen after it: cloning a VM, and
+// releasing and acquiring a synchronization object like a mutex, a channel
+// or a wait group, are the only ways to order them.
+//
+// The shadow with the last accesses is stored in the value itself, or in a
+// table shared by the VMs that use the same globals, so it is collected
+// with the value.
+
+// RaceDetector collects the data races of a VM and its clones.
+type RaceDetector struct {
+	mutex   sync.Mutex
+	threads int
+	syncs   map[interface{}]vectorClock // the clocks released by sync objects
+	seen    map[string]bool
+	races   []*Race
+}
+
+// Race is a pair of accesses to the same value by two goroutines
+// where at least one is a write.
+type Race struct {
+	Location string
+	Current  RaceAccess
+	Previous RaceAccess
+}
+
+type RaceAccess struct {
+	Goroutine  int
+	Write      bool
+	Stacktrace []string
+}
+
+func (r *Race) String() string {
+	var b strings.Builder
+	b.WriteString("WARNING: DATA RACE\n")
+	r.Current.write(&b, r.Location, "")
+	b.WriteString("\n")
+	r.Previous.write(&b, r.Location, "Previous ")
+	return b.String()
+}
+
+func (a RaceAccess) write(b *strings.Builder, location, prefix string) {
+	op := "read"
+	if a.Write {
+		op = "write"
+	}
+	if prefix == "" {
+		op = strings.ToUpper(op[:1]) + op[1:]
+	}
+	fmt.Fprintf(b, "%s%s at %s by goroutine %d:\n", prefix, op, location, a.Goroutine)
+	for _, s := range a.Stacktrace {
+		b.WriteString("  ")
+		b.WriteString(s)
+		b.WriteString("\n")
+	}
+}
+
+type vectorClock []uint64
+
+func (c vectorClock) get(thread int) uint64 {
+	if thread < len(c) {
+		return c[thread]
+	}
+	return 0
+}
+
+func (c vectorClock) join(o vectorClock) vectorClock {
+	for len(c) < len(o) {
+		c = append(c, 0)
+	}
+	for i, v := range o {
+		if v > c[i] {
+			c[i] = v
+		}
+	}
+	return c
+}
+
+func (c vectorClock) copy() vectorClock {
+	return append(vectorClock(nil), c...)
+}
+
+type raceThread struct {
+	id    int
+	clock vectorClock
+}
+
+func (t *raceThread) tick() {
+	t.clock[t.id]++
+}
+
+type raceShadow struct {
+	location string
+	write    *raceAccess
+	reads    map[int]*raceAccess
+}
+
+type raceAccess struct {
+	thread  int
+	clock   uint64
+	write   bool
+	program *Program
+	frames  []framePC // rendered only if there is a race
+	caller  *callerStack
+}
+
+// stacktrace renders the stack of the access.
+func (a *raceAccess) stacktrace() []string {
+	st := append(traceLines(a.program, a.frames), a.caller.lines()...)
+	s := make([]string, len(st))
+	for i, l := range st {
+		s[i] = l.String()
+	}
+	return s
+}
+
+// key identifies the lines of the stack of the access.
+func (a *raceAccess) key() string {
+	var b strings.Builder
+	for _, f := range a.frames {
+		pos, _ := a.program.Functions[f.funcIndex].position(f.pc)
+		fmt.Fprintf(&b, "%d:%d:%d,", f.funcIndex, pos.File, pos.Line)
+	}
+	for c := a.caller; c != nil; c = c.parent {
+		for _, f := range c.frames {
+			pos, _ := c.program.Functions[f.funcIndex].position(f.pc)
+			fmt.Fprintf(&b, "%d:%d:%d,", f.funcIndex, pos.File, pos.Line)
+		}
+	}
+	return b.String()
+}
+
+// happensBefore returns true if the access is ordered before
+// the current point of the thread.
+func (a *raceAccess) happensBefore(t *raceThread) bool {
+	return a.thread == t.id || a.clock <= t.clock.get(a.thread)
+}
+
+func NewRaceDetector() *RaceDetector {
+	return &RaceDetector{
+		syncs: make(map[interface{}]vectorClock),
+		seen:  make(map[string]bool),
+	}
+}
+
+// DetectRaces enables the race detector in the VM and the ones cloned
+// from it and returns it to get the races found.
+func (vm *VM) DetectRaces() *RaceDetector {
+	d := NewRaceDetector()
+	vm.Races = d
+	vm.raceThread = d.newThread(nil)
+	vm.raceGlobals = make([]*raceShadow, len(vm.callStack[0].values))
+	return d
+}
+
+// cloneRaces starts a goroutine in the detector for m, a clone of vm.
+func (vm *VM) cloneRaces(m *VM) {
+	m.Races = vm.Races
+	m.raceThread = vm.Races.newThread(vm.raceThread)
+
+	// goroutines share the globals and isolates have a copy
+	g, mg := vm.callStack[0].values, m.callStack[0].values
+	if len(g) > 0 && len(mg) == len(g) && &mg[0] == &g[0] {
+		m.raceGlobals = vm.raceGlobals
+	} else {
+		m.raceGlobals = make([]*raceShadow, len(mg))
+	}
+}
+
+// Races returns the races found so far.
+func (d *RaceDetector) Races() []*Race {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return append([]*Race(nil), d.races...)
+}
+
+// newThread returns the clock of a goroutine started by parent.
+func (d *RaceDetector) newThread(parent *raceThread) *raceThread {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.threads++
+	t := &raceThread{id: d.threads}
+
+	if parent != nil {
+		// everything done before the clone happens before the new goroutine
+		t.clock = parent.clock.copy()
+		parent.tick()
+	}
+
+	for len(t.clock) <= t.id {
+		t.clock = append(t.clock, 0)
+	}
+	t.tick()
+	return t
+}
+
+// RaceRelease is called by natives when the VM releases a synchronization
+// object, like unlocking a mutex or sending to a channel.
+func (vm *VM) RaceRelease(obj interface{}) {
+	if vm.Races == nil {
+		return
+	}
+	d := vm.Races
+	t := vm.raceThread
+
+	d.mutex.Lock()
+	d.syncs[obj] = d.syncs[obj].join(t.clock)
+	t.tick()
+	d.mutex.Unlock()
+}
+
+// RaceAcquire is called by natives when the VM acquires a synchronization
+// object, like locking a mutex or receiving from a channel. The VM then
+// sees everything done before it was released.
+func (vm *VM) RaceAcquire(obj interface{}) {
+	if vm.Races == nil {
+		return
+	}
+	d := vm.Races
+	t := vm.raceThread
+
+	d.mutex.Lock()
+	t.clock = t.clock.join(d.syncs[obj])
+	d.mutex.Unlock()
+}
+
+// raceSlot holds the shadow of a register captured by closures.
+// The closures created in the same frame share it.
+type raceSlot struct {
+	shadow *raceShadow
+}
+
+// raceAccess checks the access to the value with the shadow returned by slot.
+func (vm *VM) raceAccess(slot func() **raceShadow, write bool, location func() string) {
+	d := vm.Races
+	t := vm.raceThread
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	shadow := slot()
+	s := *shadow
+	if s == nil {
+		s = &raceShadow{location: location(), reads: make(map[int]*raceAccess)}
+		*shadow = s
+	}
+
+	var current *raceAccess
+	access := func() *raceAccess {
+		if current == nil {
+			current = &raceAccess{
+				thread:  t.id,
+				clock:   t.clock.get(t.id),
+				write:   write,
+				program: vm.Program,
+				frames:  vm.framePCs(),
+				caller:  vm.callerStack,
+			}
+		}
+		return current
+	}
+
+	if s.write != nil && !s.write.happensBefore(t) {
+		d.report(s, access(), s.write)
+	}
+
+	if write {
+		for _, r := range s.reads {
+			if !r.happensBefore(t) {
+				d.report(s, access(), r)
+			}
+		}
+		s.write = access()
+		s.reads = make(map[int]*raceAccess)
+		return
+	}
+
+	s.reads[t.id] = access()
+}
+
+func (d *RaceDetector) report(s *raceShadow, current, previous *raceAccess) {
+	// report every pair of lines once
+	key := s.location + "|" + current.key() + "|" + previous.key()
+	if d.seen[key] {
+		return
+	}
+	d.seen[key] = true
+
+	r := &Race{
+		Location: s.location,
+		Current: RaceAccess{
+			Goroutine:  current.thread,
+			Write:      current.write,
+			Stacktrace: current.stacktrace(),
+		},
+		Previous: RaceAccess{
+			Goroutine:  previous.thread,
+			Write:      previous.write,
+			Stacktrace: previous.stacktrace(),
+		},
+	}
+
+	d.races = append(d.races, r)
+}
+
+func (vm *VM) raceGlobal(index int, write bool) {
+	slot := func() **raceShadow {
+		if vm.raceGlobals == nil {
+			vm.raceGlobals = make([]*raceShadow, len(vm.callStack[0].values))
+		}
+		return &vm.raceGlobals[index]
+	}
+
+	vm.raceAccess(slot, write, func() string {
+		for _, r := range vm.Program.Functions[0].Registers {
+			if r.Index == index {
+				return "global " + r.Name
+			}
+		}
+		return fmt.Sprintf("global %d", index)
+	})
+}
+
+func (vm *VM) raceClosure(c *closureRegister, write bool) {
+	slot := func() **raceShadow {
+		// closures created before enabling the detector
+		if c.race == nil {
+			c.race = &raceSlot{}
+		}
+		return &c.race.shadow
+	}
+
+	vm.raceAccess(slot, write, func() string {
+		return "variable " + c.register.Name
+	})
+}
+
+// raceValue checks the access to an array or a map.
+func (vm *VM) raceValue(v Value, write bool) {
+	switch v.Type {
+	case Array:
+		a := v.ToArrayObject()
+		vm.raceAccess(func() **raceShadow { return &a.race }, write, func() string { return "array" })
+	case Map:
+		m := v.ToMap()
+		vm.raceAccess(func() **raceShadow { return &m.race }, write, func() string { return "map" })
+	}
+}
+
+// raceMethod checks the call to an array method. The ones that
+// modify the array are writes.
+func (vm *VM) raceMethod(v Value, name string) {
+	switch name {
+	case "push", "pushRange", "append", "insertAt", "removeAt",
+		"removeRange", "remove", "sort", "reverse", "copyAt":
+		vm.raceValue(v, true)
+	default:
+		vm.raceValue(v, false)
+	}
+}
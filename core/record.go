@@ -0,0 +1,629 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A Recorder logs every native function call and every method call and
+// property access of native objects with its arguments and result.
+// A Replayer serves them from the log so the program runs exactly as it
+// did when it was recorded, even if it depends on the time, random numbers
+// or the responses of a server.
+//
+// Natives that call functions of the program, like array.map, or start
+// goroutines are executed again when replaying so the callbacks run.
+// The goroutines themselves are not recorded.
+//
+// Objects returned by natives are identified by the order in which
+// they are seen and replayed by placeholders that serve their methods
+// and properties from the log.
+
+// maxRecordDepth limits the nesting of the arrays and maps that are recorded.
+const maxRecordDepth = 100
+
+type recordedCall struct {
+	Kind     string          `json:"kind"` // call, method, get or set
+	Name     string          `json:"name"`
+	Object   int             `json:"object,omitempty"` // the receiver of methods and properties
+	This     *recordedValue  `json:"this,omitempty"`
+	Args     []recordedValue `json:"args,omitempty"`
+	Result   recordedValue   `json:"result"`
+	Error    string          `json:"error,omitempty"`
+	Public   bool            `json:"public,omitempty"`
+	Live     bool            `json:"live,omitempty"` // executed again when replaying
+	Position string          `json:"position,omitempty"`
+}
+
+type recordedValue struct {
+	Type   string                   `json:"t"`
+	Int    int64                    `json:"i,omitempty"`
+	Float  string                   `json:"f,omitempty"`
+	Bool   bool                     `json:"b,omitempty"`
+	String string                   `json:"s,omitempty"`
+	Bytes  []byte                   `json:"y,omitempty"`
+	Items  []recordedValue          `json:"a,omitempty"`
+	Map    map[string]recordedValue `json:"m,omitempty"`
+	Keys   []string                 `json:"k,omitempty"` // the order of the keys of Map
+}
+
+// Recorder writes the native calls of a VM. Set it in VM.Recorder.
+type Recorder struct {
+	w       *bufio.Writer
+	objects objectTable
+	pending []*recordedCall // calls not written yet in the order they started
+	active  []*recordedCall // calls running
+}
+
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{w: bufio.NewWriter(w), objects: newObjectTable()}
+}
+
+// Replayer serves the native calls of a VM from a log written by a Recorder.
+// Set it in VM.Replayer.
+type Replayer struct {
+	calls   []*recordedCall
+	pos     int
+	objects objectTable
+}
+
+func NewReplayer(r io.Reader) (*Replayer, error) {
+	p := &Replayer{objects: newObjectTable()}
+
+	dec := json.NewDecoder(r)
+	for {
+		c := &recordedCall{}
+		if err := dec.Decode(c); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("error reading the log: %v", err)
+		}
+		p.calls = append(p.calls, c)
+	}
+
+	return p, nil
+}
+
+// Done returns a DivergenceError if the program made fewer calls
+// than the ones recorded.
+func (p *Replayer) Done() error {
+	if p.pos < len(p.calls) {
+		c := p.calls[p.pos]
+		return &DivergenceError{
+			Index:    p.pos,
+			Expected: c.String(),
+			Got:      "the end of the program",
+			Position: c.Position,
+		}
+	}
+	return nil
+}
+
+// DivergenceError is returned when the program makes a different call
+// than the one that was recorded. It can't be catched.
+type DivergenceError struct {
+	Index      int      // the position of the call in the log
+	Expected   string   // the recorded call
+	Got        string   // the call made by the program
+	Position   string   // where the recorded call was made
+	Stacktrace []string // where the program made the call
+}
+
+func (e *DivergenceError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "replay diverged at call %d:\n", e.Index)
+	fmt.Fprintf(&b, " expected %s", e.Expected)
+	if e.Position != "" {
+		fmt.Fprintf(&b, " at %s", e.Position)
+	}
+	fmt.Fprintf(&b, "\n got %s", e.Got)
+	for _, s := range e.Stacktrace {
+		fmt.Fprintf(&b, "\n -> %s", s)
+	}
+	return b.String()
+}
+
+func (c *recordedCall) String() string {
+	var b strings.Builder
+
+	b.WriteString(c.Kind)
+	b.WriteByte(' ')
+
+	if c.Object != 0 {
+		fmt.Fprintf(&b, "#%d.", c.Object)
+	}
+	b.WriteString(c.Name)
+
+	if c.Kind == "get" {
+		return b.String()
+	}
+
+	b.WriteByte('(')
+	for i, a := range c.Args {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(a.format())
+	}
+	b.WriteByte(')')
+
+	return b.String()
+}
+
+func (v recordedValue) format() string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// objectTable assigns ids to native objects in the order they are seen.
+type objectTable struct {
+	ids     map[interface{}]int
+	objects map[int]interface{}
+	next    int
+}
+
+func newObjectTable() objectTable {
+	return objectTable{
+		ids:     make(map[interface{}]int),
+		objects: make(map[int]interface{}),
+		next:    1,
+	}
+}
+
+func (t *objectTable) id(o interface{}) int {
+	if p, ok := o.(*replayObject); ok {
+		return p.id
+	}
+
+	comparable := reflect.TypeOf(o).Comparable()
+	if comparable {
+		if id, ok := t.ids[o]; ok {
+			return id
+		}
+	}
+
+	id := t.next
+	t.next++
+	t.objects[id] = o
+	if comparable {
+		t.ids[o] = id
+	}
+	return id
+}
+
+func (t *objectTable) get(id int, name string) interface{} {
+	if o, ok := t.objects[id]; ok {
+		return o
+	}
+
+	o := &replayObject{id: id, name: name}
+	t.objects[id] = o
+	if id >= t.next {
+		t.next = id + 1
+	}
+	return o
+}
+
+// replayObject replaces the objects returned by natives when replaying.
+type replayObject struct {
+	id   int
+	name string
+}
+
+func (o *replayObject) Type() string {
+	return o.name
+}
+
+func (o *replayObject) GetProperty(name string, vm *VM) (Value, error) {
+	return NullValue, fmt.Errorf("can't read %s.%s outside of the replay", o.name, name)
+}
+
+func (o *replayObject) SetProperty(name string, v Value, vm *VM) error {
+	return fmt.Errorf("can't set %s.%s outside of the replay", o.name, name)
+}
+
+func (t *objectTable) encode(v Value, depth int) (recordedValue, error) {
+	if depth > maxRecordDepth {
+		return recordedValue{}, fmt.Errorf("can't record values nested more than %d levels", maxRecordDepth)
+	}
+
+	switch v.Type {
+	case Null:
+		return recordedValue{Type: "null"}, nil
+	case Undefined:
+		return recordedValue{Type: "undefined"}, nil
+	case Int:
+		return recordedValue{Type: "int", Int: v.ToInt()}, nil
+	case Float:
+		return recordedValue{Type: "float", Float: strconv.FormatFloat(v.ToFloat(), 'g', -1, 64)}, nil
+	case Bool:
+		return recordedValue{Type: "bool", Bool: v.ToBool()}, nil
+	case String:
+		return recordedValue{Type: "string", String: v.ToString()}, nil
+	case Bytes:
+		return recordedValue{Type: "bytes", Bytes: v.ToBytes()}, nil
+	case Rune:
+		return recordedValue{Type: "rune", Int: int64(v.ToRune())}, nil
+	case Func:
+		return recordedValue{Type: "func", Int: int64(v.ToFunction())}, nil
+	case NativeFunc:
+		return recordedValue{Type: "native", String: allNativeFuncs[v.ToNativeFunction()].Name}, nil
+
+	case Array:
+		a := v.ToArray()
+		items := make([]recordedValue, len(a))
+		for i, item := range a {
+			x, err := t.encode(item, depth+1)
+			if err != nil {
+				return recordedValue{}, err
+			}
+			items[i] = x
+		}
+		return recordedValue{Type: "array", Items: items}, nil
+
+	case Map:
+		m := v.ToMap()
+		m.Mutex.RLock()
+		defer m.Mutex.RUnlock()
+		items := make(map[string]recordedValue, len(m.Map))
+		for k, item := range m.Map {
+			x, err := t.encode(item, depth+1)
+			if err != nil {
+				return recordedValue{}, err
+			}
+			items[k] = x
+		}
+		keys := append([]string(nil), m.Keys()...)
+		return recordedValue{Type: "map", Map: items, Keys: keys}, nil
+
+	case Object:
+		switch o := v.ToObject().(type) {
+		case Error:
+			return recordedValue{Type: "error", String: o.message, Bool: o.public}, nil
+		case Closure:
+			return recordedValue{Type: "closure", Int: int64(o.funcIndex)}, nil
+		case method:
+			return recordedValue{Type: "method", Int: int64(o.fn)}, nil
+		case NativeMethod:
+			// replayed by the method of the receiver
+			return recordedValue{Type: "nativeMethod"}, nil
+		default:
+			name := fmt.Sprintf("%T", o)
+			if n, ok := o.(NamedType); ok {
+				name = n.Type()
+			}
+			return recordedValue{Type: "object", Int: int64(t.id(o)), String: name}, nil
+		}
+
+	default:
+		return recordedValue{}, fmt.Errorf("can't record values of type %s", v.TypeName())
+	}
+}
+
+func (t *objectTable) decode(v recordedValue, p *Program) (Value, error) {
+	switch v.Type {
+	case "null":
+		return NullValue, nil
+	case "undefined":
+		return UndefinedValue, nil
+	case "int":
+		return NewInt64(v.Int), nil
+	case "float":
+		f, err := strconv.ParseFloat(v.Float, 64)
+		if err != nil {
+			return NullValue, err
+		}
+		return NewFloat(f), nil
+	case "bool":
+		return NewBool(v.Bool), nil
+	case "string":
+		return NewString(v.String), nil
+	case "bytes":
+		return NewBytes(v.Bytes), nil
+	case "rune":
+		return NewRune(rune(v.Int)), nil
+
+	case "func":
+		if v.Int < 0 || int(v.Int) >= len(p.Functions) {
+			return NullValue, fmt.Errorf("invalid function %d", v.Int)
+		}
+		return NewFunction(int(v.Int)), nil
+
+	case "native":
+		f, ok := allNativeMap[v.String]
+		if !ok {
+			return NullValue, fmt.Errorf("native function %s not found", v.String)
+		}
+		return NewNativeFunction(f.Index), nil
+
+	case "array":
+		a := make([]Value, len(v.Items))
+		for i, item := range v.Items {
+			x, err := t.decode(item, p)
+			if err != nil {
+				return NullValue, err
+			}
+			a[i] = x
+		}
+		return NewArrayValues(a), nil
+
+	case "map":
+		keys := v.Keys
+		if len(keys) != len(v.Map) {
+			// recorded without the order
+			keys = make([]string, 0, len(v.Map))
+			for k := range v.Map {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+		}
+
+		m := NewMap(len(v.Map))
+		mv := m.ToMap()
+		for _, k := range keys {
+			x, err := t.decode(v.Map[k], p)
+			if err != nil {
+				return NullValue, err
+			}
+			mv.Set(k, x)
+		}
+		return m, nil
+
+	case "error":
+		return NewObject(Error{message: v.String, public: v.Bool}), nil
+
+	case "object":
+		return NewObject(t.get(int(v.Int), v.String)), nil
+
+	case "nativeMethod":
+		return NewObject(NativeMethod(func(args []Value, vm *VM) (Value, error) {
+			return NullValue, fmt.Errorf("can't call a replayed method outside of the replay")
+		})), nil
+
+	default:
+		return NullValue, fmt.Errorf("can't replay values of type %s", v.Type)
+	}
+}
+
+func (t *objectTable) encodeCall(kind, name string, obj interface{}, this Value, args []Value) (*recordedCall, error) {
+	c := &recordedCall{Kind: kind, Name: name}
+
+	if obj != nil {
+		c.Object = t.id(obj)
+	}
+
+	if this.Type != Null {
+		x, err := t.encode(this, 0)
+		if err != nil {
+			return nil, err
+		}
+		c.This = &x
+	}
+
+	if len(args) > 0 {
+		c.Args = make([]recordedValue, len(args))
+		for i, a := range args {
+			x, err := t.encode(a, 0)
+			if err != nil {
+				return nil, err
+			}
+			c.Args[i] = x
+		}
+	}
+
+	return c, nil
+}
+
+func (c *recordedCall) setResult(t *objectTable, ret Value, err error) error {
+	if err != nil {
+		c.Error = err.Error()
+		if e, ok := err.(Error); ok {
+			c.Error = e.message
+			c.Public = e.public
+		}
+		return nil
+	}
+
+	x, err := t.encode(ret, 0)
+	if err != nil {
+		return err
+	}
+	c.Result = x
+	return nil
+}
+
+// intercepted returns true if native calls must go through invokeNative.
+func (vm *VM) intercepted() bool {
+	return vm.Recorder != nil || vm.Replayer != nil
+}
+
+// invokeNative records or replays a call to a native.
+func (vm *VM) invokeNative(kind, name string, obj interface{}, this Value, args []Value,
+	fn func() (Value, error)) (Value, error) {
+	if vm.Replayer != nil {
+		return vm.replayNative(kind, name, obj, this, args, fn)
+	}
+
+	r := vm.Recorder
+
+	c, err := r.objects.encodeCall(kind, name, obj, this, args)
+	if err != nil {
+		return NullValue, err
+	}
+
+	if st := vm.Stacktrace(); len(st) > 0 {
+		c.Position = st[0]
+	}
+
+	r.pending = append(r.pending, c)
+	r.active = append(r.active, c)
+
+	runs := vm.runs
+	ret, err := fn()
+
+	r.active = r.active[:len(r.active)-1]
+
+	// if it called functions of the program it must run again
+	if vm.runs != runs {
+		c.Live = true
+	}
+
+	if e := c.setResult(&r.objects, ret, err); e != nil {
+		vm.abort = e
+		return NullValue, e
+	}
+
+	if len(r.active) == 0 {
+		if e := r.flush(); e != nil {
+			vm.abort = e
+			return NullValue, e
+		}
+	}
+
+	return ret, err
+}
+
+func (r *Recorder) flush() error {
+	for _, c := range r.pending {
+		b, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		r.w.Write(b)
+		r.w.WriteByte('\n')
+	}
+	r.pending = r.pending[:0]
+	return r.w.Flush()
+}
+
+// markLive makes the running calls run again when replaying. It is
+// called when the VM is cloned because it is probably to run a goroutine.
+func (r *Recorder) markLive() {
+	for _, c := range r.active {
+		c.Live = true
+	}
+}
+
+func (vm *VM) replayNative(kind, name string, obj interface{}, this Value, args []Value,
+	fn func() (Value, error)) (Value, error) {
+	p := vm.Replayer
+
+	got, err := p.objects.encodeCall(kind, name, obj, this, args)
+	if err != nil {
+		return NullValue, err
+	}
+
+	if p.pos >= len(p.calls) {
+		return NullValue, vm.diverged(p.pos, "the end of the log", "", got.String())
+	}
+
+	index := p.pos
+	c := p.calls[index]
+	p.pos++
+
+	if !sameCall(c, got) {
+		return NullValue, vm.diverged(index, c.String(), c.Position, got.String())
+	}
+
+	if c.Live {
+		ret, err := fn()
+		if e := got.setResult(&p.objects, ret, err); e != nil {
+			vm.abort = e
+			return NullValue, e
+		}
+		if got.Error != c.Error || !sameJSON(got.Result, c.Result) {
+			return NullValue, vm.diverged(index, c.String()+" returning "+c.Result.format(),
+				c.Position, got.String()+" returning "+got.Result.format())
+		}
+		return ret, err
+	}
+
+	if c.Error != "" {
+		return NullValue, Error{message: c.Error, public: c.Public}
+	}
+
+	ret, err := p.objects.decode(c.Result, vm.Program)
+	if err != nil {
+		vm.abort = err
+		return NullValue, err
+	}
+
+	return ret, nil
+}
+
+func sameCall(a, b *recordedCall) bool {
+	return a.Kind == b.Kind &&
+		a.Name == b.Name &&
+		a.Object == b.Object &&
+		sameJSON(a.This, b.This) &&
+		sameJSON(a.Args, b.Args)
+}
+
+// sameJSON compares values as they are stored in the log where
+// empty and nil slices are the same.
+func sameJSON(a, b interface{}) bool {
+	x, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	y, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(x, y)
+}
+
+func (vm *VM) diverged(index int, expected, position, got string) error {
+	err := &DivergenceError{
+		Index:      index,
+		Expected:   expected,
+		Got:        got,
+		Position:   position,
+		Stacktrace: vm.Stacktrace(),
+	}
+	vm.abort = err
+	return err
+}
+
+// interceptMember records or replays reading a method or a property
+// of a native object.
+func (vm *VM) interceptMember(obj interface{}, name string) (Value, error) {
+	v, err := vm.invokeNative("get", name, obj, NullValue, nil, func() (Value, error) {
+		if n, ok := obj.(Callable); ok {
+			if m := n.GetMethod(name); m != nil {
+				return NewObject(m), nil
+			}
+		}
+		if i, ok := obj.(PropertyGetter); ok {
+			return i.GetProperty(name, vm)
+		}
+		return UndefinedValue, nil
+	})
+	if err != nil {
+		return NullValue, err
+	}
+
+	if m, ok := v.ToObjectOrNil().(NativeMethod); ok {
+		v = NewObject(vm.interceptMethod(obj, name, m))
+	}
+
+	return v, nil
+}
+
+// interceptMethod returns a method that records or replays
+// the calls to the method of a native object.
+func (vm *VM) interceptMethod(obj interface{}, name string, m NativeMethod) NativeMethod {
+	return func(args []Value, vm *VM) (Value, error) {
+		return vm.invokeNative("method", name, obj, NullValue, args, func() (Value, error) {
+			return m(args, vm)
+		})
+	}
+}
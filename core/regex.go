@@ -0,0 +1,234 @@
+package core
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Regex is a compiled regular expression. Literals like /[a-z]+/i are
+// compiled once and stored as constants of the program so they are
+// immutable and shared by all the VMs that run it.
+//
+// The flags are "i" (case insensitive), "m" (multiline), "s" (dot matches
+// new lines) and "g" (replace all the matches instead of the first).
+type Regex struct {
+	re     *regexp.Regexp
+	source string
+	flags  string
+	global bool
+}
+
+// NewRegex compiles the pattern with the flags of a regex literal.
+func NewRegex(source, flags string) (*Regex, error) {
+	r := &Regex{source: source, flags: flags}
+
+	var prefix string
+	for _, f := range flags {
+		switch f {
+		case 'i', 'm', 's':
+			if strings.ContainsRune(prefix, f) {
+				return nil, fmt.Errorf("duplicated regex flag %q", f)
+			}
+			prefix += string(f)
+		case 'g':
+			if r.global {
+				return nil, fmt.Errorf("duplicated regex flag %q", f)
+			}
+			r.global = true
+		default:
+			return nil, fmt.Errorf("invalid regex flag %q", f)
+		}
+	}
+
+	pattern := source
+	if prefix != "" {
+		pattern = "(?" + prefix + ")" + source
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	r.re = re
+	return r, nil
+}
+
+// ParseRegex compiles a literal like /[a-z]+/i.
+func ParseRegex(literal string) (*Regex, error) {
+	i := strings.LastIndexByte(literal, '/')
+	if len(literal) < 2 || literal[0] != '/' || i == 0 {
+		return nil, fmt.Errorf("invalid regex %s", literal)
+	}
+	return NewRegex(literal[1:i], literal[i+1:])
+}
+
+func (r *Regex) Type() string {
+	return "RegExp"
+}
+
+// Regexp returns the compiled expression.
+func (r *Regex) Regexp() *regexp.Regexp {
+	return r.re
+}
+
+func (r *Regex) String() string {
+	return "/" + r.source + "/" + r.flags
+}
+
+func (r *Regex) GetProperty(name string, vm *VM) (Value, error) {
+	switch name {
+	case "source":
+		return NewString(r.source), nil
+	case "flags":
+		return NewString(r.flags), nil
+	case "global":
+		return NewBool(r.global), nil
+	}
+	return UndefinedValue, nil
+}
+
+func (r *Regex) GetMethod(name string) NativeMethod {
+	switch name {
+	case "test":
+		return r.test
+	case "exec":
+		return r.exec
+	case "execAll":
+		return r.execAll
+	case "replace":
+		return r.replace
+	case "split":
+		return r.split
+	case "toString":
+		return r.toString
+	}
+	return nil
+}
+
+func (r *Regex) test(args []Value, vm *VM) (Value, error) {
+	if len(args) != 1 || args[0].Type != String {
+		return NullValue, fmt.Errorf("expected a string argument")
+	}
+	return NewBool(r.re.MatchString(args[0].ToString())), nil
+}
+
+func (r *Regex) exec(args []Value, vm *VM) (Value, error) {
+	if len(args) != 1 || args[0].Type != String {
+		return NullValue, fmt.Errorf("expected a string argument")
+	}
+	s := args[0].ToString()
+	m := r.re.FindStringSubmatchIndex(s)
+	if m == nil {
+		return NullValue, nil
+	}
+	return r.match(s, m), nil
+}
+
+func (r *Regex) execAll(args []Value, vm *VM) (Value, error) {
+	if len(args) != 1 || args[0].Type != String {
+		return NullValue, fmt.Errorf("expected a string argument")
+	}
+	s := args[0].ToString()
+	matches := r.re.FindAllStringSubmatchIndex(s, -1)
+	result := make([]Value, len(matches))
+	for i, m := range matches {
+		result[i] = r.match(s, m)
+	}
+	return NewArrayValues(result), nil
+}
+
+// match returns the map with the position and the groups of a match:
+// { index, value, captures, groups } where groups has the named ones.
+// The groups that don't participate in the match are null.
+func (r *Regex) match(s string, m []int) Value {
+	names := r.re.SubexpNames()
+
+	captures := make([]Value, len(names)-1)
+	groups := NewMap(0)
+	for i := 1; i < len(names); i++ {
+		v := NullValue
+		if m[2*i] >= 0 {
+			v = NewString(s[m[2*i]:m[2*i+1]])
+		}
+		captures[i-1] = v
+		if names[i] != "" {
+			groups.ToMap().Set(names[i], v)
+		}
+	}
+
+	v := NewMap(4)
+	mv := v.ToMap()
+	mv.Set("index", NewInt(m[0]))
+	mv.Set("value", NewString(s[m[0]:m[1]]))
+	mv.Set("captures", NewArrayValues(captures))
+	mv.Set("groups", groups)
+	return v
+}
+
+// replace replaces the first match or all of them with the g flag.
+// The replacement is a string that can reference groups with $1 or
+// ${name} or a function that receives the match and returns the string.
+func (r *Regex) replace(args []Value, vm *VM) (Value, error) {
+	if len(args) != 2 || args[0].Type != String {
+		return NullValue, fmt.Errorf("expected a string and a replacement")
+	}
+	s := args[0].ToString()
+	repl := args[1]
+
+	n := 1
+	if r.global {
+		n = -1
+	}
+
+	matches := r.re.FindAllStringSubmatchIndex(s, n)
+	if len(matches) == 0 {
+		return NewString(s), nil
+	}
+
+	var b []byte
+	var last int
+	for _, m := range matches {
+		b = append(b, s[last:m[0]]...)
+		last = m[1]
+
+		switch repl.Type {
+		case String:
+			b = r.re.ExpandString(b, repl.ToString(), s, m)
+		default:
+			v, err := vm.runValue(repl, r.match(s, m))
+			if err != nil {
+				return NullValue, err
+			}
+			b = append(b, v.ToString()...)
+		}
+	}
+
+	b = append(b, s[last:]...)
+	return NewString(string(b)), nil
+}
+
+func (r *Regex) split(args []Value, vm *VM) (Value, error) {
+	if len(args) == 0 || len(args) > 2 || args[0].Type != String {
+		return NullValue, fmt.Errorf("expected a string and an optional limit")
+	}
+
+	n := -1
+	if len(args) == 2 {
+		if args[1].Type != Int {
+			return NullValue, fmt.Errorf("expected the limit to be int, got %s", args[1].TypeName())
+		}
+		n = int(args[1].ToInt())
+	}
+
+	parts := r.re.Split(args[0].ToString(), n)
+	result := make([]Value, len(parts))
+	for i, p := range parts {
+		result[i] = NewString(p)
+	}
+	return NewArrayValues(result), nil
+}
+
+func (r *Regex) toString(args []Value, vm *VM) (Value, error) {
+	return NewString(r.String()), nil
+}
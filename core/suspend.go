@@ -0,0 +1,1237 @@
+package core
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// A program can be suspended by a native, like runtime.suspend, and
+// resumed later in another process. The state contains the stack frames,
+// registers, closures and try/catch blocks and can only be resumed
+// by the same program.
+//
+// Values shared by several registers, like an array referenced by
+// two variables or the registers captured by closures, are stored
+// once so they are still shared when the program is resumed.
+
+const stateVersion = 3
+
+var stateMagic = []byte("GTSTATE")
+
+var ErrInvalidState = errors.New("invalid state")
+
+// Suspended is the error returned by Run when the program is suspended.
+type Suspended struct {
+	Value Value  // the value passed to Suspend
+	State []byte // the serialized execution to pass to Resume
+}
+
+func (s *Suspended) Error() string {
+	return "execution suspended"
+}
+
+// Suspend serializes the execution and returns a *Suspended error that
+// the native must return to stop the program. It can't be catched.
+// When the program is resumed the native call returns the input.
+func (vm *VM) Suspend(v Value) error {
+	if vm.fp == 0 {
+		return errors.New("can't suspend while initializing the program")
+	}
+
+	for i := 2; i <= vm.fp; i++ {
+		if vm.callStack[i].exit {
+			return errors.New("can't suspend inside a function called by a native")
+		}
+	}
+
+	for i := 0; i <= vm.fp; i++ {
+		if len(vm.callStack[i].finalizables) > 0 {
+			return fmt.Errorf("can't suspend in %s: it has pending finalizers", vm.frameName(i))
+		}
+	}
+
+	instr := vm.instruction()
+	switch instr.Opcode {
+	case op_cal, op_cas:
+	default:
+		return errors.New("suspend must be called as a function")
+	}
+
+	hash, err := vm.Program.stateHash()
+	if err != nil {
+		return err
+	}
+
+	e := &stateEncoder{
+		refs:      make(map[interface{}]int),
+		registers: make(map[*Register][2]int),
+	}
+
+	for i, f := range vm.Program.Functions {
+		for j, r := range f.Closures {
+			e.registers[r] = [2]int{i, j}
+		}
+	}
+
+	e.buf.Write(stateMagic)
+	e.writeInt(stateVersion)
+	e.buf.Write(hash)
+	e.writeInt(int(vm.steps))
+	e.writeInt(int(vm.allocations))
+	e.writeAddress(instr.B)
+	e.writeInt(vm.fp)
+
+	for i := 0; i <= vm.fp; i++ {
+		e.path = vm.frameName(i)
+		if err := e.writeFrame(vm.callStack[i]); err != nil {
+			return err
+		}
+	}
+
+	e.path = "try/catch"
+	e.writeInt(len(vm.tryCatchs))
+	for _, t := range vm.tryCatchs {
+		if err := e.writeTryCatch(t); err != nil {
+			return err
+		}
+	}
+
+	e.path = "suspended value"
+	if err := e.writeValue(v); err != nil {
+		return err
+	}
+
+	s := &Suspended{Value: v, State: e.buf.Bytes()}
+	vm.abort = s
+	return s
+}
+
+// Resume continues the execution of a suspended program. The native that
+// suspended it returns input. It returns the value returned by the program
+// or another *Suspended error if it is suspended again.
+func (vm *VM) Resume(state []byte, input Value) (Value, error) {
+	hash, err := vm.Program.stateHash()
+	if err != nil {
+		return NullValue, err
+	}
+
+	d := &stateDecoder{
+		r:    bytes.NewReader(state),
+		vm:   vm,
+		refs: make(map[int]interface{}),
+	}
+
+	retAddress, err := d.readState(hash)
+	if err != nil {
+		return NullValue, err
+	}
+
+	vm.initialized = true
+
+	// the suspended native returns the input
+	if retAddress != Void {
+		vm.set(retAddress, input)
+	}
+	vm.incPC(1)
+
+	// the program ends in this run so the global finalizers are called
+	vm.run(true)
+
+	for i := len(vm.callStack) - 1; i > 0; i-- {
+		vm.release(vm.callStack[i])
+	}
+
+	vm.tryCatchs = nil
+	vm.fp = 0
+
+	if vm.Error != nil && vm.Error != io.EOF {
+		return NullValue, vm.Error
+	}
+
+	return vm.RetValue, nil
+}
+
+func (vm *VM) frameName(i int) string {
+	if i == 0 {
+		return "globals"
+	}
+	return "function " + vm.Program.Functions[vm.callStack[i].funcIndex].Name
+}
+
+// stateHash identifies the program by its disassembly so a state can't
+// be resumed by a different version.
+func (p *Program) stateHash() ([]byte, error) {
+	h := sha256.New()
+	if err := Disassemble(h, p); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// value tags
+const (
+	stNull byte = iota
+	stUndefined
+	stInt
+	stFloat
+	stBool
+	stString
+	stBytes
+	stRune
+	stArray
+	stMap
+	stFunc
+	stNativeFunc
+	stClosure
+	stMethod
+	stNativePrototype
+	stError
+	stRef
+	stIterator
+	stRegex
+)
+
+type stateEncoder struct {
+	buf       bytes.Buffer
+	refs      map[interface{}]int
+	registers map[*Register][2]int
+	path      string
+}
+
+func (e *stateEncoder) writeInt(i int) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(b[:], int64(i))
+	e.buf.Write(b[:n])
+}
+
+func (e *stateEncoder) writeBool(v bool) {
+	if v {
+		e.buf.WriteByte(1)
+	} else {
+		e.buf.WriteByte(0)
+	}
+}
+
+func (e *stateEncoder) writeBytes(b []byte) {
+	e.writeInt(len(b))
+	e.buf.Write(b)
+}
+
+func (e *stateEncoder) writeAddress(a *Address) {
+	if a == nil {
+		e.buf.WriteByte(0)
+		return
+	}
+	if a == Void {
+		e.buf.WriteByte(1)
+		return
+	}
+	e.buf.WriteByte(2)
+	e.buf.WriteByte(byte(a.Kind))
+	e.writeInt(int(a.Value))
+}
+
+// writeRef writes a reference if the object has already been written and
+// returns true. Otherwise it assigns it an id.
+func (e *stateEncoder) writeRef(key interface{}) bool {
+	if id, ok := e.refs[key]; ok {
+		e.buf.WriteByte(stRef)
+		e.writeInt(id)
+		return true
+	}
+	e.refs[key] = len(e.refs)
+	return false
+}
+
+func (e *stateEncoder) writeFrame(f *stackFrame) error {
+	e.writeInt(f.funcIndex)
+	e.writeInt(f.pc)
+	e.writeInt(f.maxRegIndex)
+	e.writeAddress(f.retAddress)
+	e.writeBool(f.retValueSet)
+	e.writeBool(f.exit)
+	e.writeInt(int(f.allocations))
+
+	if err := e.writeValue(f.retValue); err != nil {
+		return err
+	}
+
+	if err := e.writeValues(f.values); err != nil {
+		return err
+	}
+
+	e.writeInt(len(f.closures))
+	for _, c := range f.closures {
+		if err := e.writeClosureRegister(c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeValues writes the registers of a frame that can be shared
+// with the closures created in it.
+func (e *stateEncoder) writeValues(values []Value) error {
+	if len(values) > 0 && e.writeRef(&values[0]) {
+		return nil
+	}
+
+	e.buf.WriteByte(stArray)
+	e.writeInt(len(values))
+	for _, v := range values {
+		if err := e.writeValue(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *stateEncoder) writeClosureRegister(c *closureRegister) error {
+	if e.writeRef(c) {
+		return nil
+	}
+
+	r, ok := e.registers[c.register]
+	if !ok {
+		return fmt.Errorf("can't suspend in %s: unknown closure register %s", e.path, c.register.Name)
+	}
+
+	e.buf.WriteByte(stClosure)
+	e.writeInt(r[0])
+	e.writeInt(r[1])
+	return e.writeValues(c.values)
+}
+
+func (e *stateEncoder) writeTryCatch(t *tryCatch) error {
+	e.writeInt(t.catchPC)
+	e.writeAddress(t.errorReg)
+	e.writeInt(t.finallyPC)
+	e.writeInt(t.fp)
+	e.writeInt(t.retPC)
+	e.writeBool(t.catchExecuted)
+	e.writeBool(t.finallyExecuted)
+
+	if t.err == nil {
+		e.writeBool(false)
+		return nil
+	}
+
+	e.writeBool(true)
+
+	return e.writeValue(NewObject(causeError(t.err)))
+}
+
+func (e *stateEncoder) writeValue(v Value) error {
+	switch v.Type {
+	case Null:
+		e.buf.WriteByte(stNull)
+	case Undefined:
+		e.buf.WriteByte(stUndefined)
+	case Int:
+		e.buf.WriteByte(stInt)
+		e.writeInt(int(v.ToInt()))
+	case Float:
+		e.buf.WriteByte(stFloat)
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(v.ToFloat()))
+		e.buf.Write(b[:])
+	case Bool:
+		e.buf.WriteByte(stBool)
+		e.writeBool(v.ToBool())
+	case String:
+		e.buf.WriteByte(stString)
+		e.writeBytes([]byte(v.ToString()))
+	case Bytes:
+		e.buf.WriteByte(stBytes)
+		e.writeBytes(v.ToBytes())
+	case Rune:
+		e.buf.WriteByte(stRune)
+		e.writeInt(int(v.ToRune()))
+	case Func:
+		e.buf.WriteByte(stFunc)
+		e.writeInt(v.ToFunction())
+	case NativeFunc:
+		// the index of natives can change between processes
+		e.buf.WriteByte(stNativeFunc)
+		e.writeBytes([]byte(allNativeFuncs[v.ToNativeFunction()].Name))
+	case Array:
+		a := v.ToArrayObject()
+		if e.writeRef(a) {
+			return nil
+		}
+		e.buf.WriteByte(stArray)
+		e.writeInt(len(a.Array))
+		for _, item := range a.Array {
+			if err := e.writeValue(item); err != nil {
+				return err
+			}
+		}
+	case Map:
+		m := v.ToMap()
+		if e.writeRef(m) {
+			return nil
+		}
+		m.Mutex.RLock()
+		defer m.Mutex.RUnlock()
+		e.buf.WriteByte(stMap)
+		e.writeInt(len(m.Map))
+		for _, k := range m.Keys() {
+			e.writeBytes([]byte(k))
+			if err := e.writeValue(m.Map[k]); err != nil {
+				return err
+			}
+		}
+	case Object:
+		return e.writeObject(v.ToObject())
+	default:
+		return fmt.Errorf("can't suspend in %s: values of type %s can't be serialized", e.path, v.TypeName())
+	}
+	return nil
+}
+
+func (e *stateEncoder) writeObject(o interface{}) error {
+	switch t := o.(type) {
+	case Closure:
+		e.buf.WriteByte(stClosure)
+		e.writeInt(t.funcIndex)
+		e.writeInt(len(t.closures))
+		for _, c := range t.closures {
+			if err := e.writeClosureRegister(c); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case method:
+		e.buf.WriteByte(stMethod)
+		e.writeInt(t.fn)
+		return e.writeValue(t.this)
+
+	case nativePrototype:
+		e.buf.WriteByte(stNativePrototype)
+		e.writeBytes([]byte(allNativeFuncs[t.fn].Name))
+		return e.writeValue(t.this)
+
+	case *valuesIterator:
+		e.buf.WriteByte(stIterator)
+		e.writeInt(t.length)
+		e.writeInt(t.index)
+		return e.writeValue(Value{Type: Array, object: t.array})
+
+	case *Regex:
+		e.buf.WriteByte(stRegex)
+		e.writeBytes([]byte(t.String()))
+		return nil
+
+	case Error:
+		e.buf.WriteByte(stError)
+		return e.writeError(t)
+
+	default:
+		name := fmt.Sprintf("%T", o)
+		if n, ok := o.(NamedType); ok {
+			name = n.Type()
+		}
+		return fmt.Errorf("can't suspend in %s: values of type %s can't be serialized", e.path, name)
+	}
+}
+
+// writeError writes an error with its stack trace and its chain. The Go
+// error returned by a native is written as an Error with its message and
+// code, so errors.is still matches the code but not the Go value.
+func (e *stateEncoder) writeError(t Error) error {
+	e.writeBytes([]byte(t.message))
+	e.writeBool(t.public)
+	e.writeBytes([]byte(t.code))
+	e.writeInt(t.pc)
+	if err := e.writeValue(t.data); err != nil {
+		return err
+	}
+	if err := e.writeValue(t.value); err != nil {
+		return err
+	}
+
+	e.writeInt(len(t.stacktrace))
+	for _, s := range t.stacktrace {
+		e.writeBytes([]byte(s.Function))
+		e.writeBytes([]byte(s.File))
+		e.writeInt(s.Line)
+		e.writeInt(s.Column)
+		e.writeBytes([]byte(s.Source))
+		e.writeBytes([]byte(s.Boundary))
+	}
+
+	if t.cause == nil {
+		e.writeBool(false)
+	} else {
+		e.writeBool(true)
+		if err := e.writeError(causeError(t.cause)); err != nil {
+			return err
+		}
+	}
+
+	e.writeInt(len(t.wraped))
+	for _, w := range t.wraped {
+		if err := e.writeError(w); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type stateDecoder struct {
+	r    *bytes.Reader
+	vm   *VM
+	refs map[int]interface{}
+}
+
+func (d *stateDecoder) readState(hash []byte) (*Address, error) {
+	magic := make([]byte, len(stateMagic))
+	if _, err := io.ReadFull(d.r, magic); err != nil || !bytes.Equal(magic, stateMagic) {
+		return nil, ErrInvalidState
+	}
+
+	version, err := d.readInt()
+	if err != nil {
+		return nil, err
+	}
+	if version != stateVersion {
+		return nil, fmt.Errorf("unsupported state version %d", version)
+	}
+
+	h := make([]byte, len(hash))
+	if _, err := io.ReadFull(d.r, h); err != nil {
+		return nil, ErrInvalidState
+	}
+	if !bytes.Equal(h, hash) {
+		return nil, errors.New("the state belongs to a different program")
+	}
+
+	steps, err := d.readInt()
+	if err != nil {
+		return nil, err
+	}
+
+	allocations, err := d.readInt()
+	if err != nil {
+		return nil, err
+	}
+
+	retAddress, err := d.readAddress()
+	if err != nil {
+		return nil, err
+	}
+
+	fp, err := d.readInt()
+	if err != nil {
+		return nil, err
+	}
+	if fp < 1 || fp > d.r.Len() {
+		return nil, ErrInvalidState
+	}
+
+	frames := make([]*stackFrame, fp+1)
+	for i := range frames {
+		f, err := d.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		frames[i] = f
+	}
+
+	n, err := d.readInt()
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 || n > d.r.Len() {
+		return nil, ErrInvalidState
+	}
+
+	tryCatchs := make([]*tryCatch, n)
+	for i := range tryCatchs {
+		t, err := d.readTryCatch()
+		if err != nil {
+			return nil, err
+		}
+		if t.fp > fp {
+			return nil, ErrInvalidState
+		}
+		tryCatchs[i] = t
+	}
+
+	// the suspended value is not needed to resume
+	if _, err := d.readValue(); err != nil {
+		return nil, err
+	}
+
+	if d.r.Len() != 0 {
+		return nil, ErrInvalidState
+	}
+
+	// the state can be edited so check that the VM can't panic
+	if err := d.validate(frames, tryCatchs, retAddress); err != nil {
+		return nil, err
+	}
+
+	// the values held by globals are already accounted globally
+	for _, v := range frames[0].values {
+		escape(v)
+	}
+
+	d.vm.callStack = frames
+	d.vm.fp = fp
+	d.vm.tryCatchs = tryCatchs
+	d.vm.steps = int64(steps)
+	d.vm.allocations = int64(allocations)
+	d.vm.Error = nil
+	d.vm.RetValue = NullValue
+
+	return retAddress, nil
+}
+
+// validate checks the frames and the try catch blocks against their functions.
+func (d *stateDecoder) validate(frames []*stackFrame, tryCatchs []*tryCatch, retAddress *Address) error {
+	p := d.vm.Program
+
+	closures, err := closureCounts(p)
+	if err != nil {
+		return err
+	}
+
+	for i, f := range frames {
+		fn := p.Functions[f.funcIndex]
+
+		// the global frame is the only one of the global function
+		if (i == 0) != (f.funcIndex == 0) {
+			return ErrInvalidState
+		}
+
+		if len(f.values) != fn.MaxRegIndex {
+			return ErrInvalidState
+		}
+
+		if i > 0 && f.maxRegIndex != fn.MaxRegIndex {
+			return ErrInvalidState
+		}
+
+		if len(f.closures) < closures[f.funcIndex] {
+			return ErrInvalidState
+		}
+
+		if !validAddress(f.retAddress, frames[0], f) {
+			return ErrInvalidState
+		}
+	}
+
+	top := frames[len(frames)-1]
+	if !validAddress(retAddress, frames[0], top) {
+		return ErrInvalidState
+	}
+
+	for _, t := range tryCatchs {
+		if t.fp < 0 {
+			return ErrInvalidState
+		}
+
+		f := frames[t.fp]
+		n := len(p.Functions[f.funcIndex].Instructions)
+
+		if t.catchPC < -1 || t.catchPC >= n ||
+			t.finallyPC < -1 || t.finallyPC >= n ||
+			t.retPC < -1 || t.retPC > n {
+			return ErrInvalidState
+		}
+
+		if !validAddress(t.errorReg, frames[0], f) {
+			return ErrInvalidState
+		}
+	}
+
+	return nil
+}
+
+// validAddress returns true if the register a exists in the frame f.
+func validAddress(a *Address, global, f *stackFrame) bool {
+	if a == nil {
+		return true
+	}
+
+	var max int
+
+	switch a.Kind {
+	case AddrVoid:
+		return true
+	case AddrLocal:
+		max = len(f.values)
+	case AddrGlobal:
+		max = len(global.values)
+	case AddrClosure:
+		max = len(f.closures)
+	default:
+		return false
+	}
+
+	return a.Value >= 0 && int(a.Value) < max
+}
+
+func (d *stateDecoder) readInt() (int, error) {
+	i, err := binary.ReadVarint(d.r)
+	if err != nil {
+		return 0, ErrInvalidState
+	}
+	return int(i), nil
+}
+
+func (d *stateDecoder) readBool() (bool, error) {
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return false, ErrInvalidState
+	}
+	return b == 1, nil
+}
+
+func (d *stateDecoder) readBytes() ([]byte, error) {
+	n, err := d.readInt()
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 || n > d.r.Len() {
+		return nil, ErrInvalidState
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		return nil, ErrInvalidState
+	}
+	return b, nil
+}
+
+func (d *stateDecoder) readAddress() (*Address, error) {
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return nil, ErrInvalidState
+	}
+
+	switch b {
+	case 0:
+		return nil, nil
+	case 1:
+		return Void, nil
+	}
+
+	kind, err := d.r.ReadByte()
+	if err != nil {
+		return nil, ErrInvalidState
+	}
+
+	v, err := d.readInt()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewAddress(AddressKind(kind), v), nil
+}
+
+func (d *stateDecoder) readFuncIndex() (int, error) {
+	i, err := d.readInt()
+	if err != nil {
+		return 0, err
+	}
+	if i < 0 || i >= len(d.vm.Program.Functions) {
+		return 0, ErrInvalidState
+	}
+	return i, nil
+}
+
+func (d *stateDecoder) readNative() (int, error) {
+	name, err := d.readBytes()
+	if err != nil {
+		return 0, err
+	}
+	f, ok := allNativeMap[string(name)]
+	if !ok {
+		return 0, fmt.Errorf("native function %s not found", name)
+	}
+	return f.Index, nil
+}
+
+func (d *stateDecoder) readFrame() (*stackFrame, error) {
+	f := &stackFrame{}
+
+	var err error
+
+	if f.funcIndex, err = d.readFuncIndex(); err != nil {
+		return nil, err
+	}
+	if f.pc, err = d.readInt(); err != nil {
+		return nil, err
+	}
+	if f.pc < 0 || f.pc >= len(d.vm.Program.Functions[f.funcIndex].Instructions) {
+		return nil, ErrInvalidState
+	}
+	if f.maxRegIndex, err = d.readInt(); err != nil {
+		return nil, err
+	}
+	if f.retAddress, err = d.readAddress(); err != nil {
+		return nil, err
+	}
+	if f.retValueSet, err = d.readBool(); err != nil {
+		return nil, err
+	}
+	if f.exit, err = d.readBool(); err != nil {
+		return nil, err
+	}
+
+	allocations, err := d.readInt()
+	if err != nil {
+		return nil, err
+	}
+	f.allocations = int64(allocations)
+
+	if f.retValue, err = d.readValue(); err != nil {
+		return nil, err
+	}
+
+	if f.values, err = d.readValues(); err != nil {
+		return nil, err
+	}
+
+	n, err := d.readInt()
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 || n > d.r.Len() {
+		return nil, ErrInvalidState
+	}
+
+	f.closures = make([]*closureRegister, n)
+	for i := range f.closures {
+		if f.closures[i], err = d.readClosureRegister(); err != nil {
+			return nil, err
+		}
+	}
+
+	return f, nil
+}
+
+func (d *stateDecoder) readValues() ([]Value, error) {
+	tag, err := d.r.ReadByte()
+	if err != nil {
+		return nil, ErrInvalidState
+	}
+
+	switch tag {
+	case stRef:
+		values, ok := d.ref().([]Value)
+		if !ok {
+			return nil, ErrInvalidState
+		}
+		return values, nil
+
+	case stArray:
+		n, err := d.readInt()
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 || n > d.r.Len() {
+			return nil, ErrInvalidState
+		}
+		values := make([]Value, n)
+		if n > 0 {
+			d.refs[len(d.refs)] = values
+		}
+		for i := range values {
+			if values[i], err = d.readValue(); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+
+	default:
+		return nil, ErrInvalidState
+	}
+}
+
+// ref reads the id of an object already decoded.
+func (d *stateDecoder) ref() interface{} {
+	id, err := d.readInt()
+	if err != nil {
+		return nil
+	}
+	return d.refs[id]
+}
+
+func (d *stateDecoder) readClosureRegister() (*closureRegister, error) {
+	tag, err := d.r.ReadByte()
+	if err != nil {
+		return nil, ErrInvalidState
+	}
+
+	switch tag {
+	case stRef:
+		c, ok := d.ref().(*closureRegister)
+		if !ok {
+			return nil, ErrInvalidState
+		}
+		return c, nil
+
+	case stClosure:
+		c := &closureRegister{}
+		d.refs[len(d.refs)] = c
+
+		fn, err := d.readFuncIndex()
+		if err != nil {
+			return nil, err
+		}
+
+		i, err := d.readInt()
+		if err != nil {
+			return nil, err
+		}
+
+		closures := d.vm.Program.Functions[fn].Closures
+		if i < 0 || i >= len(closures) {
+			return nil, ErrInvalidState
+		}
+		c.register = closures[i]
+
+		if c.values, err = d.readValues(); err != nil {
+			return nil, err
+		}
+
+		if c.register.Index >= len(c.values) {
+			return nil, ErrInvalidState
+		}
+		return c, nil
+
+	default:
+		return nil, ErrInvalidState
+	}
+}
+
+func (d *stateDecoder) readTryCatch() (*tryCatch, error) {
+	t := &tryCatch{}
+
+	var err error
+
+	if t.catchPC, err = d.readInt(); err != nil {
+		return nil, err
+	}
+	if t.errorReg, err = d.readAddress(); err != nil {
+		return nil, err
+	}
+	if t.finallyPC, err = d.readInt(); err != nil {
+		return nil, err
+	}
+	if t.fp, err = d.readInt(); err != nil {
+		return nil, err
+	}
+	if t.retPC, err = d.readInt(); err != nil {
+		return nil, err
+	}
+	if t.catchExecuted, err = d.readBool(); err != nil {
+		return nil, err
+	}
+	if t.finallyExecuted, err = d.readBool(); err != nil {
+		return nil, err
+	}
+
+	hasErr, err := d.readBool()
+	if err != nil {
+		return nil, err
+	}
+
+	if hasErr {
+		v, err := d.readValue()
+		if err != nil {
+			return nil, err
+		}
+		e, ok := v.ToObjectOrNil().(Error)
+		if !ok {
+			return nil, ErrInvalidState
+		}
+		t.err = e
+	}
+
+	return t, nil
+}
+
+func (d *stateDecoder) readError() (Error, error) {
+	var e Error
+
+	msg, err := d.readBytes()
+	if err != nil {
+		return e, err
+	}
+	e.message = string(msg)
+
+	if e.public, err = d.readBool(); err != nil {
+		return e, err
+	}
+
+	code, err := d.readBytes()
+	if err != nil {
+		return e, err
+	}
+	e.code = string(code)
+
+	if e.pc, err = d.readInt(); err != nil {
+		return e, err
+	}
+	if e.data, err = d.readValue(); err != nil {
+		return e, err
+	}
+	if e.value, err = d.readValue(); err != nil {
+		return e, err
+	}
+
+	n, err := d.readInt()
+	if err != nil {
+		return e, err
+	}
+	if n < 0 || n > d.r.Len() {
+		return e, ErrInvalidState
+	}
+	for i := 0; i < n; i++ {
+		var s TraceLine
+		b, err := d.readBytes()
+		if err != nil {
+			return e, err
+		}
+		s.Function = string(b)
+		if b, err = d.readBytes(); err != nil {
+			return e, err
+		}
+		s.File = string(b)
+		if s.Line, err = d.readInt(); err != nil {
+			return e, err
+		}
+		if s.Column, err = d.readInt(); err != nil {
+			return e, err
+		}
+		if b, err = d.readBytes(); err != nil {
+			return e, err
+		}
+		s.Source = string(b)
+		if b, err = d.readBytes(); err != nil {
+			return e, err
+		}
+		s.Boundary = string(b)
+		e.stacktrace = append(e.stacktrace, s)
+	}
+
+	hasCause, err := d.readBool()
+	if err != nil {
+		return e, err
+	}
+	if hasCause {
+		cause, err := d.readError()
+		if err != nil {
+			return e, err
+		}
+		e.cause = cause
+	}
+
+	if n, err = d.readInt(); err != nil {
+		return e, err
+	}
+	if n < 0 || n > d.r.Len() {
+		return e, ErrInvalidState
+	}
+	for i := 0; i < n; i++ {
+		w, err := d.readError()
+		if err != nil {
+			return e, err
+		}
+		e.wraped = append(e.wraped, w)
+	}
+
+	return e, nil
+}
+
+func (d *stateDecoder) readValue() (Value, error) {
+	tag, err := d.r.ReadByte()
+	if err != nil {
+		return NullValue, ErrInvalidState
+	}
+
+	switch tag {
+	case stNull:
+		return NullValue, nil
+
+	case stUndefined:
+		return UndefinedValue, nil
+
+	case stInt:
+		i, err := d.readInt()
+		return NewInt(i), err
+
+	case stFloat:
+		var b [8]byte
+		if _, err := io.ReadFull(d.r, b[:]); err != nil {
+			return NullValue, ErrInvalidState
+		}
+		return NewFloat(math.Float64frombits(binary.LittleEndian.Uint64(b[:]))), nil
+
+	case stBool:
+		b, err := d.readBool()
+		return NewBool(b), err
+
+	case stString:
+		b, err := d.readBytes()
+		return NewString(string(b)), err
+
+	case stBytes:
+		b, err := d.readBytes()
+		return NewBytes(b), err
+
+	case stRune:
+		i, err := d.readInt()
+		return NewRune(rune(i)), err
+
+	case stFunc:
+		i, err := d.readFuncIndex()
+		return NewFunction(i), err
+
+	case stNativeFunc:
+		i, err := d.readNative()
+		return NewNativeFunction(i), err
+
+	case stRef:
+		switch t := d.ref().(type) {
+		case *NewArrayObject:
+			return Value{Type: Array, object: t}, nil
+		case *MapValue:
+			return Value{Type: Map, object: t}, nil
+		default:
+			return NullValue, ErrInvalidState
+		}
+
+	case stArray:
+		n, err := d.readInt()
+		if err != nil {
+			return NullValue, err
+		}
+		if n < 0 || n > d.r.Len() {
+			return NullValue, ErrInvalidState
+		}
+		a := &NewArrayObject{Array: make([]Value, n)}
+		d.refs[len(d.refs)] = a
+		for i := range a.Array {
+			if a.Array[i], err = d.readValue(); err != nil {
+				return NullValue, err
+			}
+		}
+		return Value{Type: Array, object: a}, nil
+
+	case stMap:
+		n, err := d.readInt()
+		if err != nil {
+			return NullValue, err
+		}
+		if n < 0 || n > d.r.Len() {
+			return NullValue, ErrInvalidState
+		}
+		m := newMapValue(make(map[string]Value, n))
+		d.refs[len(d.refs)] = m
+		for i := 0; i < n; i++ {
+			k, err := d.readBytes()
+			if err != nil {
+				return NullValue, err
+			}
+			v, err := d.readValue()
+			if err != nil {
+				return NullValue, err
+			}
+			m.Set(string(k), v)
+		}
+		return Value{Type: Map, object: m}, nil
+
+	case stClosure:
+		fn, err := d.readFuncIndex()
+		if err != nil {
+			return NullValue, err
+		}
+		n, err := d.readInt()
+		if err != nil {
+			return NullValue, err
+		}
+		if n < 0 || n > d.r.Len() {
+			return NullValue, ErrInvalidState
+		}
+		c := Closure{funcIndex: fn, closures: make([]*closureRegister, n)}
+		for i := range c.closures {
+			if c.closures[i], err = d.readClosureRegister(); err != nil {
+				return NullValue, err
+			}
+		}
+		return NewObject(c), nil
+
+	case stMethod:
+		fn, err := d.readFuncIndex()
+		if err != nil {
+			return NullValue, err
+		}
+		this, err := d.readValue()
+		if err != nil {
+			return NullValue, err
+		}
+		return NewObject(method{this: this, fn: fn}), nil
+
+	case stNativePrototype:
+		fn, err := d.readNative()
+		if err != nil {
+			return NullValue, err
+		}
+		this, err := d.readValue()
+		if err != nil {
+			return NullValue, err
+		}
+		return NewObject(nativePrototype{this: this, fn: fn}), nil
+
+	case stError:
+		e, err := d.readError()
+		if err != nil {
+			return NullValue, err
+		}
+		return NewObject(e), nil
+
+	case stIterator:
+		length, err := d.readInt()
+		if err != nil {
+			return NullValue, err
+		}
+		index, err := d.readInt()
+		if err != nil {
+			return NullValue, err
+		}
+		a, err := d.readValue()
+		if err != nil {
+			return NullValue, err
+		}
+		if a.Type != Array {
+			return NullValue, ErrInvalidState
+		}
+		return NewObject(&valuesIterator{array: a.ToArrayObject(), length: length, index: index}), nil
+
+	case stRegex:
+		b, err := d.readBytes()
+		if err != nil {
+			return NullValue, err
+		}
+		r, err := ParseRegex(string(b))
+		if err != nil {
+			return NullValue, ErrInvalidState
+		}
+		return NewObject(r), nil
+
+	default:
+		return NullValue, ErrInvalidState
+	}
+}
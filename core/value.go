@@ -1,8 +1,10 @@
 package core
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"strconv"
 	"sync"
 	"unicode/utf8"
@@ -133,29 +135,81 @@ func NewObject(v interface{}) Value {
 }
 
 type NewArrayObject struct {
-	Array []Value
+	Array  []Value
+	global bool        // if it escaped the function that created it
+	race   *raceShadow // the last accesses if the race detector is enabled
 }
 
 func NewArray(size int) Value {
-	a := NewArrayObject{make([]Value, size)}
+	a := NewArrayObject{Array: make([]Value, size)}
 	return Value{Type: Array, object: &a}
 }
 
 func NewArrayValues(v []Value) Value {
-	a := NewArrayObject{v}
+	a := NewArrayObject{Array: v}
 	return Value{Type: Array, object: &a}
 }
 
+// MapValue is a map that remembers the order in which the keys were
+// added, like javascript objects. Map can be read directly but it must
+// be modified with Set, Delete and Clear to keep the order.
 type MapValue struct {
-	Map   map[string]Value
-	Mutex *sync.RWMutex
+	Map    map[string]Value
+	Mutex  *sync.RWMutex
+	keys   []string
+	global bool        // if it escaped the function that created it
+	race   *raceShadow // the last accesses if the race detector is enabled
 }
 
+// newMapValue wraps a Go map. Its keys are sorted because Go maps
+// have no order.
 func newMapValue(m map[string]Value) *MapValue {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
 	return &MapValue{
 		Map:   m,
 		Mutex: &sync.RWMutex{},
+		keys:  keys,
+	}
+}
+
+// Keys returns the keys in insertion order. The slice must not be modified.
+func (m *MapValue) Keys() []string {
+	return m.keys
+}
+
+// Set adds or replaces a value. New keys go to the end.
+func (m *MapValue) Set(key string, v Value) {
+	if _, ok := m.Map[key]; !ok {
+		m.keys = append(m.keys, key)
+	}
+	m.Map[key] = v
+}
+
+// Delete removes a key. It is O(n) to keep the order of the rest.
+func (m *MapValue) Delete(key string) {
+	if _, ok := m.Map[key]; !ok {
+		return
+	}
+	delete(m.Map, key)
+	for i, k := range m.keys {
+		if k == key {
+			m.keys = append(m.keys[:i], m.keys[i+1:]...)
+			break
+		}
+	}
+}
+
+// Clear removes all the keys.
+func (m *MapValue) Clear() {
+	for k := range m.Map {
+		delete(m.Map, k)
 	}
+	m.keys = nil
 }
 
 func NewMap(size int) Value {
@@ -209,8 +263,66 @@ func (v Value) ToString() string {
 	}
 }
 
+// MarshalJSON writes the keys of maps in insertion order.
 func (v Value) MarshalJSON() ([]byte, error) {
-	return json.Marshal(v.Export(0))
+	var b bytes.Buffer
+	if err := v.writeJSON(&b, 0); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (v Value) writeJSON(b *bytes.Buffer, recursionLevel int) error {
+	if recursionLevel > MAX_EXPORT_RECURSION {
+		return fmt.Errorf("max recursion exceeded")
+	}
+	recursionLevel++
+
+	switch v.Type {
+	case Array:
+		b.WriteByte('[')
+		for i, item := range v.ToArray() {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			if err := item.writeJSON(b, recursionLevel); err != nil {
+				return err
+			}
+		}
+		b.WriteByte(']')
+		return nil
+
+	case Map:
+		m := v.ToMap()
+		m.Mutex.RLock()
+		defer m.Mutex.RUnlock()
+
+		b.WriteByte('{')
+		for i, k := range m.keys {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			key, err := json.Marshal(k)
+			if err != nil {
+				return err
+			}
+			b.Write(key)
+			b.WriteByte(':')
+			if err := m.Map[k].writeJSON(b, recursionLevel); err != nil {
+				return err
+			}
+		}
+		b.WriteByte('}')
+		return nil
+
+	default:
+		data, err := json.Marshal(v.Export(recursionLevel))
+		if err != nil {
+			return err
+		}
+		b.Write(data)
+		return nil
+	}
 }
 
 func (v Value) TypeName() string {
@@ -413,50 +525,38 @@ func (v Value) ToObjectOrNil() interface{} {
 	return v.object
 }
 
+// Size returns an estimation of the memory used by the value. Arrays and
+// maps only count their slots because the elements are accounted when
+// they are added.
 func (v Value) Size() int {
 	switch v.Type {
 	case String:
 		return len(v.object.(string))
+	case Bytes:
+		return len(v.object.([]byte))
+	case Array:
+		return len(v.ToArrayObject().Array)
+	case Map:
+		m := v.object.(*MapValue)
+		m.Mutex.RLock()
+		n := len(m.Map)
+		m.Mutex.RUnlock()
+		return n
+	case Object:
+		if a, ok := v.object.(Allocator); ok {
+			return a.Size()
+		}
+		return 1
 	default:
-		// because of recursive dangers: an array or map that contains itself
 		return 1
 	}
-
-	// switch v.Type {
-	// case NullType, IntType, FloatType, BoolType, FunctionType, NativeFunctionType,
-	// 	UndefinedType, RuneType:
-	// 	return 1
-	// case StringType:
-	// 	return len(v.ToString())
-	// case BytesType:
-	// 	return len(v.ToBytes())
-	// case ArrayType:
-	// 	var i int
-	// 	for _, v := range v.ToArray() {
-	// 		i += v.Size()
-	// 	}
-	// 	return i
-	// case MapType:
-	// 	var i int
-	// 	m := v.ToMap()
-	// 	m.Mutex.RLock()
-	// 	for _, v := range m.Map {
-	// 		i += v.Size()
-	// 	}
-	// 	m.Mutex.RUnlock()
-	// 	return i
-	// case ObjectType:
-	// 	if a, ok := v.Obj.(Allocator); ok {
-	// 		return a.Size()
-	// 	}
-	// 	return 1
-	// default:
-	// 	panic("unknown type: " + v.Type.String())
-	// }
 }
 
 const MAX_EXPORT_RECURSION = 200
 
+// Export converts the value to Go types. Maps are exported as Go maps
+// so they lose the order of the keys: use MarshalJSON or MapValue.Keys
+// when it matters.
 func (v Value) Export(recursionLevel int) interface{} {
 	if recursionLevel > MAX_EXPORT_RECURSION {
 		fmt.Println("[Export Error: max recursion exceeded]", recursionLevel)
@@ -548,6 +648,12 @@ func (v Value) StrictEquals(other Value) bool {
 		return false
 	}
 
+	if t1 == Object {
+		if e, ok := v.object.(Equaler); ok {
+			return e.Equal(other)
+		}
+	}
+
 	switch t1 {
 	case Int:
 		return v.ToInt() == other.ToInt()
@@ -576,6 +682,17 @@ func (v Value) Equals(other Value) bool {
 	t1 := v.Type
 	t2 := other.Type
 
+	if t1 == Object {
+		if e, ok := v.object.(Equaler); ok {
+			return e.Equal(other)
+		}
+	}
+	if t2 == Object {
+		if e, ok := other.object.(Equaler); ok {
+			return e.Equal(v)
+		}
+	}
+
 	if t1 != t2 {
 		switch t1 {
 
@@ -677,6 +794,19 @@ func (v Value) Equals(other Value) bool {
 	}
 }
 
+// Operand is implemented by native objects that support the arithmetic
+// operators and the comparisons < and <=, like decimals. The object
+// can be either a or b.
+type Operand interface {
+	Operate(op string, a, b Value, vm *VM) (Value, error)
+}
+
+// Equaler is implemented by native objects that can be equal to
+// other values, like decimals.
+type Equaler interface {
+	Equal(v Value) bool
+}
+
 type Callable interface {
 	GetMethod(name string) NativeMethod
 }
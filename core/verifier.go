@@ -0,0 +1,424 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+)
+
+// VerifyError is returned by Verify when a program would not run safely.
+type VerifyError struct {
+	Function    string
+	PC          int
+	Instruction *Instruction
+	Message     string
+}
+
+func (e *VerifyError) Error() string {
+	if e.Instruction == nil {
+		return fmt.Sprintf("invalid program: function %s: %s", e.Function, e.Message)
+	}
+	return fmt.Sprintf("invalid program: function %s, pc %d (%v): %s", e.Function, e.PC, e.Instruction, e.Message)
+}
+
+// operand is what an instruction does with each address.
+type operand byte
+
+const (
+	opUnused      operand = iota
+	opRead                // a value read with vm.get
+	opWrite               // a register written with vm.set
+	opReadOrVoid          // opRead or Void
+	opWriteOrVoid         // opWrite or Void
+	opConstant            // a constant index
+	opFunc                // a function index
+	opData                // a literal value
+	opDataOrVoid          // opData or Void
+)
+
+var operands = [...][3]operand{
+	op_ldk: {opWrite, opConstant, opUnused},
+	op_mov: {opWrite, opRead, opUnused},
+	op_mob: {opWrite, opRead, opWrite},
+	op_add: {opWrite, opRead, opRead},
+	op_sub: {opWrite, opRead, opRead},
+	op_mul: {opWrite, opRead, opRead},
+	op_div: {opWrite, opRead, opRead},
+	op_mod: {opWrite, opRead, opRead},
+	op_bor: {opWrite, opRead, opRead},
+	op_and: {opWrite, opRead, opRead},
+	op_xor: {opWrite, opRead, opRead},
+	op_lsh: {opWrite, opRead, opRead},
+	op_rsh: {opWrite, opRead, opRead},
+	op_inc: {opWrite, opUnused, opUnused},
+	op_dec: {opWrite, opUnused, opUnused},
+	op_unm: {opWrite, opRead, opUnused},
+	op_not: {opWrite, opRead, opUnused},
+	op_bnt: {opWrite, opRead, opUnused},
+	op_new: {opRead, opWrite, opReadOrVoid},
+	op_nes: {opRead, opWrite, opRead},
+	op_arr: {opWrite, opData, opDataOrVoid},
+	op_map: {opWrite, opData, opUnused},
+	op_key: {opWrite, opRead, opUnused},
+	op_val: {opWrite, opRead, opUnused},
+	op_len: {opWrite, opRead, opUnused},
+	op_get: {opWrite, opRead, opRead},
+	op_set: {opRead, opRead, opRead},
+	op_spa: {opWrite, opUnused, opUnused},
+	op_jmp: {opDataOrVoid, opUnused, opUnused},
+	op_jpb: {opDataOrVoid, opUnused, opUnused},
+	op_ejp: {opRead, opRead, opDataOrVoid},
+	op_djp: {opRead, opRead, opDataOrVoid},
+	op_tjp: {opRead, opDataOrVoid, opDataOrVoid},
+	op_eql: {opWrite, opRead, opRead},
+	op_neq: {opWrite, opRead, opRead},
+	op_seq: {opWrite, opRead, opRead},
+	op_sne: {opWrite, opRead, opRead},
+	op_lst: {opWrite, opRead, opRead},
+	op_lse: {opWrite, opRead, opRead},
+	op_cal: {opRead, opWriteOrVoid, opReadOrVoid},
+	op_cas: {opRead, opWriteOrVoid, opRead},
+	op_rnp: {opWriteOrVoid, opRead, opUnused},
+	op_ret: {opReadOrVoid, opUnused, opUnused},
+	op_clo: {opWrite, opFunc, opUnused},
+	op_trw: {opRead, opUnused, opUnused},
+	op_try: {opDataOrVoid, opWriteOrVoid, opUnused},
+	op_tre: {opUnused, opUnused, opUnused},
+	op_cen: {opUnused, opUnused, opUnused},
+	op_fen: {opUnused, opUnused, opUnused},
+	op_trx: {opUnused, opUnused, opUnused},
+	op_itr: {opWrite, opRead, opUnused},
+	op_nxt: {opWrite, opRead, opWrite},
+	op_apd: {opRead, opRead, opUnused},
+	op_spr: {opRead, opRead, opUnused},
+}
+
+// Verify checks that every instruction of the program only references
+// registers, constants, functions and native functions that exist and
+// that all jumps land inside the function. Programs that come from an
+// untrusted source must be verified before passing them to NewVM.
+func Verify(p *Program) error {
+	if len(p.Functions) == 0 {
+		return &VerifyError{Function: "-", Message: "the program has no functions"}
+	}
+
+	for i, f := range p.Functions {
+		if f == nil {
+			return &VerifyError{Function: fmt.Sprintf("%d", i), Message: "nil function"}
+		}
+		if err := verifyFunctionHeader(p, f, i); err != nil {
+			return err
+		}
+	}
+
+	closures, err := closureCounts(p)
+	if err != nil {
+		return err
+	}
+
+	for i, f := range p.Functions {
+		v := &verifier{program: p, function: f, closures: closures[i]}
+		if err := v.verify(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func verifyFunctionHeader(p *Program, f *Function, index int) error {
+	errorf := func(format string, args ...interface{}) error {
+		return &VerifyError{Function: f.Name, Message: fmt.Sprintf(format, args...)}
+	}
+
+	if f.Index != index {
+		return errorf("invalid index %d, expected %d", f.Index, index)
+	}
+
+	if f.MaxRegIndex < 0 {
+		return errorf("invalid MaxRegIndex %d", f.MaxRegIndex)
+	}
+
+	if f.Arguments < 0 || f.Arguments > f.MaxRegIndex {
+		return errorf("%d arguments don't fit in %d registers", f.Arguments, f.MaxRegIndex)
+	}
+
+	// methods store 'this' after the arguments
+	if strings.Contains(f.Name, ".prototype.") && f.Arguments >= f.MaxRegIndex {
+		return errorf("%d arguments and this don't fit in %d registers", f.Arguments, f.MaxRegIndex)
+	}
+
+	if len(f.Instructions) == 0 {
+		return errorf("the function has no instructions")
+	}
+
+	for _, r := range f.Closures {
+		if r == nil || r.Index < 0 || r.Index >= f.MaxRegIndex {
+			return errorf("closure register out of range")
+		}
+	}
+
+	for _, pos := range f.Positions {
+		if len(p.Files) > 0 && (pos.File < 0 || pos.File >= len(p.Files)) {
+			return errorf("position file %d out of range", pos.File)
+		}
+	}
+
+	return nil
+}
+
+// closureCounts returns for each function the number of closures
+// that its frame has when it is called.
+func closureCounts(p *Program) ([]int, error) {
+	ln := len(p.Functions)
+
+	// the functions that create a closure of each function.
+	// Functions referenced in any other way run without closures.
+	creators := make([][]int, ln)
+	direct := make([]bool, ln)
+
+	for i, f := range p.Functions {
+		for _, instr := range f.Instructions {
+			if instr == nil {
+				continue
+			}
+			for j, a := range []*Address{instr.A, instr.B, instr.C} {
+				if a == nil || a.Kind != AddrFunc || a.Value < 0 || int(a.Value) >= ln {
+					continue
+				}
+				if instr.Opcode == op_clo && j == 1 {
+					creators[a.Value] = append(creators[a.Value], i)
+				} else {
+					direct[a.Value] = true
+				}
+			}
+		}
+	}
+
+	counts := make([]int, ln)
+	for i := range counts {
+		if direct[i] || len(creators[i]) == 0 {
+			counts[i] = 0
+		} else {
+			counts[i] = -1
+		}
+	}
+
+	// propagate from the outer functions to the inner ones
+	for changed := true; changed; {
+		changed = false
+		for i := range counts {
+			if counts[i] != -1 {
+				continue
+			}
+			min := -1
+			for _, c := range creators[i] {
+				if counts[c] == -1 {
+					min = -1
+					break
+				}
+				n := counts[c] + len(p.Functions[c].Closures)
+				if min == -1 || n < min {
+					min = n
+				}
+			}
+			if min != -1 {
+				counts[i] = min
+				changed = true
+			}
+		}
+	}
+
+	for i, n := range counts {
+		if n == -1 {
+			return nil, &VerifyError{Function: p.Functions[i].Name, Message: "recursive closure definition"}
+		}
+	}
+
+	return counts, nil
+}
+
+type verifier struct {
+	program  *Program
+	function *Function
+	closures int
+	pc       int
+}
+
+func (v *verifier) errorf(format string, args ...interface{}) error {
+	return &VerifyError{
+		Function:    v.function.Name,
+		PC:          v.pc,
+		Instruction: v.function.Instructions[v.pc],
+		Message:     fmt.Sprintf(format, args...),
+	}
+}
+
+func (v *verifier) verify() error {
+	f := v.function
+
+	for pc, instr := range f.Instructions {
+		v.pc = pc
+
+		if instr == nil {
+			return &VerifyError{Function: f.Name, PC: pc, Message: "nil instruction"}
+		}
+
+		if int(instr.Opcode) >= len(operands) {
+			return v.errorf("invalid opcode %d", instr.Opcode)
+		}
+
+		ops := operands[instr.Opcode]
+		for i, a := range []*Address{instr.A, instr.B, instr.C} {
+			if err := v.verifyAddress(a, ops[i], "ABC"[i]); err != nil {
+				return err
+			}
+		}
+
+		if err := v.verifyJump(instr); err != nil {
+			return err
+		}
+	}
+
+	// the run loop would read past the last instruction
+	switch f.Instructions[len(f.Instructions)-1].Opcode {
+	case op_ret, op_jmp, op_jpb, op_trw:
+	default:
+		return v.errorf("the function doesn't end with a return")
+	}
+
+	return nil
+}
+
+func (v *verifier) verifyAddress(a *Address, op operand, name byte) error {
+	if a == nil {
+		return v.errorf("operand %c: nil address", name)
+	}
+
+	if a.Kind > AddrClass {
+		return v.errorf("operand %c: invalid address kind %d", name, a.Kind)
+	}
+
+	if a.Kind == AddrUnresolved {
+		return v.errorf("operand %c: unresolved address %v", name, a)
+	}
+
+	switch op {
+	case opUnused:
+		return nil
+
+	case opReadOrVoid, opWriteOrVoid, opDataOrVoid:
+		if a.Kind == AddrVoid {
+			return nil
+		}
+	}
+
+	switch op {
+	case opRead, opReadOrVoid:
+		if a.Kind == AddrVoid {
+			return v.errorf("operand %c: expected a value, got void", name)
+		}
+		return v.verifyRange(a, name)
+
+	case opWrite, opWriteOrVoid:
+		switch a.Kind {
+		case AddrLocal, AddrGlobal, AddrClosure:
+			return v.verifyRange(a, name)
+		}
+		return v.errorf("operand %c: expected a register, got %v", name, a.Kind)
+
+	case opConstant:
+		if a.Kind != AddrConstant {
+			return v.errorf("operand %c: expected a constant, got %v", name, a.Kind)
+		}
+		return v.verifyRange(a, name)
+
+	case opFunc:
+		if a.Kind != AddrFunc {
+			return v.errorf("operand %c: expected a function, got %v", name, a.Kind)
+		}
+		return v.verifyRange(a, name)
+
+	case opData, opDataOrVoid:
+		if a.Kind != AddrData {
+			return v.errorf("operand %c: expected data, got %v", name, a.Kind)
+		}
+		return nil
+	}
+
+	return nil
+}
+
+func (v *verifier) verifyRange(a *Address, name byte) error {
+	var max int
+
+	switch a.Kind {
+	case AddrLocal:
+		max = v.function.MaxRegIndex
+	case AddrGlobal:
+		max = v.program.Functions[0].MaxRegIndex
+	case AddrConstant:
+		max = len(v.program.Constants)
+	case AddrClosure:
+		max = v.closures
+	case AddrFunc:
+		max = len(v.program.Functions)
+	case AddrNativeFunc:
+		max = len(allNativeFuncs)
+	case AddrClass:
+		max = len(v.program.Classes)
+	default:
+		return nil
+	}
+
+	if a.Value < 0 || int(a.Value) >= max {
+		return v.errorf("operand %c: %v out of range (%d available)", name, a.Kind, max)
+	}
+
+	return nil
+}
+
+func (v *verifier) verifyJump(instr *Instruction) error {
+	var target int
+	pc := v.pc
+
+	switch instr.Opcode {
+	case op_jmp:
+		target = pc + int(instr.A.Value) + 1
+	case op_jpb:
+		target = pc - int(instr.A.Value)
+	case op_ejp, op_djp:
+		target = pc + int(instr.C.Value) + 1
+	case op_tjp:
+		if c := instr.C.Value; c != 0 && c != 1 {
+			return v.errorf("operand C: invalid jump condition %d", c)
+		}
+		target = pc + int(instr.B.Value) + 1
+	case op_try:
+		if instr.A.Kind == AddrData {
+			if err := v.verifyTarget(int(instr.A.Value), 'A'); err != nil {
+				return err
+			}
+		}
+		if instr.C.Kind == AddrData {
+			if err := v.verifyTarget(int(instr.C.Value), 'C'); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return nil
+	}
+
+	return v.verifyTarget(target, 0)
+}
+
+func (v *verifier) verifyTarget(target int, name byte) error {
+	if target >= 0 && target < len(v.function.Instructions) {
+		return nil
+	}
+
+	if name == 0 {
+		return v.errorf("jump to %d out of range (%d instructions)", target, len(v.function.Instructions))
+	}
+	return v.errorf("operand %c: jump to %d out of range (%d instructions)", name, target, len(v.function.Instructions))
+}
@@ -1,9 +1,11 @@
 package core
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"strings"
+	"time"
 	"unicode/utf8"
 
 	"github.com/gtlang/filesystem"
@@ -76,7 +78,9 @@ type stackFrame struct {
 	finalizables []Finalizable
 	retValueSet  bool
 	retValue     Value
-	exit         bool // if it should exit the program when returns
+	exit         bool  // if it should exit the program when returns
+	allocations  int64 // memory accounted while the function runs
+	raceSlots    map[int]*raceSlot
 }
 
 type VM struct {
@@ -84,17 +88,51 @@ type VM struct {
 	MaxSteps       int64
 	MaxAllocations int64
 	MaxFrames      int
+	Deadline       time.Time
 	RetValue       Value
 	Error          error
 	Trusted        bool
 	Context        interface{}
 	FileSystem     filesystem.FS
+	Audit          func(AuditEntry) // called for every denied capability check
+	Recorder       *Recorder        // logs the native calls
+	Replayer       *Replayer        // serves the native calls from a log
 	fp             int
 	steps          int64
 	allocations    int64
 	initialized    bool
 	callStack      []*stackFrame
 	tryCatchs      []*tryCatch
+	ctx            context.Context // passed to RunContext
+	runCtx         context.Context // ctx with the deadline while running
+	auditLog       []AuditEntry
+	natives        map[int]NativeFunction // overrides set with SetNative
+	abort          error                  // stops the execution and can't be catched
+	runs           int                    // calls to runFunc, to know if natives call the program
+	Decimals       *DecimalContext        // the precision of the divisions of decimals
+	Races          *RaceDetector          // set with DetectRaces
+	raceThread     *raceThread            // the clock of this VM in the race detector
+	raceGlobals    []*raceShadow          // shared by the VMs that share the globals
+	callerStack    *callerStack           // the stack of the VM that started this one
+}
+
+// CancelError is returned when the execution is stopped because the
+// context is canceled or the deadline is reached. It can't be catched.
+type CancelError struct {
+	Err error
+}
+
+func (e *CancelError) Error() string {
+	return "execution canceled: " + e.Err.Error()
+}
+
+func (e *CancelError) Unwrap() error {
+	return e.Err
+}
+
+// Allocations returns the estimated memory in use by the program.
+func (vm *VM) Allocations() int64 {
+	return vm.allocations
 }
 
 func (vm *VM) Steps() int64 {
@@ -134,9 +172,70 @@ func (vm *VM) Clone(p *Program, globals []Value) *VM {
 	m.FileSystem = vm.FileSystem
 	m.Context = vm.Context
 	m.Trusted = vm.Trusted
+	m.Deadline = vm.Deadline
+	m.ctx = vm.ctx
+	m.Audit = vm.Audit
+	m.Decimals = vm.Decimals
+	if vm.Recorder != nil {
+		vm.Recorder.markLive()
+	}
+	if vm.Races != nil {
+		vm.cloneRaces(m)
+	}
+	if vm.natives != nil {
+		m.natives = make(map[int]NativeFunction, len(vm.natives))
+		for k, v := range vm.natives {
+			m.natives[k] = v
+		}
+	}
 	return m
 }
 
+// GoContext returns the context that natives must use for blocking calls.
+// It is canceled when the execution is canceled or the deadline is reached.
+func (vm *VM) GoContext() context.Context {
+	if vm.runCtx != nil {
+		return vm.runCtx
+	}
+	if vm.ctx != nil {
+		return vm.ctx
+	}
+	return context.Background()
+}
+
+// RunContext is like Run but the execution stops with a CancelError
+// when ctx is done.
+func (vm *VM) RunContext(ctx context.Context, args ...Value) (Value, error) {
+	defer vm.setContext(ctx)()
+	return vm.Run(args...)
+}
+
+// RunFuncContext is like RunFunc but the execution stops with a CancelError
+// when ctx is done.
+func (vm *VM) RunFuncContext(ctx context.Context, name string, args ...Value) (Value, error) {
+	defer vm.setContext(ctx)()
+	return vm.RunFunc(name, args...)
+}
+
+func (vm *VM) setContext(ctx context.Context) func() {
+	prev := vm.ctx
+	vm.ctx = ctx
+	return func() {
+		vm.ctx = prev
+	}
+}
+
+// canceled returns a CancelError if the execution must stop.
+func (vm *VM) canceled() error {
+	if vm.runCtx == nil {
+		return nil
+	}
+	if err := vm.runCtx.Err(); err != nil {
+		return &CancelError{Err: err}
+	}
+	return nil
+}
+
 func (vm *VM) Initialized() bool {
 	return vm.initialized
 }
@@ -204,12 +303,23 @@ func (vm *VM) Globals() []Value {
 }
 
 func (vm *VM) runFunc(f *Function, finalizeGlobals bool, closures []*closureRegister, args ...Value) (Value, error) {
+	return vm.runFrame(f, finalizeGlobals, closures, nil, args)
+}
+
+// runMethod executes a class method with this.
+func (vm *VM) runMethod(f *Function, this Value, args ...Value) (Value, error) {
+	return vm.runFrame(f, false, nil, &this, args)
+}
+
+func (vm *VM) runFrame(f *Function, finalizeGlobals bool, closures []*closureRegister, this *Value, args []Value) (Value, error) {
 	// allow to pass less args but not more
 	if !f.Variadic && f.Arguments < len(args) {
 		return NullValue, fmt.Errorf("function '%s' expects %d parameters, got %d",
 			f.Name, f.Arguments, len(args))
 	}
 
+	vm.runs++
+
 	currentFp := vm.fp
 	currentTryCatchs := vm.tryCatchs
 
@@ -247,16 +357,11 @@ func (vm *VM) runFunc(f *Function, finalizeGlobals bool, closures []*closureRegi
 			}
 		}
 		// set the variadic as an array with the rest of the parameters
-		if lenArgs > regularArgs {
-			v := NewArrayValues(args[regularArgs:])
-			if err := vm.AddAllocations(v.Size()); err != nil {
-				return NullValue, err
-			}
-			locals[regularArgs] = v
-		} else {
-			// if no arguments are passed set the variadic param as an empty array
-			locals[regularArgs] = NewArray(0)
+		v := restArgs(f, args)
+		if err := vm.AddAllocations(v.Size()); err != nil {
+			return NullValue, err
 		}
+		locals[regularArgs] = v
 	} else {
 		for i := 0; i < f.Arguments; i++ {
 			if i >= lenArgs {
@@ -271,8 +376,18 @@ func (vm *VM) runFunc(f *Function, finalizeGlobals bool, closures []*closureRegi
 		}
 	}
 
+	if this != nil {
+		// this is always the next value after the arguments
+		locals[f.Arguments] = *this
+	}
+
 	vm.run(finalizeGlobals)
 
+	// release the frames left by an error
+	for i := len(vm.callStack) - 1; i > currentFp; i-- {
+		vm.release(vm.callStack[i])
+	}
+
 	// restore
 	vm.tryCatchs = currentTryCatchs
 	vm.fp = currentFp
@@ -284,6 +399,19 @@ func (vm *VM) runFunc(f *Function, finalizeGlobals bool, closures []*closureRegi
 	return vm.RetValue, nil
 }
 
+// raceSlot returns the shadow of the register shared by the closures of the frame.
+func (f *stackFrame) raceSlot(index int) *raceSlot {
+	if f.raceSlots == nil {
+		f.raceSlots = make(map[int]*raceSlot)
+	}
+	s, ok := f.raceSlots[index]
+	if !ok {
+		s = &raceSlot{}
+		f.raceSlots[index] = s
+	}
+	return s
+}
+
 func (vm *VM) addFrame(f *Function) *stackFrame {
 	frame := &stackFrame{values: make([]Value, f.MaxRegIndex)}
 	vm.fp++
@@ -306,7 +434,11 @@ func (vm *VM) createClosure() {
 
 	// copy closures defined in this function.
 	for i, r := range f.Closures {
-		c.closures[frLen+i] = &closureRegister{register: r, values: frame.values}
+		cr := &closureRegister{register: r, values: frame.values}
+		if vm.Races != nil {
+			cr.race = frame.raceSlot(r.Index)
+		}
+		c.closures[frLen+i] = cr
 	}
 
 	vm.set(instr.A, NewObject(c))
@@ -351,6 +483,9 @@ func (vm *VM) SetGlobalFinalizer(v Finalizable) {
 func (vm *VM) get(a *Address) Value {
 	switch a.Kind {
 	case AddrGlobal:
+		if vm.Races != nil {
+			vm.raceGlobal(int(a.Value), false)
+		}
 		return vm.callStack[0].values[a.Value]
 	case AddrLocal:
 		return vm.callStack[vm.fp].values[a.Value]
@@ -361,9 +496,15 @@ func (vm *VM) get(a *Address) Value {
 	case AddrData:
 		return NewInt(int(a.Value))
 	case AddrClosure:
-		return vm.callStack[vm.fp].closures[a.Value].get()
+		c := vm.callStack[vm.fp].closures[a.Value]
+		if vm.Races != nil {
+			vm.raceClosure(c, false)
+		}
+		return c.get()
 	case AddrConstant:
 		return vm.Program.Constants[a.Value]
+	case AddrClass:
+		return vm.Program.classValue(int(a.Value))
 	case AddrUnresolved:
 		panic(fmt.Sprintf("Unresolved address: %v", a))
 	default:
@@ -372,35 +513,235 @@ func (vm *VM) get(a *Address) Value {
 }
 
 func (vm *VM) set(a *Address, v Value) {
-	if err := vm.AddAllocations(v.Size()); err != nil {
-		vm.Error = err
-		return
-	}
-
 	switch a.Kind {
 	case AddrGlobal:
-		vm.callStack[0].values[a.Value] = v
+		if vm.Races != nil {
+			vm.raceGlobal(int(a.Value), true)
+		}
+		frame := vm.callStack[0]
+		if err := vm.replace(frame, frame.values[a.Value], v); err != nil {
+			vm.Error = err
+			return
+		}
+		if err := vm.escape(v); err != nil {
+			vm.Error = err
+			return
+		}
+		frame.values[a.Value] = v
 	case AddrLocal:
-		vm.callStack[vm.fp].values[a.Value] = v
+		frame := vm.callStack[vm.fp]
+		if err := vm.replace(frame, frame.values[a.Value], v); err != nil {
+			vm.Error = err
+			return
+		}
+		frame.values[a.Value] = v
 	case AddrClosure:
-		vm.callStack[vm.fp].closures[a.Value].set(v)
+		// closures can outlive the frame so they are accounted globally
+		c := vm.callStack[vm.fp].closures[a.Value]
+		if vm.Races != nil {
+			vm.raceClosure(c, true)
+		}
+		if err := vm.replace(vm.callStack[0], c.get(), v); err != nil {
+			vm.Error = err
+			return
+		}
+		if err := vm.escape(v); err != nil {
+			vm.Error = err
+			return
+		}
+		c.set(v)
 	default:
 		panic(fmt.Sprintf("Invalid register address: %v", a))
 	}
 }
 
+// replace accounts the new value of a register releasing the previous one.
+func (vm *VM) replace(frame *stackFrame, old, v Value) error {
+	if vm.MaxAllocations == 0 {
+		return nil
+	}
+	return vm.allocate(frame, v.Size()-old.Size())
+}
+
+// AddAllocations accounts memory used by the current function.
+// It is released when the function returns.
 func (vm *VM) AddAllocations(size int) error {
 	if vm.MaxAllocations == 0 {
 		return nil
 	}
+	return vm.allocate(vm.callStack[vm.fp], size)
+}
+
+// AddGlobalAllocations accounts memory retained by values that can
+// outlive the current function, like the values stored in globals.
+func (vm *VM) AddGlobalAllocations(size int) error {
+	if vm.MaxAllocations == 0 {
+		return nil
+	}
+	return vm.allocate(vm.callStack[0], size)
+}
+
+// CheckAllocations returns an error if allocating size would exceed
+// the memory limit. Natives use it to fail before creating big values
+// that are accounted when they are stored.
+func (vm *VM) CheckAllocations(size int) error {
+	if vm.MaxAllocations == 0 {
+		return nil
+	}
+	if vm.allocations+int64(size) > vm.MaxAllocations {
+		return vm.memoryLimitError()
+	}
+	return nil
+}
+
+// AddAllocationsTo accounts memory stored in the array or map v, like
+// the items pushed to it. If v escaped the function that created it,
+// because it is held by a global or a closure or by another container
+// that escaped, the memory is accounted globally and the items escape
+// with it. Otherwise it is released when the function returns.
+func (vm *VM) AddAllocationsTo(v Value, size int, items ...Value) error {
+	if vm.MaxAllocations == 0 {
+		return nil
+	}
+
+	if !isGlobal(v) {
+		return vm.allocate(vm.callStack[vm.fp], size)
+	}
+
+	if err := vm.allocate(vm.callStack[0], size); err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		if err := vm.escape(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// allocateAt is AddAllocationsTo for v, the value of the register a.
+func (vm *VM) allocateAt(a *Address, v Value, size int, items ...Value) error {
+	if vm.MaxAllocations == 0 {
+		return nil
+	}
+
+	switch a.Kind {
+	case AddrGlobal, AddrClosure:
+		if err := vm.escape(v); err != nil {
+			return err
+		}
+	}
+
+	return vm.AddAllocationsTo(v, size, items...)
+}
+
+// escape accounts globally v and the values that it holds because they
+// can outlive the current function. The memory that they have accounted
+// in the current frame is moved to the global frame.
+func (vm *VM) escape(v Value) error {
+	if vm.MaxAllocations == 0 {
+		return nil
+	}
+
+	size := int64(escape(v))
+	if size == 0 {
+		return nil
+	}
+
+	// the values could have been accounted by other frames
+	frame := vm.callStack[vm.fp]
+	moved := size
+	if moved > frame.allocations {
+		moved = frame.allocations
+	}
+	if moved < 0 {
+		moved = 0
+	}
+	frame.allocations -= moved
+
+	return vm.allocate(vm.callStack[0], int(size-moved))
+}
+
+// escape marks v and the containers that it holds as global. It returns
+// the size of the values that were not global yet.
+func escape(v Value) int {
+	var size int
+
+	switch v.Type {
+	case Array:
+		a := v.ToArrayObject()
+		if a.global {
+			return 0
+		}
+		a.global = true
+		for _, item := range a.Array {
+			size += item.Size() + escape(item)
+		}
+
+	case Map:
+		m := v.ToMap()
+		if m.global {
+			return 0
+		}
+		m.global = true
+		m.Mutex.RLock()
+		for _, item := range m.Map {
+			size += item.Size() + escape(item)
+		}
+		m.Mutex.RUnlock()
+
+	case Object:
+		i, ok := v.ToObject().(*instance)
+		if !ok || i.global {
+			return 0
+		}
+		i.global = true
+		i.RLock()
+		for _, item := range i.iMap {
+			size += item.Size() + escape(item)
+		}
+		i.RUnlock()
+	}
+
+	return size
+}
 
+// isGlobal returns true if v is an array, map or instance that escaped
+// the function that created it.
+func isGlobal(v Value) bool {
+	switch v.Type {
+	case Array:
+		return v.ToArrayObject().global
+	case Map:
+		return v.ToMap().global
+	case Object:
+		if i, ok := v.ToObject().(*instance); ok {
+			return i.global
+		}
+	}
+	return false
+}
+
+func (vm *VM) allocate(frame *stackFrame, size int) error {
+	frame.allocations += int64(size)
 	vm.allocations += int64(size)
 	if vm.allocations > vm.MaxAllocations {
-		return vm.NewError("Max allocations reached: %d", vm.MaxAllocations)
+		return vm.memoryLimitError()
 	}
 	return nil
 }
 
+// release frees the memory accounted by a frame when it ends.
+func (vm *VM) release(frame *stackFrame) {
+	vm.allocations -= frame.allocations
+	frame.allocations = 0
+}
+
+func (vm *VM) memoryLimitError() error {
+	return vm.NewError("Memory limit reached: %d", vm.MaxAllocations)
+}
+
 func (vm *VM) setPrototype(name string, this Value, dst *Address) bool {
 	if m, ok := vm.getNativePrototype(name, this); ok {
 		vm.set(dst, NewObject(m))
@@ -443,25 +784,141 @@ func (vm *VM) Stacktrace() []string {
 }
 
 func (vm *VM) getStackTrace() []TraceLine {
-	var trace []TraceLine
+	trace := traceLines(vm.Program, vm.framePCs())
+	return append(trace, vm.callerStack.lines()...)
+}
 
-	p := vm.Program
+// framePC is the position of a frame. It is cheaper to keep
+// than a TraceLine and is rendered only when needed.
+type framePC struct {
+	funcIndex int
+	pc        int
+}
+
+// framePCs returns the positions of the frames from the current one.
+func (vm *VM) framePCs() []framePC {
+	pcs := make([]framePC, 0, vm.fp+1)
 
 	for i := vm.fp; i >= 0; i-- {
 		frame := vm.callStack[i]
-		f := p.Functions[frame.funcIndex]
 
-		if f.IsGlobal && vm.initialized {
+		if vm.Program.Functions[frame.funcIndex].IsGlobal && vm.initialized {
 			// the global function has ended
 			continue
 		}
 
-		trace = append(trace, p.ToTraceLine(f, frame.pc))
+		pcs = append(pcs, framePC{funcIndex: frame.funcIndex, pc: frame.pc})
 	}
 
+	return pcs
+}
+
+// traceLines renders the positions of the frames.
+func traceLines(p *Program, pcs []framePC) []TraceLine {
+	trace := make([]TraceLine, len(pcs))
+	for i, f := range pcs {
+		trace[i] = p.ToTraceLine(p.Functions[f.funcIndex], f.pc)
+	}
 	return trace
 }
 
+// maxCallerDepth is the number of boundaries kept in the stack
+// traces of VMs that start other VMs.
+const maxCallerDepth = 10
+
+// callerStack is the stack of a VM that started another one. It is kept
+// as positions and is rendered only when a stack trace is needed. The
+// stacks of the callers of the caller are shared, not copied.
+type callerStack struct {
+	boundary string
+	program  *Program
+	frames   []framePC
+	parent   *callerStack
+	depth    int // the number of boundaries up to this one
+}
+
+// lines renders the stack and the stacks of its callers.
+func (c *callerStack) lines() []TraceLine {
+	var trace []TraceLine
+	for ; c != nil; c = c.parent {
+		lines := traceLines(c.program, c.frames)
+		if len(lines) > 0 {
+			lines[0].Boundary = c.boundary
+		}
+		trace = append(trace, lines...)
+	}
+	return trace
+}
+
+// SetCaller chains the current stack of the caller to the stack traces
+// of this VM. The boundary describes how it was started, like "go" for
+// goroutines or "plugin" for calls to other programs. Only the stacks of
+// the last maxCallerDepth boundaries are kept.
+func (vm *VM) SetCaller(boundary string, caller *VM) {
+	c := &callerStack{
+		boundary: boundary,
+		program:  caller.Program,
+		frames:   caller.framePCs(),
+		parent:   caller.callerStack,
+		depth:    1,
+	}
+
+	if c.parent != nil {
+		c.depth = c.parent.depth + 1
+		if c.depth > maxCallerDepth {
+			c.parent = c.parent.trim(maxCallerDepth - 1)
+			c.depth = maxCallerDepth
+		}
+	}
+
+	vm.callerStack = c
+}
+
+// trim returns a copy of the chain with only the first depth stacks.
+func (c *callerStack) trim(depth int) *callerStack {
+	if c == nil || depth == 0 {
+		return nil
+	}
+	t := *c
+	t.parent = c.parent.trim(depth - 1)
+	t.depth = depth
+	return &t
+}
+
+// startedBy returns true if c is the stack of this VM when it started the
+// VM that has it: the stack traces with c already have the lines of this VM.
+func (vm *VM) startedBy(c *callerStack) bool {
+	if c == nil || c.program != vm.Program {
+		return false
+	}
+
+	pcs := vm.framePCs()
+	if len(pcs) != len(c.frames) {
+		return false
+	}
+	for i, f := range pcs {
+		if f != c.frames[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// endsWithStack reports whether the error already has the lines of st
+// because it comes from a VM started with SetCaller by this one.
+func endsWithStack(lines, st []TraceLine) bool {
+	i := len(lines) - len(st)
+	if len(st) == 0 || i < 0 {
+		return false
+	}
+	for j, l := range st {
+		if !lines[i+j].samePosition(l) {
+			return false
+		}
+	}
+	return true
+}
+
 type messageError interface {
 	Message() string
 }
@@ -469,11 +926,17 @@ type messageError interface {
 func (vm *VM) WrapError(err error) Error {
 	var msg string
 
-	st := vm.getStackTrace()
-
 	switch t := err.(type) {
 	case Error:
-		t.stacktrace = append(t.stacktrace, st...)
+		if vm.startedBy(t.callers) {
+			// it has the stack of this VM and its callers up to the limit
+			t.callers = vm.callerStack
+			return t
+		}
+		if st := vm.getStackTrace(); !endsWithStack(t.stacktrace, st) {
+			t.stacktrace = append(t.stacktrace, st...)
+			t.callers = vm.callerStack
+		}
 		return t
 	case messageError:
 		msg = t.Message()
@@ -483,17 +946,19 @@ func (vm *VM) WrapError(err error) Error {
 
 	return Error{
 		message:     msg,
+		cause:       err,
 		instruction: vm.instruction(),
-		stacktrace:  st,
+		stacktrace:  vm.getStackTrace(),
+		callers:     vm.callerStack,
 	}
 }
 
 func (vm *VM) NewError(format string, a ...interface{}) Error {
-	st := vm.getStackTrace()
 	return Error{
 		message:     fmt.Sprintf(format, a...),
 		instruction: vm.instruction(),
-		stacktrace:  st,
+		stacktrace:  vm.getStackTrace(),
+		callers:     vm.callerStack,
 	}
 }
 
@@ -552,6 +1017,19 @@ func (vm *VM) returnFromFinally() bool {
 
 // returns true if the error is handled
 func (vm *VM) handle(err error) bool {
+	// a suspended execution or a replay that diverged can't be catched
+	if e := vm.abort; e != nil {
+		vm.abort = nil
+		vm.Error = e
+		return false
+	}
+
+	// a canceled execution can't be catched
+	if e := vm.canceled(); e != nil {
+		vm.Error = e
+		return false
+	}
+
 	ln := len(vm.tryCatchs)
 	if ln == 0 {
 		vm.Error = err
@@ -635,7 +1113,7 @@ func (vm *VM) handle(err error) bool {
 	if try.errorReg != Void {
 		e, ok := err.(Error)
 		if !ok {
-			e = Error{message: err.Error()}
+			e = Error{message: err.Error(), cause: err}
 		}
 		vm.set(try.errorReg, NewObject(e))
 	}
@@ -675,6 +1153,7 @@ func (vm *VM) runFinalizables(frame *stackFrame) {
 func (vm *VM) cleanupFrame(index int) {
 	frame := vm.callStack[index]
 	vm.runFinalizables(frame)
+	vm.release(frame)
 }
 
 func (vm *VM) run(finalizeGlobals bool) {
@@ -703,6 +1182,29 @@ func (vm *VM) run(finalizeGlobals bool) {
 		}()
 	}
 
+	// nested runs from natives share the context of the first one
+	if vm.runCtx == nil {
+		ctx := vm.ctx
+		if ctx == nil {
+			ctx = context.Background()
+		}
+
+		var cancel context.CancelFunc
+		if !vm.Deadline.IsZero() {
+			ctx, cancel = context.WithDeadline(ctx, vm.Deadline)
+		}
+
+		vm.runCtx = ctx
+		defer func() {
+			if cancel != nil {
+				cancel()
+			}
+			vm.runCtx = nil
+		}()
+	}
+
+	done := vm.runCtx.Done()
+
 	p := vm.Program
 
 	for {
@@ -712,6 +1214,15 @@ func (vm *VM) run(finalizeGlobals bool) {
 			return
 		}
 
+		if done != nil && vm.steps&0xFF == 0 {
+			select {
+			case <-done:
+				vm.Error = vm.canceled()
+				return
+			default:
+			}
+		}
+
 		frame := vm.callStack[vm.fp]
 		i := frame.funcIndex
 		f := p.Functions[i]
@@ -738,6 +1249,19 @@ func (vm *VM) run(finalizeGlobals bool) {
 	}
 }
 
+// restArgs returns the value of the rest parameter of a variadic function:
+// an array with the arguments after the regular ones, even if there are none.
+// It doesn't share memory with the arguments that the caller passed.
+func restArgs(f *Function, args []Value) Value {
+	regularArgs := f.Arguments - 1
+	if len(args) <= regularArgs {
+		return NewArray(0)
+	}
+	rest := make([]Value, len(args)-regularArgs)
+	copy(rest, args[regularArgs:])
+	return NewArrayValues(rest)
+}
+
 func (vm *VM) setPC(pc int) {
 	vm.callStack[vm.fp].pc = pc
 }
@@ -747,7 +1271,6 @@ func (vm *VM) incPC(steps int) {
 }
 
 func (vm *VM) call(a, b *Address, args []Value) int {
-	// TODO Handle variadic and spread with closures.
 	// get the function
 	var f *Function
 	var closures []*closureRegister
@@ -845,15 +1368,13 @@ func (vm *VM) callProgramFunc(f *Function, retAddr *Address, args []Value, isMet
 			if count < regularArgs {
 				copy(locals, args)
 				// zero the rest of the args because memory can be reused
-				for i := count; i < f.Arguments; i++ {
+				for i := count; i < regularArgs; i++ {
 					locals[i] = NullValue
 				}
 			} else {
-				for i := 0; i < regularArgs; i++ {
-					locals[i] = args[i]
-				}
-				locals[regularArgs] = NewArrayValues(args[regularArgs:])
+				copy(locals, args[:regularArgs])
 			}
+			locals[regularArgs] = restArgs(f, args)
 		} else {
 			if count > f.Arguments {
 				// ignore if too many parameters are passed
@@ -870,6 +1391,18 @@ func (vm *VM) callProgramFunc(f *Function, retAddr *Address, args []Value, isMet
 		}
 	}
 
+	// the arguments are released when they are replaced
+	if vm.MaxAllocations > 0 {
+		var size int
+		for _, v := range locals[:f.Arguments] {
+			size += v.Size()
+		}
+		if err := vm.AddAllocations(size); err != nil {
+			vm.Error = err
+			return vm_exit
+		}
+	}
+
 	if isMethod {
 		// this is always the next value after the arguments
 		locals[f.Arguments] = this
@@ -879,14 +1412,25 @@ func (vm *VM) callProgramFunc(f *Function, retAddr *Address, args []Value, isMet
 }
 
 func (vm *VM) callNativeFunc(i int, args []Value, retAddress *Address, this Value) error {
-	f := allNativeFuncs[i]
+	f, ok := vm.natives[i]
+	if !ok {
+		f = allNativeFuncs[i]
+	}
 
 	l := f.Arguments
 	if l != -1 && l != len(args) {
 		return fmt.Errorf("function '%s' expects %d parameters, got %d", f.Name, l, len(args))
 	}
 
-	ret, err := f.Function(this, args, vm)
+	var ret Value
+	var err error
+	if vm.intercepted() {
+		ret, err = vm.invokeNative("call", f.Name, nil, this, args, func() (Value, error) {
+			return f.Function(this, args, vm)
+		})
+	} else {
+		ret, err = f.Function(this, args, vm)
+	}
 	if err != nil {
 		return err
 	}
@@ -923,7 +1467,11 @@ func (vm *VM) setToObject(instr *Instruction) error {
 		}
 	}
 
-	if err := vm.AddAllocations(cv.Size()); err != nil {
+	if vm.Races != nil {
+		vm.raceValue(av, true)
+	}
+
+	if err := vm.allocateAt(instr.A, av, cv.Size(), cv); err != nil {
 		return err
 	}
 
@@ -948,7 +1496,7 @@ func (vm *VM) setToObject(instr *Instruction) error {
 		case Map:
 			m := av.ToMap()
 			m.Mutex.Lock()
-			m.Map[bv.ToString()] = cv
+			m.Set(bv.ToString(), cv)
 			m.Mutex.Unlock()
 		default:
 			return vm.NewError("Can't set %v by index", av.Type)
@@ -958,14 +1506,22 @@ func (vm *VM) setToObject(instr *Instruction) error {
 		case Map:
 			m := av.ToMap()
 			m.Mutex.Lock()
-			m.Map[bv.ToString()] = cv
+			m.Set(bv.ToString(), cv)
 			m.Mutex.Unlock()
 		case Object:
 			i, ok := av.ToObject().(PropertySetter)
 			if !ok {
 				return vm.NewError("Readonly property or not a PropertySetter: %T", av.TypeName())
 			}
-			if err := i.SetProperty(bv.ToString(), cv, vm); err != nil {
+			var err error
+			if vm.intercepted() {
+				_, err = vm.invokeNative("set", bv.ToString(), i, NullValue, []Value{cv}, func() (Value, error) {
+					return NullValue, i.SetProperty(bv.ToString(), cv, vm)
+				})
+			} else {
+				err = i.SetProperty(bv.ToString(), cv, vm)
+			}
+			if err != nil {
 				return vm.WrapError(err)
 			}
 
@@ -1000,6 +1556,14 @@ func (vm *VM) getFromObject(instr *Instruction) error {
 
 	cv := vm.get(instr.C) // index or key
 
+	if vm.Races != nil {
+		if bv.Type == Array && cv.Type == String {
+			vm.raceMethod(bv, cv.ToString())
+		} else {
+			vm.raceValue(bv, false)
+		}
+	}
+
 	switch cv.Type {
 
 	case Int:
@@ -1080,15 +1644,8 @@ func (vm *VM) getFromObject(instr *Instruction) error {
 		case Object:
 			obj := bv.ToObject()
 
-			if n, ok := obj.(Callable); ok {
-				if m := n.GetMethod(key); m != nil {
-					vm.set(instr.A, NewObject(m))
-					return nil
-				}
-			}
-
-			if i, ok := obj.(PropertyGetter); ok {
-				v, err := i.GetProperty(key, vm)
+			if vm.intercepted() {
+				v, err := vm.interceptMember(obj, key)
 				if err != nil {
 					return vm.WrapError(err)
 				}
@@ -1096,20 +1653,38 @@ func (vm *VM) getFromObject(instr *Instruction) error {
 					vm.set(instr.A, v)
 					return nil
 				}
-			}
+			} else {
+				if n, ok := obj.(Callable); ok {
+					if m := n.GetMethod(key); m != nil {
+						vm.set(instr.A, NewObject(m))
+						return nil
+					}
+				}
 
-			// try if it's an enunmerable method
-			if _, ok := obj.(Enumerable); ok {
-				if m, ok := vm.getNativePrototype("Array.prototype."+key, bv); ok {
-					vm.set(instr.A, NewObject(m))
-					return nil
+				// the members of an iterable class hide the array methods
+				if t, ok := obj.(*instance); ok && !t.hasMember(key) && vm.iterable(obj) {
+					if vm.setPrototype("Array.prototype."+key, bv, instr.A) {
+						return nil
+					}
 				}
-				if m, ok := vm.getProgramPrototype("Array.prototype."+key, bv); ok {
-					vm.set(instr.A, NewObject(m))
-					return nil
+
+				if i, ok := obj.(PropertyGetter); ok {
+					v, err := i.GetProperty(key, vm)
+					if err != nil {
+						return vm.WrapError(err)
+					}
+					if v.Type != Undefined {
+						vm.set(instr.A, v)
+						return nil
+					}
 				}
 			}
 
+			// try if it's an enunmerable method
+			if vm.iterable(obj) && vm.setPrototype("Array.prototype."+key, bv, instr.A) {
+				return nil
+			}
+
 			// allow to call anything on an object.
 			// If it doesn't exist set it to undefined
 			vm.set(instr.A, UndefinedValue)
@@ -1211,6 +1786,7 @@ func (c Closure) Export(recursionLevel int) interface{} {
 type closureRegister struct {
 	register *Register
 	values   []Value
+	race     *raceSlot // set if the race detector is enabled
 }
 
 func (c *closureRegister) get() Value {
@@ -1,10 +1,20 @@
 package core
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
+	"math"
+	"reflect"
 	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gtlang/filesystem"
 	"github.com/gtlang/gt/parser"
@@ -235,6 +245,83 @@ func TestLoopLabel3(t *testing.T) {
 	`)
 }
 
+func TestIterator(t *testing.T) {
+	assertValue(t, 7, `
+		class Range {
+			n: number
+			constructor(n: number) {
+				this.n = n
+			}
+			iterator() {
+				let i = 0
+				let n = this.n
+				return {
+					next: () => {
+						if (i < n) {
+							i++
+							return { value: i - 1 }
+						}
+						return { done: true }
+					}
+				}
+			}
+		}
+
+		let a = 0
+		for (let v of new Range(10)) {
+			if (v == 1) {
+				continue
+			}
+			if (v == 4) {
+				break
+			}
+			a += v
+		}
+
+		function count(...values) {
+			return values.length
+		}
+
+		let r = new Range(2)
+		return a + count(...r)
+	`)
+}
+
+func TestMapOrder(t *testing.T) {
+	assertValue(t, "zaxyb", `
+		let m = { z: 1, a: 2 }
+		m.x = 3
+		m.y = 4
+		m.b = 5
+		m.a = 6 // replacing doesn't move the key
+
+		let keys = ""
+		for (let k in m) {
+			keys += k
+		}
+		return keys
+	`)
+}
+
+func TestMapMarshalJSON(t *testing.T) {
+	m := NewMap(0)
+	mv := m.ToMap()
+	mv.Set("z", NewInt(1))
+	mv.Set("a", NewArrayValues([]Value{NewString("b")}))
+	mv.Set("m", NewMapValues(map[string]Value{"y": TrueValue, "x": NullValue}))
+	mv.Delete("a")
+	mv.Set("a", NewInt(2))
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s := string(b); s != `{"z":1,"m":{"x":null,"y":true},"a":2}` {
+		t.Fatal(s)
+	}
+}
+
 func TestLoopLabel4(t *testing.T) {
 	assertValue(t, 4, `
 		let a = 0;
@@ -375,9 +462,11 @@ func TestStacktrace(t *testing.T) {
 	_, err := vm.Run()
 
 	se := normalize(`
-		-> line 7
-		-> line 3
-		-> line 11
+		-> line 7:4
+			throw "snap!"
+			^
+		-> line 3:4
+		-> line 11:4
 	`)
 
 	if !strings.Contains(normalize(err.Error()), se) {
@@ -410,8 +499,10 @@ func TestStacktrace2(t *testing.T) {
 	_, err = vm.Run()
 
 	se := normalize(`
-		-> /other/path/bar.ts:3
-		-> /main.ts:5
+		-> /other/path/bar.ts:3:11
+			return 1 / 0
+			       ^
+		-> /main.ts:5:4
 	`)
 
 	if !strings.Contains(normalize(err.Error()), se) {
@@ -419,6 +510,103 @@ func TestStacktrace2(t *testing.T) {
 	}
 }
 
+func TestStacktraceSnippet(t *testing.T) {
+	p := compileTest(t, "function main() {\n\tlet s = \"ñ\"; let x = 1 / 0\n}")
+
+	_, err := NewVM(p).Run()
+
+	e, ok := err.(Error)
+	if !ok {
+		t.Fatal(err)
+	}
+
+	expected := "Attempt to divide by zero\n -> line 2:24\n    \tlet s = \"ñ\"; let x = 1 / 0\n    \t                     ^\n"
+	if e.Error() != expected {
+		t.Fatalf("%q", e.Error())
+	}
+
+	p.Strip()
+	_, err = NewVM(p).Run()
+	if strings.Contains(err.Error(), "^") {
+		t.Fatal(err)
+	}
+}
+
+func TestStacktraceCaller(t *testing.T) {
+	AddNativeFunc(NativeFunction{
+		Name: "tests.callFail",
+		Function: func(this Value, args []Value, vm *VM) (Value, error) {
+			m := vm.Clone(vm.Program, vm.Globals())
+			m.SetCaller("child", vm)
+			return m.RunFunc("fail")
+		},
+	})
+
+	p := compileTest(t, `
+		function main() {
+			tests.callFail()
+		}
+
+		function fail() {
+			throw "snap!"
+		}
+	`)
+
+	_, err := NewVM(p).Run()
+
+	se := normalize(`
+		-> line 7:4
+			throw "snap!"
+			^
+		-- child --
+		-> line 3:4
+	`)
+
+	s := normalize(err.Error())
+	if !strings.HasSuffix(s, se) || strings.Count(s, "line 3:4") != 1 {
+		t.Fatal(err)
+	}
+}
+
+func TestStacktraceCallerDepth(t *testing.T) {
+	AddNativeFunc(NativeFunction{
+		Name:      "tests.spawn",
+		Arguments: 1,
+		Function: func(this Value, args []Value, vm *VM) (Value, error) {
+			m := vm.Clone(vm.Program, vm.Globals())
+			m.SetCaller("child", vm)
+			return m.RunFunc("spawn", args...)
+		},
+	})
+
+	p := compileTest(t, `
+		function main() {
+			spawn(25)
+		}
+
+		function spawn(n) {
+			if (n == 0) {
+				throw "snap!"
+			}
+			tests.spawn(n - 1)
+		}
+	`)
+
+	_, err := NewVM(p).Run()
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	// only the last boundaries are kept and they are not repeated
+	s := err.Error()
+	if n := strings.Count(s, "-- child --"); n != maxCallerDepth {
+		t.Fatalf("expected %d boundaries, got %d:\n%s", maxCallerDepth, n, s)
+	}
+	if n := strings.Count(s, "->"); n != maxCallerDepth+1 {
+		t.Fatalf("expected %d lines, got %d:\n%s", maxCallerDepth+1, n, s)
+	}
+}
+
 func TestReturnFromScript(t *testing.T) {
 	assertValue(t, 5, `
 		return 5
@@ -1215,6 +1403,169 @@ func TestEnumString(t *testing.T) {
 	`)
 }
 
+func TestEnumInlined(t *testing.T) {
+	p := compileTest(t, `
+		enum Direction {
+		    Up = 5,
+		    Down
+		}
+		return Direction.Down
+	`)
+
+	for _, f := range p.Functions {
+		for _, i := range f.Instructions {
+			if i.Opcode == op_get {
+				t.Fatal("the enum member was not inlined")
+			}
+		}
+	}
+
+	vm := NewVM(p)
+	ret, err := vm.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret != NewValue(6) {
+		t.Fatalf("Expected 6, got %v", ret)
+	}
+}
+
+func TestEnumShadowed(t *testing.T) {
+	assertValue(t, 2, `
+		enum Direction {
+		    Up = 5,
+		    Down
+		}
+		function main() {
+			let Direction = { Down: 2 }
+			return Direction.Down
+		}
+	`)
+}
+
+func TestEnumInlinedModule(t *testing.T) {
+	fs := filesystem.NewVirtualFS()
+	fs.WritePath("main.ts", []byte(`
+		import * as foo from "foo"
+
+		function main() {
+			if (foo.Level.High == 3) {
+				return foo.Level.Low
+			}
+			return -1
+		}
+	`))
+
+	fs.WritePath("foo.ts", []byte(`
+		export enum Level {
+		    Low = 1,
+		    High = 3
+		}
+	`))
+
+	assertValueFS(t, fs, "main.ts", 1)
+}
+
+// Tests: Defines
+func TestParseDefine(t *testing.T) {
+	data := []struct {
+		s     string
+		name  string
+		value interface{}
+	}{
+		{"DEBUG", "DEBUG", true},
+		{"DEBUG=false", "DEBUG", false},
+		{"LEVEL=2", "LEVEL", 2},
+		{"RATIO=0.5", "RATIO", 0.5},
+		{"ENV=prod", "ENV", "prod"},
+		{`ENV="a b"`, "ENV", "a b"},
+	}
+
+	for _, d := range data {
+		name, v, err := ParseDefine(d.s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != d.name || v != NewValue(d.value) {
+			t.Fatalf("%s: got %s=%v", d.s, name, v)
+		}
+	}
+
+	if _, _, err := ParseDefine("1A=2"); err == nil {
+		t.Fatal("expected an invalid name error")
+	}
+}
+
+func TestDefineDirective(t *testing.T) {
+	assertValue(t, "debug 2", `
+		//gt: define DEBUG
+		// [define LEVEL=2]
+
+		let s = "none"
+		if (__DEFINE__.RELEASE) {
+			s = "release"
+		} else if (__DEFINE__.DEBUG && __DEFINE__.LEVEL == 2) {
+			s = "debug " + __DEFINE__.LEVEL
+		} else {
+			s = "other"
+		}
+		return s
+	`)
+}
+
+func TestDefineEliminated(t *testing.T) {
+	fs := filesystem.NewVirtualFS()
+	fs.WritePath("main.ts", []byte(`
+		import * as debug from "debug"
+
+		function main() {
+			let s = "release"
+			if (!__DEFINE__.DEBUG) {
+				return s
+			} else {
+				s = "debug only"
+			}
+			return s
+		}
+	`))
+
+	fs.WritePath("debug.ts", []byte(`
+		if (__DEFINE__.DEBUG) {
+			console.log("debug only")
+		}
+	`))
+
+	p, err := CompileWithDefines(fs, "main.ts", map[string]Value{"DEBUG": FalseValue})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, k := range p.Constants {
+		if k.ToString() == "debug only" {
+			t.Fatal("the eliminated code was compiled")
+		}
+	}
+
+	for file, src := range p.Sources {
+		if strings.Contains(string(src), "debug only") {
+			t.Fatalf("the eliminated code is in the sources of %s", file)
+		}
+	}
+
+	if p.FileIndex("/debug.ts") == -1 {
+		t.Fatalf("expected debug.ts in the files: %v", p.Files)
+	}
+
+	vm := NewVM(p)
+	ret, err := vm.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret != NewValue("release") {
+		t.Fatalf("Expected release, got %v", ret)
+	}
+}
+
 // Tests: Error
 func TestError(t *testing.T) {
 	assertValue(t, "Attempt to divide by zero", `
@@ -1663,162 +2014,1893 @@ func TestNativeObject(t *testing.T) {
 	`)
 }
 
-func TestNativeFuncError(t *testing.T) {
+func TestThrowInstance(t *testing.T) {
+	assertValue(t, "notFound no user 3 true", `
+		class NotFound {
+			code = "notFound"
+			message = "no user"
+			id: number
+			constructor(id: number) {
+				this.id = id
+			}
+		}
+
+		function main() {
+			try {
+				throw new NotFound(3)
+			} catch (e) {
+				return e.code + " " + e.message + " " + e.value.id + " " + (e.cause == null)
+			}
+		}
+	`)
+}
+
+func TestNativeErrorCause(t *testing.T) {
 	libs := []NativeFunction{
 		NativeFunction{
-			Name:      "math.square",
-			Arguments: 1,
-			Function: func(this Value, args []Value, vm *VM) (Value, error) {
-				return NullValue, fmt.Errorf("snap!")
-			},
-		},
-		NativeFunction{
-			Name:      "log.error",
-			Arguments: -1,
+			Name: "tests.open",
 			Function: func(this Value, args []Value, vm *VM) (Value, error) {
-				return NullValue, nil
+				return NullValue, fmt.Errorf("open foo: %w", fs.ErrNotExist)
 			},
 		},
 	}
 
-	assertNativeValue(t, libs, nil, `
+	RegisterErrorCode(fs.ErrNotExist, "notFound")
+	defer delete(errorCodes, fs.ErrNotExist)
+
+	assertNativeValue(t, libs, "notFound file does not exist", `
 		function main() {
 			try {
-				math.square(2)				
-			} catch (error) {
-				log.error("asdfas", error)
+				tests.open()
+			} catch (e) {
+				return e.code + " " + e.cause.cause.message
 			}
 		}
 	`)
-}
 
-type obj struct{}
-
-func (d obj) GetProperty(key string, vm *VM) (Value, error) {
-	switch key {
-	case "name":
-		return NewString("foo"), nil
+	p, err := CompileStr(`function main() { tests.open() }`)
+	if err != nil {
+		t.Fatal(err)
 	}
-	return UndefinedValue, nil
-}
 
-func (d obj) GetMethod(name string) NativeMethod {
-	switch name {
-	case "sayHi":
-		return d.sayHI
+	_, err = NewVM(p).Run()
+	if !errors.Is(err, fs.ErrNotExist) || ErrorCode(err) != "notFound" {
+		t.Fatalf("expected a not found error, got %v", err)
 	}
-	return nil
 }
 
-func (d obj) sayHI(args []Value, vm *VM) (Value, error) {
-	return NewString("Hi " + args[0].ToString()), nil
-}
+func TestFindThrownClass(t *testing.T) {
+	src := `
+		class NotFound {
+			code = "notFound"
+		}
 
-func assertNativeValue(t *testing.T, funcs []NativeFunction, expected interface{}, code string) {
-	a, err := parser.ParseStr(code)
-	if err != nil {
-		t.Fatal(err)
-	}
+		function main() {
+			throw new NotFound()
+		}
+	`
 
-	c := NewCompiler()
+	p1 := compileTest(t, src)
+	p2 := compileTest(t, src)
 
-	for _, f := range funcs {
-		AddNativeFunc(f)
+	_, err := NewVM(p1).Run()
+	if err == nil {
+		t.Fatal("expected an error")
 	}
 
-	p, err := c.Compile(a)
-	if err != nil {
-		t.Fatal(err)
+	if _, ok := FindThrown(err, p1.classValue(0)); !ok {
+		t.Fatal("expected the class of the program")
+	}
+	if _, ok := FindThrown(err, p2.classValue(0)); ok {
+		t.Fatal("expected the class of another program to not match")
+	}
+	if _, ok := FindThrown(err, NewString("NotFound")); !ok {
+		t.Fatal("expected the name of the class to match")
 	}
 
-	vm := NewVM(p)
-
-	// Print(p)
-	// vm.MaxSteps = 10
+	v, err := NewVM(compileTest(t, `
+		class A {}
+		class B {}
 
-	ret, err := vm.Run()
+		function main() {
+			let a = A
+			return (a == A) + " " + (a == B)
+		}
+	`)).Run()
 	if err != nil {
 		t.Fatal(err)
 	}
+	if v.ToString() != "true false" {
+		t.Fatal(v)
+	}
+}
 
-	v := NewValue(expected)
+type unhashableError struct {
+	detail interface{}
+}
 
-	if ret != v {
-		t.Fatalf("Expected %v %T, got %v %T", expected, expected, ret, ret)
-	}
+func (e unhashableError) Error() string {
+	return "unhashable"
 }
 
-func assertValueFS(t *testing.T, fs filesystem.FS, path string, expected interface{}) {
-	p, err := Compile(fs, path)
-	if err != nil {
-		t.Fatal(err)
+func TestErrorCodeUnhashable(t *testing.T) {
+	err := fmt.Errorf("wrapped: %w", unhashableError{detail: []string{"a"}})
+	if code := ErrorCode(err); code != "" {
+		t.Fatalf("expected no code, got %q", code)
 	}
+}
 
-	// Print(p)
-	// PrintNames(p, true)
-	// vm.MaxSteps = 50
+type bindAddress struct {
+	City string
+}
 
-	vm := NewVM(p)
+type bindUser struct {
+	ID       int
+	Name     string
+	Tags     []string
+	Address  *bindAddress
+	Password string `gt:"-"`
+}
+
+func (u *bindUser) Greet(prefix string) string {
+	return prefix + " " + u.Name
+}
+
+func (u *bindUser) Validate() error {
+	if u.Name == "" {
+		return errors.New("empty name")
+	}
+	return nil
+}
+
+func TestBind(t *testing.T) {
+	u := &bindUser{ID: 1, Name: "foo", Tags: []string{"a", "b"}, Address: &bindAddress{City: "Paris"}}
+	Bind("tests.user", u)
+
+	assertNativeValue(t, nil, "hi bar 1 2 Paris undefined", `
+		function main() {
+			let u = tests.user
+			u.name = "bar"
+			return u.greet("hi") + " " + u.id + " " + u.tags.length + " " + u.address.city + " " + u.password
+		}
+	`)
+
+	if u.Name != "bar" {
+		t.Fatalf("expected the field to be set, got %s", u.Name)
+	}
+
+	assertNativeValue(t, nil, "empty name", `
+		function main() {
+			let u = tests.user
+			u.name = ""
+			try {
+				u.validate()
+			} catch (e) {
+				return e.message
+			}
+		}
+	`)
+
+	dts := TypeDefs()
+	for _, s := range []string{
+		"declare interface bindUser {",
+		"tags: string[]",
+		"address: bindAddress",
+		"greet(a1: string): string",
+		"validate(): void",
+		"declare interface bindAddress {",
+		"export const user: bindUser",
+	} {
+		if !strings.Contains(dts, s) {
+			t.Fatalf("expected %q in the declarations", s)
+		}
+	}
+
+	if strings.Contains(dts, "password") {
+		t.Fatal("expected the password to be hidden")
+	}
+}
+
+type bindServer struct {
+	Host string
+	Port int
+}
+
+type bindConfig struct {
+	Server bindServer
+}
+
+func TestBindNestedStruct(t *testing.T) {
+	cfg := &bindConfig{Server: bindServer{Host: "localhost", Port: 80}}
+	Bind("tests.config", cfg)
+
+	assertNativeValue(t, nil, 8080, `
+		function main() {
+			let cfg = tests.config
+			cfg.server.port = 8080
+			return tests.config.server.port
+		}
+	`)
+
+	if cfg.Server.Port != 8080 {
+		t.Fatalf("expected the nested field to be set, got %d", cfg.Server.Port)
+	}
+}
+
+func TestBindCopied(t *testing.T) {
+	Bind("tests.tags", []string{"a", "b"})
+	Bind("tests.data", []byte("ab"))
+
+	code := `
+		function main() {
+			let tags = tests.tags
+			tags[0] = "x"
+			let data = tests.data
+			data[0] = 120
+			return tags[0] + " " + tests.tags[0] + " " + tests.data[0]
+		}
+	`
+
+	// the changes of a VM are not visible in the next one
+	for i := 0; i < 2; i++ {
+		assertNativeValue(t, nil, "x a 97", code)
+	}
+}
+
+func TestBindUintOverflow(t *testing.T) {
+	if _, err := toValue(reflect.ValueOf(uint64(math.MaxUint64))); err == nil {
+		t.Fatal("expected an overflow error")
+	}
+
+	v, err := toValue(reflect.ValueOf(uint64(math.MaxInt64)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != NewInt64(math.MaxInt64) {
+		t.Fatalf("expected %d, got %v", int64(math.MaxInt64), v)
+	}
+}
+
+func TestMemberName(t *testing.T) {
+	data := map[string]string{
+		"Name":       "name",
+		"ID":         "id",
+		"URL":        "url",
+		"URLPath":    "urlPath",
+		"HTTPServer": "httpServer",
+		"X":          "x",
+	}
+
+	for k, v := range data {
+		if n := memberName(k, ""); n != v {
+			t.Fatalf("expected %s for %s, got %s", v, k, n)
+		}
+	}
+}
+
+type convertLevel int
+
+func (l convertLevel) MarshalText() ([]byte, error) {
+	return []byte("level" + fmt.Sprint(int(l))), nil
+}
+
+func (l *convertLevel) UnmarshalText(b []byte) error {
+	_, err := fmt.Sscanf(string(b), "level%d", (*int)(l))
+	return err
+}
+
+type convertBase struct {
+	ID int `json:"id"`
+}
+
+type convertItem struct {
+	convertBase
+	Name   string            `json:"name"`
+	Level  convertLevel      `json:"level"`
+	Tags   []string          `json:"tags,omitempty"`
+	Labels map[string]int    `json:"labels"`
+	Parent *convertItem      `json:"parent"`
+	Secret string            `json:"-"`
+	Extra  map[string]string `json:"extra,omitempty"`
+}
+
+func TestToValue(t *testing.T) {
+	v, err := ToValue(&convertItem{
+		convertBase: convertBase{ID: 3},
+		Name:        "foo",
+		Level:       2,
+		Labels:      map[string]int{"a": 1},
+		Parent:      &convertItem{Name: "bar"},
+		Secret:      "x",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := v.Export(0).(map[string]interface{})
+
+	if m["id"] != int64(3) || m["name"] != "foo" || m["level"] != "level2" {
+		t.Fatalf("unexpected value %v", m)
+	}
+
+	if _, ok := m["tags"]; ok {
+		t.Fatal("expected tags to be omitted")
+	}
+
+	if _, ok := m["Secret"]; ok {
+		t.Fatal("expected the secret to be ignored")
+	}
+
+	if m["labels"].(map[string]interface{})["a"] != int64(1) {
+		t.Fatalf("unexpected labels %v", m["labels"])
+	}
+
+	parent := m["parent"].(map[string]interface{})
+	if parent["name"] != "bar" || parent["parent"] != nil {
+		t.Fatalf("unexpected parent %v", parent)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	p := compileTest(t, `
+		function main() {
+			return {
+				id: 3,
+				name: "foo",
+				level: "level2",
+				tags: ["a", "b"],
+				labels: { a: 1 },
+				parent: { Name: "bar" },
+				unknown: true
+			}
+		}
+	`)
+
+	v, err := NewVM(p).Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var item convertItem
+	if err := v.Decode(&item); err != nil {
+		t.Fatal(err)
+	}
+
+	if item.ID != 3 || item.Name != "foo" || item.Level != 2 || len(item.Tags) != 2 ||
+		item.Labels["a"] != 1 || item.Parent == nil || item.Parent.Name != "bar" {
+		t.Fatalf("unexpected value %+v", item)
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	p := compileTest(t, `
+		function main() {
+			return { parent: { tags: ["a", 2] } }
+		}
+	`)
+
+	v, err := NewVM(p).Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var item convertItem
+	err = v.Decode(&item)
+
+	var de *DecodeError
+	if !errors.As(err, &de) {
+		t.Fatalf("expected a DecodeError, got %v", err)
+	}
+
+	if de.Path != "parent.tags[1]" {
+		t.Fatalf("unexpected path %s", de.Path)
+	}
+
+	if err := v.Decode(item); err == nil {
+		t.Fatal("expected an error decoding to a non pointer")
+	}
+}
+
+func TestSetNative(t *testing.T) {
+	AddNativeFunc(NativeFunction{
+		Name:      "tests.answer",
+		Arguments: 0,
+		Function: func(this Value, args []Value, vm *VM) (Value, error) {
+			return NewInt(1), nil
+		},
+	})
+
+	p := compileTest(t, `
+		function main() {
+			return tests.answer()
+		}
+	`)
+
+	vm := NewVM(p)
+
+	err := vm.SetNative(NativeFunction{
+		Name:      "tests.answer",
+		Arguments: 0,
+		Function: func(this Value, args []Value, vm *VM) (Value, error) {
+			return NewInt(42), nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range []*VM{vm, vm.Clone(p, nil), NewVM(p)} {
+		v, err := m.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := 42
+		if m.natives == nil {
+			expected = 1
+		}
+
+		if v != NewInt(expected) {
+			t.Fatalf("expected %d, got %v", expected, v)
+		}
+	}
+
+	if err := vm.SetNative(NativeFunction{Name: "tests.notFound"}); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestSuspend(t *testing.T) {
+	AddNativeFunc(NativeFunction{
+		Name:      "tests.suspend",
+		Arguments: 1,
+		Function: func(this Value, args []Value, vm *VM) (Value, error) {
+			return NullValue, vm.Suspend(args[0])
+		},
+	})
+
+	code := `
+		let total = 0
+
+		function main() {
+			let items = ""
+			let add = (v: number) => { items += v + ","; total += v }
+
+			for (let i = 0; i < 3; i++) {
+				try {
+					let v = tests.suspend("step " + i)
+					if (v < 0) {
+						throw "negative"
+					}
+					add(v)
+				} catch (e) {
+					add(100)
+				}
+			}
+
+			return items + " " + total
+		}
+	`
+
+	p := compileTest(t, code)
+	_, err := NewVM(p).Run()
+
+	inputs := []int{1, -1, 3}
+
+	for i, input := range inputs {
+		s, ok := err.(*Suspended)
+		if !ok {
+			t.Fatalf("expected the program to be suspended, got %v", err)
+		}
+
+		if s.Value != NewString(fmt.Sprintf("step %d", i)) {
+			t.Fatalf("unexpected suspended value %v", s.Value)
+		}
+
+		// resume in a new VM of a program compiled again
+		vm := NewVM(compileTest(t, code))
+
+		var v Value
+		v, err = vm.Resume(s.State, NewInt(input))
+
+		if i == len(inputs)-1 {
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v != NewString("1,100,3, 104") {
+				t.Fatalf("unexpected value %v", v)
+			}
+		}
+	}
+}
+
+func TestSuspendErrors(t *testing.T) {
+	AddNativeFunc(NativeFunction{
+		Name:      "tests.suspend",
+		Arguments: 1,
+		Function: func(this Value, args []Value, vm *VM) (Value, error) {
+			return NullValue, vm.Suspend(args[0])
+		},
+	})
+
+	AddNativeFunc(NativeFunction{
+		Name:      "tests.newObject",
+		Arguments: 0,
+		Function: func(this Value, args []Value, vm *VM) (Value, error) {
+			return NewObject(obj{}), nil
+		},
+	})
+
+	p := compileTest(t, `
+		function main() {
+			let o = tests.newObject()
+			tests.suspend(1)
+		}
+	`)
+
+	_, err := NewVM(p).Run()
+	if err == nil || !strings.Contains(err.Error(), "can't be serialized") {
+		t.Fatalf("expected a serialization error, got %v", err)
+	}
+
+	p = compileTest(t, `
+		function main() {
+			tests.suspend(1)
+		}
+	`)
+
+	_, err = NewVM(p).Run()
+	s, ok := err.(*Suspended)
+	if !ok {
+		t.Fatalf("expected the program to be suspended, got %v", err)
+	}
+
+	other := compileTest(t, `
+		function main() {
+			tests.suspend(2)
+		}
+	`)
+
+	if _, err := NewVM(other).Resume(s.State, NullValue); err == nil {
+		t.Fatal("expected an error resuming another program")
+	}
+
+	if _, err := NewVM(p).Resume(s.State[:len(s.State)-1], NullValue); err != ErrInvalidState {
+		t.Fatalf("expected an invalid state, got %v", err)
+	}
+}
+
+func TestSuspendEditedState(t *testing.T) {
+	var edit func(f *stackFrame)
+
+	AddNativeFunc(NativeFunction{
+		Name:      "tests.suspendEdited",
+		Arguments: 0,
+		Function: func(this Value, args []Value, vm *VM) (Value, error) {
+			edit(vm.callStack[vm.fp])
+			return NullValue, vm.Suspend(NullValue)
+		},
+	})
+
+	p := compileTest(t, `
+		function main() {
+			let a = 1
+			let b = 2
+			tests.suspendEdited()
+			return a + b
+		}
+	`)
+
+	edits := []func(f *stackFrame){
+		func(f *stackFrame) { f.values = f.values[:1] },
+		func(f *stackFrame) { f.maxRegIndex = 1 },
+		func(f *stackFrame) { f.retAddress = NewAddress(AddrLocal, 1000) },
+	}
+
+	for i, e := range edits {
+		edit = e
+
+		_, err := NewVM(p).Run()
+		s, ok := err.(*Suspended)
+		if !ok {
+			t.Fatalf("%d: expected the program to be suspended, got %v", i, err)
+		}
+
+		if _, err := NewVM(p).Resume(s.State, NullValue); err != ErrInvalidState {
+			t.Fatalf("%d: expected an invalid state, got %v", i, err)
+		}
+	}
+}
+
+type suspendFinalizer struct {
+	closed *bool
+}
+
+func (f suspendFinalizer) Close() error {
+	*f.closed = true
+	return nil
+}
+
+func TestSuspendErrorChain(t *testing.T) {
+	var closed bool
+
+	libs := []NativeFunction{
+		{
+			Name:      "tests.suspend",
+			Arguments: 1,
+			Function: func(this Value, args []Value, vm *VM) (Value, error) {
+				return NullValue, vm.Suspend(args[0])
+			},
+		},
+		{
+			Name: "tests.open",
+			Function: func(this Value, args []Value, vm *VM) (Value, error) {
+				return NullValue, fmt.Errorf("open foo: %w", fs.ErrNotExist)
+			},
+		},
+		{
+			Name: "tests.finalizer",
+			Function: func(this Value, args []Value, vm *VM) (Value, error) {
+				vm.SetGlobalFinalizer(suspendFinalizer{&closed})
+				return NullValue, nil
+			},
+		},
+	}
+
+	for _, l := range libs {
+		AddNativeFunc(l)
+	}
+
+	RegisterErrorCode(fs.ErrNotExist, "notFound")
+	defer delete(errorCodes, fs.ErrNotExist)
+
+	p := compileTest(t, `
+		function main() {
+			let err
+			try {
+				tests.open()
+			} catch (e) {
+				err = e
+			}
+
+			tests.suspend(1)
+			tests.finalizer()
+
+			return err.code + " " + err.cause.cause.message + " " + (err.stackTrace != "")
+		}
+	`)
+
+	_, err := NewVM(p).Run()
+	s, ok := err.(*Suspended)
+	if !ok {
+		t.Fatalf("expected the program to be suspended, got %v", err)
+	}
+
+	v, err := NewVM(p).Resume(s.State, NullValue)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v != NewString("notFound file does not exist true") {
+		t.Fatalf("unexpected value %v", v)
+	}
+
+	if !closed {
+		t.Fatal("expected the global finalizers to run after resuming")
+	}
+}
+
+func TestIsolate(t *testing.T) {
+	p := compileTest(t, `
+		let a = [1, 2]
+		let b = { a: a }
+
+		function main() {
+			let n = 3
+			return () => a[0] + b.a[1] + n
+		}
+	`)
+
+	vm := NewVM(p)
+	f, err := vm.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, values, err := vm.Isolate(context.Background(), f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the copies don't change the globals of vm
+	m.Globals()[0].ToArray()[0] = NewInt(10)
+
+	v, err := m.RunClosure(values[0].ToObject().(Closure))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.ToInt() != 15 {
+		t.Fatalf("expected 15, got %v", v)
+	}
+
+	v, err = vm.RunClosure(f.ToObject().(Closure))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.ToInt() != 6 {
+		t.Fatalf("expected 6, got %v", v)
+	}
+
+	if _, err := CopyValue(f); err == nil {
+		t.Fatal("expected an error copying a function")
+	}
+}
+
+func TestCopyError(t *testing.T) {
+	data := NewMapValues(map[string]Value{"id": NewInt(3)})
+
+	inner := NewCodeError("inner", "inner error")
+	inner.SetData(data)
+
+	e := NewCodeError("outer", "outer error")
+	e.SetData(data)
+	e.Wrap(inner)
+
+	c := CopyError(e)
+	if c.Code() != "outer" || c.Data().ToMap() == data.ToMap() {
+		t.Fatalf("expected a copy of the data, got %v", c.Data())
+	}
+
+	if w := c.wraped[0]; w.Code() != "inner" || w.Data().ToMap() == data.ToMap() {
+		t.Fatalf("expected a copy of the wrapped data, got %v", w.Data())
+	}
+
+	g := CopyError(context.Canceled)
+	if g.Message() != "context canceled" || !errors.Is(g, context.Canceled) {
+		t.Fatalf("expected the Go error to be converted, got %v", g)
+	}
+}
+
+func TestRaceDetector(t *testing.T) {
+	p := compileTest(t, `
+		let count = 0
+		function inc() { count++ }
+	`)
+
+	vm := NewVM(p)
+	d := vm.DetectRaces()
+	if err := vm.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a and b are synchronized by the lock
+	a := vm.Clone(p, vm.Globals())
+	b := vm.Clone(p, vm.Globals())
+	if _, err := a.RunFunc("inc"); err != nil {
+		t.Fatal(err)
+	}
+	a.RaceRelease("lock")
+	b.RaceAcquire("lock")
+	if _, err := b.RunFunc("inc"); err != nil {
+		t.Fatal(err)
+	}
+
+	if races := d.Races(); len(races) != 0 {
+		t.Fatalf("unexpected race %v", races[0])
+	}
+
+	// c doesn't know about the writes of a and b
+	c := vm.Clone(p, vm.Globals())
+	if _, err := c.RunFunc("inc"); err != nil {
+		t.Fatal(err)
+	}
+
+	races := d.Races()
+	if len(races) != 1 {
+		t.Fatalf("expected 1 race, got %d", len(races))
+	}
+
+	r := races[0]
+	if r.Location != "global count" || r.Current.Write || !r.Previous.Write {
+		t.Fatalf("unexpected race %v", r)
+	}
+}
+
+func TestRaceDetectorReleasesValues(t *testing.T) {
+	p := compileTest(t, `
+		function touch(a) { a[0] = 1 }
+	`)
+
+	vm := NewVM(p)
+	vm.DetectRaces()
+	if err := vm.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+
+	collected := make(chan bool, 1)
+
+	func() {
+		a := NewArrayValues([]Value{NewInt(0)})
+		runtime.SetFinalizer(a.ToArrayObject(), func(*NewArrayObject) { collected <- true })
+		if _, err := vm.RunFunc("touch", a); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// the detector must not keep the values that it has seen
+	for i := 0; i < 10; i++ {
+		runtime.GC()
+		select {
+		case <-collected:
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	t.Fatal("the array was not collected")
+}
+
+func TestRecordReplay(t *testing.T) {
+	counter := 0
+
+	AddNativeFunc(NativeFunction{
+		Name:      "tests.next",
+		Arguments: 0,
+		Function: func(this Value, args []Value, vm *VM) (Value, error) {
+			counter++
+			return NewInt(counter), nil
+		},
+	})
+
+	AddNativeFunc(NativeFunction{
+		Name:      "tests.newObject",
+		Arguments: 0,
+		Function: func(this Value, args []Value, vm *VM) (Value, error) {
+			return NewObject(obj{}), nil
+		},
+	})
+
+	AddNativeFunc(NativeFunction{
+		Name:      "tests.fail",
+		Arguments: 0,
+		Function: func(this Value, args []Value, vm *VM) (Value, error) {
+			if counter > 5 {
+				return NullValue, fmt.Errorf("snap!")
+			}
+			return NullValue, nil
+		},
+	})
+
+	code := `
+		function main() {
+			let o = tests.newObject()
+			let s = tests.next() + " " + tests.next() + " " + o.sayHi(o.name)
+			try {
+				tests.fail()
+			} catch (e) {
+				s += " " + e.message
+			}
+			return s
+		}
+	`
+
+	var log bytes.Buffer
+
+	vm := NewVM(compileTest(t, code))
+	vm.Recorder = NewRecorder(&log)
+
+	counter = 10
+	v, err := vm.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v != NewString("11 12 Hi foo snap!") {
+		t.Fatalf("unexpected value %v", v)
+	}
+
+	// replaying doesn't call the natives
+	counter = 0
+
+	replayer, err := NewReplayer(bytes.NewReader(log.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm = NewVM(compileTest(t, code))
+	vm.Replayer = replayer
+
+	v, err = vm.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v != NewString("11 12 Hi foo snap!") {
+		t.Fatalf("unexpected replayed value %v", v)
+	}
+
+	if counter != 0 {
+		t.Fatalf("expected the natives not to be called")
+	}
+
+	if err := replayer.Done(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a program that makes different calls
+	replayer, err = NewReplayer(bytes.NewReader(log.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm = NewVM(compileTest(t, `
+		function main() {
+			let o = tests.newObject()
+			try {
+				return o.sayHi("bar")
+			} catch (e) {
+				return "catched"
+			}
+		}
+	`))
+	vm.Replayer = replayer
+
+	_, err = vm.Run()
+
+	d, ok := err.(*DivergenceError)
+	if !ok {
+		t.Fatalf("expected a DivergenceError, got %v", err)
+	}
+
+	if d.Index != 1 || !strings.Contains(d.Expected, "call tests.next()") ||
+		!strings.Contains(d.Got, "get #1.sayHi") || len(d.Stacktrace) == 0 {
+		t.Fatalf("unexpected divergence %v", d)
+	}
+}
+
+func TestNativeFuncError(t *testing.T) {
+	libs := []NativeFunction{
+		NativeFunction{
+			Name:      "math.square",
+			Arguments: 1,
+			Function: func(this Value, args []Value, vm *VM) (Value, error) {
+				return NullValue, fmt.Errorf("snap!")
+			},
+		},
+		NativeFunction{
+			Name:      "log.error",
+			Arguments: -1,
+			Function: func(this Value, args []Value, vm *VM) (Value, error) {
+				return NullValue, nil
+			},
+		},
+	}
+
+	assertNativeValue(t, libs, nil, `
+		function main() {
+			try {
+				math.square(2)				
+			} catch (error) {
+				log.error("asdfas", error)
+			}
+		}
+	`)
+}
+
+type obj struct{}
+
+func (d obj) GetProperty(key string, vm *VM) (Value, error) {
+	switch key {
+	case "name":
+		return NewString("foo"), nil
+	}
+	return UndefinedValue, nil
+}
+
+func (d obj) GetMethod(name string) NativeMethod {
+	switch name {
+	case "sayHi":
+		return d.sayHI
+	}
+	return nil
+}
+
+func (d obj) sayHI(args []Value, vm *VM) (Value, error) {
+	return NewString("Hi " + args[0].ToString()), nil
+}
+
+func assertNativeValue(t *testing.T, funcs []NativeFunction, expected interface{}, code string) {
+	a, err := parser.ParseStr(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewCompiler()
+
+	for _, f := range funcs {
+		AddNativeFunc(f)
+	}
+
+	p, err := c.Compile(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm := NewVM(p)
+
+	// Print(p)
+	// vm.MaxSteps = 10
+
+	ret, err := vm.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := NewValue(expected)
+
+	if ret != v {
+		t.Fatalf("Expected %v %T, got %v %T", expected, expected, ret, ret)
+	}
+}
+
+func assertValueFS(t *testing.T, fs filesystem.FS, path string, expected interface{}) {
+	p, err := Compile(fs, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Print(p)
+	// PrintNames(p, true)
+	// vm.MaxSteps = 50
+
+	vm := NewVM(p)
+
+	ret, err := vm.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := NewValue(expected)
+
+	if ret != v {
+		t.Fatalf("Expected %v %T, got %v %T", expected, expected, ret, ret)
+	}
+}
+
+func assertValue(t *testing.T, expected interface{}, code string) {
+	p := compileTest(t, code)
+	vm := NewVM(p)
+
+	// Print(p)
+	// vm.MaxSteps = 50
+
+	ret, err := vm.Run()
+	if err != nil {
+
+		t.Fatal(err)
+	}
+
+	if ret != NewValue(expected) {
+		t.Fatalf("Expected %v %T, got %v", expected, expected, ret.ToString())
+	}
+}
+
+func assertRegister(t *testing.T, register string, expected interface{}, code string) {
+	p := compileTest(t, code)
+	vm := NewVM(p)
+
+	// Print(p)
+	// vm.MaxSteps = 50
+
+	_, err := vm.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, _ := vm.RegisterValue(register)
+
+	if v != NewValue(expected) {
+		t.Fatalf("Expected %v, got %v", expected, v)
+	}
+}
+
+func compileTest(t *testing.T, code string) *Program {
+	p, err := CompileStr(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func normalize(s string) string {
+	var reg = regexp.MustCompile(`\s+`)
+	s = reg.ReplaceAllString(s, ` `)
+	return s
+}
+
+func TestVerify(t *testing.T) {
+	code := `
+		function main() {
+			let a = 3
+			let f = (x) => x + a
+			try {
+				return f(2)
+			} catch(e) {
+				return 0
+			}
+		}
+	`
+
+	if err := Verify(compileTest(t, code)); err != nil {
+		t.Fatal(err)
+	}
+
+	data := []struct {
+		name   string
+		modify func(p *Program)
+	}{
+		{"local out of range", func(p *Program) {
+			f := mainFunc(t, p)
+			f.MaxRegIndex = 0
+		}},
+		{"constant out of range", func(p *Program) {
+			instr := findInstruction(t, p, op_ldk)
+			instr.B = NewAddress(AddrConstant, len(p.Constants))
+		}},
+		{"write to constant", func(p *Program) {
+			instr := findInstruction(t, p, op_ldk)
+			instr.A = NewAddress(AddrConstant, 0)
+		}},
+		{"native out of range", func(p *Program) {
+			instr := findInstruction(t, p, op_ret)
+			instr.A = NewAddress(AddrNativeFunc, len(All()))
+		}},
+		{"function out of range", func(p *Program) {
+			instr := findInstruction(t, p, op_clo)
+			instr.B = NewAddress(AddrFunc, len(p.Functions))
+		}},
+		{"jump out of range", func(p *Program) {
+			f := mainFunc(t, p)
+			f.Instructions[0] = NewInstruction(op_jmp, NewAddress(AddrData, len(f.Instructions)), Void, Void)
+		}},
+		{"jump back out of range", func(p *Program) {
+			f := mainFunc(t, p)
+			f.Instructions[0] = NewInstruction(op_jpb, NewAddress(AddrData, 1), Void, Void)
+		}},
+		{"catch out of range", func(p *Program) {
+			instr := findInstruction(t, p, op_try)
+			instr.A = NewAddress(AddrData, 1000)
+		}},
+		{"closure out of range", func(p *Program) {
+			instr := findInstruction(t, p, op_ret)
+			instr.A = NewAddress(AddrClosure, 0)
+		}},
+		{"closure called directly", func(p *Program) {
+			instr := findInstruction(t, p, op_cas)
+			instr.A = findInstruction(t, p, op_clo).B
+		}},
+		{"unresolved", func(p *Program) {
+			instr := findInstruction(t, p, op_ret)
+			instr.A = NewAddress(AddrUnresolved, 0)
+		}},
+		{"no return", func(p *Program) {
+			f := mainFunc(t, p)
+			f.Instructions = f.Instructions[:1]
+		}},
+	}
+
+	for _, d := range data {
+		p := compileTest(t, code)
+		d.modify(p)
+
+		err := Verify(p)
+		if _, ok := err.(*VerifyError); !ok {
+			t.Fatalf("%s: expected a VerifyError, got %v", d.name, err)
+		}
+	}
+}
+
+func TestAsmRoundTrip(t *testing.T) {
+	AddNativeFunc(NativeFunction{
+		Name:      "asm.square",
+		Arguments: 1,
+		Function: func(this Value, args []Value, vm *VM) (Value, error) {
+			v := args[0].ToInt()
+			return NewInt64(v * v), nil
+		},
+	})
+
+	p := compileTest(t, `
+		//gt: permissions "trusted" x
+
+		class Foo {
+			bar = 1.5
+			constructor(v) { this.bar += v }
+			get() { return this.bar }
+		}
+
+		function main() {
+			let s = "a\t\"b\"; c"
+			let r = 'x'
+			let n = null
+			let a = 3
+			let f = (x) => x + a
+			try {
+				return asm.square(f(2)) + new Foo(0.5).get() + s.length
+			} catch(e) {
+				return 0
+			}
+		}
+	`)
+
+	var b bytes.Buffer
+	if err := Disassemble(&b, p); err != nil {
+		t.Fatal(err)
+	}
+
+	p2, err := Assemble(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(p.Functions, p2.Functions) {
+		t.Fatal("the functions are different")
+	}
+	if !reflect.DeepEqual(p.Constants, p2.Constants) {
+		t.Fatal("the constants are different")
+	}
+	if !reflect.DeepEqual(p.Classes, p2.Classes) {
+		t.Fatal("the classes are different")
+	}
+	if !reflect.DeepEqual(p.Directives, p2.Directives) {
+		t.Fatal("the directives are different")
+	}
+	if !reflect.DeepEqual(p.Files, p2.Files) {
+		t.Fatal("the files are different")
+	}
+
+	ret, err := NewVM(p2).Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret != NewFloat(35) {
+		t.Fatalf("expected 35, got %v", ret)
+	}
+}
+
+func TestAsm(t *testing.T) {
+	p, err := Assemble(strings.NewReader(`
+		.function 0 "@global" args=0 regs=0 kind=global
+		  RET --  --  --
+		.end
+
+		.function 1 "main" args=0 regs=2 kind=main
+		  .register "i" 0 0 5
+		  LDK 0L 0K -- ; i = 0
+		  ADD 0L 0L 1K
+		  LST 1L 0L 2K
+		  TJP 1L 1D 1D
+		  JPB 3D -- --
+		  RET 0L -- --
+		.end
+
+		.constant int 0
+		.constant int 1
+		.constant int 10
+	`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Verify(p); err != nil {
+		t.Fatal(err)
+	}
+
+	ret, err := NewVM(p).Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret != NewInt(10) {
+		t.Fatalf("expected 10, got %v", ret)
+	}
+}
+
+func TestRunContext(t *testing.T) {
+	p := compileTest(t, `
+		function main() {
+			while (true) { }
+		}
+	`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	_, err := NewVM(p).RunContext(ctx)
+
+	var e *CancelError
+	if !errors.As(err, &e) {
+		t.Fatalf("expected a CancelError, got %v", err)
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", e.Err)
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	p := compileTest(t, `
+		function main() {
+			let i = 0
+			while (true) {
+				try {
+					i++
+				} catch {
+					return i
+				}
+			}
+		}
+	`)
+
+	vm := NewVM(p)
+	vm.Deadline = time.Now().Add(20 * time.Millisecond)
+
+	_, err := vm.Run()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the deadline to be exceeded, got %v", err)
+	}
+}
+
+func TestCancelNotCatched(t *testing.T) {
+	AddNativeFunc(NativeFunction{
+		Name: "tests.wait",
+		Function: func(this Value, args []Value, vm *VM) (Value, error) {
+			ctx := vm.GoContext()
+			<-ctx.Done()
+			return NullValue, ctx.Err()
+		},
+	})
+
+	a, err := parser.ParseStr(`
+		function main() {
+			try {
+				tests.wait()
+			} catch {
+				return "catched"
+			}
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	ret, err := vm.Run()
+	p, err := NewCompiler().Compile(a)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	v := NewValue(expected)
+	vm := NewVM(p)
+	vm.Deadline = time.Now().Add(20 * time.Millisecond)
 
-	if ret != v {
-		t.Fatalf("Expected %v %T, got %v %T", expected, expected, ret, ret)
+	ret, err := vm.Run()
+
+	var e *CancelError
+	if !errors.As(err, &e) {
+		t.Fatalf("expected a CancelError, got %v %v", ret, err)
 	}
 }
 
-func assertValue(t *testing.T, expected interface{}, code string) {
-	p := compileTest(t, code)
+func TestMemoryLimit(t *testing.T) {
+	p := compileTest(t, `
+		function main() {
+			let s = "0123456789"
+			while (true) {
+				s += s
+			}
+		}
+	`)
+
 	vm := NewVM(p)
+	vm.MaxAllocations = 10000
 
-	// Print(p)
-	// vm.MaxSteps = 50
+	_, err := vm.Run()
+	if err == nil || !strings.Contains(err.Error(), "Memory limit reached") {
+		t.Fatalf("expected a memory limit error, got %v", err)
+	}
+}
+
+func TestMemoryReleased(t *testing.T) {
+	p := compileTest(t, `
+		function build() {
+			let s = ""
+			for (let i = 0; i < 100; i++) {
+				s += "0123456789"
+			}
+			return s.length
+		}
+
+		function main() {
+			let n = 0
+			for (let i = 0; i < 100; i++) {
+				n += build()
+			}
+			return n
+		}
+	`)
+
+	vm := NewVM(p)
+	vm.MaxAllocations = 100000
 
 	ret, err := vm.Run()
 	if err != nil {
-
 		t.Fatal(err)
 	}
+	if ret != NewInt(100000) {
+		t.Fatalf("expected 100000, got %v", ret)
+	}
+	if vm.Allocations() > 1000 {
+		t.Fatalf("the memory of the functions was not released: %d", vm.Allocations())
+	}
+}
 
-	if ret != NewValue(expected) {
-		t.Fatalf("Expected %v %T, got %v", expected, expected, ret.ToString())
+func TestMemoryReleasedTemporaryArray(t *testing.T) {
+	p := compileTest(t, `
+		function build() {
+			let s = "0123456789"
+			let a = [s, s, s, s, s, s, s, s, s, s]
+			let b = [...a, ...a, ...a, ...a, ...a, ...a, ...a, ...a, ...a, ...a]
+			return b.length
+		}
+
+		function main() {
+			let n = 0
+			for (let i = 0; i < 1000; i++) {
+				n += build()
+			}
+			return n
+		}
+	`)
+
+	vm := NewVM(p)
+	vm.MaxAllocations = 100000
+
+	ret, err := vm.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret != NewInt(100000) {
+		t.Fatalf("expected 100000, got %v", ret)
 	}
 }
 
-func assertRegister(t *testing.T, register string, expected interface{}, code string) {
-	p := compileTest(t, code)
+func TestMemoryLimitGlobal(t *testing.T) {
+	p := compileTest(t, `
+		let s = ""
+
+		function add() {
+			s += "0123456789"
+		}
+
+		function main() {
+			for (let i = 0; i < 1000; i++) {
+				add()
+			}
+		}
+	`)
+
 	vm := NewVM(p)
+	vm.MaxAllocations = 5000
 
-	// Print(p)
-	// vm.MaxSteps = 50
+	_, err := vm.Run()
+	if err == nil || !strings.Contains(err.Error(), "Memory limit reached") {
+		t.Fatalf("expected a memory limit error, got %v", err)
+	}
+}
+
+func TestMemoryLimitEscaped(t *testing.T) {
+	p := compileTest(t, `
+		let store = {}
+
+		function put(i) {
+			let m = {}
+			store["k" + i] = m
+		}
+
+		function grow(i) {
+			let m = store["k" + i]
+			for (let j = 0; j < 100; j++) {
+				m["j" + j] = "0123456789"
+			}
+		}
+
+		function main() {
+			for (let i = 0; i < 1000; i++) {
+				put(i)
+				grow(i)
+			}
+		}
+	`)
+
+	vm := NewVM(p)
+	vm.MaxAllocations = 100000
 
 	_, err := vm.Run()
+	if err == nil || !strings.Contains(err.Error(), "Memory limit reached") {
+		t.Fatalf("expected a memory limit error, got %v", err)
+	}
+}
+
+func TestMemoryArguments(t *testing.T) {
+	p := compileTest(t, `
+		function replace(s) {
+			s = ""
+			return s
+		}
+
+		function main() {
+			for (let i = 0; i < 100; i++) {
+				replace("0123456789")
+			}
+		}
+	`)
+
+	vm := NewVM(p)
+	vm.MaxAllocations = 100000
+
+	if _, err := vm.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if vm.Allocations() < 0 {
+		t.Fatalf("the arguments were not accounted: %d", vm.Allocations())
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	p := compileTest(t, `
+		//gt: permissions net:dial:*.internal:443 sql:db:tenant_* fs:write
+
+		function main() { }
+	`)
+
+	vm := NewVM(p)
+
+	var audited []AuditEntry
+	vm.Audit = func(e AuditEntry) {
+		audited = append(audited, e)
+	}
+
+	data := []struct {
+		capability string
+		resource   string
+		expected   bool
+	}{
+		{"net:dial", "api.internal:443", true},
+		{"net:dial", "api.internal:80", false},
+		{"net:dial", "api.internal:443.evil.com:443", false},
+		{"net:dial", "internal:443", false},
+		{"net:listen", ":8080", false},
+		{"sql:db", "tenant_1", true},
+		{"sql:db", "admin", false},
+		{"fs:write", "/any/file", true},
+		{"fs:read", "/any/file", false},
+	}
+
+	var denied int
+	for _, d := range data {
+		if vm.HasCapability(d.capability, d.resource) != d.expected {
+			t.Fatalf("%s %s: expected %v", d.capability, d.resource, d.expected)
+		}
+		if !d.expected {
+			denied++
+		}
+	}
+
+	if len(vm.AuditLog()) != denied || len(audited) != denied {
+		t.Fatalf("expected %d audit entries, got %d", denied, len(vm.AuditLog()))
+	}
+
+	if !p.HasScope("net") || p.HasScope("http") {
+		t.Fatal("invalid scopes")
+	}
+
+	vm.Trusted = true
+	if !vm.HasCapability("net:listen", ":8080") {
+		t.Fatal("trusted VMs have all the capabilities")
+	}
+}
+
+func mainFunc(t *testing.T, p *Program) *Function {
+	f, ok := p.Function("main")
+	if !ok {
+		t.Fatal("main not found")
+	}
+	return f
+}
+
+func findInstruction(t *testing.T, p *Program, op Opcode) *Instruction {
+	for _, instr := range mainFunc(t, p).Instructions {
+		if instr.Opcode == op {
+			return instr
+		}
+	}
+	t.Fatalf("instruction %v not found", op)
+	return nil
+}
+
+func TestSpread(t *testing.T) {
+	assertValue(t, "0 1 2 3 4 5 6 | 3 | 5", `
+		function join(...values) {
+			let s = ""
+			for (let v of values) {
+				s += v + " "
+			}
+			return s
+		}
+
+		function count(a, ...rest) {
+			return rest.length
+		}
+
+		function main() {
+			let a = [1, 2]
+			let b = [4, 5]
+			let c = [0, ...a, 3, ...b, ...null]
+			let f = (x, ...y) => x + y.length
+			return join(...c, 6) + "| " + count(1, ...a, 3) + " | " + f(...[4], ...[5])
+		}
+	`)
+
+	assertValue(t, 0, `
+		function count(a, b, ...rest) {
+			return rest.length
+		}
+
+		function main() {
+			return count(1)
+		}
+	`)
+
+	assertValue(t, "a1b3c4", `
+		function main() {
+			let defaults = { a: 1, b: 2 }
+			let overrides = { b: 3 }
+			let m = { ...defaults, ...overrides, c: 4, ...undefined }
+			let s = ""
+			for (let k in m) {
+				s += k + m[k]
+			}
+			return s
+		}
+	`)
+}
+
+func TestRegexLiteral(t *testing.T) {
+	assertValue(t, "true 2 2-1|4-3 a,b,c", `
+		function main() {
+			let a = 8
+			let b = 2
+			let n = a / b / 2
+			let r = /(\d)-(?P<last>\d)/g
+			let ok = /^ab+c$/i.test("ABBC") && !/x/.test("abc")
+			let s = r.replace("1-2|3-4", m => m.groups.last + "-" + m.captures[0])
+			let p = /\s*;\s*/.split("a ; b;c")
+			return ok + " " + n + " " + s + " " + p[0] + "," + p[1] + "," + p[2]
+		}
+	`)
+
+	assertValue(t, "3 bc true", `
+		function main() {
+			let m = /b(c)(d)?/.exec("abc")
+			return m.index + m.value.length + " " + m.value + " " + (m.captures[1] == null)
+		}
+	`)
+
+	if _, err := CompileStr(`function main() { return /a/x }`); err == nil {
+		t.Fatal("expected an invalid flag error")
+	}
+}
+
+func TestDecimal(t *testing.T) {
+	tests := []struct {
+		value  string
+		places int
+		mode   RoundingMode
+		result string
+	}{
+		{"1.005", 2, RoundHalfUp, "1.01"},
+		{"1.005", 2, RoundHalfEven, "1.00"},
+		{"1.015", 2, RoundHalfEven, "1.02"},
+		{"1.005", 2, RoundHalfDown, "1.00"},
+		{"-1.005", 2, RoundHalfUp, "-1.01"},
+		{"1.001", 2, RoundUp, "1.01"},
+		{"1.009", 2, RoundDown, "1.00"},
+		{"-1.001", 2, RoundCeiling, "-1.00"},
+		{"-1.001", 2, RoundFloor, "-1.01"},
+		{"1.5", 3, RoundHalfUp, "1.500"},
+		{"1.5e2", 0, RoundHalfUp, "150"},
+		{".5", 0, RoundHalfEven, "0"},
+	}
+
+	for _, tt := range tests {
+		d, err := ParseDecimal(tt.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := d.Round(tt.places, tt.mode).String(); s != tt.result {
+			t.Fatalf("%s %v: expected %s, got %s", tt.value, tt.mode, tt.result, s)
+		}
+	}
+
+	if _, err := ParseDecimal("1.2.3"); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestDecimalOperators(t *testing.T) {
+	p := compileTest(t, `
+		function main(a, b) {
+			let total = a
+			for (let i = 0; i < 2; i++) {
+				total += b
+			}
+			if (total <= 0.3 && total == 0.3 && 0.3 == total && total > 0) {
+				return (-total * 2 / 3) + " " + (total % 0.2)
+			}
+			return "not equal: " + total
+		}
+	`)
+
+	vm := NewVM(p)
+	v, err := vm.Run(NewObject(NewDecimal(1, 1)), NewObject(NewDecimal(1, 1)))
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	v, _ := vm.RegisterValue(register)
+	if s := v.ToString(); s != "-0.2000000000000000 0.1" {
+		t.Fatal(s)
+	}
 
-	if v != NewValue(expected) {
-		t.Fatalf("Expected %v, got %v", expected, v)
+	vm = NewVM(p)
+	vm.Decimals = &DecimalContext{Places: 2, Rounding: RoundDown}
+	v, err = vm.Run(NewObject(NewDecimal(1, 1)), NewInt(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s := v.ToString(); s != "not equal: 0.1" {
+		t.Fatal(s)
+	}
+
+	b, err := json.Marshal(NewObject(NewDecimal(-5, 3)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `"-0.005"` {
+		t.Fatal(string(b))
 	}
 }
 
-func compileTest(t *testing.T, code string) *Program {
-	p, err := CompileStr(code)
+func TestDecimalLimits(t *testing.T) {
+	p := compileTest(t, `
+		function main(a) {
+			let total = a
+			for (let i = 0; i < 20; i++) {
+				total *= total
+			}
+			return total
+		}
+	`)
+
+	_, err := NewVM(p).Run(NewObject(NewDecimal(11, 1)))
+	if err == nil || !strings.Contains(err.Error(), "decimal out of range") {
+		t.Fatalf("expected an out of range error, got %v", err)
+	}
+
+	_, err = NewVM(p).Run(NewObject(NewDecimal(2, 0)))
+	if err == nil || !strings.Contains(err.Error(), "decimal out of range") {
+		t.Fatalf("expected an out of range error, got %v", err)
+	}
+
+	big, err := ParseDecimal("1" + strings.Repeat("0", 1500))
 	if err != nil {
 		t.Fatal(err)
 	}
-	return p
+	small, err := ParseDecimal("1e-900")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := big.Add(small); err == nil {
+		t.Fatal("expected an error rescaling the coefficient")
+	}
+
+	if _, err := ParseDecimal("1e-1001"); err == nil {
+		t.Fatal("expected an error parsing too many places")
+	}
+
+	i, err := ParseDecimal("-9223372036854775808.9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := i.Int64(); err != nil || n != math.MinInt64 {
+		t.Fatalf("expected %d, got %d %v", int64(math.MinInt64), n, err)
+	}
+
+	i, err = ParseDecimal("9223372036854775808")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := i.Int64(); err == nil {
+		t.Fatal("expected an int64 overflow")
+	}
 }
 
-func normalize(s string) string {
-	var reg = regexp.MustCompile(`\s+`)
-	s = reg.ReplaceAllString(s, ` `)
-	return s
+func BenchmarkMapSet(b *testing.B) {
+	keys := benchmarkKeys()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m := NewMap(0).ToMap()
+		for j, k := range keys {
+			m.Set(k, NewInt(j))
+		}
+	}
+}
+
+// BenchmarkGoMapSet is the unordered map that MapValue used before.
+func BenchmarkGoMapSet(b *testing.B) {
+	keys := benchmarkKeys()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m := make(map[string]Value)
+		for j, k := range keys {
+			m[k] = NewInt(j)
+		}
+	}
+}
+
+func BenchmarkMapGet(b *testing.B) {
+	keys := benchmarkKeys()
+	m := NewMap(0).ToMap()
+	for j, k := range keys {
+		m.Set(k, NewInt(j))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, k := range keys {
+			_ = m.Map[k]
+		}
+	}
+}
+
+func BenchmarkMapIterate(b *testing.B) {
+	keys := benchmarkKeys()
+	m := NewMap(0).ToMap()
+	for j, k := range keys {
+		m.Set(k, NewInt(j))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, k := range m.Keys() {
+			_ = m.Map[k]
+		}
+	}
+}
+
+func BenchmarkGoMapIterate(b *testing.B) {
+	keys := benchmarkKeys()
+	m := make(map[string]Value)
+	for j, k := range keys {
+		m[k] = NewInt(j)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for k, v := range m {
+			_, _ = k, v
+		}
+	}
+}
+
+func benchmarkKeys() []string {
+	keys := make([]string, 100)
+	for i := range keys {
+		keys[i] = "key" + strconv.Itoa(i)
+	}
+	return keys
 }
@@ -39,8 +39,10 @@ interface Array<T> {
     select<K>(func: (t: T) => K): Array<K>;
     selectMany<K>(func: (t: T) => K): K;
     distinct<K>(func?: (t: K) => any): Array<K>;
+    distinct(func: ((t: T) => any) | null, asSet: true): collections.Set<T>;
     where(func: (t: T) => any): Array<T>;
     groupBy(func: (t: T) => string | number): KeyIndexer<T[]>;
+    groupBy<K>(func: (t: T) => K, asMap: true): collections.Map<K, T[]>;
     sum<K extends number>(): number;
     sum<K extends number>(func: (t: T) => K): number;
     min(func: (t: T) => number): number;
@@ -163,7 +165,7 @@ var libArray = []core.NativeFunction{
 		Name:      "Array.prototype.any",
 		Arguments: 1,
 		Function: func(this core.Value, args []core.Value, vm *core.VM) (core.Value, error) {
-			a, err := toArray(this)
+			it, err := iterate(vm, this)
 			if err != nil {
 				return core.NullValue, err
 			}
@@ -187,7 +189,8 @@ var libArray = []core.NativeFunction{
 				return core.NullValue, fmt.Errorf("expected a function, got %s", b.TypeName())
 			}
 
-			for _, v := range a {
+			for it.next() {
+				v := it.value
 				var r core.Value
 				if funcIndex != -1 {
 					r, err = vm.RunFuncIndex(funcIndex, v)
@@ -222,6 +225,10 @@ var libArray = []core.NativeFunction{
 				}
 			}
 
+			if it.err != nil {
+				return core.NullValue, it.err
+			}
+
 			return core.FalseValue, nil
 		},
 	},
@@ -230,15 +237,11 @@ var libArray = []core.NativeFunction{
 		Name:      "Array.prototype.all",
 		Arguments: 1,
 		Function: func(this core.Value, args []core.Value, vm *core.VM) (core.Value, error) {
-			a, err := toArray(this)
+			it, err := iterate(vm, this)
 			if err != nil {
 				return core.NullValue, err
 			}
 
-			if len(a) == 0 {
-				return core.FalseValue, nil
-			}
-
 			funcIndex := -1
 			var closure core.Closure
 
@@ -258,7 +261,8 @@ var libArray = []core.NativeFunction{
 				return core.NullValue, fmt.Errorf("expected a function, got %s", b.TypeName())
 			}
 
-			for _, v := range a {
+			for it.next() {
+				v := it.value
 				var r core.Value
 				if funcIndex != -1 {
 					r, err = vm.RunFuncIndex(funcIndex, v)
@@ -293,6 +297,15 @@ var libArray = []core.NativeFunction{
 				}
 			}
 
+			if it.err != nil {
+				return core.NullValue, it.err
+			}
+
+			if it.index == -1 {
+				// no values
+				return core.FalseValue, nil
+			}
+
 			return core.TrueValue, nil
 		},
 	},
@@ -301,18 +314,23 @@ var libArray = []core.NativeFunction{
 		Name:      "Array.prototype.contains",
 		Arguments: 1,
 		Function: func(this core.Value, args []core.Value, vm *core.VM) (core.Value, error) {
-			a, err := toArray(this)
+			it, err := iterate(vm, this)
 			if err != nil {
 				return core.NullValue, err
 			}
 			b := args[0]
 
-			for _, v := range a {
+			for it.next() {
+				v := it.value
 				if v.Equals(b) {
 					return core.TrueValue, nil
 				}
 			}
 
+			if it.err != nil {
+				return core.NullValue, it.err
+			}
+
 			return core.FalseValue, nil
 		},
 	},
@@ -343,7 +361,7 @@ var libArray = []core.NativeFunction{
 		Name:      "Array.prototype.firstIndex",
 		Arguments: 1,
 		Function: func(this core.Value, args []core.Value, vm *core.VM) (core.Value, error) {
-			a, err := toArray(this)
+			it, err := iterate(vm, this)
 			if err != nil {
 				return core.NullValue, err
 			}
@@ -367,7 +385,8 @@ var libArray = []core.NativeFunction{
 				return core.NullValue, fmt.Errorf("expected a function, got %s", b.TypeName())
 			}
 
-			for i, v := range a {
+			for it.next() {
+				i, v := it.index, it.value
 				var r core.Value
 				if funcIndex != -1 {
 					r, err = vm.RunFuncIndex(funcIndex, v)
@@ -402,6 +421,10 @@ var libArray = []core.NativeFunction{
 				}
 			}
 
+			if it.err != nil {
+				return core.NullValue, it.err
+			}
+
 			return core.NewInt(-1), nil
 		},
 	},
@@ -410,17 +433,16 @@ var libArray = []core.NativeFunction{
 		Name:      "Array.prototype.first",
 		Arguments: -1,
 		Function: func(this core.Value, args []core.Value, vm *core.VM) (core.Value, error) {
-			items, err := toArray(this)
+			it, err := iterate(vm, this)
 			if err != nil {
 				return core.NullValue, err
 			}
 
 			if len(args) == 0 {
-				if len(items) > 0 {
-					return items[0], nil
-				} else {
-					return core.NullValue, nil
+				if it.next() {
+					return it.value, nil
 				}
+				return core.NullValue, it.err
 			}
 
 			funcIndex := -1
@@ -442,7 +464,8 @@ var libArray = []core.NativeFunction{
 				return core.NullValue, fmt.Errorf("expected a function, got %s", b.TypeName())
 			}
 
-			for i, item := range items {
+			for it.next() {
+				item := it.value
 				var r core.Value
 				if funcIndex != -1 {
 					r, err = vm.RunFuncIndex(funcIndex, item)
@@ -474,10 +497,14 @@ var libArray = []core.NativeFunction{
 				}
 
 				if found {
-					return items[i], nil
+					return item, nil
 				}
 			}
 
+			if it.err != nil {
+				return core.NullValue, it.err
+			}
+
 			return core.NullValue, nil
 		},
 	},
@@ -485,7 +512,7 @@ var libArray = []core.NativeFunction{
 		Name:      "Array.prototype.last",
 		Arguments: -1,
 		Function: func(this core.Value, args []core.Value, vm *core.VM) (core.Value, error) {
-			a, err := toArray(this)
+			a, err := toArray(vm, this)
 			if err != nil {
 				return core.NullValue, err
 			}
@@ -562,7 +589,7 @@ var libArray = []core.NativeFunction{
 		Name:      "Array.prototype.where",
 		Arguments: 1,
 		Function: func(this core.Value, args []core.Value, vm *core.VM) (core.Value, error) {
-			a, err := toArray(this)
+			it, err := iterate(vm, this)
 			if err != nil {
 				return core.NullValue, err
 			}
@@ -588,7 +615,8 @@ var libArray = []core.NativeFunction{
 
 			filtered := make([]core.Value, 0)
 
-			for _, v := range a {
+			for it.next() {
+				v := it.value
 				var r core.Value
 				if funcIndex != -1 {
 					r, err = vm.RunFuncIndex(funcIndex, v)
@@ -623,6 +651,10 @@ var libArray = []core.NativeFunction{
 				}
 			}
 
+			if it.err != nil {
+				return core.NullValue, it.err
+			}
+
 			return core.NewArrayValues(filtered), nil
 		},
 	},
@@ -631,7 +663,7 @@ var libArray = []core.NativeFunction{
 		Name:      "Array.prototype.sum",
 		Arguments: -1,
 		Function: func(this core.Value, args []core.Value, vm *core.VM) (core.Value, error) {
-			a, err := toArray(this)
+			it, err := iterate(vm, this)
 			if err != nil {
 				return core.NullValue, err
 			}
@@ -640,7 +672,8 @@ var libArray = []core.NativeFunction{
 				var ret float64
 				var anyFloat bool
 
-				for i, v := range a {
+				for it.next() {
+					i, v := it.index, it.value
 					switch v.Type {
 					case core.Int:
 						ret += v.ToFloat()
@@ -654,6 +687,10 @@ var libArray = []core.NativeFunction{
 					}
 				}
 
+				if it.err != nil {
+					return core.NullValue, it.err
+				}
+
 				if anyFloat {
 					return core.NewFloat(ret), nil
 				}
@@ -682,7 +719,8 @@ var libArray = []core.NativeFunction{
 			var ret float64
 			var anyFloat bool
 
-			for i, v := range a {
+			for it.next() {
+				i, v := it.index, it.value
 				var r core.Value
 				if funcIndex != -1 {
 					r, err = vm.RunFuncIndex(funcIndex, v)
@@ -706,6 +744,10 @@ var libArray = []core.NativeFunction{
 				}
 			}
 
+			if it.err != nil {
+				return core.NullValue, it.err
+			}
+
 			if anyFloat {
 				return core.NewFloat(ret), nil
 			}
@@ -717,7 +759,7 @@ var libArray = []core.NativeFunction{
 		Name:      "Array.prototype.min",
 		Arguments: -1,
 		Function: func(this core.Value, args []core.Value, vm *core.VM) (core.Value, error) {
-			a, err := toArray(this)
+			a, err := toArray(vm, this)
 			if err != nil {
 				return core.NullValue, err
 			}
@@ -812,7 +854,7 @@ var libArray = []core.NativeFunction{
 		Name:      "Array.prototype.max",
 		Arguments: -1,
 		Function: func(this core.Value, args []core.Value, vm *core.VM) (core.Value, error) {
-			a, err := toArray(this)
+			a, err := toArray(vm, this)
 			if err != nil {
 				return core.NullValue, err
 			}
@@ -907,7 +949,7 @@ var libArray = []core.NativeFunction{
 		Name:      "Array.prototype.count",
 		Arguments: 1,
 		Function: func(this core.Value, args []core.Value, vm *core.VM) (core.Value, error) {
-			a, err := toArray(this)
+			it, err := iterate(vm, this)
 			if err != nil {
 				return core.NullValue, err
 			}
@@ -933,7 +975,8 @@ var libArray = []core.NativeFunction{
 
 			var c int
 
-			for _, v := range a {
+			for it.next() {
+				v := it.value
 				var r core.Value
 				if funcIndex != -1 {
 					r, err = vm.RunFuncIndex(funcIndex, v)
@@ -968,6 +1011,10 @@ var libArray = []core.NativeFunction{
 				}
 			}
 
+			if it.err != nil {
+				return core.NullValue, it.err
+			}
+
 			return core.NewInt(c), nil
 		},
 	},
@@ -976,13 +1023,11 @@ var libArray = []core.NativeFunction{
 		Name:      "Array.prototype.select",
 		Arguments: 1,
 		Function: func(this core.Value, args []core.Value, vm *core.VM) (core.Value, error) {
-			a, err := toArray(this)
+			it, err := iterate(vm, this)
 			if err != nil {
 				return core.NullValue, err
 			}
 
-			l := len(a)
-
 			funcIndex := -1
 			var closure core.Closure
 
@@ -1002,9 +1047,10 @@ var libArray = []core.NativeFunction{
 				return core.NullValue, fmt.Errorf("expected a function, got %s", b.TypeName())
 			}
 
-			items := make([]core.Value, l)
+			items := make([]core.Value, 0)
 
-			for i, v := range a {
+			for it.next() {
+				v := it.value
 				var r core.Value
 				if funcIndex != -1 {
 					r, err = vm.RunFuncIndex(funcIndex, v)
@@ -1015,7 +1061,11 @@ var libArray = []core.NativeFunction{
 					return core.NullValue, err
 				}
 
-				items[i] = r
+				items = append(items, r)
+			}
+
+			if it.err != nil {
+				return core.NullValue, it.err
 			}
 
 			return core.NewArrayValues(items), nil
@@ -1026,7 +1076,7 @@ var libArray = []core.NativeFunction{
 		Name:      "Array.prototype.selectMany",
 		Arguments: 1,
 		Function: func(this core.Value, args []core.Value, vm *core.VM) (core.Value, error) {
-			a, err := toArray(this)
+			it, err := iterate(vm, this)
 			if err != nil {
 				return core.NullValue, err
 			}
@@ -1052,7 +1102,8 @@ var libArray = []core.NativeFunction{
 
 			items := make([]core.Value, 0)
 
-			for i, v := range a {
+			for it.next() {
+				i, v := it.index, it.value
 				var r core.Value
 				if funcIndex != -1 {
 					r, err = vm.RunFuncIndex(funcIndex, v)
@@ -1068,6 +1119,10 @@ var libArray = []core.NativeFunction{
 				items = append(items, r.ToArray()...)
 			}
 
+			if it.err != nil {
+				return core.NullValue, it.err
+			}
+
 			return core.NewArrayValues(items), nil
 		},
 	},
@@ -1076,80 +1131,83 @@ var libArray = []core.NativeFunction{
 		Name:      "Array.prototype.distinct",
 		Arguments: -1,
 		Function: func(this core.Value, args []core.Value, vm *core.VM) (core.Value, error) {
-			thisItems, err := toArray(this)
+			thisItems, err := toArray(vm, this)
 			if err != nil {
 				return core.NullValue, err
 			}
 
-			items := make([]core.Value, 0)
-
-			if len(args) == 0 {
-				for _, v := range thisItems {
-					exists := false
-					for _, w := range items {
-						if v == w {
-							exists = true
-							break
-						}
-					}
-					if !exists {
-						items = append(items, v)
-					}
-				}
-				return core.NewArrayValues(items), nil
+			if len(args) > 2 {
+				return core.NullValue, fmt.Errorf("expected 0 to 2 arguments, got %d", len(args))
 			}
 
 			funcIndex := -1
 			var closure core.Closure
+			hasClosure := false
 
-			b := args[0]
-			switch b.Type {
-			case core.Func:
-				funcIndex = b.ToFunction()
+			if len(args) > 0 {
+				b := args[0]
+				switch b.Type {
+				case core.Null, core.Undefined:
 
-			case core.Object:
-				c, ok := b.ToObject().(core.Closure)
-				if !ok {
+				case core.Func:
+					funcIndex = b.ToFunction()
+
+				case core.Object:
+					c, ok := b.ToObject().(core.Closure)
+					if !ok {
+						return core.NullValue, fmt.Errorf("expected a function, got %s", b.TypeName())
+					}
+					closure = c
+					hasClosure = true
+
+				default:
 					return core.NullValue, fmt.Errorf("expected a function, got %s", b.TypeName())
 				}
-				closure = c
-
-			default:
-				return core.NullValue, fmt.Errorf("expected a function, got %s", b.TypeName())
 			}
 
+			asSet := len(args) == 2 && args[1].ToBool()
+
+			// the keys are hashed in a set so it is O(n). The ones that
+			// can't be hashed, like times, are compared one by one.
+			keys := newSet()
+			var others []core.Value
+			items := make([]core.Value, 0)
+
 			for _, v := range thisItems {
-				var vKey core.Value
+				vKey := v
 				if funcIndex != -1 {
 					vKey, err = vm.RunFuncIndex(funcIndex, v)
-				} else {
+				} else if hasClosure {
 					vKey, err = vm.RunClosure(closure, v)
 				}
 				if err != nil {
 					return core.NullValue, err
 				}
 
-				exists := false
-				for _, w := range items {
-					var existingKey core.Value
-					if funcIndex != -1 {
-						existingKey, err = vm.RunFuncIndex(funcIndex, w)
-					} else {
-						existingKey, err = vm.RunClosure(closure, w)
+				if validateKey(vKey) != nil {
+					if containsEqual(others, vKey) {
+						continue
 					}
-					if err != nil {
-						return core.NullValue, err
+					others = append(others, vKey)
+				} else {
+					if _, exists := keys.get(vKey); exists {
+						continue
 					}
-
-					if existingKey == vKey {
-						exists = true
-						break
+					if err := keys.set(vKey, core.TrueValue); err != nil {
+						return core.NullValue, err
 					}
 				}
+				items = append(items, v)
+			}
 
-				if !exists {
-					items = append(items, v)
+			if asSet {
+				s := newSet()
+				for _, v := range items {
+					if err := s.set(v, core.TrueValue); err != nil {
+						return core.NullValue, err
+					}
 				}
+				return core.NewObject(s), nil
 			}
 
 			return core.NewArrayValues(items), nil
@@ -1158,14 +1216,25 @@ var libArray = []core.NativeFunction{
 
 	core.NativeFunction{
 		Name:      "Array.prototype.groupBy",
-		Arguments: 1,
+		Arguments: -1,
 		Function: func(this core.Value, args []core.Value, vm *core.VM) (core.Value, error) {
-			a, err := toArray(this)
+			if len(args) == 0 || len(args) > 2 {
+				return core.NullValue, fmt.Errorf("expected 1 or 2 arguments, got %d", len(args))
+			}
+
+			it, err := iterate(vm, this)
 			if err != nil {
 				return core.NullValue, err
 			}
 			groups := make(map[string]core.Value)
 
+			// with asMap the groups are keyed by the values returned
+			// by the function instead of converting them to strings.
+			var keyed *keyedMap
+			if len(args) == 2 && args[1].ToBool() {
+				keyed = newKeyedMap()
+			}
+
 			funcIndex := -1
 			var closure core.Closure
 
@@ -1185,7 +1254,8 @@ var libArray = []core.NativeFunction{
 				return core.NullValue, fmt.Errorf("expected a function, got %s", b.TypeName())
 			}
 
-			for _, v := range a {
+			for it.next() {
+				v := it.value
 				var r core.Value
 				if funcIndex != -1 {
 					r, err = vm.RunFuncIndex(funcIndex, v)
@@ -1196,6 +1266,19 @@ var libArray = []core.NativeFunction{
 					return core.NullValue, err
 				}
 
+				if keyed != nil {
+					g, _ := keyed.get(r)
+					if g.Type != core.Array {
+						g = core.NewArray(0)
+					}
+					a := g.ToArrayObject()
+					a.Array = append(a.Array, v)
+					if err := keyed.set(r, g); err != nil {
+						return core.NullValue, err
+					}
+					continue
+				}
+
 				var key string
 				if r.Type == core.Null {
 					key = ""
@@ -1215,6 +1298,14 @@ var libArray = []core.NativeFunction{
 				}
 			}
 
+			if it.err != nil {
+				return core.NullValue, it.err
+			}
+
+			if keyed != nil {
+				return core.NewObject(keyed), nil
+			}
+
 			return core.NewMapValues(groups), nil
 		},
 	},
@@ -1227,7 +1318,7 @@ var libArray = []core.NativeFunction{
 				return core.FalseValue, nil
 			}
 
-			a, err := toArray(this)
+			a, err := toArray(vm, this)
 			if err != nil {
 				return core.NullValue, err
 			}
@@ -1324,18 +1415,18 @@ var libArray = []core.NativeFunction{
 			case core.Array, core.Bytes:
 				a := this.ToArrayObject()
 				items := b.ToArray()
-				a.Array = append(a.Array, items...)
-
 				if vm.MaxAllocations > 0 {
 					var allocs int
 					for _, v := range items {
 						allocs += v.Size()
 					}
-					if err := vm.AddAllocations(allocs); err != nil {
+					if err := vm.AddAllocationsTo(this, allocs, items...); err != nil {
 						return core.NullValue, err
 					}
 				}
 
+				a.Array = append(a.Array, items...)
+
 			default:
 				return core.NullValue, fmt.Errorf("expected array, called on %s", b.TypeName())
 			}
@@ -1350,16 +1441,16 @@ var libArray = []core.NativeFunction{
 			switch this.Type {
 			case core.Array:
 				a := this.ToArrayObject()
-				a.Array = append(a.Array, args...)
 				if vm.MaxAllocations > 0 {
 					var allocs int
-					for _, v := range a.Array {
+					for _, v := range args {
 						allocs += v.Size()
 					}
-					if err := vm.AddAllocations(allocs); err != nil {
+					if err := vm.AddAllocationsTo(this, allocs, args...); err != nil {
 						return core.NullValue, err
 					}
 				}
+				a.Array = append(a.Array, args...)
 
 			default:
 				return core.NullValue, fmt.Errorf("expected array, got %s", this.TypeName())
@@ -1440,7 +1531,7 @@ var libArray = []core.NativeFunction{
 			if this.Type != core.Array {
 				return core.NullValue, fmt.Errorf("expected string array, got %s", this.TypeName())
 			}
-			a, err := toArray(this)
+			a, err := toArray(vm, this)
 			if err != nil {
 				return core.NullValue, err
 			}
@@ -1461,7 +1552,7 @@ var libArray = []core.NativeFunction{
 			if this.Type != core.Array {
 				return core.NullValue, fmt.Errorf("expected string array, got %s", this.TypeName())
 			}
-			a, err := toArray(this)
+			a, err := toArray(vm, this)
 			if err != nil {
 				return core.NullValue, err
 			}
@@ -1481,7 +1572,7 @@ var libArray = []core.NativeFunction{
 			if this.Type != core.Array {
 				return core.NullValue, fmt.Errorf("expected string array, got %s", this.TypeName())
 			}
-			a, err := toArray(this)
+			a, err := toArray(vm, this)
 			if err != nil {
 				return core.NullValue, err
 			}
@@ -1514,7 +1605,7 @@ var libArray = []core.NativeFunction{
 			if this.Type != core.Array {
 				return core.NullValue, fmt.Errorf("expected array, called on %s", this.TypeName())
 			}
-			a, err := toArray(this)
+			a, err := toArray(vm, this)
 			if err != nil {
 				return core.NullValue, err
 			}
@@ -1551,7 +1642,7 @@ var libArray = []core.NativeFunction{
 			if this.Type != core.Array {
 				return core.NullValue, fmt.Errorf("expected array, called on %s", this.TypeName())
 			}
-			a, err := toArray(this)
+			a, err := toArray(vm, this)
 			if err != nil {
 				return core.NullValue, err
 			}
@@ -1583,7 +1674,7 @@ var libArray = []core.NativeFunction{
 	},
 }
 
-func toArray(v core.Value) ([]core.Value, error) {
+func toArray(vm *core.VM, v core.Value) ([]core.Value, error) {
 	switch v.Type {
 	case core.Array:
 		return v.ToArray(), nil
@@ -1591,7 +1682,16 @@ func toArray(v core.Value) ([]core.Value, error) {
 	case core.Object:
 		e, ok := v.ToObject().(core.Enumerable)
 		if !ok {
-			return nil, fmt.Errorf("expected an enumerable, got %s", v.TypeName())
+			// read all the values of an iterable
+			it, err := iterate(vm, v)
+			if err != nil {
+				return nil, err
+			}
+			var a []core.Value
+			for it.next() {
+				a = append(a, it.value)
+			}
+			return a, it.err
 		}
 
 		a, err := e.Values()
@@ -1606,6 +1706,44 @@ func toArray(v core.Value) ([]core.Value, error) {
 	}
 }
 
+// values iterates lazily the values of an array or an iterable object.
+type values struct {
+	it    core.Iterator
+	index int
+	value core.Value
+	err   error
+}
+
+func iterate(vm *core.VM, v core.Value) (*values, error) {
+	switch v.Type {
+	case core.Array, core.Object:
+		it, err := vm.Iterator(v)
+		if err != nil {
+			return nil, err
+		}
+		return &values{it: it, index: -1}, nil
+
+	default:
+		return nil, fmt.Errorf("expected an enumerable, got %s", v.TypeName())
+	}
+}
+
+// next advances to the next value. It returns false at the end
+// or if there is an error.
+func (v *values) next() bool {
+	value, ok, err := v.it.Next()
+	if err != nil {
+		v.err = err
+		return false
+	}
+	if !ok {
+		return false
+	}
+	v.index++
+	v.value = value
+	return true
+}
+
 type comparer struct {
 	items    []core.Value
 	compFunc int
@@ -1663,3 +1801,13 @@ func (c *closureComparer) Less(i, j int) bool {
 	}
 	return v.ToBool()
 }
+
+// containsEqual returns true if any of the values is equal to v.
+func containsEqual(values []core.Value, v core.Value) bool {
+	for _, w := range values {
+		if w.Equals(v) {
+			return true
+		}
+	}
+	return false
+}
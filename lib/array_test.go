@@ -1,6 +1,11 @@
 package lib
 
-import "testing"
+import (
+	"strings"
+	"testing"
+
+	"github.com/gtlang/gt/core"
+)
 
 func TestArraySum(t *testing.T) {
 	v := runTest(t, `	
@@ -29,3 +34,142 @@ func TestArrayWhere(t *testing.T) {
 		t.Fatal(v)
 	}
 }
+
+func TestArrayIterable(t *testing.T) {
+	v := runTest(t, `
+		let calls = 0
+
+		class Range {
+			iterator() {
+				let i = 0
+				return {
+					next: () => {
+						calls++
+						if (i < 10) {
+							i++
+							return { value: i }
+						}
+						return { done: true }
+					}
+				}
+			}
+		}
+
+		function main() {
+			let r = new Range()
+			let first = r.first(t => t > 3)
+			return [first, calls, r.where(t => t % 2 == 0).sum()]
+		}
+	`)
+
+	// first stops reading values after the first match
+	a := v.ToArray()
+	if a[0].ToInt() != 4 || a[1].ToInt() != 4 || a[2].ToInt() != 30 {
+		t.Fatal(v)
+	}
+}
+
+func TestArrayPushIterate(t *testing.T) {
+	// the values added while iterating are not iterated
+	v := runTest(t, `
+		function main() {
+			let a = [1, 2, 3]
+			for (let v of a) {
+				a.push(v)
+			}
+			return a.length
+		}
+	`)
+
+	if v.ToInt() != 6 {
+		t.Fatal(v)
+	}
+}
+
+func TestArrayPushMemoryReleased(t *testing.T) {
+	p, err := core.CompileStr(`
+		function build() {
+			let a = []
+			for (let i = 0; i < 100; i++) {
+				a.push("0123456789")
+			}
+			return a.length
+		}
+
+		function main() {
+			let n = 0
+			for (let i = 0; i < 1000; i++) {
+				n += build()
+			}
+			return n
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm := core.NewVM(p)
+	vm.MaxAllocations = 100000
+
+	v, err := vm.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != core.NewInt(100000) {
+		t.Fatalf("expected 100000, got %v", v)
+	}
+}
+
+func TestArrayPushMemoryLimit(t *testing.T) {
+	p, err := core.CompileStr(`
+		let a = []
+
+		function add() {
+			a.push("0123456789")
+		}
+
+		function main() {
+			for (let i = 0; i < 1000; i++) {
+				add()
+			}
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm := core.NewVM(p)
+	vm.MaxAllocations = 5000
+
+	_, err = vm.Run()
+	if err == nil || !strings.Contains(err.Error(), "Memory limit reached") {
+		t.Fatalf("expected a memory limit error, got %v", err)
+	}
+}
+
+func TestArrayPushMemoryLimitEscaped(t *testing.T) {
+	p, err := core.CompileStr(`
+		let store = {}
+
+		function main() {
+			for (let i = 0; i < 1000; i++) {
+				let a = []
+				store["k" + i] = a
+				for (let j = 0; j < 100; j++) {
+					a.push("0123456789")
+				}
+			}
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm := core.NewVM(p)
+	vm.MaxAllocations = 100000
+
+	_, err = vm.Run()
+	if err == nil || !strings.Contains(err.Error(), "Memory limit reached") {
+		t.Fatalf("expected a memory limit error, got %v", err)
+	}
+}
@@ -28,12 +28,32 @@ declare namespace bytecode {
      * Load a binary program from the file system
      * @param path the path to the main binary.
      * @param fs the file trusted. If empty it will use the current fs.
+     * @param trustedKeys if provided, the program must be signed by one of the keys.
+     * @param key the AES key if the program is encrypted.
      */
-    export function load(path: string, fs?: io.FileSystem): runtime.Program
+    export function load(path: string, fs?: io.FileSystem, trustedKeys?: Array<rsa.PublicKey | string | byte[]>, key?: string | byte[]): runtime.Program
 
-    export function loadProgram(b: byte[]): runtime.Program
-    export function readProgram(r: io.Reader): runtime.Program
-    export function writeProgram(w: io.Writer, p: runtime.Program): void
+    /**
+     * Load a binary program from bytes.
+     * @param trustedKeys if provided, the program must be signed by one of the keys.
+     * @param key the AES key if the program is encrypted.
+     */
+    export function loadProgram(b: byte[], trustedKeys?: Array<rsa.PublicKey | string | byte[]>, key?: string | byte[]): runtime.Program
+
+    /**
+     * Read a binary program.
+     * @param trustedKeys if provided, the program must be signed by one of the keys.
+     * @param key the AES key if the program is encrypted.
+     */
+    export function readProgram(r: io.Reader, trustedKeys?: Array<rsa.PublicKey | string | byte[]>, key?: string | byte[]): runtime.Program
+
+    /**
+     * Write a binary program.
+     * @param signKey if provided, the program is signed with it.
+     * @param encryptionKey if provided, the program is encrypted with AES-GCM. 
+     * It must be 16, 24 or 32 bytes long.
+     */
+    export function writeProgram(w: io.Writer, p: runtime.Program, signKey?: rsa.PrivateKey, encryptionKey?: string | byte[]): void
 }
 
 `)
@@ -74,17 +94,26 @@ var Bytecode = []core.NativeFunction{
 	},
 	core.NativeFunction{
 		Name:      "bytecode.loadProgram",
-		Arguments: 1,
+		Arguments: -1,
 		Function: func(this core.Value, args []core.Value, vm *core.VM) (core.Value, error) {
 			if !vm.HasPermission("trusted") {
 				return core.NullValue, ErrUnauthorized
 			}
 
-			if err := ValidateArgs(args, core.Bytes); err != nil {
+			if err := ValidateArgRange(args, 1, 2, 3); err != nil {
 				return core.NullValue, err
 			}
 
-			p, err := binary.Load(args[0].ToBytes())
+			if err := ValidateOptionalArgs(args[:1], core.Bytes); err != nil {
+				return core.NullValue, err
+			}
+
+			opts, err := readOptions(args[1:])
+			if err != nil {
+				return core.NullValue, err
+			}
+
+			p, err := binary.Load(args[0].ToBytes(), opts...)
 			if err != nil {
 				return core.NullValue, err
 			}
@@ -100,19 +129,19 @@ var Bytecode = []core.NativeFunction{
 				return core.NullValue, ErrUnauthorized
 			}
 
-			if err := ValidateOptionalArgs(args, core.String, core.Bool, core.Object); err != nil {
-				return core.NullValue, err
+			l := len(args)
+			if l < 1 || l > 4 {
+				return core.NullValue, fmt.Errorf("expected 1 to 4 args, got %d", l)
 			}
 
-			l := len(args)
-			if l < 1 || l > 3 {
-				return core.NullValue, fmt.Errorf("expected 1 to 3 args, got %d", l)
+			if err := ValidateOptionalArgs(args[:1], core.String); err != nil {
+				return core.NullValue, err
 			}
 
 			path := args[0].ToString()
 			var fs filesystem.FS
 
-			if l > 1 {
+			if l > 1 && !args[1].IsNil() {
 				vfs, ok := args[1].ToObjectOrNil().(*FileSystemObj)
 				if !ok {
 					return core.NullValue, fmt.Errorf("expected a filesystem, got %v", args[1])
@@ -128,7 +157,14 @@ var Bytecode = []core.NativeFunction{
 			}
 			defer f.Close()
 
-			p, err := binary.Read(f)
+			var opts []binary.ReadOption
+			if l > 2 {
+				if opts, err = readOptions(args[2:]); err != nil {
+					return core.NullValue, err
+				}
+			}
+
+			p, err := binary.Read(f, opts...)
 			if err != nil {
 				return core.NullValue, err
 			}
@@ -138,13 +174,13 @@ var Bytecode = []core.NativeFunction{
 	},
 	core.NativeFunction{
 		Name:      "bytecode.readProgram",
-		Arguments: 1,
+		Arguments: -1,
 		Function: func(this core.Value, args []core.Value, vm *core.VM) (core.Value, error) {
 			if !vm.HasPermission("trusted") {
 				return core.NullValue, ErrUnauthorized
 			}
 
-			if err := ValidateArgs(args, core.Object); err != nil {
+			if err := ValidateArgRange(args, 1, 2, 3); err != nil {
 				return core.NullValue, err
 			}
 
@@ -153,7 +189,12 @@ var Bytecode = []core.NativeFunction{
 				return core.NullValue, fmt.Errorf("expected parameter 1 to be io.Reader, got %T", args[0].ToObjectOrNil())
 			}
 
-			p, err := binary.Read(r)
+			opts, err := readOptions(args[1:])
+			if err != nil {
+				return core.NullValue, err
+			}
+
+			p, err := binary.Read(r, opts...)
 			if err != nil {
 				return core.NullValue, err
 			}
@@ -163,13 +204,13 @@ var Bytecode = []core.NativeFunction{
 	},
 	core.NativeFunction{
 		Name:      "bytecode.writeProgram",
-		Arguments: 2,
+		Arguments: -1,
 		Function: func(this core.Value, args []core.Value, vm *core.VM) (core.Value, error) {
 			if !vm.HasPermission("trusted") {
 				return core.NullValue, ErrUnauthorized
 			}
 
-			if err := ValidateArgs(args, core.Object, core.Object); err != nil {
+			if err := ValidateArgRange(args, 2, 3, 4); err != nil {
 				return core.NullValue, err
 			}
 
@@ -183,7 +224,7 @@ var Bytecode = []core.NativeFunction{
 				return core.NullValue, fmt.Errorf("expected parameter 2 to be a program, got %T", args[0].ToObjectOrNil())
 			}
 
-			if err := binary.Write(w, p.prog); err != nil {
+			if err := writeProgram(w, p.prog, args[2:]); err != nil {
 				return core.NullValue, err
 			}
 
@@ -192,6 +233,100 @@ var Bytecode = []core.NativeFunction{
 	},
 }
 
+// writeProgram writes p signing it if a private key is passed in args
+// and encrypting it if an encryption key follows.
+func writeProgram(w io.Writer, p *core.Program, args []core.Value) error {
+	var opts []binary.WriteOption
+
+	if len(args) > 0 && !args[0].IsNil() {
+		key, ok := args[0].ToObjectOrNil().(*rsaPrivateKey)
+		if !ok {
+			return fmt.Errorf("expected a rsa private key, got %s", args[0].TypeName())
+		}
+		opts = append(opts, binary.WithSigner(key.key))
+	}
+
+	if len(args) > 1 && !args[1].IsNil() {
+		key, err := encryptionKey(args[1])
+		if err != nil {
+			return err
+		}
+		opts = append(opts, binary.WithEncryptionKey(key))
+	}
+
+	return binary.Write(w, p, opts...)
+}
+
+// readOptions returns the options for the optional array of trusted keys
+// and decryption key in args.
+func readOptions(args []core.Value) ([]binary.ReadOption, error) {
+	var opts []binary.ReadOption
+
+	t, err := trustPolicy(args)
+	if err != nil {
+		return nil, err
+	}
+	if t != nil {
+		opts = append(opts, binary.WithTrustPolicy(t))
+	}
+
+	if len(args) > 1 && !args[1].IsNil() {
+		key, err := encryptionKey(args[1])
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, binary.WithDecryptionKey(key))
+	}
+
+	return opts, nil
+}
+
+func encryptionKey(v core.Value) ([]byte, error) {
+	switch v.Type {
+	case core.String, core.Bytes:
+		return v.ToBytes(), nil
+	default:
+		return nil, fmt.Errorf("expected the key to be string or bytes, got %s", v.TypeName())
+	}
+}
+
+// trustPolicy returns the policy for the optional array of trusted keys in args.
+func trustPolicy(args []core.Value) (*binary.TrustPolicy, error) {
+	if len(args) == 0 || args[0].IsNil() {
+		return nil, nil
+	}
+
+	if args[0].Type != core.Array {
+		return nil, fmt.Errorf("expected an array of trusted keys, got %s", args[0].TypeName())
+	}
+
+	t := &binary.TrustPolicy{}
+
+	for _, v := range args[0].ToArray() {
+		if err := addTrustedKey(t, v); err != nil {
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+// addTrustedKey adds a rsa.PublicKey object or a PEM encoded key to t.
+func addTrustedKey(t *binary.TrustPolicy, v core.Value) error {
+	switch v.Type {
+	case core.Object:
+		k, ok := v.ToObject().(*rsaPublicKey)
+		if !ok {
+			return fmt.Errorf("expected a public key, got %s", v.TypeName())
+		}
+		return t.AddKey(k.key)
+	case core.String, core.Bytes:
+		return t.AddPEM(v.ToBytes())
+	default:
+		return fmt.Errorf("expected a public key, got %s", v.TypeName())
+	}
+}
+
 func compile(args []core.Value, vm *core.VM) (core.Value, error) {
 	if err := ValidateOptionalArgs(args, core.String, core.Bool, core.Bool, core.Object); err != nil {
 		return core.NullValue, err
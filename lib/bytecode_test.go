@@ -0,0 +1,77 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/gtlang/filesystem"
+	"github.com/gtlang/gt/binary"
+	"github.com/gtlang/gt/core"
+)
+
+func TestLoadTrustedKeys(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	p, err := core.CompileStr("function main() { return 3 }")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := filesystem.NewVirtualFS()
+
+	var buf bytes.Buffer
+	if err := binary.WriteSigned(&buf, p, key); err != nil {
+		t.Fatal(err)
+	}
+	fs.WritePath("/signed.gt", buf.Bytes())
+
+	buf.Reset()
+	if err := binary.Write(&buf, p); err != nil {
+		t.Fatal(err)
+	}
+	fs.WritePath("/unsigned.gt", buf.Bytes())
+
+	code := `
+		function main(key) {
+			let p = bytecode.load("/signed.gt", null, [key])
+
+			try {
+				bytecode.load("/unsigned.gt", null, [key])
+			} catch (e) {
+				return runtime.newVM(p).run()
+			}
+			throw "the unsigned program was loaded"
+		}
+	`
+
+	lp, err := core.CompileStr(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm := core.NewVM(lp)
+	vm.Trusted = true
+	vm.FileSystem = fs
+
+	v, err := vm.Run(core.NewString(string(pemKey)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v != core.NewInt(3) {
+		t.Fatalf("expected 3, got %v", v)
+	}
+}
@@ -0,0 +1,626 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+
+	"github.com/gtlang/gt/core"
+)
+
+func init() {
+	core.RegisterLib(Collections, `
+
+declare namespace collections {
+    /**
+     * Creates a set with the values of an array or an iterable.
+     * Keys can be ints, floats, strings, runes, bools or objects,
+     * that are compared by identity.
+     */
+    export function newSet<T>(values?: Iterable<T>): Set<T>
+
+    /**
+     * Creates a map with keys of any type like a Set. The entries
+     * can be initialized with an array of [key, value] pairs.
+     */
+    export function newMap<K, V>(entries?: Iterable<[K, V]>): Map<K, V>
+
+    /**
+     * Iterating a set returns the values in the order they were added.
+     * It is serialized to JSON as an array.
+     */
+    export interface Set<T> {
+        readonly size: number
+        add(v: T): Set<T>
+        has(v: T): boolean
+        delete(v: T): boolean
+        clear(): void
+        values(): T[]
+        union(other: Iterable<T>): Set<T>
+        intersect(other: Iterable<T>): Set<T>
+        difference(other: Iterable<T>): Set<T>
+    }
+
+    /**
+     * Iterating a map returns [key, value] pairs in the order the keys were
+     * added. It is serialized to JSON as an object: the keys must be strings,
+     * numbers, runes or bools.
+     */
+    export interface Map<K, V> {
+        readonly size: number
+        set(k: K, v: V): Map<K, V>
+        get(k: K): V
+        has(k: K): boolean
+        delete(k: K): boolean
+        clear(): void
+        keys(): K[]
+        values(): V[]
+    }
+}
+
+`)
+}
+
+var Collections = []core.NativeFunction{
+	core.NativeFunction{
+		Name:      "collections.newSet",
+		Arguments: -1,
+		Function: func(this core.Value, args []core.Value, vm *core.VM) (core.Value, error) {
+			if len(args) > 1 {
+				return core.NullValue, fmt.Errorf("expected 0 or 1 arguments, got %d", len(args))
+			}
+
+			s := newSet()
+			if len(args) == 1 {
+				if err := s.addValues(args[0], vm); err != nil {
+					return core.NullValue, err
+				}
+			}
+			return core.NewObject(s), nil
+		},
+	},
+	core.NativeFunction{
+		Name:      "collections.newMap",
+		Arguments: -1,
+		Function: func(this core.Value, args []core.Value, vm *core.VM) (core.Value, error) {
+			if len(args) > 1 {
+				return core.NullValue, fmt.Errorf("expected 0 or 1 arguments, got %d", len(args))
+			}
+
+			m := newKeyedMap()
+			if len(args) == 1 && !args[0].IsNil() {
+				if err := m.addEntries(args[0], vm); err != nil {
+					return core.NullValue, err
+				}
+			}
+			return core.NewObject(m), nil
+		},
+	},
+}
+
+// validateKey checks that the value can be hashed: objects are
+// compared by identity so they must be pointers.
+func validateKey(v core.Value) error {
+	switch v.Type {
+	case core.Null, core.Undefined, core.Int, core.Float, core.Bool,
+		core.String, core.Rune, core.Array, core.Map, core.Func, core.NativeFunc:
+		return nil
+
+	case core.Object:
+		if reflect.ValueOf(v.ToObject()).Kind() == reflect.Ptr {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("values of type %s can't be keys", v.TypeName())
+}
+
+// orderedKeys is a map with keys of any type that keeps the insertion order.
+type orderedKeys struct {
+	mutex  sync.RWMutex
+	values map[core.Value]core.Value
+	keys   []core.Value
+}
+
+func (o *orderedKeys) init() {
+	o.values = make(map[core.Value]core.Value)
+}
+
+func (o *orderedKeys) set(k, v core.Value) error {
+	if err := validateKey(k); err != nil {
+		return err
+	}
+
+	o.mutex.Lock()
+	if _, ok := o.values[k]; !ok {
+		o.keys = append(o.keys, k)
+	}
+	o.values[k] = v
+	o.mutex.Unlock()
+	return nil
+}
+
+func (o *orderedKeys) get(k core.Value) (core.Value, bool) {
+	if validateKey(k) != nil {
+		return core.UndefinedValue, false
+	}
+
+	o.mutex.RLock()
+	v, ok := o.values[k]
+	o.mutex.RUnlock()
+	return v, ok
+}
+
+// delete removes a key. It is O(n) to keep the order of the rest.
+func (o *orderedKeys) delete(k core.Value) bool {
+	if validateKey(k) != nil {
+		return false
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if _, ok := o.values[k]; !ok {
+		return false
+	}
+	delete(o.values, k)
+	for i, key := range o.keys {
+		if key == k {
+			o.keys = append(o.keys[:i], o.keys[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+func (o *orderedKeys) clear() {
+	o.mutex.Lock()
+	o.values = make(map[core.Value]core.Value)
+	o.keys = nil
+	o.mutex.Unlock()
+}
+
+func (o *orderedKeys) size() int {
+	o.mutex.RLock()
+	l := len(o.keys)
+	o.mutex.RUnlock()
+	return l
+}
+
+// snapshot returns a copy of the keys and values to iterate them
+// without holding the lock.
+func (o *orderedKeys) snapshot() ([]core.Value, []core.Value) {
+	o.mutex.RLock()
+	defer o.mutex.RUnlock()
+
+	keys := make([]core.Value, len(o.keys))
+	values := make([]core.Value, len(o.keys))
+	for i, k := range o.keys {
+		keys[i] = k
+		values[i] = o.values[k]
+	}
+	return keys, values
+}
+
+// copyTo copies the keys and values to dst to pass them to another VM.
+func (o *orderedKeys) copyTo(dst *orderedKeys, fn func(core.Value) (core.Value, error)) error {
+	keys, values := o.snapshot()
+	for i, k := range keys {
+		x, err := fn(k)
+		if err != nil {
+			return err
+		}
+		v, err := fn(values[i])
+		if err != nil {
+			return err
+		}
+		if err := dst.set(x, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type set struct {
+	orderedKeys
+}
+
+func newSet() *set {
+	s := &set{}
+	s.init()
+	return s
+}
+
+func (s *set) Type() string {
+	return "collections.Set"
+}
+
+// addValues adds the values of an array or an iterable.
+func (s *set) addValues(v core.Value, vm *core.VM) error {
+	it, err := vm.Iterator(v)
+	if err != nil {
+		return err
+	}
+	for {
+		item, ok, err := it.Next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+		if err := s.set(item, core.TrueValue); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *set) Copy(fn func(core.Value) (core.Value, error)) (interface{}, error) {
+	c := newSet()
+	if err := s.copyTo(&c.orderedKeys, fn); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (s *set) Iterator() (core.Iterator, error) {
+	keys, _ := s.snapshot()
+	return &sliceIterator{values: keys}, nil
+}
+
+func (s *set) MarshalJSON() ([]byte, error) {
+	keys, _ := s.snapshot()
+	return json.Marshal(keys)
+}
+
+func (s *set) GetProperty(name string, vm *core.VM) (core.Value, error) {
+	switch name {
+	case "size":
+		return core.NewInt(s.size()), nil
+	}
+	return core.UndefinedValue, nil
+}
+
+func (s *set) GetMethod(name string) core.NativeMethod {
+	switch name {
+	case "add":
+		return s.add
+	case "has":
+		return s.has
+	case "delete":
+		return s.remove
+	case "clear":
+		return s.clearValues
+	case "values":
+		return s.valuesArray
+	case "union":
+		return s.union
+	case "intersect":
+		return s.intersect
+	case "difference":
+		return s.difference
+	}
+	return nil
+}
+
+func (s *set) add(args []core.Value, vm *core.VM) (core.Value, error) {
+	if len(args) != 1 {
+		return core.NullValue, fmt.Errorf("expected 1 argument, got %d", len(args))
+	}
+	if err := s.set(args[0], core.TrueValue); err != nil {
+		return core.NullValue, err
+	}
+	return core.NewObject(s), nil
+}
+
+func (s *set) has(args []core.Value, vm *core.VM) (core.Value, error) {
+	if len(args) != 1 {
+		return core.NullValue, fmt.Errorf("expected 1 argument, got %d", len(args))
+	}
+	_, ok := s.get(args[0])
+	return core.NewBool(ok), nil
+}
+
+func (s *set) remove(args []core.Value, vm *core.VM) (core.Value, error) {
+	if len(args) != 1 {
+		return core.NullValue, fmt.Errorf("expected 1 argument, got %d", len(args))
+	}
+	return core.NewBool(s.delete(args[0])), nil
+}
+
+func (s *set) clearValues(args []core.Value, vm *core.VM) (core.Value, error) {
+	if len(args) != 0 {
+		return core.NullValue, fmt.Errorf("expected no arguments, got %d", len(args))
+	}
+	s.clear()
+	return core.NullValue, nil
+}
+
+func (s *set) valuesArray(args []core.Value, vm *core.VM) (core.Value, error) {
+	if len(args) != 0 {
+		return core.NullValue, fmt.Errorf("expected no arguments, got %d", len(args))
+	}
+	keys, _ := s.snapshot()
+	return core.NewArrayValues(keys), nil
+}
+
+// other returns the values of the argument of the set operations.
+func (s *set) other(args []core.Value, vm *core.VM) (*set, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("expected 1 argument, got %d", len(args))
+	}
+	if o, ok := args[0].ToObjectOrNil().(*set); ok {
+		return o, nil
+	}
+	o := newSet()
+	if err := o.addValues(args[0], vm); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func (s *set) union(args []core.Value, vm *core.VM) (core.Value, error) {
+	o, err := s.other(args, vm)
+	if err != nil {
+		return core.NullValue, err
+	}
+
+	r := newSet()
+	keys, _ := s.snapshot()
+	otherKeys, _ := o.snapshot()
+	for _, k := range append(keys, otherKeys...) {
+		r.set(k, core.TrueValue)
+	}
+	return core.NewObject(r), nil
+}
+
+func (s *set) intersect(args []core.Value, vm *core.VM) (core.Value, error) {
+	o, err := s.other(args, vm)
+	if err != nil {
+		return core.NullValue, err
+	}
+
+	r := newSet()
+	keys, _ := s.snapshot()
+	for _, k := range keys {
+		if _, ok := o.get(k); ok {
+			r.set(k, core.TrueValue)
+		}
+	}
+	return core.NewObject(r), nil
+}
+
+func (s *set) difference(args []core.Value, vm *core.VM) (core.Value, error) {
+	o, err := s.other(args, vm)
+	if err != nil {
+		return core.NullValue, err
+	}
+
+	r := newSet()
+	keys, _ := s.snapshot()
+	for _, k := range keys {
+		if _, ok := o.get(k); !ok {
+			r.set(k, core.TrueValue)
+		}
+	}
+	return core.NewObject(r), nil
+}
+
+type keyedMap struct {
+	orderedKeys
+}
+
+func newKeyedMap() *keyedMap {
+	m := &keyedMap{}
+	m.init()
+	return m
+}
+
+func (m *keyedMap) Type() string {
+	return "collections.Map"
+}
+
+// addEntries adds the [key, value] pairs of an array or an iterable.
+func (m *keyedMap) addEntries(v core.Value, vm *core.VM) error {
+	it, err := vm.Iterator(v)
+	if err != nil {
+		return err
+	}
+	for {
+		entry, ok, err := it.Next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+		if entry.Type != core.Array || len(entry.ToArray()) != 2 {
+			return fmt.Errorf("expected a [key, value] pair, got %s", entry.TypeName())
+		}
+		kv := entry.ToArray()
+		if err := m.set(kv[0], kv[1]); err != nil {
+			return err
+		}
+	}
+}
+
+func (m *keyedMap) Copy(fn func(core.Value) (core.Value, error)) (interface{}, error) {
+	c := newKeyedMap()
+	if err := m.copyTo(&c.orderedKeys, fn); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Iterator returns the entries as [key, value] pairs.
+func (m *keyedMap) Iterator() (core.Iterator, error) {
+	keys, values := m.snapshot()
+	entries := make([]core.Value, len(keys))
+	for i, k := range keys {
+		entries[i] = core.NewArrayValues([]core.Value{k, values[i]})
+	}
+	return &sliceIterator{values: entries}, nil
+}
+
+// MarshalJSON writes an object with the keys converted to strings.
+func (m *keyedMap) MarshalJSON() ([]byte, error) {
+	keys, values := m.snapshot()
+
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+
+		var s string
+		switch k.Type {
+		case core.String:
+			s = k.ToString()
+		case core.Int:
+			s = strconv.FormatInt(k.ToInt(), 10)
+		case core.Float:
+			s = strconv.FormatFloat(k.ToFloat(), 'f', -1, 64)
+		case core.Rune:
+			s = string(k.ToRune())
+		case core.Bool:
+			s = strconv.FormatBool(k.ToBool())
+		default:
+			return nil, fmt.Errorf("can't serialize a map with %s keys", k.TypeName())
+		}
+
+		key, err := json.Marshal(s)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(key)
+		b.WriteByte(':')
+
+		value, err := json.Marshal(values[i])
+		if err != nil {
+			return nil, err
+		}
+		b.Write(value)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+func (m *keyedMap) GetProperty(name string, vm *core.VM) (core.Value, error) {
+	switch name {
+	case "size":
+		return core.NewInt(m.size()), nil
+	}
+	return core.UndefinedValue, nil
+}
+
+func (m *keyedMap) GetMethod(name string) core.NativeMethod {
+	switch name {
+	case "set":
+		return m.setValue
+	case "get":
+		return m.getValue
+	case "has":
+		return m.has
+	case "delete":
+		return m.remove
+	case "clear":
+		return m.clearValues
+	case "keys":
+		return m.keysArray
+	case "values":
+		return m.valuesArray
+	}
+	return nil
+}
+
+func (m *keyedMap) setValue(args []core.Value, vm *core.VM) (core.Value, error) {
+	if len(args) != 2 {
+		return core.NullValue, fmt.Errorf("expected 2 arguments, got %d", len(args))
+	}
+	if err := m.set(args[0], args[1]); err != nil {
+		return core.NullValue, err
+	}
+	return core.NewObject(m), nil
+}
+
+func (m *keyedMap) getValue(args []core.Value, vm *core.VM) (core.Value, error) {
+	if len(args) != 1 {
+		return core.NullValue, fmt.Errorf("expected 1 argument, got %d", len(args))
+	}
+	v, _ := m.get(args[0])
+	return v, nil
+}
+
+func (m *keyedMap) has(args []core.Value, vm *core.VM) (core.Value, error) {
+	if len(args) != 1 {
+		return core.NullValue, fmt.Errorf("expected 1 argument, got %d", len(args))
+	}
+	_, ok := m.get(args[0])
+	return core.NewBool(ok), nil
+}
+
+func (m *keyedMap) remove(args []core.Value, vm *core.VM) (core.Value, error) {
+	if len(args) != 1 {
+		return core.NullValue, fmt.Errorf("expected 1 argument, got %d", len(args))
+	}
+	return core.NewBool(m.delete(args[0])), nil
+}
+
+func (m *keyedMap) clearValues(args []core.Value, vm *core.VM) (core.Value, error) {
+	if len(args) != 0 {
+		return core.NullValue, fmt.Errorf("expected no arguments, got %d", len(args))
+	}
+	m.clear()
+	return core.NullValue, nil
+}
+
+func (m *keyedMap) keysArray(args []core.Value, vm *core.VM) (core.Value, error) {
+	if len(args) != 0 {
+		return core.NullValue, fmt.Errorf("expected no arguments, got %d", len(args))
+	}
+	keys, _ := m.snapshot()
+	return core.NewArrayValues(keys), nil
+}
+
+func (m *keyedMap) valuesArray(args []core.Value, vm *core.VM) (core.Value, error) {
+	if len(args) != 0 {
+		return core.NullValue, fmt.Errorf("expected no arguments, got %d", len(args))
+	}
+	_, values := m.snapshot()
+	return core.NewArrayValues(values), nil
+}
+
+// sliceIterator iterates a copy of the values of a collection.
+type sliceIterator struct {
+	values []core.Value
+	index  int
+}
+
+func (it *sliceIterator) Type() string {
+	return "Iterator"
+}
+
+func (it *sliceIterator) Copy(fn func(core.Value) (core.Value, error)) (interface{}, error) {
+	values := make([]core.Value, len(it.values))
+	for i, v := range it.values {
+		x, err := fn(v)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = x
+	}
+	return &sliceIterator{values: values, index: it.index}, nil
+}
+
+func (it *sliceIterator) Next() (core.Value, bool, error) {
+	if it.index >= len(it.values) {
+		return core.NullValue, false, nil
+	}
+	v := it.values[it.index]
+	it.index++
+	return v, true, nil
+}
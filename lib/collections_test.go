@@ -0,0 +1,118 @@
+package lib
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSet(t *testing.T) {
+	v := runTest(t, `
+		function main() {
+			let s = collections.newSet([1, "1", '1', true, 1])
+			s.add(2).add(1)
+			let a = s.size + " " + s.has(1) + " " + s.has("2") + " " + s.delete(true) + " " + s.delete(true)
+
+			let b = ""
+			for (let v of s) {
+				b += v + ";"
+			}
+
+			let o = {}
+			let objs = collections.newSet([o, o, {}])
+			return a + " " + b + " " + objs.size + " " + objs.has(o) + " " + json.marshal(s)
+		}
+	`)
+
+	if v.ToString() != `5 true false true false 1;1;1;2; 2 true [1,"1","1",2]` {
+		t.Fatal(v)
+	}
+}
+
+func TestSetAlgebra(t *testing.T) {
+	v := runTest(t, `
+		function main() {
+			let a = collections.newSet([1, 2, 3])
+			let b = collections.newSet([2, 3, 4])
+			let r = [
+				json.marshal(a.union(b)),
+				json.marshal(a.intersect(b)),
+				json.marshal(a.difference([3, 1])),
+				a.select(t => t * 2).join(",")
+			]
+			return r.join(" ")
+		}
+	`)
+
+	if v.ToString() != "[1,2,3,4] [2,3] [2] 2,4,6" {
+		t.Fatal(v)
+	}
+}
+
+func TestKeyedMap(t *testing.T) {
+	v := runTest(t, `
+		function main() {
+			let m = collections.newMap([[1, "a"], ["1", "b"]])
+			m.set(true, "c").set(1, "d")
+			let a = m.size + " " + m.get(1) + " " + m.get("1") + " " + (m.get(2) == null) + " " + m.has(true)
+
+			let b = ""
+			for (let e of m) {
+				b += e[0] + "=" + e[1] + ";"
+			}
+
+			m.delete("1")
+			return a + " " + b + " " + json.marshal(m) + " " + m.keys().join(",")
+		}
+	`)
+
+	if v.ToString() != `3 d b true true 1=d;1=b;true=c; {"1":"d","true":"c"} 1,true` {
+		t.Fatal(v)
+	}
+}
+
+func TestKeyedMapInvalidKey(t *testing.T) {
+	_, err := runExpr(t, `
+		function main() {
+			let m = collections.newMap()
+			m.set(convert.toBytes("a"), 1)
+		}
+	`)
+
+	if err == nil || !strings.Contains(err.Error(), "can't be keys") {
+		t.Fatalf("expected an invalid key error, got %v", err)
+	}
+}
+
+func TestDistinctAndGroupByCollections(t *testing.T) {
+	v := runTest(t, `
+		function main() {
+			let items = [1, 2, 3, 4, 5, 2, 1]
+			let s = items.distinct(null, true)
+			let d = items.distinct(t => t % 3)
+
+			let g = items.groupBy(t => t % 2 == 0, true)
+			return s.size + " " + d.join(",") + " " + g.get(true).join(",") + " " + g.get(false).join(",")
+		}
+	`)
+
+	if v.ToString() != "5 1,2,3 2,4,2 1,3,5,1" {
+		t.Fatal(v)
+	}
+}
+
+func TestDistinctUnhashable(t *testing.T) {
+	v := runTest(t, `
+		function main() {
+			let d = time.date(2021, 1, 1)
+			let dates = [d, d, time.date(2021, 1, 1), time.date(2022, 1, 1)]
+			let items = [1, 2, 3]
+			let a = dates.distinct()
+			let b = items.distinct(t => time.date(2021, 1, t % 2))
+			return a.length + " " + b.join(",")
+		}
+	`)
+
+	if v.ToString() != "2 1,2" {
+		t.Fatal(v)
+	}
+}
@@ -250,11 +250,17 @@ func parseFloat(s string, c i18n.Culture) (float64, error) {
 		return 0, fmt.Errorf("invalid format: NaN")
 	}
 
+	return strconv.ParseFloat(normalizeNumber(s, c), 64)
+}
+
+// normalizeNumber removes the thousands separators of the culture
+// and uses . as the decimal separator.
+func normalizeNumber(s string, c i18n.Culture) string {
 	// if the string only contains a . accept it always as the decimal separator
 	// for any culture.
 	if c.DecimalSeparator == '.' || !strings.Contains(s, string(c.DecimalSeparator)) {
 		if strings.Count(s, ".") == 1 {
-			return strconv.ParseFloat(s, 64)
+			return s
 		}
 	}
 
@@ -270,7 +276,7 @@ func parseFloat(s string, c i18n.Culture) (float64, error) {
 		s = strings.Replace(s, string(c.DecimalSeparator), ".", -1)
 	}
 
-	return strconv.ParseFloat(s, 64)
+	return s
 }
 
 func trimZeros(s string) (string, error) {
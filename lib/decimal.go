@@ -0,0 +1,139 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gtlang/gt/core"
+)
+
+func init() {
+	core.RegisterLib(Decimal, `
+
+declare namespace decimal {
+    /**
+     * The digits that don't fit are discarded: "halfUp" (the default),
+     * "halfEven", "halfDown", "up", "down", "ceiling" or "floor".
+     */
+    export type RoundingMode = string
+
+    /**
+     * Returns an exact decimal number. Adding, subtracting and multiplying
+     * decimals with the operators is exact. Dividing rounds to 16 places
+     * or the precision set with setPrecision. Ints and floats are converted
+     * to decimals when they are mixed with them. The operations whose result
+     * has more than 1000 places or 2000 digits throw an error.
+     */
+    export function parse(v: string | number | Decimal): Decimal
+
+    /**
+     * Parses a number formatted with the separators and currency
+     * symbol of the current culture.
+     */
+    export function parseCurrency(v: string | number): Decimal
+
+    export function isDecimal(v: any): boolean
+
+    /**
+     * Sets the number of places and the rounding of the divisions.
+     */
+    export function setPrecision(places: number, rounding?: RoundingMode): void
+
+    /**
+     * Decimals are serialized to JSON as strings.
+     */
+    export interface Decimal {
+        round(places: number, rounding?: RoundingMode): Decimal
+        div(v: Decimal | number, places?: number, rounding?: RoundingMode): Decimal
+        abs(): Decimal
+        cmp(v: Decimal | number): number
+        toFloat(): number
+        toInt(): number
+        toString(): string
+    }
+}
+
+`)
+}
+
+var Decimal = []core.NativeFunction{
+	core.NativeFunction{
+		Name:      "decimal.parse",
+		Arguments: 1,
+		Function: func(this core.Value, args []core.Value, vm *core.VM) (core.Value, error) {
+			d, err := core.ToDecimal(args[0])
+			if err != nil {
+				return core.NullValue, err
+			}
+			return core.NewObject(d), nil
+		},
+	},
+	core.NativeFunction{
+		Name:      "decimal.parseCurrency",
+		Arguments: 1,
+		Function: func(this core.Value, args []core.Value, vm *core.VM) (core.Value, error) {
+			a := args[0]
+			if a.Type != core.String {
+				d, err := core.ToDecimal(a)
+				if err != nil {
+					return core.NullValue, err
+				}
+				return core.NewObject(d), nil
+			}
+
+			c := GetContext(vm).GetCulture()
+			s, err := trimZeros(a.ToString())
+			if err != nil {
+				return core.NullValue, err
+			}
+			s = strings.Replace(s, c.culture.CurrencySymbol, "", 1)
+
+			d, err := core.ParseDecimal(normalizeNumber(strings.TrimSpace(s), c.culture))
+			if err != nil {
+				return core.NullValue, err
+			}
+			return core.NewObject(d), nil
+		},
+	},
+	core.NativeFunction{
+		Name:      "decimal.isDecimal",
+		Arguments: 1,
+		Function: func(this core.Value, args []core.Value, vm *core.VM) (core.Value, error) {
+			a := args[0]
+			if a.Type != core.Object {
+				return core.FalseValue, nil
+			}
+			_, ok := a.ToObject().(*core.Decimal)
+			return core.NewBool(ok), nil
+		},
+	},
+	core.NativeFunction{
+		Name:      "decimal.setPrecision",
+		Arguments: -1,
+		Function: func(this core.Value, args []core.Value, vm *core.VM) (core.Value, error) {
+			if err := ValidateOptionalArgs(args, core.Int, core.String); err != nil {
+				return core.NullValue, err
+			}
+			if len(args) == 0 {
+				return core.NullValue, fmt.Errorf("expected the number of places")
+			}
+
+			places := int(args[0].ToInt())
+			if places < 0 || places > core.MaxDecimalPlaces {
+				return core.NullValue, fmt.Errorf("invalid number of places: %d", places)
+			}
+
+			c := core.DecimalContext{Places: places, Rounding: core.DefaultDecimalContext.Rounding}
+			if len(args) > 1 {
+				r, err := core.ParseRoundingMode(args[1].ToString())
+				if err != nil {
+					return core.NullValue, err
+				}
+				c.Rounding = r
+			}
+
+			vm.Decimals = &c
+			return core.NullValue, nil
+		},
+	},
+}
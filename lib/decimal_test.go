@@ -0,0 +1,100 @@
+package lib
+
+import (
+	"testing"
+)
+
+func TestDecimalSum(t *testing.T) {
+	v := runTest(t, `
+		function main() {
+			let a = decimal.parse("0.1")
+			let b = decimal.parse(0.2)
+			let c = a + b
+			return (c == decimal.parse("0.30")) + " " + c + " " + (c * 3 - 1)
+		}
+	`)
+
+	if v.ToString() != "true 0.3 -0.1" {
+		t.Fatal(v)
+	}
+}
+
+func TestDecimalPrecision(t *testing.T) {
+	v := runTest(t, `
+		function main() {
+			let a = decimal.parse(2) / 3
+			decimal.setPrecision(2, "down")
+			let b = decimal.parse(2) / 3
+			return a + " " + b + " " + a.round(2, "halfEven") + " " + b.div(3, 4)
+		}
+	`)
+
+	if v.ToString() != "0.6666666666666667 0.66 0.67 0.2200" {
+		t.Fatal(v)
+	}
+}
+
+func TestDecimalJSON(t *testing.T) {
+	v := runTest(t, `
+		function main() {
+			let s = json.marshal({ total: decimal.parse("10.50") })
+			let total = decimal.parse(json.unmarshal(s).total)
+			return s + " " + (total + 1)
+		}
+	`)
+
+	if v.ToString() != `{"total":"10.50"} 11.50` {
+		t.Fatal(v)
+	}
+}
+
+func TestDecimalFormat(t *testing.T) {
+	v := runTest(t, `
+		function main() {
+			let c = i18n.addCulture(
+					"es-XX",
+					",",
+					".",
+					"EUR",
+					"€",
+					"0:00€",
+					"0:0000€",
+					"0:00",
+					"dd-MM-yyyy HH:mm",
+					"dddd, dd-MM-yyyy HH:mm",
+					"dd-MM-yyyy",
+					"dddd, dd MMM yyyy",
+					"HH:mm",
+					"HH:mm:ss",
+					time.Monday,
+				)
+
+			runtime.context.culture = c
+			let d = decimal.parseCurrency("1.234.567,895€")
+			return i18n.format("c", d) + " " + d
+		}
+	`)
+
+	if v.ToString() != "1.234.567,90€ 1234567.895" {
+		t.Fatal(v)
+	}
+}
+
+func TestDecimalSQL(t *testing.T) {
+	v := runTest(t, `
+		function main() {
+			let db = sql.open("sqlite3", ":memory:")
+			// exec translates decimal columns to REAL in sqlite
+			db.execRaw("CREATE TABLE foo (id INTEGER, price DECIMAL(10,2))")
+			db.exec("INSERT INTO foo VALUES (1, ?)", decimal.parse("9.99"))
+			let float = db.queryValue("SELECT price FROM foo WHERE id = 1")
+			db.decimals = true
+			let price = db.queryValue("SELECT price FROM foo WHERE id = 1")
+			return decimal.isDecimal(float) + " " + decimal.isDecimal(price) + " " + (price * 3)
+		}
+	`)
+
+	if v.ToString() != "false true 29.97" {
+		t.Fatal(v)
+	}
+}
@@ -1,8 +1,46 @@
 package lib
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"io/fs"
+
+	"github.com/gtlang/gt/core"
+)
 
 var ErrReadOnlyOrUndefined = errors.New("undefined or readonly property")
 var ErrInvalidType = errors.New("invalid value type")
 var ErrFileNotFound = errors.New("file not found")
 var ErrUnauthorized = errors.New("unauthorized")
+var ErrTimeout = errors.New("timeout")
+
+func init() {
+	// the codes that scripts can check with errors.is
+	core.RegisterErrorCode(ErrFileNotFound, "notFound")
+	core.RegisterErrorCode(fs.ErrNotExist, "notFound")
+	core.RegisterErrorCode(ErrUnauthorized, "unauthorized")
+	core.RegisterErrorCode(fs.ErrPermission, "forbidden")
+	core.RegisterErrorCode(ErrTimeout, "timeout")
+	core.RegisterErrorCode(context.DeadlineExceeded, "timeout")
+	core.RegisterErrorCode(ErrInvalidType, "badRequest")
+}
+
+// httpStatusCodes maps the error codes to the status
+// written by the http helpers.
+var httpStatusCodes = map[string]int{
+	"badRequest":   400,
+	"unauthorized": 401,
+	"forbidden":    403,
+	"notFound":     404,
+	"conflict":     409,
+	"timeout":      504,
+}
+
+// httpStatus returns the status for the code of the error or 500.
+func httpStatus(err error) int {
+	status, ok := httpStatusCodes[core.ErrorCode(err)]
+	if !ok {
+		return 500
+	}
+	return status
+}
@@ -0,0 +1,147 @@
+package lib
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gtlang/filesystem"
+	"github.com/gtlang/gt/core"
+)
+
+func TestErrorCodes(t *testing.T) {
+	v := runTest(t, `
+		class Conflict {
+			code = "conflict"
+			message = "already exists"
+		}
+
+		function main() {
+			let a = errors.newError("notFound", "no user", { id: 3 })
+			let b = errors.wrap("can't load", a)
+
+			let c
+			try {
+				throw new Conflict()
+			} catch (e) {
+				c = errors.as(e, "Conflict").message + " " + (errors.as(e, "Other") == null)
+			}
+
+			let r = [
+				errors.is(b, "notFound"),
+				errors.is(b, "timeout"),
+				b.code,
+				b.cause.data.id,
+				c
+			]
+			return r.join(" ")
+		}
+	`)
+
+	if v.ToString() != "true false notFound 3 already exists true" {
+		t.Fatal(v)
+	}
+}
+
+func TestErrorCodesFromNatives(t *testing.T) {
+	fs := NewFileSystem(filesystem.NewVirtualFS())
+
+	v := runTest(t, `
+		function main(fs) {
+			try {
+				fs.readString("/foo.txt")
+			} catch (e) {
+				return errors.is(e, "notFound") && !errors.is(e, "forbidden")
+			}
+		}
+	`, core.NewObject(fs))
+
+	if v != core.TrueValue {
+		t.Fatal(v)
+	}
+}
+
+func TestWriteErrorStatus(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := &responseWriter{writer: w}
+
+	e := core.NewCodeError("notFound", "no such user")
+	e.SetPublic(true)
+
+	if _, err := r.writeJSONError([]core.Value{core.NewObject(e)}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if w.Code != 404 || w.Body.String() != `{"error":"no such user"}`+"\n" {
+		t.Fatal(w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	r = &responseWriter{writer: w}
+	if _, err := r.writeError([]core.Value{core.NewObject(core.NewCodeError("other", "secret"))}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if w.Code != 500 || w.Body.String() != "Internal error\n" {
+		t.Fatal(w.Code, w.Body.String())
+	}
+}
+
+func TestErrorsAsModuleClass(t *testing.T) {
+	fs := filesystem.NewVirtualFS()
+	fs.WritePath("main.ts", []byte(`
+		import * as users from "users"
+
+		function main() {
+			try {
+				users.load(3)
+			} catch (e) {
+				let nf = errors.as(e, users.NotFound)
+				let r = [
+					nf.id,
+					e.code,
+					e.message,
+					errors.is(e, "notFound"),
+					errors.as(e, users.Other) == null
+				]
+				return r.join(" ")
+			}
+		}
+	`))
+
+	fs.WritePath("users.ts", []byte(`
+		export class NotFound {
+			code = "notFound"
+			message: string
+			id: number
+
+			constructor(id: number) {
+				this.id = id
+				this.message = "no user " + id
+			}
+		}
+
+		export class Other {
+		}
+
+		export function load(id: number) {
+			throw new NotFound(id)
+		}
+	`))
+
+	p, err := core.Compile(fs, "main.ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm := core.NewVM(p)
+	vm.Trusted = true
+
+	v, err := vm.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v.ToString() != "3 notFound no user 3 true true" {
+		t.Fatal(v)
+	}
+}
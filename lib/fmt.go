@@ -160,8 +160,7 @@ var libFmt = []core.NativeFunction{
 			if a.Type == core.Undefined {
 				fmt.Print("undefined")
 			} else {
-				v := a.Export(0)
-				b, err := json.MarshalIndent(v, "", "    ")
+				b, err := json.MarshalIndent(a, "", "    ")
 				if err != nil {
 					return core.NullValue, err
 				}
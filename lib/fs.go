@@ -3,7 +3,6 @@ package lib
 import (
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
@@ -96,6 +95,13 @@ func (f *FileSystemObj) rename(args []core.Value, vm *core.VM) (core.Value, erro
 	source := args[0].ToString()
 	dest := args[1].ToString()
 
+	if err := f.checkPath(vm, "write", source); err != nil {
+		return core.NullValue, err
+	}
+	if err := f.checkPath(vm, "write", dest); err != nil {
+		return core.NullValue, err
+	}
+
 	if err := f.FS.Rename(source, dest); err != nil {
 		if os.IsNotExist(err) {
 			return core.NullValue, fmt.Errorf("rename %v to %v: %w", source, dest, err)
@@ -113,6 +119,10 @@ func (f *FileSystemObj) removeAll(args []core.Value, vm *core.VM) (core.Value, e
 
 	name := args[0].ToString()
 
+	if err := f.checkPath(vm, "write", name); err != nil {
+		return core.NullValue, err
+	}
+
 	if err := f.FS.RemoveAll(name); err != nil {
 		return core.NullValue, err
 	}
@@ -127,6 +137,10 @@ func (f *FileSystemObj) openIfExists(args []core.Value, vm *core.VM) (core.Value
 
 	name := args[0].ToString()
 
+	if err := f.checkPath(vm, "read", name); err != nil {
+		return core.NullValue, err
+	}
+
 	fi, err := f.FS.Open(name)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -145,6 +159,10 @@ func (f *FileSystemObj) open(args []core.Value, vm *core.VM) (core.Value, error)
 
 	name := args[0].ToString()
 
+	if err := f.checkPath(vm, "read", name); err != nil {
+		return core.NullValue, err
+	}
+
 	fi, err := f.FS.Open(name)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -163,6 +181,10 @@ func (f *FileSystemObj) openForWrite(args []core.Value, vm *core.VM) (core.Value
 
 	name := args[0].ToString()
 
+	if err := f.checkPath(vm, "write", name); err != nil {
+		return core.NullValue, err
+	}
+
 	fi, err := f.FS.OpenForWrite(name)
 	if err != nil {
 		return core.NullValue, err
@@ -178,6 +200,10 @@ func (f *FileSystemObj) openForAppend(args []core.Value, vm *core.VM) (core.Valu
 
 	name := args[0].ToString()
 
+	if err := f.checkPath(vm, "write", name); err != nil {
+		return core.NullValue, err
+	}
+
 	fi, err := f.FS.OpenForAppend(name)
 	if err != nil {
 		return core.NullValue, err
@@ -186,6 +212,20 @@ func (f *FileSystemObj) openForAppend(args []core.Value, vm *core.VM) (core.Valu
 	return core.NewObject(newFile(fi, vm)), nil
 }
 
+// checkPath checks the fs capabilities of the program for the file.
+func (f *FileSystemObj) checkPath(vm *core.VM, action, name string) error {
+	if !vm.Program.HasScope("fs") {
+		return nil
+	}
+
+	abs, err := f.FS.Abs(name)
+	if err != nil {
+		return err
+	}
+
+	return checkScoped(vm, "fs:"+action, filepath.Clean(abs))
+}
+
 func newFile(fi filesystem.File, vm *core.VM) *file {
 	f := &file{f: fi}
 	vm.SetGlobalFinalizer(f)
@@ -343,6 +383,10 @@ func (f *FileSystemObj) exists(args []core.Value, vm *core.VM) (core.Value, erro
 
 	name := args[0].ToString()
 
+	if err := f.checkPath(vm, "read", name); err != nil {
+		return core.NullValue, err
+	}
+
 	if _, err := f.FS.Stat(name); err != nil {
 		return core.FalseValue, nil
 	}
@@ -368,6 +412,10 @@ func (f *FileSystemObj) readNames(args []core.Value, vm *core.VM) (core.Value, e
 
 	name = args[0].ToString()
 
+	if err := f.checkPath(vm, "read", name); err != nil {
+		return core.NullValue, err
+	}
+
 	if l == 2 {
 		if args[1].Type != core.Bool {
 			return core.NullValue, fmt.Errorf("expected argument 2 to be a boolean, got %v", args[0].TypeName())
@@ -447,6 +495,10 @@ func (f *FileSystemObj) stat(args []core.Value, vm *core.VM) (core.Value, error)
 
 	name := args[0].ToString()
 
+	if err := f.checkPath(vm, "read", name); err != nil {
+		return core.NullValue, err
+	}
+
 	fi, err := f.FS.Stat(name)
 	if err != nil {
 		// ignore errors. Just return null if is invalid
@@ -463,6 +515,10 @@ func (f *FileSystemObj) readDir(args []core.Value, vm *core.VM) (core.Value, err
 
 	name := args[0].ToString()
 
+	if err := f.checkPath(vm, "read", name); err != nil {
+		return core.NullValue, err
+	}
+
 	file, err := f.FS.Open(name)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -492,6 +548,10 @@ func (f *FileSystemObj) mkdir(args []core.Value, vm *core.VM) (core.Value, error
 	}
 	name := args[0].ToString()
 
+	if err := f.checkPath(vm, "write", name); err != nil {
+		return core.NullValue, err
+	}
+
 	if err := f.FS.MkdirAll(name); err != nil {
 		return core.NullValue, err
 	}
@@ -508,6 +568,10 @@ func (f *FileSystemObj) write(args []core.Value, vm *core.VM) (core.Value, error
 	}
 	name := args[0].ToString()
 
+	if err := f.checkPath(vm, "write", name); err != nil {
+		return core.NullValue, err
+	}
+
 	file, err := f.FS.OpenForWrite(name)
 	if err != nil {
 		return core.NullValue, err
@@ -529,6 +593,10 @@ func (f *FileSystemObj) append(args []core.Value, vm *core.VM) (core.Value, erro
 	}
 	name := args[0].ToString()
 
+	if err := f.checkPath(vm, "write", name); err != nil {
+		return core.NullValue, err
+	}
+
 	b := args[1]
 	switch b.Type {
 	case core.Bytes, core.String:
@@ -593,6 +661,10 @@ func (f *FileSystemObj) read(ifExists bool, args []core.Value, vm *core.VM) ([]b
 	}
 	name := args[0].ToString()
 
+	if err := f.checkPath(vm, "read", name); err != nil {
+		return nil, err
+	}
+
 	file, err := f.FS.Open(name)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -603,7 +675,7 @@ func (f *FileSystemObj) read(ifExists bool, args []core.Value, vm *core.VM) ([]b
 		}
 		return nil, err
 	}
-	b, err := ioutil.ReadAll(file)
+	b, err := ReadAll(file, vm)
 	file.Close()
 	if err != nil {
 		return nil, err
@@ -121,7 +121,7 @@ func (w *fsWatcher) start(fn core.Value, vm *core.VM) {
 					operation: int(event.Op),
 				}
 
-				if err := runFuncOrClosure(vm, fn, core.NewObject(e)); err != nil {
+				if err := runFuncOrClosure(vm, "fsnotify", fn, core.NewObject(e)); err != nil {
 					fmt.Println(err)
 				}
 
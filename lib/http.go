@@ -8,7 +8,6 @@ import (
 	"fmt"
 	"html"
 	"io"
-	"io/ioutil"
 	"mime/multipart"
 	"net"
 	"net/http"
@@ -305,10 +304,18 @@ declare namespace http {
          */
         writeError(status: number, msg?: string): void
 
+        /**
+         * Send the status of the error code to the client: badRequest 400,
+         * unauthorized 401, forbidden 403, notFound 404, conflict 409,
+         * timeout 504 and 500 for the rest. Public errors send their message.
+         */
+        writeError(err: errors.Error, msg?: string): void
+
         /**
          * Send a error with json content-type to the client
          */
         writeJSONError(status: number, msg?: string): void
+        writeJSONError(err: errors.Error, msg?: string): void
 
         redirect(url: string): void
     }
@@ -525,11 +532,6 @@ var HTTP = []core.NativeFunction{
 		Name:      "http.newRequest",
 		Arguments: -1,
 		Function: func(this core.Value, args []core.Value, vm *core.VM) (core.Value, error) {
-			if !vm.HasPermission("networking") {
-				fmt.Println(23423)
-				return core.NullValue, ErrUnauthorized
-			}
-
 			if err := ValidateArgRange(args, 2, 3); err != nil {
 				return core.NullValue, err
 			}
@@ -594,6 +596,10 @@ var HTTP = []core.NativeFunction{
 				return core.NullValue, err
 			}
 
+			if err := checkURL(vm, r.URL); err != nil {
+				return core.NullValue, err
+			}
+
 			if method == "POST" {
 				r.Header.Add("Content-Type", contentType)
 			} else if method == "GET" && queryMap != nil {
@@ -615,11 +621,7 @@ var HTTP = []core.NativeFunction{
 		Name:      "http.get",
 		Arguments: -1,
 		Function: func(this core.Value, args []core.Value, vm *core.VM) (core.Value, error) {
-			if !vm.HasPermission("networking") {
-				return core.NullValue, ErrUnauthorized
-			}
-
-			client := &http.Client{}
+			client := checkRedirects(vm, &http.Client{})
 			timeout := 20 * time.Second
 
 			ln := len(args)
@@ -667,12 +669,21 @@ var HTTP = []core.NativeFunction{
 
 			client.Timeout = timeout
 
-			resp, err := client.Get(url)
+			r, err := http.NewRequestWithContext(vm.GoContext(), "GET", url, nil)
 			if err != nil {
 				return core.NullValue, err
 			}
 
-			b, err := ioutil.ReadAll(resp.Body)
+			if err := checkURL(vm, r.URL); err != nil {
+				return core.NullValue, err
+			}
+
+			resp, err := client.Do(r)
+			if err != nil {
+				return core.NullValue, err
+			}
+
+			b, err := ReadAll(resp.Body, vm)
 
 			resp.Body.Close()
 
@@ -691,9 +702,6 @@ var HTTP = []core.NativeFunction{
 		Name:      "http.post",
 		Arguments: 2,
 		Function: func(this core.Value, args []core.Value, vm *core.VM) (core.Value, error) {
-			if !vm.HasPermission("networking") {
-				return core.NullValue, ErrUnauthorized
-			}
 			if err := ValidateArgs(args, core.String, core.Map); err != nil {
 				return core.NullValue, err
 			}
@@ -708,12 +716,22 @@ var HTTP = []core.NativeFunction{
 			}
 			m.Mutex.RUnlock()
 
-			resp, err := http.PostForm(u, data)
+			r, err := http.NewRequestWithContext(vm.GoContext(), "POST", u, strings.NewReader(data.Encode()))
+			if err != nil {
+				return core.NullValue, err
+			}
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			if err := checkURL(vm, r.URL); err != nil {
+				return core.NullValue, err
+			}
+
+			resp, err := checkRedirects(vm, &http.Client{}).Do(r)
 			if err != nil {
 				return core.NullValue, err
 			}
 
-			b, err := ioutil.ReadAll(resp.Body)
+			b, err := ReadAll(resp.Body, vm)
 			resp.Body.Close()
 			if err != nil {
 				return core.NullValue, err
@@ -726,20 +744,26 @@ var HTTP = []core.NativeFunction{
 		Name:      "http.getJSON",
 		Arguments: 1,
 		Function: func(this core.Value, args []core.Value, vm *core.VM) (core.Value, error) {
-			if !vm.HasPermission("networking") {
-				return core.NullValue, ErrUnauthorized
-			}
 			if err := ValidateArgs(args, core.String); err != nil {
 				return core.NullValue, err
 			}
 			url := args[0].ToString()
 
-			resp, err := http.Get(url)
+			r, err := http.NewRequestWithContext(vm.GoContext(), "GET", url, nil)
 			if err != nil {
 				return core.NullValue, err
 			}
 
-			b, err := ioutil.ReadAll(resp.Body)
+			if err := checkURL(vm, r.URL); err != nil {
+				return core.NullValue, err
+			}
+
+			resp, err := checkRedirects(vm, &http.Client{}).Do(r)
+			if err != nil {
+				return core.NullValue, err
+			}
+
+			b, err := ReadAll(resp.Body, vm)
 			resp.Body.Close()
 			if err != nil {
 				return core.NullValue, err
@@ -778,9 +802,6 @@ var HTTP = []core.NativeFunction{
 		Name:      "http.serveReverseProxy",
 		Arguments: 3,
 		Function: func(this core.Value, args []core.Value, vm *core.VM) (core.Value, error) {
-			if !vm.HasPermission("networking") {
-				return core.NullValue, ErrUnauthorized
-			}
 			if err := ValidateArgs(args, core.Object, core.Object, core.Object); err != nil {
 				return core.NullValue, err
 			}
@@ -788,6 +809,9 @@ var HTTP = []core.NativeFunction{
 			if url == nil {
 				return core.NullValue, fmt.Errorf("invalid URL, got %s", args[0].TypeName())
 			}
+			if err := checkURL(vm, url.url); err != nil {
+				return core.NullValue, err
+			}
 			resp, ok := args[1].ToObject().(*responseWriter)
 			if !ok {
 				return core.NullValue, fmt.Errorf("invalid Response, got %s", args[2].TypeName())
@@ -810,7 +834,7 @@ func serialize(v core.Value) (string, error) {
 		return v.ToString(), nil
 	}
 
-	b, err := json.Marshal(v.Export(0))
+	b, err := json.Marshal(v)
 	if err != nil {
 		return "", err
 	}
@@ -1252,7 +1276,7 @@ func (r *response) body(args []core.Value, vm *core.VM) (core.Value, error) {
 
 	resp := r.r
 
-	b, err := ioutil.ReadAll(resp.Body)
+	b, err := ReadAll(resp.Body, vm)
 
 	resp.Body.Close()
 
@@ -1439,7 +1463,11 @@ func (r *request) setBasicAuth(args []core.Value, vm *core.VM) (core.Value, erro
 }
 
 func (r *request) execute(args []core.Value, vm *core.VM) (core.Value, error) {
-	client := &http.Client{}
+	if err := checkURL(vm, r.request.URL); err != nil {
+		return core.NullValue, err
+	}
+
+	client := checkRedirects(vm, &http.Client{})
 
 	ln := len(args)
 
@@ -1469,7 +1497,7 @@ func (r *request) execute(args []core.Value, vm *core.VM) (core.Value, error) {
 		}
 	}
 
-	resp, err := client.Do(r.request)
+	resp, err := client.Do(r.request.WithContext(vm.GoContext()))
 	if err != nil {
 		return core.NullValue, err
 	}
@@ -1478,7 +1506,11 @@ func (r *request) execute(args []core.Value, vm *core.VM) (core.Value, error) {
 }
 
 func (r *request) mustExecute(args []core.Value, vm *core.VM) (core.Value, error) {
-	client := &http.Client{}
+	if err := checkURL(vm, r.request.URL); err != nil {
+		return core.NullValue, err
+	}
+
+	client := checkRedirects(vm, &http.Client{})
 
 	ln := len(args)
 
@@ -1508,12 +1540,12 @@ func (r *request) mustExecute(args []core.Value, vm *core.VM) (core.Value, error
 		}
 	}
 
-	resp, err := client.Do(r.request)
+	resp, err := client.Do(r.request.WithContext(vm.GoContext()))
 	if err != nil {
 		return core.NullValue, err
 	}
 
-	b, err := ioutil.ReadAll(resp.Body)
+	b, err := ReadAll(resp.Body, vm)
 
 	resp.Body.Close()
 
@@ -2245,6 +2277,7 @@ func (r *responseWriter) writeHTML(args []core.Value, vm *core.VM) (core.Value,
 }
 
 func (r *responseWriter) writeError(args []core.Value, vm *core.VM) (core.Value, error) {
+	args = errorStatusArgs(args)
 	if err := ValidateOptionalArgs(args, core.Int, core.String); err != nil {
 		return core.NullValue, err
 	}
@@ -2271,6 +2304,10 @@ func (r *responseWriter) writeError(args []core.Value, vm *core.VM) (core.Value,
 			r.writer.Write([]byte("Forbidden"))
 		case 404:
 			r.writer.Write([]byte("Not Found"))
+		case 409:
+			r.writer.Write([]byte("Conflict"))
+		case 504:
+			r.writer.Write([]byte("Timeout"))
 		default:
 			r.writer.Write([]byte("Internal error"))
 		}
@@ -2281,6 +2318,7 @@ func (r *responseWriter) writeError(args []core.Value, vm *core.VM) (core.Value,
 }
 
 func (r *responseWriter) writeJSONError(args []core.Value, vm *core.VM) (core.Value, error) {
+	args = errorStatusArgs(args)
 	if err := ValidateOptionalArgs(args, core.Int, core.String); err != nil {
 		return core.NullValue, err
 	}
@@ -2303,8 +2341,14 @@ func (r *responseWriter) writeJSONError(args []core.Value, vm *core.VM) (core.Va
 			err = []byte("Bad Request")
 		case 401:
 			err = []byte("Unauthorized")
+		case 403:
+			err = []byte("Forbidden")
 		case 404:
 			err = []byte("Not Found")
+		case 409:
+			err = []byte("Conflict")
+		case 504:
+			err = []byte("Timeout")
 		default:
 			err = []byte("Internal error")
 		}
@@ -2318,6 +2362,26 @@ func (r *responseWriter) writeJSONError(args []core.Value, vm *core.VM) (core.Va
 	return core.NullValue, nil
 }
 
+// errorStatusArgs replaces an error passed to writeError with the status
+// of its code and, if the error is public and there is no message, its message.
+func errorStatusArgs(args []core.Value) []core.Value {
+	if len(args) == 0 || args[0].Type != core.Object {
+		return args
+	}
+	e, ok := args[0].ToObject().(core.Error)
+	if !ok {
+		return args
+	}
+
+	a := []core.Value{core.NewInt(httpStatus(e))}
+	if len(args) > 1 {
+		a = append(a, args[1:]...)
+	} else if e.Public() {
+		a = append(a, core.NewString(e.Message()))
+	}
+	return a
+}
+
 func (r *responseWriter) writeJSONStatus(args []core.Value, vm *core.VM) (core.Value, error) {
 	l := len(args)
 	if l < 2 {
@@ -2342,7 +2406,7 @@ func (r *responseWriter) doWriteJSON(status int, args []core.Value, vm *core.VM)
 		return core.NullValue, fmt.Errorf("expected 1 argument, got %d", l)
 	}
 
-	v := args[0].Export(0)
+	v := args[0]
 
 	r.status = status
 
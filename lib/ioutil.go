@@ -43,21 +43,23 @@ var IOUtil = []core.NativeFunction{
 	},
 }
 
+// ReadAll reads until EOF failing if the data doesn't fit in the memory
+// limit of the vm. The result is accounted when it is stored.
 func ReadAll(reader io.Reader, vm *core.VM) ([]byte, error) {
-	const SIZE = 250
+	const SIZE = 4096
 	b := make([]byte, SIZE)
 	var buf bytes.Buffer
 
 	for {
 		n, err := reader.Read(b)
 
-		if err := vm.AddAllocations(n); err != nil {
+		if err := vm.CheckAllocations(buf.Len() + n); err != nil {
 			return nil, err
 		}
 
 		buf.Write(b[:n])
 
-		if n < SIZE || err == io.EOF {
+		if err == io.EOF {
 			return buf.Bytes(), nil
 		}
 
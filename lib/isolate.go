@@ -0,0 +1,556 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gtlang/gt/core"
+)
+
+func init() {
+	core.RegisterLib(Isolates, `
+
+declare namespace runtime {
+    /**
+     * Runs a function or a program in a new VM that doesn't share values
+     * with this one. A function starts with a copy of the globals and a
+     * program is initialized from scratch. The arguments, the messages and
+     * the returned value are copied. Native objects like channels are
+     * passed as they are.
+     *
+     * The isolate is killed when this program ends.
+     */
+    export function spawn<In = any, Out = any>(f: Function | Program, ...args: any[]): Isolate<In, Out>
+
+    /**
+     * Sends a message from an isolate to its parent.
+     */
+    export function send(v: any): void
+
+    /**
+     * Returns the next message sent by the parent of the isolate or undefined
+     * if the mailbox is closed. It throws runtime.timeout after the timeout.
+     */
+    export function receive(timeout?: time.Duration | number): any
+
+    /**
+     * Handles the messages sent by the parent after the isolate function
+     * returns, until the parent closes the mailbox.
+     */
+    export function onMessage(f: (msg: any) => void): void
+
+    export interface Isolate<In = any, Out = any> {
+        /**
+         * If the isolate has exited.
+         */
+        readonly done: boolean
+
+        /**
+         * The error if the isolate crashed.
+         */
+        readonly error: errors.Error | null
+
+        send(v: In): void
+
+        /**
+         * Returns the next message sent by the isolate or undefined when it
+         * has exited and there are no more messages. If it crashed it throws
+         * the error. It throws runtime.timeout after the timeout.
+         */
+        receive(timeout?: time.Duration | number): Out
+
+        /**
+         * Handles the messages sent by the isolate while wait is called.
+         * Without a handler wait discards them.
+         */
+        onMessage(f: (msg: Out) => void): void
+
+        /**
+         * Closes the mailbox of the isolate. It can't receive more messages.
+         */
+        close(): void
+
+        /**
+         * Stops the isolate.
+         */
+        kill(): void
+
+        /**
+         * Closes the mailbox and waits until the isolate exits. It returns the
+         * value returned by the isolate or throws the error if it crashed.
+         */
+        wait(): any
+    }
+}
+
+`)
+}
+
+// the number of messages that can be sent without being received
+const mailboxSize = 100
+
+var Isolates = []core.NativeFunction{
+	core.NativeFunction{
+		Name:      "runtime.spawn",
+		Arguments: -1,
+		Function: func(this core.Value, args []core.Value, vm *core.VM) (core.Value, error) {
+			if !vm.HasPermission("sync") {
+				return core.NullValue, ErrUnauthorized
+			}
+
+			if len(args) == 0 {
+				return core.NullValue, fmt.Errorf("expected at least 1 argument, got 0")
+			}
+
+			ctx, cancel := context.WithCancel(vm.GoContext())
+
+			iso := &isolate{
+				in:     make(chan core.Value, mailboxSize),
+				out:    make(chan core.Value, mailboxSize),
+				closed: make(chan struct{}),
+				done:   make(chan struct{}),
+				cancel: cancel,
+			}
+
+			var m *core.VM
+			var run func() (core.Value, error)
+
+			a := args[0]
+			if p, ok := a.ToObjectOrNil().(*program); ok {
+				params, err := copyValues(args[1:])
+				if err != nil {
+					cancel()
+					return core.NullValue, err
+				}
+				m = core.NewVM(p.prog)
+				m.MaxAllocations = vm.MaxAllocations
+				m.MaxFrames = vm.MaxFrames
+				m.MaxSteps = vm.MaxSteps
+				m.FileSystem = vm.FileSystem
+				m.Context = &Context{}
+				run = func() (core.Value, error) {
+					return m.RunContext(ctx, params...)
+				}
+			} else {
+				if err := validateFunc(a); err != nil {
+					cancel()
+					return core.NullValue, fmt.Errorf("expected a function or a program, got %s", a.TypeName())
+				}
+				// the function is copied too because a closure
+				// captures registers of this VM.
+				i, params, err := vm.Isolate(ctx, args...)
+				if err != nil {
+					cancel()
+					return core.NullValue, err
+				}
+				m = i
+				m.Context = cloneContext(vm, m)
+				run = func() (core.Value, error) {
+					return callFunc(m, params[0], params[1:]...)
+				}
+			}
+
+			GetContext(m).isolate = iso
+
+			// the isolate dies with its parent
+			vm.SetGlobalFinalizer(iso)
+
+			go iso.run(m, ctx, run)
+
+			return core.NewObject(iso), nil
+		},
+	},
+	core.NativeFunction{
+		Name:      "runtime.send",
+		Arguments: 1,
+		Function: func(this core.Value, args []core.Value, vm *core.VM) (core.Value, error) {
+			iso, err := currentIsolate(vm)
+			if err != nil {
+				return core.NullValue, err
+			}
+
+			v, err := core.CopyValue(args[0])
+			if err != nil {
+				return core.NullValue, err
+			}
+
+			ctx := vm.GoContext()
+			select {
+			case iso.out <- v:
+				return core.NullValue, nil
+			case <-ctx.Done():
+				return core.NullValue, ctx.Err()
+			}
+		},
+	},
+	core.NativeFunction{
+		Name:      "runtime.receive",
+		Arguments: -1,
+		Function: func(this core.Value, args []core.Value, vm *core.VM) (core.Value, error) {
+			iso, err := currentIsolate(vm)
+			if err != nil {
+				return core.NullValue, err
+			}
+
+			timeout, err := receiveTimeout(args)
+			if err != nil {
+				return core.NullValue, err
+			}
+
+			ctx := vm.GoContext()
+			select {
+			case v := <-iso.in:
+				return v, nil
+			case <-iso.closed:
+				select {
+				case v := <-iso.in:
+					return v, nil
+				default:
+					return core.UndefinedValue, nil
+				}
+			case <-timeout:
+				return core.NullValue, ErrTimeout
+			case <-ctx.Done():
+				return core.NullValue, ctx.Err()
+			}
+		},
+	},
+	core.NativeFunction{
+		Name:      "runtime.onMessage",
+		Arguments: 1,
+		Function: func(this core.Value, args []core.Value, vm *core.VM) (core.Value, error) {
+			iso, err := currentIsolate(vm)
+			if err != nil {
+				return core.NullValue, err
+			}
+
+			if err := validateFunc(args[0]); err != nil {
+				return core.NullValue, err
+			}
+
+			iso.mutex.Lock()
+			iso.handler = args[0]
+			iso.mutex.Unlock()
+			return core.NullValue, nil
+		},
+	},
+}
+
+func currentIsolate(vm *core.VM) (*isolate, error) {
+	iso := GetContext(vm).isolate
+	if iso == nil {
+		return nil, fmt.Errorf("not running in an isolate")
+	}
+	return iso, nil
+}
+
+func validateFunc(v core.Value) error {
+	switch v.Type {
+	case core.Func:
+		return nil
+	case core.Object:
+		if _, ok := v.ToObject().(core.Closure); ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("expected a function, got %s", v.TypeName())
+}
+
+// copyValues copies the values to pass them to another VM.
+func copyValues(values []core.Value) ([]core.Value, error) {
+	copies := make([]core.Value, len(values))
+	for i, v := range values {
+		c, err := core.CopyValue(v)
+		if err != nil {
+			return nil, err
+		}
+		copies[i] = c
+	}
+	return copies, nil
+}
+
+// receiveTimeout returns a channel that is ready after the optional timeout.
+func receiveTimeout(args []core.Value) (<-chan time.Time, error) {
+	switch len(args) {
+	case 0:
+		return nil, nil
+	case 1:
+		d, err := ToDuration(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return time.After(d), nil
+	default:
+		return nil, fmt.Errorf("expected 0 or 1 arguments, got %d", len(args))
+	}
+}
+
+// callFunc runs a function or a closure in vm.
+func callFunc(vm *core.VM, fn core.Value, args ...core.Value) (core.Value, error) {
+	if fn.Type == core.Func {
+		return vm.RunFuncIndex(fn.ToFunction(), args...)
+	}
+	return vm.RunClosure(fn.ToObject().(core.Closure), args...)
+}
+
+type isolate struct {
+	mutex     sync.Mutex
+	in        chan core.Value // messages from the parent
+	out       chan core.Value // messages to the parent
+	closed    chan struct{}   // closed when the parent closes the mailbox
+	done      chan struct{}   // closed when the isolate exits
+	closeOnce sync.Once
+	cancel    context.CancelFunc
+	handler   core.Value // the function set with runtime.onMessage
+	onMessage core.Value // the function of the parent that handles messages
+	result    core.Value
+	err       error
+}
+
+func (iso *isolate) Type() string {
+	return "runtime.Isolate"
+}
+
+// run executes the isolate and then serves the messages
+// if it has set a handler.
+func (iso *isolate) run(m *core.VM, ctx context.Context, run func() (core.Value, error)) {
+	defer iso.cancel()
+
+	v, err := run()
+	if err == nil {
+		err = iso.serve(m, ctx)
+	}
+	if err == nil {
+		v, err = core.CopyValue(v)
+	}
+
+	iso.result = v
+	if err != nil {
+		// the error can hold values of the isolate
+		iso.err = core.CopyError(err)
+	}
+	close(iso.done)
+}
+
+func (iso *isolate) serve(m *core.VM, ctx context.Context) error {
+	iso.mutex.Lock()
+	h := iso.handler
+	iso.mutex.Unlock()
+
+	if h.Type == core.Null {
+		return nil
+	}
+
+	for {
+		select {
+		case v := <-iso.in:
+			if _, err := callFunc(m, h, v); err != nil {
+				return err
+			}
+		case <-iso.closed:
+			for {
+				select {
+				case v := <-iso.in:
+					if _, err := callFunc(m, h, v); err != nil {
+						return err
+					}
+				default:
+					return nil
+				}
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Close kills the isolate when the parent program ends.
+func (iso *isolate) Close() error {
+	iso.cancel()
+	return nil
+}
+
+// exitError returns the error of the isolate if it crashed.
+func (iso *isolate) exitError() error {
+	if iso.err == nil {
+		return nil
+	}
+	return fmt.Errorf("isolate failed: %w", iso.err)
+}
+
+func (iso *isolate) GetProperty(name string, vm *core.VM) (core.Value, error) {
+	switch name {
+	case "done":
+		select {
+		case <-iso.done:
+			return core.NewBool(true), nil
+		default:
+			return core.NewBool(false), nil
+		}
+	case "error":
+		select {
+		case <-iso.done:
+			if iso.err != nil {
+				return core.NewObject(iso.err), nil
+			}
+		default:
+		}
+		return core.NullValue, nil
+	}
+	return core.UndefinedValue, nil
+}
+
+func (iso *isolate) GetMethod(name string) core.NativeMethod {
+	switch name {
+	case "send":
+		return iso.send
+	case "receive":
+		return iso.receive
+	case "onMessage":
+		return iso.setOnMessage
+	case "close":
+		return iso.close
+	case "kill":
+		return iso.kill
+	case "wait":
+		return iso.wait
+	}
+	return nil
+}
+
+func (iso *isolate) send(args []core.Value, vm *core.VM) (core.Value, error) {
+	if err := ValidateArgs(args, nil); err != nil {
+		return core.NullValue, err
+	}
+
+	select {
+	case <-iso.closed:
+		return core.NullValue, fmt.Errorf("the mailbox is closed")
+	case <-iso.done:
+		if err := iso.exitError(); err != nil {
+			return core.NullValue, err
+		}
+		return core.NullValue, fmt.Errorf("the isolate has exited")
+	default:
+	}
+
+	v, err := core.CopyValue(args[0])
+	if err != nil {
+		return core.NullValue, err
+	}
+
+	ctx := vm.GoContext()
+	select {
+	case iso.in <- v:
+		return core.NullValue, nil
+	case <-iso.done:
+		if err := iso.exitError(); err != nil {
+			return core.NullValue, err
+		}
+		return core.NullValue, fmt.Errorf("the isolate has exited")
+	case <-ctx.Done():
+		return core.NullValue, ctx.Err()
+	}
+}
+
+func (iso *isolate) receive(args []core.Value, vm *core.VM) (core.Value, error) {
+	timeout, err := receiveTimeout(args)
+	if err != nil {
+		return core.NullValue, err
+	}
+
+	ctx := vm.GoContext()
+	select {
+	case v := <-iso.out:
+		return v, nil
+	case <-iso.done:
+		select {
+		case v := <-iso.out:
+			return v, nil
+		default:
+		}
+		if err := iso.exitError(); err != nil {
+			return core.NullValue, err
+		}
+		return core.UndefinedValue, nil
+	case <-timeout:
+		return core.NullValue, ErrTimeout
+	case <-ctx.Done():
+		return core.NullValue, ctx.Err()
+	}
+}
+
+func (iso *isolate) setOnMessage(args []core.Value, vm *core.VM) (core.Value, error) {
+	if err := ValidateArgs(args, nil); err != nil {
+		return core.NullValue, err
+	}
+	if err := validateFunc(args[0]); err != nil {
+		return core.NullValue, err
+	}
+	iso.onMessage = args[0]
+	return core.NullValue, nil
+}
+
+func (iso *isolate) close(args []core.Value, vm *core.VM) (core.Value, error) {
+	if err := ValidateArgs(args); err != nil {
+		return core.NullValue, err
+	}
+	iso.closeOnce.Do(func() { close(iso.closed) })
+	return core.NullValue, nil
+}
+
+func (iso *isolate) kill(args []core.Value, vm *core.VM) (core.Value, error) {
+	if err := ValidateArgs(args); err != nil {
+		return core.NullValue, err
+	}
+	iso.cancel()
+	<-iso.done
+	return core.NullValue, nil
+}
+
+func (iso *isolate) wait(args []core.Value, vm *core.VM) (core.Value, error) {
+	if err := ValidateArgs(args); err != nil {
+		return core.NullValue, err
+	}
+
+	iso.closeOnce.Do(func() { close(iso.closed) })
+
+	// the messages are discarded if there is no handler so
+	// the isolate doesn't block when the mailbox is full
+	handle := func(v core.Value) error {
+		if iso.onMessage.Type == core.Null {
+			return nil
+		}
+		_, err := callFunc(vm, iso.onMessage, v)
+		return err
+	}
+
+	ctx := vm.GoContext()
+	for {
+		select {
+		case v := <-iso.out:
+			if err := handle(v); err != nil {
+				return core.NullValue, err
+			}
+		case <-iso.done:
+			for done := false; !done; {
+				select {
+				case v := <-iso.out:
+					if err := handle(v); err != nil {
+						return core.NullValue, err
+					}
+				default:
+					done = true
+				}
+			}
+			if err := iso.exitError(); err != nil {
+				return core.NullValue, err
+			}
+			return iso.result, nil
+		case <-ctx.Done():
+			return core.NullValue, ctx.Err()
+		}
+	}
+}
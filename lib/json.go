@@ -1,9 +1,11 @@
 package lib
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"github.com/gtlang/gt/core"
+	"io"
 	"strings"
 )
 
@@ -40,7 +42,8 @@ var JSON = []core.NativeFunction{
 				return core.NullValue, fmt.Errorf("expected 1 or 2 arguments, got %d", len(args))
 			}
 
-			v := args[0].Export(0)
+			// marshal the value to keep the order of the keys
+			v := args[0]
 
 			var b []byte
 			var err error
@@ -102,13 +105,66 @@ var JSON = []core.NativeFunction{
 }
 
 func unmarshal(buf []byte) (core.Value, error) {
-	var o interface{}
-	err := json.Unmarshal(buf, &o)
+	d := json.NewDecoder(bytes.NewReader(buf))
+
+	v, err := unmarshalValue(d)
 	if err != nil {
 		return core.NullValue, err
 	}
 
-	return unmarshalObject(o)
+	if _, err := d.Token(); err != io.EOF {
+		if err == nil {
+			err = fmt.Errorf("invalid data after the top-level value")
+		}
+		return core.NullValue, err
+	}
+
+	return v, nil
+}
+
+// unmarshalValue reads the tokens one by one to keep the order of the keys.
+func unmarshalValue(d *json.Decoder) (core.Value, error) {
+	t, err := d.Token()
+	if err != nil {
+		return core.NullValue, err
+	}
+
+	switch t {
+	case json.Delim('['):
+		s := make([]core.Value, 0)
+		for d.More() {
+			v, err := unmarshalValue(d)
+			if err != nil {
+				return core.NullValue, err
+			}
+			s = append(s, v)
+		}
+		if _, err := d.Token(); err != nil {
+			return core.NullValue, err
+		}
+		return core.NewArrayValues(s), nil
+
+	case json.Delim('{'):
+		m := core.NewMap(0)
+		mv := m.ToMap()
+		for d.More() {
+			k, err := d.Token()
+			if err != nil {
+				return core.NullValue, err
+			}
+			v, err := unmarshalValue(d)
+			if err != nil {
+				return core.NullValue, err
+			}
+			mv.Set(k.(string), v)
+		}
+		if _, err := d.Token(); err != nil {
+			return core.NullValue, err
+		}
+		return m, nil
+	}
+
+	return unmarshalObject(t)
 }
 
 func unmarshalObject(value interface{}) (core.Value, error) {
@@ -129,27 +185,6 @@ func unmarshalObject(value interface{}) (core.Value, error) {
 		return core.NewFloat(t), nil
 	case int, int32, int64, bool, string:
 		return core.NewValue(t), nil
-	case []interface{}:
-		s := make([]core.Value, len(t))
-		for i, v := range t {
-			o, err := unmarshalObject(v)
-			if err != nil {
-				return core.NullValue, err
-			}
-			s[i] = o
-		}
-		return core.NewArrayValues(s), nil
-	case map[string]interface{}:
-		m := make(map[string]core.Value, len(t))
-		for k, v := range t {
-			o, err := unmarshalObject(v)
-			if err != nil {
-				return core.NullValue, err
-			}
-			m[k] = o
-		}
-		return core.NewMapValues(m), nil
-
 	default:
 		return core.NullValue, fmt.Errorf("invalid serialized type %T", value)
 	}
@@ -0,0 +1,19 @@
+package lib
+
+import (
+	"testing"
+)
+
+func TestJSONKeyOrder(t *testing.T) {
+	v := runTest(t, `
+		function main() {
+			let m = json.unmarshal('{"z": 1, "a": {"y": 2, "b": [3]}}')
+			m.c = 4
+			return json.marshal(m)
+		}
+	`)
+
+	if s := v.ToString(); s != `{"z":1,"a":{"y":2,"b":[3]},"c":4}` {
+		t.Fatal(s)
+	}
+}
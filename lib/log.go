@@ -381,6 +381,18 @@ func (s *logDBScanner) GetMethod(name string) core.NativeMethod {
 	return nil
 }
 
+// Iterator iterates the data points so a scanner can be used in a for...of loop.
+func (s *logDBScanner) Iterator() (core.Iterator, error) {
+	return s, nil
+}
+
+func (s *logDBScanner) Next() (core.Value, bool, error) {
+	if !s.s.Scan() {
+		return core.NullValue, false, nil
+	}
+	return core.NewObject(&dataPoint{s.s.Data()}), true, nil
+}
+
 func (s *logDBScanner) setFilter(args []core.Value, vm *core.VM) (core.Value, error) {
 	if len(args) != 1 {
 		return core.NullValue, fmt.Errorf("expected a string arg")
@@ -48,14 +48,16 @@ var libMap = []core.NativeFunction{
 				return core.NullValue, fmt.Errorf("expected a map or object, got %s", a.TypeName())
 			}
 
-			m := a.ToMap().Map
-
-			clone := make(map[string]core.Value, len(m))
-			for k, v := range m {
-				clone[k] = v
+			m := a.ToMap()
+			m.Mutex.RLock()
+			clone := core.NewMap(len(m.Map))
+			c := clone.ToMap()
+			for _, k := range m.Keys() {
+				c.Set(k, m.Map[k])
 			}
+			m.Mutex.RUnlock()
 
-			return core.NewMapValues(clone), nil
+			return clone, nil
 		},
 	},
 	core.NativeFunction{
@@ -88,10 +90,8 @@ var libMap = []core.NativeFunction{
 			m := a.ToMap()
 			m.Mutex.RLock()
 			keys := make([]core.Value, len(m.Map))
-			var i int
-			for k := range m.Map {
+			for i, k := range m.Keys() {
 				keys[i] = core.NewString(k)
-				i++
 			}
 			m.Mutex.RUnlock()
 			return core.NewArrayValues(keys), nil
@@ -109,10 +109,8 @@ var libMap = []core.NativeFunction{
 			m := a.ToMap()
 			m.Mutex.RLock()
 			values := make([]core.Value, len(m.Map))
-			var i int
-			for k := range m.Map {
+			for i, k := range m.Keys() {
 				values[i] = m.Map[k]
-				i++
 			}
 			m.Mutex.RUnlock()
 			return core.NewArrayValues(values), nil
@@ -136,7 +134,7 @@ var libMap = []core.NativeFunction{
 
 			m := a.ToMap()
 			m.Mutex.Lock()
-			delete(m.Map, b.ToString())
+			m.Delete(b.ToString())
 			m.Mutex.Unlock()
 			return core.NullValue, nil
 		},
@@ -152,9 +150,7 @@ var libMap = []core.NativeFunction{
 
 			m := a.ToMap()
 			m.Mutex.Lock()
-			for k:= range m.Map {
-				delete(m.Map, k)
-			}
+			m.Clear()
 			m.Mutex.Unlock()
 			return core.NullValue, nil
 		},
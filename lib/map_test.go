@@ -0,0 +1,20 @@
+package lib
+
+import (
+	"testing"
+)
+
+func TestMapKeysOrder(t *testing.T) {
+	v := runTest(t, `
+		function main() {
+			let m = { z: 1, a: 2, x: 3 }
+			map.deleteKey(m, "a")
+			m.a = 4
+			return map.keys(map.clone(m)).join(",") + ":" + map.values(m).join(",")
+		}
+	`)
+
+	if s := v.ToString(); s != "z,x,a:1,3,4" {
+		t.Fatal(s)
+	}
+}
@@ -1,6 +1,7 @@
 package lib
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"strings"
@@ -48,11 +49,11 @@ var Net = []core.NativeFunction{
 		Name:      "net.listen",
 		Arguments: 2,
 		Function: func(this core.Value, args []core.Value, vm *core.VM) (core.Value, error) {
-			if !vm.HasPermission("netListen") {
-				return core.NullValue, ErrUnauthorized
+			if err := ValidateArgs(args, core.String, core.String); err != nil {
+				return core.NullValue, err
 			}
 
-			if err := ValidateArgs(args, core.String, core.String); err != nil {
+			if err := checkCapability(vm, "netListen", "net:listen", args[1].ToString()); err != nil {
 				return core.NullValue, err
 			}
 
@@ -71,7 +72,13 @@ var Net = []core.NativeFunction{
 			if err := ValidateArgs(args, core.String, core.String); err != nil {
 				return core.NullValue, err
 			}
-			conn, err := net.Dial(args[0].ToString(), args[1].ToString())
+
+			if err := checkScoped(vm, "net:dial", args[1].ToString()); err != nil {
+				return core.NullValue, err
+			}
+
+			var d net.Dialer
+			conn, err := d.DialContext(vm.GoContext(), args[0].ToString(), args[1].ToString())
 			if err != nil {
 				return core.NullValue, err
 			}
@@ -95,7 +102,12 @@ var Net = []core.NativeFunction{
 				return core.NullValue, err
 			}
 
-			conn, err := net.DialTimeout(args[0].ToString(), args[1].ToString(), d)
+			if err := checkScoped(vm, "net:dial", args[1].ToString()); err != nil {
+				return core.NullValue, err
+			}
+
+			dialer := net.Dialer{Timeout: d}
+			conn, err := dialer.DialContext(vm.GoContext(), args[0].ToString(), args[1].ToString())
 			if err != nil {
 				return core.NullValue, err
 			}
@@ -237,8 +249,16 @@ func (c netConn) read(args []core.Value, vm *core.VM) (core.Value, error) {
 		return core.NullValue, err
 	}
 	b := args[0].ToBytes()
+
+	ctx := vm.GoContext()
+	stop := interruptOnCancel(ctx, c.conn)
 	n, err := c.conn.Read(b)
+	stop()
+
 	if err != nil {
+		if ctx.Err() != nil {
+			return core.NullValue, ctx.Err()
+		}
 		return core.NullValue, err
 	}
 	return core.NewInt(n), nil
@@ -259,8 +279,15 @@ func (c netConn) write(args []core.Value, vm *core.VM) (core.Value, error) {
 		return core.NullValue, ErrInvalidType
 	}
 
+	ctx := vm.GoContext()
+	stop := interruptOnCancel(ctx, c.conn)
 	n, err := c.conn.Write(b)
+	stop()
+
 	if err != nil {
+		if ctx.Err() != nil {
+			return core.NullValue, ctx.Err()
+		}
 		return core.NullValue, err
 	}
 	return core.NewInt(n), nil
@@ -350,8 +377,20 @@ func (c *netListener) accept(args []core.Value, vm *core.VM) (core.Value, error)
 		return core.NullValue, err
 	}
 
+	ctx := vm.GoContext()
+	var stop func()
+	if d, ok := c.ls.(deadliner); ok {
+		stop = interruptOnCancel(ctx, d)
+	} else {
+		stop = func() {}
+	}
 	conn, err := c.ls.Accept()
+	stop()
+
 	if err != nil {
+		if ctx.Err() != nil {
+			return core.NullValue, ctx.Err()
+		}
 		return core.NullValue, err
 	}
 
@@ -370,3 +409,28 @@ func (c *netListener) close(args []core.Value, vm *core.VM) (core.Value, error)
 
 	return core.NullValue, nil
 }
+
+type deadliner interface {
+	SetDeadline(t time.Time) error
+}
+
+// interruptOnCancel unblocks any pending operation setting a deadline
+// in the past if ctx is done before stop is called.
+func interruptOnCancel(ctx context.Context, d deadliner) (stop func()) {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			d.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+
+	return func() {
+		close(done)
+	}
+}
@@ -0,0 +1,61 @@
+package lib
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gtlang/gt/core"
+)
+
+// checkCapability returns ErrUnauthorized if the program doesn't have the
+// permission, that grants any resource, or the capability for the resource.
+func checkCapability(vm *core.VM, permission, capability, resource string) error {
+	if vm.HasPermission(permission) || vm.HasCapability(capability, resource) {
+		return nil
+	}
+	return ErrUnauthorized
+}
+
+// checkScoped checks the capability only if the program declares any
+// capability of its kind. Otherwise the access is not restricted as
+// before capabilities existed.
+func checkScoped(vm *core.VM, capability, resource string) error {
+	kind := capability[:strings.IndexByte(capability, ':')]
+	if !vm.Program.HasScope(kind) || vm.HasCapability(capability, resource) {
+		return nil
+	}
+	return ErrUnauthorized
+}
+
+// checkURL checks that the program can connect to the host of the url.
+func checkURL(vm *core.VM, u *url.URL) error {
+	return checkCapability(vm, "networking", "net:dial", hostPort(u))
+}
+
+// checkRedirects makes the client check the capabilities also
+// for the hosts it is redirected to.
+func checkRedirects(vm *core.VM, client *http.Client) *http.Client {
+	client.CheckRedirect = func(r *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return checkURL(vm, r.URL)
+	}
+	return client
+}
+
+func hostPort(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		switch u.Scheme {
+		case "https", "wss":
+			port = "443"
+		default:
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
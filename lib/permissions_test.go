@@ -0,0 +1,81 @@
+package lib
+
+import (
+	"testing"
+
+	"github.com/gtlang/filesystem"
+	"github.com/gtlang/gt/core"
+)
+
+func TestScopedFileSystem(t *testing.T) {
+	p, err := core.CompileStr(`
+		//gt: permissions fs:read:/data/*
+
+		function main() {
+			return runtime.permissions()
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := filesystem.NewVirtualFS()
+	fs.WritePath("/data/a.txt", []byte("a"))
+	fs.WritePath("/secret.txt", []byte("b"))
+
+	vm := core.NewVM(p)
+	f := NewFileSystem(fs)
+
+	read := func(name string) error {
+		_, err := f.readString([]core.Value{core.NewString(name)}, vm)
+		return err
+	}
+
+	if err := read("/data/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := read("/secret.txt"); err != ErrUnauthorized {
+		t.Fatalf("expected unauthorized, got %v", err)
+	}
+	if err := read("/data/../secret.txt"); err != ErrUnauthorized {
+		t.Fatalf("expected unauthorized, got %v", err)
+	}
+
+	_, err = f.write([]core.Value{core.NewString("/data/b.txt"), core.NewString("b")}, vm)
+	if err != ErrUnauthorized {
+		t.Fatalf("expected unauthorized, got %v", err)
+	}
+
+	log := vm.AuditLog()
+	if len(log) != 3 {
+		t.Fatalf("expected 3 denied checks, got %d", len(log))
+	}
+	if log[2].Capability != "fs:write" || log[2].Resource != "/data/b.txt" {
+		t.Fatalf("invalid audit entry %v", log[2])
+	}
+
+	v, err := vm.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := v.ToArray(); len(s) != 1 || s[0].ToString() != "fs:read:/data/*" {
+		t.Fatalf("invalid permissions %v", v)
+	}
+}
+
+func TestUnscopedFileSystem(t *testing.T) {
+	p, err := core.CompileStr(`function main() { }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := filesystem.NewVirtualFS()
+	fs.WritePath("/secret.txt", []byte("b"))
+
+	vm := core.NewVM(p)
+
+	_, err = NewFileSystem(fs).readString([]core.Value{core.NewString("/secret.txt")}, vm)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,7 +1,9 @@
 package lib
 
 import (
+	"fmt"
 	"regexp"
+
 	"github.com/gtlang/gt/core"
 )
 
@@ -9,11 +11,40 @@ func init() {
 	core.RegisterLib(Regex, `
 
 declare namespace regex {
-    export function match(pattern: string, value: string): boolean
-    export function split(pattern: string, value: string): string[]
-    export function findAllStringSubmatch(pattern: string, value: string, count?: number): string[]
-    export function findAllStringSubmatchIndex(pattern: string, value: string, count?: number): number[][]
-    export function replaceAllString(pattern: string, source: string, replace: string): string
+    /**
+     * Compiles a pattern with the flags of a literal: "i", "m", "s" and "g".
+     */
+    export function compile(pattern: string, flags?: string): RegExp
+    export function match(pattern: string | RegExp, value: string): boolean
+    export function split(pattern: string | RegExp, value: string): string[]
+    export function findAllStringSubmatch(pattern: string | RegExp, value: string, count?: number): string[]
+    export function findAllStringSubmatchIndex(pattern: string | RegExp, value: string, count?: number): number[][]
+    export function replaceAllString(pattern: string | RegExp, source: string, replace: string): string
+}
+
+/**
+ * A regex literal like /(\d+)-(?P<name>\w+)/i. It is compiled once.
+ */
+interface RegExp {
+    source: string
+    flags: string
+    global: boolean
+    test(s: string): boolean
+    exec(s: string): RegExpMatch | null
+    execAll(s: string): RegExpMatch[]
+    /**
+     * Replaces the first match or all of them with the g flag.
+     * The replacement can reference groups with $1 or ${name}.
+     */
+    replace(s: string, replace: string | ((m: RegExpMatch) => string)): string
+    split(s: string, limit?: number): string[]
+}
+
+interface RegExpMatch {
+    index: number
+    value: string
+    captures: string[]
+    groups: StringMap
 }
 
 
@@ -21,30 +52,53 @@ declare namespace regex {
 }
 
 var Regex = []core.NativeFunction{
+	core.NativeFunction{
+		Name:      "regex.compile",
+		Arguments: -1,
+		Function: func(this core.Value, args []core.Value, vm *core.VM) (core.Value, error) {
+			if err := ValidateArgRange(args, 1, 2); err != nil {
+				return core.NullValue, err
+			}
+			if err := ValidateOptionalArgs(args, core.String, core.String); err != nil {
+				return core.NullValue, err
+			}
+
+			var flags string
+			if len(args) == 2 {
+				flags = args[1].ToString()
+			}
+
+			r, err := core.NewRegex(args[0].ToString(), flags)
+			if err != nil {
+				return core.NullValue, err
+			}
+			return core.NewObject(r), nil
+		},
+	},
 	core.NativeFunction{
 		Name:      "regex.match",
 		Arguments: 2,
 		Function: func(this core.Value, args []core.Value, vm *core.VM) (core.Value, error) {
-			if err := ValidateArgs(args, core.String, core.String); err != nil {
+			if err := ValidateArgs(args, nil, core.String); err != nil {
 				return core.NullValue, err
 			}
 
-			ok, err := regexp.MatchString(args[0].ToString(), args[1].ToString())
+			r, err := regexArg(args[0])
 			if err != nil {
 				return core.NullValue, err
 			}
-			return core.NewBool(ok), nil
+			return core.NewBool(r.MatchString(args[1].ToString())), nil
 		},
 	},
 	core.NativeFunction{
 		Name:      "regex.split",
 		Arguments: 2,
 		Function: func(this core.Value, args []core.Value, vm *core.VM) (core.Value, error) {
-			if err := ValidateArgs(args, core.String, core.String); err != nil {
+			if err := ValidateArgs(args, nil, core.String); err != nil {
 				return core.NullValue, err
 			}
 
-			r, err := regexp.Compile(args[0].ToString())
+			r, err := regexArg(args[0])
 			if err != nil {
 				return core.NullValue, err
 			}
@@ -67,11 +121,11 @@ var Regex = []core.NativeFunction{
 			if err := ValidateArgRange(args, 2, 3); err != nil {
 				return core.NullValue, err
 			}
-			if err := ValidateOptionalArgs(args, core.String, core.String, core.Int); err != nil {
+			if err := ValidateOptionalArgs(args[1:], core.String, core.Int); err != nil {
 				return core.NullValue, err
 			}
 
-			r, err := regexp.Compile(args[0].ToString())
+			r, err := regexArg(args[0])
 			if err != nil {
 				return core.NullValue, err
 			}
@@ -101,11 +155,11 @@ var Regex = []core.NativeFunction{
 			if err := ValidateArgRange(args, 2, 3); err != nil {
 				return core.NullValue, err
 			}
-			if err := ValidateOptionalArgs(args, core.String, core.String, core.Int); err != nil {
+			if err := ValidateOptionalArgs(args[1:], core.String, core.Int); err != nil {
 				return core.NullValue, err
 			}
 
-			r, err := regexp.Compile(args[0].ToString())
+			r, err := regexArg(args[0])
 			if err != nil {
 				return core.NullValue, err
 			}
@@ -134,11 +188,11 @@ var Regex = []core.NativeFunction{
 		Name:      "regex.replaceAllString",
 		Arguments: 3,
 		Function: func(this core.Value, args []core.Value, vm *core.VM) (core.Value, error) {
-			if err := ValidateArgs(args, core.String, core.String, core.String); err != nil {
+			if err := ValidateArgs(args, nil, core.String, core.String); err != nil {
 				return core.NullValue, err
 			}
 
-			r, err := regexp.Compile(args[0].ToString())
+			r, err := regexArg(args[0])
 			if err != nil {
 				return core.NullValue, err
 			}
@@ -149,3 +203,16 @@ var Regex = []core.NativeFunction{
 		},
 	},
 }
+
+// regexArg returns the expression of a RegExp or compiles a string pattern.
+func regexArg(v core.Value) (*regexp.Regexp, error) {
+	switch v.Type {
+	case core.String:
+		return regexp.Compile(v.ToString())
+	case core.Object:
+		if r, ok := v.ToObject().(*core.Regex); ok {
+			return r.Regexp(), nil
+		}
+	}
+	return nil, fmt.Errorf("expected a pattern, got %s", v.TypeName())
+}
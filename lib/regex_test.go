@@ -0,0 +1,51 @@
+package lib
+
+import (
+	"testing"
+)
+
+func TestRegexObject(t *testing.T) {
+	v := runTest(t, `
+		function main() {
+			let r = /(?P<word>[a-z]+)(\d+)/i
+			let a = regex.match(r, "AB12") + " " + regex.split(/\d/, "a1b2c").join(",")
+			let b = regex.findAllStringSubmatch(r, "a1 b2").join(",")
+			let s = "x1 y2"
+			let c = s.replaceRegex(/\d/, "#") + " " + regex.replaceAllString(r, "a1 b2", "$2${word}")
+			return a + " " + b + " " + c
+		}
+	`)
+
+	if v.ToString() != "true a,b,c a,1,b,2 x# y# 1a 2b" {
+		t.Fatal(v)
+	}
+}
+
+func TestRegexCompile(t *testing.T) {
+	v := runTest(t, `
+		function main() {
+			let r = regex.compile("o", "g")
+			return r.replace("foo", m => m.index) + " " + r.toString()
+		}
+	`)
+
+	if v.ToString() != "f12 /o/g" {
+		t.Fatal(v)
+	}
+}
+
+func TestRegexReplaceEmpty(t *testing.T) {
+	v := runTest(t, `
+		function main() {
+			let a = /^\s+/.replace("   x", "")
+			let b = /a/g.replace("aaa", "")
+			let c = /a/g.replace("aab", m => "")
+			let d = /z/.replace("abc", "")
+			return a + "|" + b + "|" + c + "|" + d
+		}
+	`)
+
+	if v.ToString() != "x||b|abc" {
+		t.Fatal(v)
+	}
+}
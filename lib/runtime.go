@@ -2,6 +2,7 @@ package lib
 
 import (
 	"bytes"
+	"crypto"
 	"errors"
 	"fmt"
 	"io"
@@ -94,6 +95,27 @@ declare namespace runtime {
     export function resource(name: string): byte[]
 
     export function getStackTrace(): string
+
+    /**
+     * Returns the permissions and scoped capabilities declared by the program
+     * like "trusted" or "net:dial:api.internal:443".
+     */
+    export function permissions(): string[]
+
+    /**
+     * Replaces a native function or property with fn in this VM and the
+     * ones cloned from it, like the async functions. A null fn restores it.
+     *
+     *     runtime.mock("time.now", () => time.date(2020, 1, 1))
+     */
+    export function mock(name: string, fn: Function | null): void
+
+    /**
+     * Stops the program returning the value to the host, that can save
+     * the state and resume it later, even in another process. When it is
+     * resumed suspend returns the input passed to resume.
+     */
+    export function suspend(value?: any): any
     export function newVM(p: Program, globals?: any[]): VirtualMachine
 
     export interface Program {
@@ -114,9 +136,23 @@ declare namespace runtime {
          */
         strip(): void
         toString(): string
-        write(w: io.Writer): void
+
+        /**
+         * Write the compiled program. If a key is provided the program is signed.
+         */
+        write(w: io.Writer, signKey?: rsa.PrivateKey, encryptionKey?: string | byte[]): void
 	}
 	
+    /**
+     * A denied capability check.
+     */
+    export interface AuditEntry {
+        time: time.Time
+        capability: string
+        resource: string
+        stackTrace: string
+    }
+
     export interface FunctionInfo {
         name: string
         index: number
@@ -131,6 +167,8 @@ declare namespace runtime {
 		maxFrames: number
 		maxSteps: number
 		readonly steps: number
+		readonly allocations: number
+		readonly auditLog: AuditEntry[]
 		readonly fileSystem: io.FileSystem
 		readonly program: Program
 		context: Context
@@ -150,6 +188,15 @@ declare namespace runtime {
 		setItem(name: string, v: any): void
 		clone(): VirtualMachine
 		resetSteps(): void
+		/**
+		 * The state of the program if the last run was suspended.
+		 */
+		readonly state: byte[] | null
+		/**
+		 * Continues a suspended program. It returns the value returned by the
+		 * program or the value passed to runtime.suspend if it is suspended again.
+		 */
+		resume(state: byte[], input?: any): any
     }
 
     export interface Context {
@@ -194,6 +241,22 @@ declare namespace runtime {
         execIfExists(c: Context, func: string, ...args: any[]): any
         copy(): PluginManager
 
+        /**
+         * Only plugins signed by a trusted key will be loaded
+         * once a key is added.
+         */
+        addTrustedKey(key: rsa.PublicKey | string | byte[]): void
+
+        /**
+         * The AES key to load encrypted plugins.
+         */
+        setDecryptionKey(key: string | byte[]): void
+
+        /**
+         * Cache the plugins compiled in debug mode in the directory.
+         */
+        setCompileCache(fs: io.FileSystem, dir: string): void
+
         addHook(name: string, func: Function): void
         execHook(name: string, ...params: any[]): void
         anyHook(name: string): boolean
@@ -627,6 +690,74 @@ var Runtime = []core.NativeFunction{
 			return wrap(true, args, vm)
 		},
 	},
+	core.NativeFunction{
+		Name:      "errors.newError",
+		Arguments: -1,
+		Function: func(this core.Value, args []core.Value, vm *core.VM) (core.Value, error) {
+			ln := len(args)
+			if ln < 1 || ln > 3 {
+				return core.NullValue, fmt.Errorf("expected 1 to 3 parameters, got %d", ln)
+			}
+			if args[0].Type != core.String {
+				return core.NullValue, fmt.Errorf("expected parameter 1 to be a string, got %s", args[0].TypeName())
+			}
+
+			code := args[0].ToString()
+			msg := code
+			if ln > 1 {
+				switch args[1].Type {
+				case core.Null, core.Undefined:
+				case core.String:
+					msg = args[1].ToString()
+				default:
+					return core.NullValue, fmt.Errorf("expected parameter 2 to be a string, got %s", args[1].TypeName())
+				}
+			}
+
+			e := vm.NewError("%s", msg)
+			e.SetCode(code)
+			if ln > 2 {
+				e.SetData(args[2])
+			}
+			return core.NewObject(e), nil
+		},
+	},
+	core.NativeFunction{
+		Name:      "errors.is",
+		Arguments: 2,
+		Function: func(this core.Value, args []core.Value, vm *core.VM) (core.Value, error) {
+			if err := ValidateArgs(args, core.Object, core.String); err != nil {
+				return core.NullValue, err
+			}
+			e, ok := args[0].ToObject().(core.Error)
+			if !ok {
+				return core.NullValue, fmt.Errorf("expected parameter 1 to be a Exception, got %s", args[0].TypeName())
+			}
+			return core.NewBool(core.HasErrorCode(e, args[1].ToString())), nil
+		},
+	},
+	core.NativeFunction{
+		Name:      "errors.as",
+		Arguments: 2,
+		Function: func(this core.Value, args []core.Value, vm *core.VM) (core.Value, error) {
+			if err := ValidateArgs(args, core.Object, nil); err != nil {
+				return core.NullValue, err
+			}
+			e, ok := args[0].ToObject().(core.Error)
+			if !ok {
+				return core.NullValue, fmt.Errorf("expected parameter 1 to be a Exception, got %s", args[0].TypeName())
+			}
+			switch args[1].Type {
+			case core.Object, core.String:
+			default:
+				return core.NullValue, fmt.Errorf("expected parameter 2 to be a class, got %s", args[1].TypeName())
+			}
+			if v, ok := core.FindThrown(e, args[1]); ok {
+				return v, nil
+			}
+			return core.NullValue, nil
+		},
+	},
 	core.NativeFunction{
 		Name: "->runtime.OS",
 		Function: func(this core.Value, args []core.Value, vm *core.VM) (core.Value, error) {
@@ -698,7 +829,7 @@ var Runtime = []core.NativeFunction{
 				return core.NullValue, err
 			}
 
-			return core.NewObject(&libVM{m}), nil
+			return core.NewObject(&libVM{vm: m}), nil
 		},
 	},
 	core.NativeFunction{
@@ -707,7 +838,7 @@ var Runtime = []core.NativeFunction{
 			if !vm.HasPermission("trusted") {
 				return core.NullValue, ErrUnauthorized
 			}
-			return core.NewObject(&libVM{vm}), nil
+			return core.NewObject(&libVM{vm: vm}), nil
 		},
 	},
 	core.NativeFunction{
@@ -728,6 +859,72 @@ var Runtime = []core.NativeFunction{
 			return core.NewString(s), nil
 		},
 	},
+	core.NativeFunction{
+		Name:      "runtime.permissions",
+		Arguments: 0,
+		Function: func(this core.Value, args []core.Value, vm *core.VM) (core.Value, error) {
+			names := vm.Program.PermissionNames()
+			a := make([]core.Value, len(names))
+			for i, v := range names {
+				a[i] = core.NewString(v)
+			}
+			return core.NewArrayValues(a), nil
+		},
+	},
+	core.NativeFunction{
+		Name:      "runtime.mock",
+		Arguments: 2,
+		Function: func(this core.Value, args []core.Value, vm *core.VM) (core.Value, error) {
+			if !vm.HasPermission("trusted") {
+				return core.NullValue, ErrUnauthorized
+			}
+
+			if err := ValidateArgs(args, core.String, nil); err != nil {
+				return core.NullValue, err
+			}
+
+			name := args[0].ToString()
+			fn := args[1]
+
+			switch fn.Type {
+			case core.Null, core.Undefined:
+				vm.ResetNative(name)
+				return core.NullValue, nil
+			case core.Func, core.NativeFunc:
+			case core.Object:
+				if _, ok := fn.ToObject().(core.Closure); !ok {
+					return core.NullValue, fmt.Errorf("expected a function, got %s", fn.TypeName())
+				}
+			default:
+				return core.NullValue, fmt.Errorf("expected a function, got %s", fn.TypeName())
+			}
+
+			err := vm.SetNative(core.NativeFunction{
+				Name:      name,
+				Arguments: -1,
+				Function: func(this core.Value, args []core.Value, vm *core.VM) (core.Value, error) {
+					return callMock(fn, this, args, vm)
+				},
+			})
+			return core.NullValue, err
+		},
+	},
+	core.NativeFunction{
+		Name:      "runtime.suspend",
+		Arguments: -1,
+		Function: func(this core.Value, args []core.Value, vm *core.VM) (core.Value, error) {
+			if err := ValidateArgRange(args, 0, 1); err != nil {
+				return core.NullValue, err
+			}
+
+			v := core.NullValue
+			if len(args) == 1 {
+				v = args[0]
+			}
+
+			return core.NullValue, vm.Suspend(v)
+		},
+	},
 	core.NativeFunction{
 		Name:      "runtime.newPluginManager",
 		Arguments: -1,
@@ -926,10 +1123,35 @@ type PluginManager struct {
 	debug      bool
 	pluginsDir string
 
+	// if set, only programs signed by a trusted key are loaded
+	trust *binary.TrustPolicy
+
+	// returns the key to load encrypted programs
+	keys binary.KeyProvider
+
+	// if set, plugins compiled in debug mode are cached
+	cache *binary.Cache
+
 	// allow to suscribe to events between plugins
 	hooks map[string][]HookFunction
 }
 
+// SetTrustPolicy makes the manager refuse plugins that are not
+// signed by one of the keys of the policy.
+func (m *PluginManager) SetTrustPolicy(t *binary.TrustPolicy) {
+	m.trust = t
+}
+
+// SetKeyProvider sets the function that returns the key to load encrypted plugins.
+func (m *PluginManager) SetKeyProvider(f binary.KeyProvider) {
+	m.keys = f
+}
+
+// SetCompileCache sets the cache used to compile plugins in debug mode.
+func (m *PluginManager) SetCompileCache(c *binary.Cache) {
+	m.cache = c
+}
+
 type HookFunction struct {
 	Plugin   string
 	Function int
@@ -1020,10 +1242,82 @@ func (m *PluginManager) GetMethod(name string) core.NativeMethod {
 		return m.unlock
 	case "runFunc":
 		return m.runFunc
+	case "addTrustedKey":
+		return m.addTrustedKey
+	case "setDecryptionKey":
+		return m.setDecryptionKey
+	case "setCompileCache":
+		return m.setCompileCache
 	}
 	return nil
 }
 
+func (m *PluginManager) addTrustedKey(args []core.Value, vm *core.VM) (core.Value, error) {
+	if !vm.HasPermission("trusted") {
+		return core.NullValue, ErrUnauthorized
+	}
+
+	if err := ValidateArgRange(args, 1); err != nil {
+		return core.NullValue, err
+	}
+
+	// don't modify the policy in place because copies of the manager share it
+	var keys []crypto.PublicKey
+	if m.trust != nil {
+		keys = m.trust.Keys()
+	}
+
+	t, err := binary.NewTrustPolicy(keys...)
+	if err != nil {
+		return core.NullValue, err
+	}
+
+	if err := addTrustedKey(t, args[0]); err != nil {
+		return core.NullValue, err
+	}
+
+	m.trust = t
+	return core.NullValue, nil
+}
+
+func (m *PluginManager) setDecryptionKey(args []core.Value, vm *core.VM) (core.Value, error) {
+	if !vm.HasPermission("trusted") {
+		return core.NullValue, ErrUnauthorized
+	}
+
+	if err := ValidateArgRange(args, 1); err != nil {
+		return core.NullValue, err
+	}
+
+	key, err := encryptionKey(args[0])
+	if err != nil {
+		return core.NullValue, err
+	}
+
+	m.keys = func(map[string]string) ([]byte, error) {
+		return key, nil
+	}
+	return core.NullValue, nil
+}
+
+func (m *PluginManager) setCompileCache(args []core.Value, vm *core.VM) (core.Value, error) {
+	if !vm.HasPermission("trusted") {
+		return core.NullValue, ErrUnauthorized
+	}
+
+	if err := ValidateArgs(args, core.Object, core.String); err != nil {
+		return core.NullValue, err
+	}
+
+	fs, ok := args[0].ToObject().(*FileSystemObj)
+	if !ok {
+		return core.NullValue, fmt.Errorf("expected a filesystem, got %v", args[0])
+	}
+
+	m.cache = binary.NewCache(fs.FS, args[1].ToString())
+	return core.NullValue, nil
+}
+
 func (m *PluginManager) lock(args []core.Value, vm *core.VM) (core.Value, error) {
 	if !vm.HasPermission("trusted") {
 		// Important or it could run arbitrary code by creating a system.xxxx
@@ -1092,6 +1386,9 @@ func (m *PluginManager) copy(args []core.Value, vm *core.VM) (core.Value, error)
 		fs:         m.fs,
 		debug:      m.debug,
 		pluginsDir: m.pluginsDir,
+		trust:      m.trust,
+		keys:       m.keys,
+		cache:      m.cache,
 		plugins:    make(map[string]*plugin),
 		hooks:      make(map[string][]HookFunction),
 	}
@@ -1417,6 +1714,7 @@ func doExecFunction(c *Context, f *core.Function, p *plugin, args []core.Value,
 	}
 
 	cvm.Context = c
+	cvm.SetCaller("plugin "+p.name, vm)
 
 	v, err := cvm.RunFuncIndex(f.Index, args...)
 	if err != nil {
@@ -1431,6 +1729,9 @@ func (m *PluginManager) Clone(vm *core.VM) (*PluginManager, error) {
 		fs:         m.fs,
 		debug:      m.debug,
 		pluginsDir: m.pluginsDir,
+		trust:      m.trust,
+		keys:       m.keys,
+		cache:      m.cache,
 		plugins:    make(map[string]*plugin),
 		hooks:      make(map[string][]HookFunction),
 	}
@@ -1584,6 +1885,23 @@ func (m *PluginManager) loadObjectPlugin(a core.Value, vm *core.VM) (core.Value,
 		return core.NullValue, fmt.Errorf("expected a plugin, got %s", a.TypeName())
 	}
 
+	if plg.program == nil {
+		return core.NullValue, fmt.Errorf("the plugin %s has no program", plg.name)
+	}
+
+	// the program is not read from a file so its signature can't be checked
+	if m.trust != nil {
+		return core.NullValue, fmt.Errorf("unauthorized: only signed plugins can be loaded: %s", plg.name)
+	}
+
+	if !vm.HasPermission("trusted") {
+		// only allow to load installed plugins
+		c := GetContext(vm)
+		if !hasPluginActive(c, plg.name) {
+			return core.NullValue, fmt.Errorf("unauthorized: the plugin is not installed: %s", plg.name)
+		}
+	}
+
 	path := fmt.Sprintf("%s.gt", plg.name)
 
 	m.Lock()
@@ -1609,8 +1927,17 @@ func (m *PluginManager) doLoadPlugin(path string, vm *core.VM) (*plugin, error)
 	var err error
 
 	if m.debug {
+		// the sources can't be verified against the trusted keys
+		if m.trust != nil {
+			return nil, fmt.Errorf("can't load %s from sources in debug mode with a trust policy", path)
+		}
+
 		src := filepath.Join("plugins", strings.TrimSuffix(path, ".gt"), "server", "main.ts")
-		p, err = core.Compile(m.fs, src)
+		if m.cache != nil {
+			p, err = m.cache.Compile(m.fs, src)
+		} else {
+			p, err = core.Compile(m.fs, src)
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -1620,11 +1947,11 @@ func (m *PluginManager) doLoadPlugin(path string, vm *core.VM) (*plugin, error)
 		if err != nil {
 			return nil, err
 		}
-		p, err = binary.Read(f)
+		p, err = binary.Read(f, binary.WithTrustPolicy(m.trust), binary.WithKeyProvider(m.keys))
+		f.Close()
 		if err != nil {
 			return nil, err
 		}
-		f.Close()
 	}
 
 	if err != nil {
@@ -1965,7 +2292,7 @@ func (p *program) write(args []core.Value, vm *core.VM) (core.Value, error) {
 		return core.NullValue, ErrUnauthorized
 	}
 
-	if err := ValidateArgs(args, core.Object); err != nil {
+	if err := ValidateArgRange(args, 1, 2, 3); err != nil {
 		return core.NullValue, err
 	}
 
@@ -1974,7 +2301,7 @@ func (p *program) write(args []core.Value, vm *core.VM) (core.Value, error) {
 		return core.NullValue, fmt.Errorf("exepected a Writer, got %s", args[0].TypeName())
 	}
 
-	if err := binary.Write(w, p.prog); err != nil {
+	if err := writeProgram(w, p.prog, args[1:]); err != nil {
 		return core.NullValue, err
 	}
 
@@ -2137,7 +2464,8 @@ func (f functionInfo) GetProperty(name string, vm *core.VM) (core.Value, error)
 }
 
 type libVM struct {
-	vm *core.VM
+	vm    *core.VM
+	state []byte // set if the last run was suspended
 }
 
 func (m *libVM) Type() string {
@@ -2169,8 +2497,27 @@ func (m *libVM) GetProperty(name string, vm *core.VM) (core.Value, error) {
 		return core.NewInt64(m.vm.MaxSteps), nil
 	case "steps":
 		return core.NewInt64(m.vm.Steps()), nil
+	case "allocations":
+		return core.NewInt64(m.vm.Allocations()), nil
+	case "auditLog":
+		log := m.vm.AuditLog()
+		a := make([]core.Value, len(log))
+		for i, e := range log {
+			a[i] = core.NewMapValues(map[string]core.Value{
+				"time":       core.NewObject(TimeObj(e.Time)),
+				"capability": core.NewString(e.Capability),
+				"resource":   core.NewString(e.Resource),
+				"stackTrace": core.NewString(strings.Join(e.Stacktrace, "\n")),
+			})
+		}
+		return core.NewArrayValues(a), nil
 	case "trusted":
 		return core.NewBool(m.vm.Trusted), nil
+	case "state":
+		if m.state == nil {
+			return core.NullValue, nil
+		}
+		return core.NewBytes(m.state), nil
 	}
 	return core.UndefinedValue, nil
 }
@@ -2265,6 +2612,8 @@ func (m *libVM) GetMethod(name string) core.NativeMethod {
 		return m.setItem
 	case "resetSteps":
 		return m.resetSteps
+	case "resume":
+		return m.resume
 	}
 	return nil
 }
@@ -2279,7 +2628,7 @@ func (m *libVM) clone(args []core.Value, vm *core.VM) (core.Value, error) {
 	}
 
 	c := m.vm.Clone(m.vm.Program, m.vm.Globals())
-	return core.NewObject(&libVM{c}), nil
+	return core.NewObject(&libVM{vm: c}), nil
 }
 
 func (m *libVM) getItem(args []core.Value, vm *core.VM) (core.Value, error) {
@@ -2355,7 +2704,40 @@ func (m *libVM) initialize(args []core.Value, vm *core.VM) (core.Value, error) {
 }
 
 func (m *libVM) run(args []core.Value, vm *core.VM) (core.Value, error) {
+	m.state = nil
 	v, err := m.vm.Run(args...)
+	if s, ok := err.(*core.Suspended); ok {
+		m.state = s.State
+		return s.Value, nil
+	}
+	if err != nil {
+		// return the error with the stacktrace included in the message
+		// because the caller in the program will have it's own stacktrace.
+		return core.NullValue, errors.New(err.Error())
+	}
+	return v, nil
+}
+
+func (m *libVM) resume(args []core.Value, vm *core.VM) (core.Value, error) {
+	if err := ValidateArgRange(args, 1, 2); err != nil {
+		return core.NullValue, err
+	}
+
+	if args[0].Type != core.Bytes {
+		return core.NullValue, fmt.Errorf("expected argument 1 to be bytes, got %s", args[0].TypeName())
+	}
+
+	input := core.NullValue
+	if len(args) == 2 {
+		input = args[1]
+	}
+
+	m.state = nil
+	v, err := m.vm.Resume(args[0].ToBytes(), input)
+	if s, ok := err.(*core.Suspended); ok {
+		m.state = s.State
+		return s.Value, nil
+	}
 	if err != nil {
 		// return the error with the stacktrace included in the message
 		// because the caller in the program will have it's own stacktrace.
@@ -2472,6 +2854,7 @@ type Context struct {
 	DataFS         *FileSystemObj
 	ErrorLogger    *file
 	protectedItems map[string]core.Value
+	isolate        *isolate // set if the VM runs in an isolate
 }
 
 func (c *Context) Type() string {
@@ -2500,6 +2883,7 @@ func (c *Context) Clone() *Context {
 		protectedItems: c.protectedItems,
 		DataFS:         c.DataFS,
 		ErrorLogger:    c.ErrorLogger,
+		isolate:        c.isolate,
 	}
 }
 
@@ -2939,3 +3323,15 @@ func (c *Context) execIfExists(args []core.Value, vm *core.VM) (core.Value, erro
 
 	return pm.execPlugin(c, args[0].ToString(), args[1:], true, vm)
 }
+
+// callMock calls the function that replaces a native in the same VM.
+func callMock(fn, this core.Value, args []core.Value, vm *core.VM) (core.Value, error) {
+	switch fn.Type {
+	case core.Func:
+		return vm.RunFuncIndex(fn.ToFunction(), args...)
+	case core.NativeFunc:
+		return core.NativeFuncFromIndex(fn.ToNativeFunction()).Function(this, args, vm)
+	default:
+		return vm.RunClosure(fn.ToObject().(core.Closure), args...)
+	}
+}
@@ -1,7 +1,9 @@
 package lib
 
 import (
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gtlang/gt/core"
 )
@@ -125,6 +127,26 @@ func TestPluginManager(t *testing.T) {
 	`)
 }
 
+func TestPluginManagerTrustPolicy(t *testing.T) {
+	runTest(t, `
+		let program = bytecode.compileStr("export function sum(a, b){ return a + b }")
+		let plugin = runtime.newPlugin("foo", program)
+
+		let pm = runtime.newPluginManager()
+		pm.addTrustedKey(rsa.generateKey(1024).publicKey)
+
+		try {
+			pm.loadPlugin(plugin)
+		} catch (e) {
+			if (!e.message.contains("only signed plugins")) {
+				throw e
+			}
+			return
+		}
+		throw "the unsigned plugin was loaded"
+	`)
+}
+
 func TestPluginManagerClone(t *testing.T) {
 	runTest(t, `		
 		let code = "export let a = 3;" +
@@ -556,3 +578,215 @@ func assertFinalized(t *testing.T, code string) *core.VM {
 
 	return vm
 }
+
+func TestProgramEncrypted(t *testing.T) {
+	runTest(t, `		
+		let key = "0123456789abcdef"
+		let program = bytecode.compileStr("function main() { return 5 }")
+
+		let b = io.newBuffer()
+		program.write(b, null, key)
+
+		let p = bytecode.readProgram(b, null, key)
+		let v = runtime.newVM(p).run()
+		if(v != 5) {
+			throw v
+		}
+	`)
+}
+
+func TestMock(t *testing.T) {
+	v := runTest(t, `
+		function main() {
+			runtime.mock("strings.isDigit", (s: string) => "mocked " + s)
+			runtime.mock("runtime.version", () => "v0")
+			let a = strings.isDigit("a") + " " + runtime.version
+
+			runtime.mock("strings.isDigit", null)
+			return a + " " + strings.isDigit("b")
+		}
+	`)
+
+	if v.ToString() != "mocked a v0 false" {
+		t.Fatalf("unexpected value %s", v.ToString())
+	}
+}
+
+func TestMockUnknown(t *testing.T) {
+	_, err := runExpr(t, `
+		function main() {
+			runtime.mock("foo.bar", () => 1)
+		}
+	`)
+
+	if err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Fatalf("expected a not found error, got %v", err)
+	}
+}
+
+func TestSpawn(t *testing.T) {
+	v := runTest(t, `
+		let items = [1, 2]
+
+		function main() {
+			let total = 0
+			let iso = runtime.spawn(work, 10)
+			items[0] = 100
+			iso.onMessage(m => { total += m })
+			let r = iso.wait()
+			return items[0] + ":" + total + ":" + r
+		}
+
+		function work(n) {
+			items[0] = n
+			runtime.send(items[0] + items[1])
+			return items[0]
+		}
+	`)
+
+	if v.ToString() != "100:12:10" {
+		t.Fatalf("unexpected value %s", v.ToString())
+	}
+}
+
+func TestSpawnMailbox(t *testing.T) {
+	v := runTest(t, `
+		function main() {
+			let iso = runtime.spawn(() => runtime.onMessage(m => runtime.send(m * 2)))
+			iso.send(1)
+			iso.send(2)
+			let a = iso.receive() + iso.receive()
+			iso.close()
+			iso.wait()
+			return a + ":" + iso.done + ":" + iso.receive()
+		}
+	`)
+
+	if v.ToString() != "6:true:undefined" {
+		t.Fatalf("unexpected value %s", v.ToString())
+	}
+}
+
+func TestSpawnCrash(t *testing.T) {
+	_, err := runExpr(t, `
+		function main() {
+			let iso = runtime.spawn(() => { throw "boom" })
+			iso.wait()
+		}
+	`)
+
+	if err == nil || !strings.Contains(err.Error(), "isolate failed: boom") {
+		t.Fatalf("expected the error of the isolate, got %v", err)
+	}
+}
+
+func TestSpawnCopy(t *testing.T) {
+	_, err := runExpr(t, `
+		function main() {
+			let iso = runtime.spawn(() => runtime.send(() => 1))
+			iso.wait()
+		}
+	`)
+
+	if err == nil || !strings.Contains(err.Error(), "can't be copied") {
+		t.Fatalf("expected a copy error, got %v", err)
+	}
+}
+
+func TestSpawnWaitWithoutHandler(t *testing.T) {
+	p, err := core.CompileStr(`
+		function main() {
+			let iso = runtime.spawn(() => {
+				for (let i = 0; i < 500; i++) {
+					runtime.send(i)
+				}
+				return "done"
+			})
+			return iso.wait()
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm := core.NewVM(p)
+	vm.Trusted = true
+	vm.Deadline = time.Now().Add(5 * time.Second)
+
+	v, err := vm.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.ToString() != "done" {
+		t.Fatalf("unexpected value %s", v.ToString())
+	}
+}
+
+func TestSpawnCopyObjects(t *testing.T) {
+	v := runTest(t, `
+		class Counter {
+			n: number
+			constructor() { this.n = 0 }
+			inc() { this.n++ }
+		}
+
+		let counter = new Counter()
+		let set = collections.newSet([1])
+
+		function main() {
+			let iso = runtime.spawn(() => {
+				counter.inc()
+				set.add(2)
+				runtime.send([counter, set])
+			})
+			let m = iso.receive()
+			iso.wait()
+			m[0].n = 10
+			return counter.n + ":" + set.size + ":" + m[1].size + ":" + m[1].has(2)
+		}
+	`)
+
+	if v.ToString() != "0:1:2:true" {
+		t.Fatalf("unexpected value %s", v.ToString())
+	}
+
+	_, err := runExpr(t, `
+		class Counter {
+			n: number
+			inc() { this.n++ }
+		}
+
+		function main() {
+			let c = new Counter()
+			let iso = runtime.spawn(() => runtime.send(c.inc))
+			iso.wait()
+		}
+	`)
+
+	if err == nil || !strings.Contains(err.Error(), "can't be copied") {
+		t.Fatalf("expected a copy error, got %v", err)
+	}
+}
+
+func TestSpawnErrorCopied(t *testing.T) {
+	v := runTest(t, `
+		class MyErr {
+			code: string
+			constructor() { this.code = "mine" }
+		}
+
+		function main() {
+			let iso = runtime.spawn(() => { throw new MyErr() })
+			try {
+				iso.wait()
+			} catch (e) {
+			}
+			let e = errors.as(iso.error, MyErr)
+			return e.code + ":" + iso.error.code
+		}
+	`)
+
+	if v.ToString() != "mine:mine" {
+		t.Fatalf("unexpected value %s", v.ToString())
+	}
+}
@@ -69,6 +69,11 @@ declare namespace sql {
         writeAnyNamespace: boolean
 		openAnyDatabase: boolean
         readOnly: boolean
+        /**
+         * decimals reads DECIMAL and NUMERIC columns as exact decimals
+         * instead of numbers. It is false by default.
+         */
+        decimals: boolean
         driver: DriverType
         nestedTransactions: number
 		hasTransaction: boolean
@@ -306,8 +311,10 @@ var SQL = []core.NativeFunction{
 				return core.NullValue, err
 			}
 
-			if !vm.HasPermission("openAnyDatabase") {
-				return core.NullValue, ErrUnauthorized
+			name := args[0].ToString()
+
+			if err := checkCapability(vm, "openAnyDatabase", "sql:db", name); err != nil {
+				return core.NullValue, err
 			}
 
 			db := GetContext(vm).DB
@@ -315,8 +322,6 @@ var SQL = []core.NativeFunction{
 				return core.NullValue, fmt.Errorf("no DB connection")
 			}
 
-			name := args[0].ToString()
-
 			db.db.Open(name)
 
 			return core.NullValue, nil
@@ -1002,11 +1007,30 @@ func (r dbReader) close(args []core.Value, vm *core.VM) (core.Value, error) {
 	return core.NullValue, err
 }
 
+// Iterator iterates the rows as objects so a reader can be used in a for...of loop.
+func (r dbReader) Iterator() (core.Iterator, error) {
+	return r, nil
+}
+
+func (r dbReader) Next() (core.Value, bool, error) {
+	if !r.r.Next() {
+		return core.NullValue, false, r.r.Err()
+	}
+	v, err := r.readRow()
+	if err != nil {
+		return core.NullValue, false, err
+	}
+	return v, true, nil
+}
+
 func (r dbReader) read(args []core.Value, vm *core.VM) (core.Value, error) {
 	if len(args) != 0 {
 		return core.NullValue, fmt.Errorf("expected 0 arguments, got %d", len(args))
 	}
+	return r.readRow()
+}
 
+func (r dbReader) readRow() (core.Value, error) {
 	cols, err := r.r.Columns()
 	if err != nil {
 		return core.NullValue, err
@@ -1017,12 +1041,7 @@ func (r dbReader) read(args []core.Value, vm *core.VM) (core.Value, error) {
 		return core.NullValue, err
 	}
 
-	obj := make(map[string]core.Value, len(cols))
-	for i, col := range cols {
-		obj[col.Name] = convertDBValue(values[i])
-	}
-
-	return core.NewMapValues(obj), nil
+	return newRowMap(cols, values), nil
 }
 
 func (r dbReader) readValues(args []core.Value, vm *core.VM) (core.Value, error) {
@@ -1043,6 +1062,16 @@ func (r dbReader) readValues(args []core.Value, vm *core.VM) (core.Value, error)
 	return core.NewArrayValues(vs), nil
 }
 
+// newRowMap returns the values of a row as a map with the keys in the order of the columns.
+func newRowMap(cols []*dbx.Column, values []interface{}) core.Value {
+	m := core.NewMap(len(cols))
+	mv := m.ToMap()
+	for i, col := range cols {
+		mv.Set(col.Name, convertDBValue(values[i]))
+	}
+	return m
+}
+
 type column struct {
 	col *dbx.Column
 }
@@ -1242,6 +1271,12 @@ func convertDBValue(v interface{}) core.Value {
 	switch t := v.(type) {
 	case time.Time:
 		return core.NewObject(TimeObj(t))
+	case dbx.Number:
+		d, err := core.ParseDecimal(string(t))
+		if err != nil {
+			return core.NewString(string(t))
+		}
+		return core.NewObject(d)
 	default:
 		return core.NewValue(v)
 	}
@@ -1337,6 +1372,8 @@ func (s *libDB) GetProperty(name string, vm *core.VM) (core.Value, error) {
 		return core.NewBool(s.db.OpenAnyDatabase), nil
 	case "readOnly":
 		return core.NewBool(s.db.ReadOnly), nil
+	case "decimals":
+		return core.NewBool(s.db.Decimals), nil
 	case "driver":
 		return core.NewString(s.db.Driver), nil
 	case "onQuery":
@@ -1419,6 +1456,13 @@ func (s *libDB) SetProperty(name string, v core.Value, vm *core.VM) error {
 		s.db.ReadOnly = readOnly
 		return nil
 
+	case "decimals":
+		if v.Type != core.Bool {
+			return fmt.Errorf("expected bool, got %s", v.TypeName())
+		}
+		s.db.Decimals = v.ToBool()
+		return nil
+
 	default:
 		return ErrReadOnlyOrUndefined
 	}
@@ -1533,16 +1577,18 @@ func (s *libDB) setConnMaxLifetime(args []core.Value, vm *core.VM) (core.Value,
 }
 
 func (s *libDB) open(args []core.Value, vm *core.VM) (core.Value, error) {
-	if !vm.HasPermission("trusted") && !s.db.OpenAnyDatabase {
-		return core.NullValue, ErrUnauthorized
-	}
-
 	if err := ValidateArgs(args, core.String); err != nil {
 		return core.NullValue, err
 	}
 
 	name := args[0].ToString()
 
+	if !s.db.OpenAnyDatabase {
+		if err := checkCapability(vm, "trusted", "sql:db", name); err != nil {
+			return core.NullValue, err
+		}
+	}
+
 	if err := validateTenant(name); err != nil {
 		return core.NullValue, err
 	}
@@ -1668,7 +1714,7 @@ func (s *libDB) execRaw(args []core.Value, vm *core.VM) (core.Value, error) {
 		params = getSqlParams(args[1:])
 	}
 
-	res, err := s.db.ExecRaw(query, params...)
+	res, err := s.db.ExecRawContext(vm.GoContext(), query, params...)
 	if err != nil {
 		if errors.Is(err, dbx.ErrReadOnly) {
 			return core.NullValue, core.NewPublicError(err.Error())
@@ -1772,7 +1818,7 @@ func (s *libDB) exec(args []core.Value, vm *core.VM) (core.Value, error) {
 		return core.NullValue, err
 	}
 
-	res, err := s.db.ExecRaw(sQuery, sParams...)
+	res, err := s.db.ExecRawContext(vm.GoContext(), sQuery, sParams...)
 	if err != nil {
 		if errors.Is(err, dbx.ErrReadOnly) {
 			return core.NullValue, core.NewPublicError(err.Error())
@@ -1821,7 +1867,7 @@ func (s *libDB) queryFirst(args []core.Value, vm *core.VM) (core.Value, error) {
 		if err != nil {
 			return core.NullValue, err
 		}
-		rows, err = s.db.QueryRaw(sQuery, sParams...)
+		rows, err = s.db.QueryRawContext(vm.GoContext(), sQuery, sParams...)
 		if err != nil {
 			return core.NullValue, err
 		}
@@ -1831,7 +1877,7 @@ func (s *libDB) queryFirst(args []core.Value, vm *core.VM) (core.Value, error) {
 
 	defer rows.Close()
 
-	t, _, err := dbx.ToTableLimit(rows, 1)
+	t, _, err := s.db.ToTableLimit(rows, 1)
 	if err != nil {
 		return core.NullValue, err
 	}
@@ -1845,11 +1891,7 @@ func (s *libDB) queryFirst(args []core.Value, vm *core.VM) (core.Value, error) {
 		return core.NullValue, nil
 	case 1:
 		r := t.Rows[0]
-		m := make(map[string]core.Value, len(t.Columns))
-		for k, col := range t.Columns {
-			m[col.Name] = convertDBValue(r.Values[k])
-		}
-		return core.NewMapValues(m), nil
+		return newRowMap(t.Columns, r.Values), nil
 	default:
 		panic(fmt.Sprintf("The table has more than 1 row: %d", len(t.Rows)))
 	}
@@ -1878,7 +1920,7 @@ func (s *libDB) queryFirstRaw(args []core.Value, vm *core.VM) (core.Value, error
 		params = append(params, getSqlParams(args[1:])...)
 	}
 
-	rows, err := s.db.QueryRaw(query, params...)
+	rows, err := s.db.QueryRawContext(vm.GoContext(), query, params...)
 	if err != nil {
 		return core.NullValue, err
 	}
@@ -1888,7 +1930,7 @@ func (s *libDB) queryFirstRaw(args []core.Value, vm *core.VM) (core.Value, error
 
 	defer rows.Close()
 
-	t, err := dbx.ToTable(rows)
+	t, err := s.db.ToTable(rows)
 	if err != nil {
 		return core.NullValue, err
 	}
@@ -1903,12 +1945,7 @@ func (s *libDB) queryFirstRaw(args []core.Value, vm *core.VM) (core.Value, error
 		return core.NullValue, fmt.Errorf("the query returned %d results", len(t.Rows))
 	}
 
-	m := make(map[string]core.Value, len(t.Columns))
-	for k, col := range t.Columns {
-		m[col.Name] = convertDBValue(r.Values[k])
-	}
-
-	return core.NewMapValues(m), nil
+	return newRowMap(t.Columns, r.Values), nil
 }
 
 func (s *libDB) queryValue(args []core.Value, vm *core.VM) (core.Value, error) {
@@ -1945,7 +1982,7 @@ func (s *libDB) queryValue(args []core.Value, vm *core.VM) (core.Value, error) {
 		if err != nil {
 			return core.NullValue, err
 		}
-		v, err = s.db.QueryValueRaw(sQuery, sParams...)
+		v, err = s.db.QueryValueRawContext(vm.GoContext(), sQuery, sParams...)
 		if err != nil {
 			return core.NullValue, err
 		}
@@ -1986,7 +2023,7 @@ func (s *libDB) queryValueRaw(args []core.Value, vm *core.VM) (core.Value, error
 		params = append(params, getSqlParams(args[1:])...)
 	}
 
-	row := s.db.QueryRowRaw(query, params...)
+	row := s.db.QueryRowRawContext(vm.GoContext(), query, params...)
 
 	var v interface{}
 	if err := row.Scan(&v); err != nil {
@@ -2251,14 +2288,9 @@ func (s *libDB) query(args []core.Value, vm *core.VM) (core.Value, error) {
 	}
 
 	result := make([]core.Value, len(tbl.Rows))
-	l := len(tbl.Columns)
 
 	for i, r := range tbl.Rows {
-		m := make(map[string]core.Value, l)
-		for k, col := range tbl.Columns {
-			m[col.Name] = convertDBValue(r.Values[k])
-		}
-		result[i] = core.NewMapValues(m)
+		result[i] = newRowMap(tbl.Columns, r.Values)
 	}
 
 	return core.NewArrayValues(result), nil
@@ -2375,7 +2407,7 @@ func (s *libDB) queryValuesRaw(args []core.Value, vm *core.VM) (core.Value, erro
 		params = append(params, getSqlParams(args[1:])...)
 	}
 
-	rows, err := s.db.QueryRaw(query, params...)
+	rows, err := s.db.QueryRawContext(vm.GoContext(), query, params...)
 	if err != nil {
 		return core.NullValue, err
 	}
@@ -2385,7 +2417,7 @@ func (s *libDB) queryValuesRaw(args []core.Value, vm *core.VM) (core.Value, erro
 
 	defer rows.Close()
 
-	tbl, err := dbx.ToTable(rows)
+	tbl, err := s.db.ToTable(rows)
 	if err != nil {
 		return core.NullValue, err
 	}
@@ -2432,12 +2464,12 @@ func (s *libDB) getTable(args []core.Value, vm *core.VM) (*dbx.Table, error) {
 		if err != nil {
 			return nil, err
 		}
-		rows, err := s.db.QueryRaw(sQuery)
+		rows, err := s.db.QueryRawContext(vm.GoContext(), sQuery)
 		if err != nil {
 			return nil, err
 		}
 		defer rows.Close()
-		tbl, err = dbx.ToTable(rows)
+		tbl, err = s.db.ToTable(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -2448,12 +2480,12 @@ func (s *libDB) getTable(args []core.Value, vm *core.VM) (*dbx.Table, error) {
 		if err != nil {
 			return nil, err
 		}
-		rows, err := s.db.QueryRaw(sQuery, sParams...)
+		rows, err := s.db.QueryRawContext(vm.GoContext(), sQuery, sParams...)
 		if err != nil {
 			return nil, err
 		}
 		defer rows.Close()
-		tbl, err = dbx.ToTable(rows)
+		tbl, err = s.db.ToTable(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -2493,7 +2525,7 @@ func (s *libDB) queryRaw(args []core.Value, vm *core.VM) (core.Value, error) {
 		params = append(params, getSqlParams(args[1:])...)
 	}
 
-	rows, err := s.db.QueryRaw(q, params...)
+	rows, err := s.db.QueryRawContext(vm.GoContext(), q, params...)
 	if err != nil {
 		return core.NullValue, err
 	}
@@ -2503,20 +2535,15 @@ func (s *libDB) queryRaw(args []core.Value, vm *core.VM) (core.Value, error) {
 
 	defer rows.Close()
 
-	t, err := dbx.ToTable(rows)
+	t, err := s.db.ToTable(rows)
 	if err != nil {
 		return core.NullValue, err
 	}
 
 	result := make([]core.Value, len(t.Rows))
-	l = len(t.Columns)
 
 	for i, r := range t.Rows {
-		m := make(map[string]core.Value, l)
-		for k, col := range t.Columns {
-			m[col.Name] = convertDBValue(r.Values[k])
-		}
-		result[i] = core.NewMapValues(m)
+		result[i] = newRowMap(t.Columns, r.Values)
 	}
 
 	if err := s.onExecutedRaw(q, args[1:], time.Since(start), vm); err != nil {
@@ -2559,7 +2586,7 @@ func (s *libDB) reader(args []core.Value, vm *core.VM) (core.Value, error) {
 		if err != nil {
 			return core.NullValue, err
 		}
-		dbxReader, err = s.db.ReaderRaw(sQuery)
+		dbxReader, err = s.db.ReaderRawContext(vm.GoContext(), sQuery)
 		if err != nil {
 			return core.NullValue, err
 		}
@@ -2570,7 +2597,7 @@ func (s *libDB) reader(args []core.Value, vm *core.VM) (core.Value, error) {
 		if err != nil {
 			return core.NullValue, err
 		}
-		dbxReader, err = s.db.ReaderRaw(sQuery, sParams...)
+		dbxReader, err = s.db.ReaderRawContext(vm.GoContext(), sQuery, sParams...)
 		if err != nil {
 			return core.NullValue, err
 		}
@@ -2620,7 +2647,7 @@ func (s *libDB) loadTable(args []core.Value, vm *core.VM) (core.Value, error) {
 		if err != nil {
 			return core.NullValue, err
 		}
-		rows, err = s.db.QueryRaw(sQuery)
+		rows, err = s.db.QueryRawContext(vm.GoContext(), sQuery)
 		if err != nil {
 			return core.NullValue, err
 		}
@@ -2630,7 +2657,7 @@ func (s *libDB) loadTable(args []core.Value, vm *core.VM) (core.Value, error) {
 		if err != nil {
 			return core.NullValue, err
 		}
-		rows, err = s.db.QueryRaw(sQuery, sParams...)
+		rows, err = s.db.QueryRawContext(vm.GoContext(), sQuery, sParams...)
 		if err != nil {
 			return core.NullValue, err
 		}
@@ -2640,7 +2667,7 @@ func (s *libDB) loadTable(args []core.Value, vm *core.VM) (core.Value, error) {
 
 	defer rows.Close()
 
-	tbl, err := dbx.ToTable(rows)
+	tbl, err := s.db.ToTable(rows)
 	if err != nil {
 		return core.NullValue, err
 	}
@@ -2675,7 +2702,7 @@ func (s *libDB) loadTableRaw(args []core.Value, vm *core.VM) (core.Value, error)
 		params = append(params, getSqlParams(args[1:])...)
 	}
 
-	rows, err := s.db.QueryRaw(query, params...)
+	rows, err := s.db.QueryRawContext(vm.GoContext(), query, params...)
 	if err != nil {
 		return core.NullValue, err
 	}
@@ -2685,7 +2712,7 @@ func (s *libDB) loadTableRaw(args []core.Value, vm *core.VM) (core.Value, error)
 
 	defer rows.Close()
 
-	t, err := dbx.ToTable(rows)
+	t, err := s.db.ToTable(rows)
 	if err != nil {
 		return core.NullValue, err
 	}
@@ -3,7 +3,6 @@ package lib
 import (
 	"fmt"
 	"math/rand"
-	"regexp"
 	"sort"
 	"strings"
 	"time"
@@ -91,7 +90,7 @@ interface String {
 	 * Replace with regular expression.
 	 * The syntax is defined: https://golang.org/pkg/regexp/syntax
 	 */
-    replaceRegex(expr: string, replace: string): string
+    replaceRegex(expr: string | RegExp, replace: string): string
 }
 
 	`)
@@ -290,10 +289,9 @@ var Strings = []core.NativeFunction{
 		Name:      "String.prototype.replaceRegex",
 		Arguments: 2,
 		Function: func(this core.Value, args []core.Value, vm *core.VM) (core.Value, error) {
-			exp := args[0].ToString()
 			repl := args[1].ToString()
 			s := this.ToString()
-			r, err := regexp.Compile(exp)
+			r, err := regexArg(args[0])
 			if err != nil {
 				return core.NullValue, err
 			}
@@ -91,7 +91,7 @@ var Sync = []core.NativeFunction{
 
 			go func() {
 				for range ticker.C {
-					if err := runFuncOrClosure(vm, v); err != nil {
+					if err := runFuncOrClosure(vm, "ticker", v); err != nil {
 						fmt.Println(err)
 					}
 				}
@@ -125,7 +125,7 @@ var Sync = []core.NativeFunction{
 
 			go func() {
 				for range timer.C {
-					if err := runFuncOrClosure(vm, v); err != nil {
+					if err := runFuncOrClosure(vm, "timer", v); err != nil {
 						fmt.Println(err)
 					}
 				}
@@ -252,7 +252,19 @@ var Sync = []core.NativeFunction{
 				}
 			}
 
+			// stop waiting if the execution is canceled
+			ctx := vm.GoContext()
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())})
+
 			i, value, ok := reflect.Select(cases)
+			if i == len(cases)-1 {
+				return core.NullValue, ctx.Err()
+			}
+
+			if i < l {
+				// receiving from a channel orders the execution after the send
+				vm.RaceAcquire(chans[i].ToObject())
+			}
 
 			m := make(map[string]core.Value, 3)
 			m["index"] = core.NewInt(i)
@@ -300,10 +312,12 @@ func (m *mutex) GetMethod(name string) core.NativeMethod {
 
 func (m *mutex) lock(args []core.Value, vm *core.VM) (core.Value, error) {
 	m.mutex.Lock()
+	vm.RaceAcquire(m)
 	return core.NullValue, nil
 }
 
 func (m *mutex) unlock(args []core.Value, vm *core.VM) (core.Value, error) {
+	vm.RaceRelease(m)
 	m.mutex.Unlock()
 	return core.NullValue, nil
 }
@@ -337,22 +351,35 @@ func (c *channel) send(args []core.Value, vm *core.VM) (core.Value, error) {
 	if len(args) != 1 {
 		return core.NullValue, fmt.Errorf("expected 1 arg")
 	}
-	c.c <- args[0]
-	return core.NullValue, nil
+	vm.RaceRelease(c)
+	ctx := vm.GoContext()
+	select {
+	case c.c <- args[0]:
+		return core.NullValue, nil
+	case <-ctx.Done():
+		return core.NullValue, ctx.Err()
+	}
 }
 
 func (c *channel) receive(args []core.Value, vm *core.VM) (core.Value, error) {
 	if len(args) != 0 {
 		return core.NullValue, fmt.Errorf("expected 0 args")
 	}
-	v := <-c.c
-	return v, nil
+	ctx := vm.GoContext()
+	select {
+	case v := <-c.c:
+		vm.RaceAcquire(c)
+		return v, nil
+	case <-ctx.Done():
+		return core.NullValue, ctx.Err()
+	}
 }
 
 func (c *channel) close(args []core.Value, vm *core.VM) (core.Value, error) {
 	if len(args) != 0 {
 		return core.NullValue, fmt.Errorf("expected 0 args")
 	}
+	vm.RaceRelease(c)
 	close(c.c)
 	return core.NullValue, nil
 }
@@ -452,7 +479,12 @@ func (t *waitGroup) goRun(args []core.Value, vm *core.VM) (core.Value, error) {
 	}
 
 	if t.limit != nil {
-		t.limit <- true
+		ctx := vm.GoContext()
+		select {
+		case t.limit <- true:
+		case <-ctx.Done():
+			return core.NullValue, ctx.Err()
+		}
 	}
 
 	return launchGoroutine(args, vm, t)
@@ -463,12 +495,25 @@ func (t *waitGroup) wait(args []core.Value, vm *core.VM) (core.Value, error) {
 		return core.NullValue, fmt.Errorf("expected 0 arguments, got %d", len(args))
 	}
 
-	t.w.Wait()
-	return core.NullValue, nil
+	done := make(chan struct{})
+	go func() {
+		t.w.Wait()
+		close(done)
+	}()
+
+	ctx := vm.GoContext()
+	select {
+	case <-done:
+		// the goroutines of the group happen before the wait returns
+		vm.RaceAcquire(t)
+		return core.NullValue, nil
+	case <-ctx.Done():
+		return core.NullValue, ctx.Err()
+	}
 }
 
 func launchGoroutine(args []core.Value, vm *core.VM, t *waitGroup) (core.Value, error) {
-	m, err := cloneForAsync(vm)
+	m, err := cloneForAsync(vm, "go")
 	if err != nil {
 		return core.NullValue, err
 	}
@@ -486,6 +531,7 @@ func launchGoroutine(args []core.Value, vm *core.VM, t *waitGroup) (core.Value,
 				fmt.Println(err)
 			}
 			if t != nil {
+				m.RaceRelease(t)
 				t.w.Done()
 				if t.limit != nil {
 					<-t.limit
@@ -510,6 +556,7 @@ func launchGoroutine(args []core.Value, vm *core.VM, t *waitGroup) (core.Value,
 				fmt.Println(err)
 			}
 			if t != nil {
+				m.RaceRelease(t)
 				t.w.Done()
 				if t.limit != nil {
 					<-t.limit
@@ -524,25 +571,28 @@ func launchGoroutine(args []core.Value, vm *core.VM, t *waitGroup) (core.Value,
 	return core.NullValue, nil
 }
 
-func cloneForAsync(vm *core.VM) (*core.VM, error) {
-	m := core.NewInitializedVM(vm.Program, vm.Globals())
-	m.MaxAllocations = vm.MaxAllocations
-	m.MaxFrames = vm.MaxFrames
-	m.MaxSteps = vm.MaxSteps
-	m.FileSystem = vm.FileSystem
-	m.Trusted = vm.Trusted
+// cloneForAsync returns a VM to run a function asynchronously. Its errors
+// show the stack of vm with the boundary, like "go" or "timer".
+func cloneForAsync(vm *core.VM, boundary string) (*core.VM, error) {
+	// the clone shares the context and the deadline of the execution
+	m := vm.Clone(vm.Program, vm.Globals())
+	m.Context = cloneContext(vm, m)
+	m.SetCaller(boundary, vm)
 
+	if err := m.AddSteps(vm.Steps()); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// cloneContext returns a copy of the context of vm to be used by m.
+func cloneContext(vm, m *core.VM) *Context {
 	c := GetContext(vm).Clone()
 	if c.DB != nil {
 		// transactions and concurrency are problematic.
 		// For now: any sync code has its own transaction context.
 		c.DB = newDB(c.DB.db.Clone(), m)
 	}
-	m.Context = c
-
-	if err := m.AddSteps(vm.Steps()); err != nil {
-		return nil, err
-	}
-
-	return m, nil
+	return c
 }
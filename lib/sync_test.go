@@ -1,7 +1,10 @@
 package lib
 
 import (
+	"context"
+	"errors"
 	"testing"
+	"time"
 
 	"github.com/gtlang/gt/core"
 )
@@ -37,3 +40,29 @@ func TestAsyncClosure(t *testing.T) {
 		t.Fatalf("Returned: %v", v)
 	}
 }
+
+func TestReceiveCanceled(t *testing.T) {
+	p, err := core.CompileStr(`
+		function main() {
+			let ch = sync.newChannel()
+			try {
+				ch.receive()
+			} catch {
+				return "catched"
+			}
+		}
+	`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm := core.NewVM(p)
+	vm.Trusted = true
+	vm.Deadline = time.Now().Add(20 * time.Millisecond)
+
+	_, err = vm.Run()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the deadline to be exceeded, got %v", err)
+	}
+}
@@ -3,6 +3,7 @@ package lib
 import (
 	"fmt"
 	"math"
+	"reflect"
 	"github.com/gtlang/gt/core"
 	"time"
 
@@ -10,6 +11,34 @@ import (
 )
 
 func init() {
+	core.RegisterConverter(reflect.TypeOf(time.Time{}), core.Converter{
+		TypeName: "time.Time",
+		ToValue: func(v reflect.Value) (core.Value, error) {
+			return core.NewObject(TimeObj(v.Interface().(time.Time))), nil
+		},
+		FromValue: func(v core.Value) (reflect.Value, error) {
+			t, ok := v.ToObjectOrNil().(TimeObj)
+			if !ok {
+				return reflect.Value{}, fmt.Errorf("expected time.Time, got %s", v.TypeName())
+			}
+			return reflect.ValueOf(time.Time(t)), nil
+		},
+	})
+
+	core.RegisterConverter(reflect.TypeOf(time.Duration(0)), core.Converter{
+		TypeName: "time.Duration",
+		ToValue: func(v reflect.Value) (core.Value, error) {
+			return core.NewObject(Duration(v.Int())), nil
+		},
+		FromValue: func(v core.Value) (reflect.Value, error) {
+			d, err := ToDuration(v)
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			return reflect.ValueOf(d), nil
+		},
+	})
+
 	core.RegisterLib(Time, `
 
 declare namespace time {
@@ -561,8 +590,16 @@ var Time = []core.NativeFunction{
 				return core.NullValue, err
 			}
 
-			time.Sleep(d)
-			return core.NullValue, nil
+			t := time.NewTimer(d)
+			defer t.Stop()
+
+			ctx := vm.GoContext()
+			select {
+			case <-t.C:
+				return core.NullValue, nil
+			case <-ctx.Done():
+				return core.NullValue, ctx.Err()
+			}
 		},
 	},
 	core.NativeFunction{
@@ -95,8 +95,10 @@ func ValidateArgRange(args []core.Value, counts ...int) error {
 	return fmt.Errorf("expected %s arguments, got %d", s, l)
 }
 
-func runFuncOrClosure(vm *core.VM, fn core.Value, args ...core.Value) error {
-	m, err := cloneForAsync(vm)
+// runFuncOrClosure runs the function in a clone of vm. The boundary
+// is shown in the stack traces, like "timer".
+func runFuncOrClosure(vm *core.VM, boundary string, fn core.Value, args ...core.Value) error {
+	m, err := cloneForAsync(vm, boundary)
 	if err != nil {
 		return err
 	}
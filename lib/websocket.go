@@ -193,9 +193,7 @@ func (c *websocketConn) writeJSON(args []core.Value, vm *core.VM) (core.Value, e
 		return core.NullValue, fmt.Errorf("expecting 1 parameter, got %d", len(args))
 	}
 
-	v := args[0].Export(0)
-
-	b, err := json.Marshal(v)
+	b, err := json.Marshal(args[0])
 
 	if err != nil {
 		return core.NullValue, err
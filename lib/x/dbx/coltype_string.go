@@ -4,9 +4,9 @@ package dbx
 
 import "fmt"
 
-const _ColType_name = "StringIntDecimalBoolTimeDateDateTimeBlobUnknown"
+const _ColType_name = "StringIntDecimalBoolTimeDateDateTimeBlobUnknownNumeric"
 
-var _ColType_index = [...]uint8{0, 6, 9, 16, 20, 24, 28, 36, 40, 47}
+var _ColType_index = [...]uint8{0, 6, 9, 16, 20, 24, 28, 36, 40, 47, 54}
 
 func (i ColType) String() string {
 	if i < 0 || i >= ColType(len(_ColType_index)-1) {
@@ -1,6 +1,7 @@
 package dbx
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -22,6 +23,10 @@ type DB struct {
 	OpenAnyDatabase   bool
 	ReadOnly          bool
 
+	// Decimals reads DECIMAL and NUMERIC columns as exact Numbers
+	// instead of floats.
+	Decimals bool
+
 	mut      *sync.Mutex
 	tx       *sql.Tx
 	nestedTx int // to keep track of the number of nested transactions
@@ -64,6 +69,7 @@ func (db *DB) Open(database string) *DB {
 		WriteAnyNamespace: db.WriteAnyNamespace,
 		OpenAnyDatabase:   db.OpenAnyDatabase,
 		ReadOnly:          db.ReadOnly,
+		Decimals:          db.Decimals,
 		DB:                db.DB,
 		mut:               &sync.Mutex{},
 	}
@@ -79,6 +85,7 @@ func (db *DB) Clone() *DB {
 		WriteAnyNamespace: db.WriteAnyNamespace,
 		OpenAnyDatabase:   db.OpenAnyDatabase,
 		ReadOnly:          db.ReadOnly,
+		Decimals:          db.Decimals,
 		DB:                db.DB,
 		mut:               &sync.Mutex{},
 	}
@@ -103,6 +110,9 @@ type queryable interface {
 	Exec(query string, args ...interface{}) (sql.Result, error)
 	Query(query string, args ...interface{}) (*sql.Rows, error)
 	QueryRow(query string, args ...interface{}) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
 }
 
 func (db *DB) queryable() queryable {
@@ -230,12 +240,17 @@ func (db *DB) ToSql(q goql.Query, params []interface{}) (string, []interface{},
 }
 
 func (db *DB) ExecRaw(query string, args ...interface{}) (sql.Result, error) {
+	return db.ExecRawContext(context.Background(), query, args...)
+}
+
+// ExecRawContext is like ExecRaw but the query is canceled when ctx is done.
+func (db *DB) ExecRawContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
 	if db.ReadOnly {
 		return nil, ErrReadOnly
 	}
 
 	q := db.queryable()
-	r, err := q.Exec(query, args...)
+	r, err := q.ExecContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -243,7 +258,12 @@ func (db *DB) ExecRaw(query string, args ...interface{}) (sql.Result, error) {
 }
 
 func (db *DB) QueryRaw(query string, args ...interface{}) (*sql.Rows, error) {
-	r, err := db.queryable().Query(query, args...)
+	return db.QueryRawContext(context.Background(), query, args...)
+}
+
+// QueryRawContext is like QueryRaw but the query is canceled when ctx is done.
+func (db *DB) QueryRawContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	r, err := db.queryable().QueryContext(ctx, query, args...)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
@@ -254,7 +274,12 @@ func (db *DB) QueryRaw(query string, args ...interface{}) (*sql.Rows, error) {
 }
 
 func (db *DB) QueryRowRaw(query string, args ...interface{}) *sql.Row {
-	return db.queryable().QueryRow(query, args...)
+	return db.QueryRowRawContext(context.Background(), query, args...)
+}
+
+// QueryRowRawContext is like QueryRowRaw but the query is canceled when ctx is done.
+func (db *DB) QueryRowRawContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return db.queryable().QueryRowContext(ctx, query, args...)
 }
 
 func (db *DB) ScanValueRaw(v interface{}, query string, args ...interface{}) error {
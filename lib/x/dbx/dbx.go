@@ -1,6 +1,7 @@
 package dbx
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 
@@ -8,14 +9,15 @@ import (
 )
 
 type Reader struct {
-	columns []*Column
-	rows    *sql.Rows
-	values  []interface{}
+	columns  []*Column
+	rows     *sql.Rows
+	values   []interface{}
+	decimals bool
 }
 
 func (r *Reader) Columns() ([]*Column, error) {
 	if r.columns == nil {
-		cols, err := getColumns(r.rows)
+		cols, err := getColumns(r.rows, r.decimals)
 		if err != nil {
 			return nil, err
 		}
@@ -98,7 +100,7 @@ func (db *DB) ShowQueryEx(query *goql.ShowQuery) (*Table, error) {
 	}
 	defer rows.Close()
 
-	return ToTable(rows)
+	return db.ToTable(rows)
 }
 
 func (db *DB) ShowReader(query string) (*Reader, error) {
@@ -125,7 +127,7 @@ func (db *DB) ShowReaderEx(query *goql.ShowQuery) (*Reader, error) {
 		return nil, err
 	}
 
-	return &Reader{rows: rows}, nil
+	return &Reader{rows: rows, decimals: db.Decimals}, nil
 }
 
 func (db *DB) ReaderEx(query *goql.SelectQuery) (*Reader, error) {
@@ -134,7 +136,7 @@ func (db *DB) ReaderEx(query *goql.SelectQuery) (*Reader, error) {
 		return nil, err
 	}
 
-	return &Reader{rows: rows}, nil
+	return &Reader{rows: rows, decimals: db.Decimals}, nil
 }
 
 func (db *DB) Reader(query string, args ...interface{}) (*Reader, error) {
@@ -143,16 +145,21 @@ func (db *DB) Reader(query string, args ...interface{}) (*Reader, error) {
 		return nil, err
 	}
 
-	return &Reader{rows: rows}, nil
+	return &Reader{rows: rows, decimals: db.Decimals}, nil
 }
 
 func (db *DB) ReaderRaw(query string, args ...interface{}) (*Reader, error) {
-	rows, err := db.QueryRaw(query, args...)
+	return db.ReaderRawContext(context.Background(), query, args...)
+}
+
+// ReaderRawContext is like ReaderRaw but the query is canceled when ctx is done.
+func (db *DB) ReaderRawContext(ctx context.Context, query string, args ...interface{}) (*Reader, error) {
+	rows, err := db.QueryRawContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Reader{rows: rows}, nil
+	return &Reader{rows: rows, decimals: db.Decimals}, nil
 }
 
 func (db *DB) QueryEx(query *goql.SelectQuery) (*Table, error) {
@@ -162,7 +169,7 @@ func (db *DB) QueryEx(query *goql.SelectQuery) (*Table, error) {
 	}
 	defer rows.Close()
 
-	return ToTable(rows)
+	return db.ToTable(rows)
 }
 
 func (db *DB) QueryRowsEx(q *goql.SelectQuery) (*sql.Rows, error) {
@@ -181,7 +188,7 @@ func (db *DB) Query(query string, args ...interface{}) (*Table, error) {
 	}
 	defer rows.Close()
 
-	return ToTable(rows)
+	return db.ToTable(rows)
 }
 
 func (db *DB) QueryRows(query string, args ...interface{}) (*sql.Rows, error) {
@@ -253,13 +260,18 @@ func (db *DB) QueryValue(query string, args ...interface{}) (interface{}, error)
 }
 
 func (db *DB) QueryValueRaw(query string, args ...interface{}) (interface{}, error) {
-	rows, err := db.QueryRaw(query, args...)
+	return db.QueryValueRawContext(context.Background(), query, args...)
+}
+
+// QueryValueRawContext is like QueryValueRaw but the query is canceled when ctx is done.
+func (db *DB) QueryValueRawContext(ctx context.Context, query string, args ...interface{}) (interface{}, error) {
+	rows, err := db.QueryRawContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	t, more, err := ToTableLimit(rows, 1)
+	t, more, err := db.ToTableLimit(rows, 1)
 	if err != nil {
 		return nil, err
 	}
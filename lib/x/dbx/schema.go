@@ -42,7 +42,7 @@ func (db *DB) Databases() (*Table, error) {
 	}
 	defer rows.Close()
 
-	return ToTable(rows)
+	return db.ToTable(rows)
 }
 
 func (db *DB) HasDatabase(name string) (bool, error) {
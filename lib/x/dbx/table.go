@@ -25,8 +25,12 @@ const (
 	DateTime
 	Blob
 	Unknown
+	Numeric // exact DECIMAL and NUMERIC columns
 )
 
+// Number is the exact value of a Numeric column, like "1234.50".
+type Number string
+
 type Column struct {
 	Name     string       `json:"name"`
 	Type     ColType      `json:"type"`
@@ -134,7 +138,24 @@ func ToTable(rows *sql.Rows) (*Table, error) {
 // Returns a table with up to maxRows number of rows and returns also if
 // there are more rows to read.
 func ToTableLimit(rows *sql.Rows, maxRows int) (*Table, bool, error) {
-	cols, err := getColumns(rows)
+	return toTableLimit(rows, maxRows, false)
+}
+
+// ToTable is like the ToTable function but reads the decimal columns
+// as Numbers if db.Decimals is set.
+func (db *DB) ToTable(rows *sql.Rows) (*Table, error) {
+	t, _, err := toTableLimit(rows, 0, db.Decimals)
+	return t, err
+}
+
+// ToTableLimit is like the ToTableLimit function but reads the decimal
+// columns as Numbers if db.Decimals is set.
+func (db *DB) ToTableLimit(rows *sql.Rows, maxRows int) (*Table, bool, error) {
+	return toTableLimit(rows, maxRows, db.Decimals)
+}
+
+func toTableLimit(rows *sql.Rows, maxRows int, decimals bool) (*Table, bool, error) {
+	cols, err := getColumns(rows, decimals)
 	if err != nil {
 		return nil, false, err
 	}
@@ -151,7 +172,7 @@ func ToTableLimit(rows *sql.Rows, maxRows int) (*Table, bool, error) {
 		i++
 
 		if t.Columns == nil {
-			cols, err := getColumns(rows)
+			cols, err := getColumns(rows, decimals)
 			if err != nil {
 				return nil, false, err
 			}
@@ -178,7 +199,7 @@ func ToTableLimit(rows *sql.Rows, maxRows int) (*Table, bool, error) {
 	return t, moreRows, nil
 }
 
-func getColumns(rows *sql.Rows) ([]*Column, error) {
+func getColumns(rows *sql.Rows, decimals bool) ([]*Column, error) {
 	types, err := rows.ColumnTypes()
 	if err != nil {
 		return nil, err
@@ -189,7 +210,7 @@ func getColumns(rows *sql.Rows) ([]*Column, error) {
 	for i, t := range types {
 		cs[i] = &Column{
 			Name:     t.Name(),
-			Type:     getType(t.DatabaseTypeName()),
+			Type:     getType(t.DatabaseTypeName(), decimals),
 			ScanType: t.ScanType(),
 		}
 	}
@@ -197,7 +218,9 @@ func getColumns(rows *sql.Rows) ([]*Column, error) {
 	return cs, nil
 }
 
-func getType(s string) ColType {
+// getType returns the type of a column. DECIMAL and NUMERIC
+// columns are floats unless decimals is set.
+func getType(s string, decimals bool) ColType {
 	// remove the size
 	i := strings.IndexRune(s, '(')
 	if i != -1 {
@@ -211,7 +234,12 @@ func getType(s string) ColType {
 		return Int
 	case "string", "text", "varchar":
 		return String
-	case "float", "real", "decimal":
+	case "float", "real":
+		return Decimal
+	case "decimal", "numeric":
+		if decimals {
+			return Numeric
+		}
 		return Decimal
 	case "time":
 		return Time
@@ -328,6 +356,19 @@ func Convert(v interface{}, t ColType) (interface{}, error) {
 		default:
 			return nil, fmt.Errorf("can't convert type %T to float", v)
 		}
+	case Numeric:
+		switch v := v.(type) {
+		case []byte:
+			return Number(v), nil
+		case string:
+			return Number(v), nil
+		case int64:
+			return Number(strconv.FormatInt(v, 10)), nil
+		case float64:
+			return Number(strconv.FormatFloat(v, 'f', -1, 64)), nil
+		default:
+			return nil, fmt.Errorf("can't convert type %T to number", v)
+		}
 	case Time, Date, DateTime:
 		switch v := v.(type) {
 		case []byte:
@@ -44,6 +44,11 @@ func Format(format string, v interface{}, c Culture) string {
 			format = "0:00"
 		}
 		return formatNum(format, t, c.ThousandSeparator, c.DecimalSeparator)
+	case Decimal:
+		if format == "" {
+			format = "0:00"
+		}
+		return formatDigits(format, t.StringFixed, c.ThousandSeparator, c.DecimalSeparator)
 	default:
 		if format == "" {
 			format = "%v"
@@ -52,14 +57,29 @@ func Format(format string, v interface{}, c Culture) string {
 	}
 }
 
+// Decimal is implemented by exact numbers that are formatted
+// without converting them to floats.
+type Decimal interface {
+	// StringFixed returns the number with places digits after the point.
+	StringFixed(places int) string
+}
+
 func formatNum(format string, num float64, thousandsSep, decimalSep rune) string {
+	return formatDigits(format, func(places int) string {
+		return strconv.FormatFloat(num, 'f', places, 64)
+	}, thousandsSep, decimalSep)
+}
+
+// formatDigits formats a number that fixed returns with the
+// number of places of the format.
+func formatDigits(format string, fixed func(places int) string, thousandsSep, decimalSep rune) string {
 	if decimalSep == 0 {
 		decimalSep = '.'
 	}
 
 	left, right, start, end, thousands := parseNumPattern(format)
 
-	s := strconv.FormatFloat(num, 'f', right, 64)
+	s := fixed(right)
 	i := strings.IndexRune(s, '.')
 	if i == -1 {
 		i = len(s)
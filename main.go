@@ -5,6 +5,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	_ "github.com/gtlang/gt/lib"
@@ -12,6 +13,7 @@ import (
 	"github.com/gtlang/filesystem"
 	"github.com/gtlang/gt/core"
 	"github.com/gtlang/gt/binary"
+	"github.com/gtlang/gt/parser"
 
 	_ "github.com/go-sql-driver/mysql"
 	_ "github.com/mattn/go-sqlite3"
@@ -24,14 +26,329 @@ func main() {
 		return
 	}
 
-	name := args[1]
+	var err error
 
-	if err := exec(name, args[2:]); err != nil {
+	switch args[1] {
+	case "disasm":
+		if len(args) != 3 {
+			log.Fatal("Usage: gt disasm [path]")
+		}
+		err = disasm(args[2])
+	case "asm":
+		if len(args) != 3 && len(args) != 4 {
+			log.Fatal("Usage: gt asm [path] [output]")
+		}
+		err = asm(args[2:])
+	case "build":
+		err = build(args[2:])
+	case "dts":
+		if len(args) != 3 && len(args) != 4 {
+			log.Fatal("Usage: gt dts [path] [outdir]")
+		}
+		err = dts(args[2:])
+	case "run":
+		if len(args) < 3 {
+			log.Fatal("Usage: gt run [-race] [path] [args...]")
+		}
+		if args[2] == "-race" {
+			if len(args) < 4 {
+				log.Fatal("Usage: gt run [-race] [path] [args...]")
+			}
+			err = runRace(args[3], args[4:])
+		} else {
+			err = exec(args[2], args[3:])
+		}
+	case "record":
+		if len(args) < 4 {
+			log.Fatal("Usage: gt record [log] [path] [args...]")
+		}
+		err = record(args[2], args[3], args[4:])
+	case "replay":
+		if len(args) < 4 {
+			log.Fatal("Usage: gt replay [log] [path] [args...]")
+		}
+		err = replay(args[2], args[3], args[4:])
+	default:
+		err = exec(args[1], args[2:])
+	}
+
+	if err != nil {
 		log.Fatal(err)
 	}
 }
 
+// disasm prints the program in the format that asm reads.
+func disasm(name string) error {
+	p, err := loadProgram(name)
+	if err != nil {
+		return err
+	}
+
+	return core.Disassemble(os.Stdout, p)
+}
+
+// asm builds a binary from the output of disasm.
+func asm(args []string) error {
+	path := args[0]
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	p, err := core.Assemble(f)
+	if err != nil {
+		return fmt.Errorf("error assembling %s: %v", path, err)
+	}
+
+	if err := core.Verify(p); err != nil {
+		return err
+	}
+
+	var out string
+	if len(args) > 1 {
+		out = args[1]
+	} else {
+		out = strings.TrimSuffix(path, filepath.Ext(path)) + ".gt"
+	}
+
+	if out == path {
+		return fmt.Errorf("the output would overwrite %s", path)
+	}
+
+	w, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+
+	// the sources are only in the assembly if they were in the binary
+	if err := binary.Write(w, p, binary.WithSources()); err != nil {
+		w.Close()
+		return err
+	}
+
+	return w.Close()
+}
+
+// build compiles the program to a binary with the compile-time defines
+// passed as -D NAME=value. The sources are only included with -sources.
+func build(args []string) error {
+	defines := make(map[string]core.Value)
+
+	var opts []binary.WriteOption
+
+	for len(args) > 0 && (strings.HasPrefix(args[0], "-D") || args[0] == "-sources") {
+		if args[0] == "-sources" {
+			opts = append(opts, binary.WithSources())
+			args = args[1:]
+			continue
+		}
+
+		d := strings.TrimPrefix(args[0], "-D")
+		args = args[1:]
+		if d == "" {
+			if len(args) == 0 {
+				break
+			}
+			d = args[0]
+			args = args[1:]
+		}
+
+		name, v, err := core.ParseDefine(d)
+		if err != nil {
+			return err
+		}
+		defines[name] = v
+	}
+
+	if len(args) != 1 && len(args) != 2 {
+		return fmt.Errorf("Usage: gt build [-sources] [-D NAME=value]... [path] [output]")
+	}
+
+	path, err := findPath(args[0])
+	if err != nil {
+		return err
+	}
+
+	p, err := core.CompileWithDefines(filesystem.OS, path, defines)
+	if err != nil {
+		return err
+	}
+
+	var out string
+	if len(args) > 1 {
+		out = args[1]
+	} else {
+		out = strings.TrimSuffix(path, filepath.Ext(path)) + ".gt"
+	}
+
+	if out == path {
+		return fmt.Errorf("the output would overwrite %s", path)
+	}
+
+	w, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+
+	if err := binary.Write(w, p, opts...); err != nil {
+		w.Close()
+		return err
+	}
+
+	return w.Close()
+}
+
+// dts generates the type definitions of the program and its imports.
+// Without an output directory they are printed.
+func dts(args []string) error {
+	path, err := findPath(args[0])
+	if err != nil {
+		return err
+	}
+
+	m, err := parser.Parse(filesystem.OS, path)
+	if err != nil {
+		return err
+	}
+
+	if len(args) > 1 {
+		// the .d.ts files would be loaded instead of the sources
+		if err := checkOutDir(args[1], m.BasePath); err != nil {
+			return err
+		}
+	}
+
+	files := parser.ModuleDeclarations(m)
+
+	paths := make([]string, 0, len(files))
+	for k := range files {
+		paths = append(paths, k)
+	}
+	sort.Strings(paths)
+
+	for _, p := range paths {
+		// keep the layout relative to the base path so imports still work
+		rel, err := filepath.Rel(m.BasePath, p)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			fmt.Fprintf(os.Stderr, "skipping %s: it is outside of %s\n", p, m.BasePath)
+			continue
+		}
+
+		if len(args) == 1 {
+			fmt.Printf("// %s\n%s\n", rel, files[p])
+			continue
+		}
+
+		out := filepath.Join(args[1], rel)
+		if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(out, []byte(files[p]), 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkOutDir returns an error if dir and basePath contain each other.
+func checkOutDir(dir, basePath string) error {
+	d, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+
+	b, err := filepath.Abs(basePath)
+	if err != nil {
+		return err
+	}
+
+	if within(d, b) || within(b, d) {
+		return fmt.Errorf("the output directory %s overlaps %s", dir, basePath)
+	}
+	return nil
+}
+
+// within returns true if path is dir or is inside it.
+func within(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// record runs the program logging the native calls.
+func record(logPath, name string, args []string) error {
+	f, err := os.Create(logPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return run(name, args, func(vm *core.VM) {
+		vm.Recorder = core.NewRecorder(f)
+	})
+}
+
+// replay runs the program serving the native calls from a log.
+func replay(logPath, name string, args []string) error {
+	f, err := os.Open(logPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := core.NewReplayer(f)
+	if err != nil {
+		return err
+	}
+
+	err = run(name, args, func(vm *core.VM) {
+		vm.Replayer = r
+	})
+	if err != nil {
+		return err
+	}
+
+	return r.Done()
+}
+
+// runRace runs the program reporting the data races between goroutines.
+func runRace(name string, args []string) error {
+	var d *core.RaceDetector
+
+	err := run(name, args, func(vm *core.VM) {
+		d = vm.DetectRaces()
+	})
+
+	// the program failed before running
+	if d == nil {
+		return err
+	}
+
+	races := d.Races()
+	for _, r := range races {
+		fmt.Fprintln(os.Stderr, r)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if len(races) > 0 {
+		return fmt.Errorf("found %d data race(s)", len(races))
+	}
+	return nil
+}
+
 func exec(name string, args []string) error {
+	return run(name, args, nil)
+}
+
+func run(name string, args []string, setup func(vm *core.VM)) error {
 	p, err := loadProgram(name)
 	if err != nil {
 		return err
@@ -40,6 +357,10 @@ func exec(name string, args []string) error {
 	vm := core.NewVM(p)
 	vm.FileSystem = filesystem.OS
 	vm.Trusted = true
+
+	if setup != nil {
+		setup(vm)
+	}
 	
 	ln := len(args)
 	values := make([]core.Value, ln)
@@ -59,7 +380,7 @@ func loadProgram(name string) (*core.Program, error) {
 
 	// by default source files have a typescript extension
 	if strings.HasSuffix(path, ".ts") {
-		return core.Compile(filesystem.OS, path)
+		return compile(path)
 	}
 
 	// first try to read as compiled
@@ -73,7 +394,7 @@ func loadProgram(name string) (*core.Program, error) {
 	if err != nil {
 		if err == binary.ErrInvalidHeader {
 			// if it is not a compiled program maybe is a source file with a different extension
-			return core.Compile(filesystem.OS, path)
+			return compile(path)
 		}
 		return p, fmt.Errorf("error loading %s: %v", path, err)
 	}
@@ -81,6 +402,17 @@ func loadProgram(name string) (*core.Program, error) {
 	return p, nil
 }
 
+// compile uses the cache in $GTPATH/.cache if GTPATH is set.
+func compile(path string) (*core.Program, error) {
+	dirs := envDirs()
+	if len(dirs) == 0 {
+		return core.Compile(filesystem.OS, path)
+	}
+
+	c := binary.NewCache(filesystem.OS, filepath.Join(dirs[0], ".cache"))
+	return c.Compile(filesystem.OS, path)
+}
+
 func findPath(name string) (string, error) {
 	if path := tryPath(name); path != "" {
 		return path, nil
@@ -0,0 +1,188 @@
+package parser
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gtlang/gt/ast"
+)
+
+// ModuleDeclarations generates the declarations of all the files
+// of the import graph. The keys are the paths of the .d.ts files.
+func ModuleDeclarations(m *ast.Module) map[string]string {
+	files := make(map[string]string, len(m.Modules)+1)
+
+	files[declarationPath(m.File.Path)] = Declarations(m.File)
+
+	for _, f := range m.Modules {
+		files[declarationPath(f.Path)] = Declarations(f)
+	}
+
+	return files
+}
+
+func declarationPath(path string) string {
+	return strings.TrimSuffix(path, ".ts") + ".d.ts"
+}
+
+// Declarations generates the type definitions of the exported functions,
+// classes, enums and variables of the file. Imports, interfaces and types
+// are kept as they are written. Missing annotations are declared as any.
+func Declarations(f *ast.File) string {
+	var b strings.Builder
+
+	imports := append(append([]*ast.ImportStmt{}, f.Imports...), f.TypeImports...)
+	sort.SliceStable(imports, func(i, j int) bool {
+		return imports[i].Pos.Line < imports[j].Pos.Line
+	})
+
+	for _, imp := range imports {
+		if imp.Alias == "" {
+			b.WriteString("import " + strconv.Quote(imp.Path) + "\n")
+		} else {
+			b.WriteString("import * as " + imp.Alias + " from " + strconv.Quote(imp.Path) + "\n")
+		}
+	}
+
+	for _, t := range f.Types {
+		if b.Len() > 0 {
+			b.WriteString("\n")
+		}
+		if t.Exported {
+			b.WriteString("export ")
+		}
+		b.WriteString(t.Code + "\n")
+	}
+
+	for _, s := range f.Stms {
+		var decl string
+
+		switch t := s.(type) {
+		case *ast.FuncDeclStmt:
+			if t.Exported && t.ReceiverType == "" {
+				decl = "export function " + funcSignature(t) + "\n"
+			}
+		case *ast.ClassDeclStmt:
+			if t.Exported {
+				decl = classDeclaration(t)
+			}
+		case *ast.VarDeclStmt:
+			if t.Exported {
+				decl = varDeclaration(t)
+			}
+		}
+
+		if decl == "" {
+			continue
+		}
+
+		if b.Len() > 0 {
+			b.WriteString("\n")
+		}
+		b.WriteString(decl)
+	}
+
+	return b.String()
+}
+
+func funcSignature(f *ast.FuncDeclStmt) string {
+	var b strings.Builder
+
+	b.WriteString(f.Name + f.TypeParams + "(")
+
+	for i, a := range f.Args.List {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+
+		typ := a.Type
+		if f.Variadic && i == len(f.Args.List)-1 {
+			b.WriteString("...")
+			if typ == "" {
+				typ = "any[]"
+			}
+		}
+
+		b.WriteString(a.Name)
+		if a.Optional {
+			b.WriteString("?")
+		}
+		b.WriteString(": " + orAny(typ))
+	}
+
+	b.WriteString(")")
+
+	if f.Name != "constructor" {
+		b.WriteString(": " + orAny(f.ReturnType))
+	}
+
+	return b.String()
+}
+
+func classDeclaration(c *ast.ClassDeclStmt) string {
+	var b strings.Builder
+
+	b.WriteString("export class " + c.Name + " {\n")
+
+	for _, f := range c.Fields {
+		if f.Exported {
+			b.WriteString("    " + f.Name + ": " + orAny(f.Type) + "\n")
+		}
+	}
+
+	for _, f := range c.Functions {
+		if f.Exported {
+			b.WriteString("    " + funcSignature(f) + "\n")
+		}
+	}
+
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func varDeclaration(v *ast.VarDeclStmt) string {
+	if v.IsEnum {
+		return enumDeclaration(v)
+	}
+
+	kind := "let"
+	if v.IsConst {
+		kind = "const"
+	}
+
+	return "export " + kind + " " + v.Name + ": " + orAny(v.Type) + "\n"
+}
+
+func enumDeclaration(v *ast.VarDeclStmt) string {
+	var b strings.Builder
+
+	b.WriteString("export enum " + v.Name + " {\n")
+
+	if m, ok := v.Value.(*ast.MapDeclExpr); ok {
+		for i, kv := range m.List {
+			b.WriteString("    " + kv.Key)
+			if k, ok := kv.Value.(*ast.ConstantExpr); ok {
+				if k.Kind == ast.STRING {
+					b.WriteString(" = " + strconv.Quote(k.Value))
+				} else {
+					b.WriteString(" = " + k.Value)
+				}
+			}
+			if i < len(m.List)-1 {
+				b.WriteString(",")
+			}
+			b.WriteString("\n")
+		}
+	}
+
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func orAny(typ string) string {
+	if typ == "" {
+		return "any"
+	}
+	return typ
+}
@@ -33,7 +33,6 @@ func TestParseBasic(t *testing.T) {
 					Value string "hi"
 				}
 			]
-			Spread bool false
 		}`)
 }
 
@@ -68,14 +67,123 @@ func TestParseImport(t *testing.T) {
 								}
 								Exported bool true
 								IsEnum bool false
+								IsConst bool true
+								Type string ""
 						}
 				]
 				Comments []*ast.Comment
 				Imports []*ast.ImportStmt
 				Directives []string
+				Types []*ast.TypeDecl
+				TypeImports []*ast.ImportStmt
 		}`)
 }
 
+func TestParseAnnotations(t *testing.T) {
+	p, err := ParseStr(`
+		function foo<T>(a: Map<string, T[]>, b?: string | null, ...c): Promise<T> {
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertContains(t, p, `TypeParams string "<T>"
+		ReturnType string "Promise<T>"`)
+
+	assertContains(t, p, `Name string "a"
+		Optional bool false
+		Type string "Map<string, T[]>"`)
+
+	assertContains(t, p, `Name string "b"
+		Optional bool true
+		Type string "string | null"`)
+}
+
+func TestDeclarations(t *testing.T) {
+	fs := filesystem.NewVirtualFS()
+	fs.WritePath("main.ts", []byte(`
+		import * as shapes from "shapes"
+
+		export interface Options {
+			size: number // in pixels
+		}
+
+		type Internal = "a" | "b";
+
+		export function draw(s: shapes.Shape, opts?: Options, ...rest) {
+		}
+
+		function helper(x: number): number {
+			return x
+		}
+
+		export const VERSION = "1.0"
+	`))
+
+	fs.WritePath("shapes.ts", []byte(`
+		export enum Kind {
+			Circle = 1,
+			Square,
+			Named = "named"
+		}
+
+		export class Shape {
+			kind: Kind
+			private id: number
+			name
+
+			constructor(kind: Kind) {
+				this.kind = kind
+			}
+
+			area(): number {
+				return 0
+			}
+		}
+	`))
+
+	m, err := Parse(fs, "main.ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := ModuleDeclarations(m)
+
+	expected := `import * as shapes from "shapes"
+
+export interface Options {
+			size: number // in pixels
+		}
+
+type Internal = "a" | "b"
+
+export function draw(s: shapes.Shape, opts?: Options, ...rest: any[]): any
+
+export const VERSION: any
+`
+	if s := files["/main.d.ts"]; s != expected {
+		t.Fatalf("got:\n%s", s)
+	}
+
+	expected = `export enum Kind {
+    Circle = 1,
+    Square = 2,
+    Named = "named"
+}
+
+export class Shape {
+    kind: Kind
+    name: any
+    constructor(kind: Kind)
+    area(): number
+}
+`
+	if s := files["/shapes.d.ts"]; s != expected {
+		t.Fatalf("got:\n%s", s)
+	}
+}
+
 func assertContains(t *testing.T, p *ast.Module, expected string) {
 	s, err := ast.Sprint(p)
 	if err != nil {
@@ -26,6 +26,7 @@ func ParseStr(code string) (*ast.Module, error) {
 	}
 
 	p := newContext(nil)
+	p.setCode(code)
 	p.tokens = l.Tokens
 	p.index = 0
 
@@ -51,6 +52,11 @@ type context struct {
 	index         int
 	FS            filesystem.FS
 	importedPaths map[string]bool
+
+	// the code being parsed and the offset of each line to
+	// get the source of type annotations
+	code        string
+	lineOffsets []int
 }
 
 func (p *context) SetFS(fs filesystem.FS) {
@@ -119,6 +125,7 @@ func (p *context) ParseStatements(code, fileName string) (*ast.Module, error) {
 		return nil, err
 	}
 
+	p.setCode(code)
 	p.tokens = l.Tokens
 	p.index = 0
 
@@ -339,6 +346,7 @@ func (p *context) parseCode(code, absPath string) (*ast.File, error) {
 		return nil, err
 	}
 
+	p.setCode(code)
 	p.tokens = l.Tokens
 	p.index = 0
 
@@ -369,11 +377,13 @@ loop:
 			if len(file.Stms) > 0 {
 				return nil, NewError(t.Pos, "non-declaration statement outside function body")
 			}
-			imp, err := p.parseImport()
+			imp, isTypeDef, err := p.parseImport()
 			if err != nil {
 				return nil, err
 			}
-			if imp != nil {
+			if isTypeDef {
+				file.TypeImports = append(file.TypeImports, imp)
+			} else {
 				file.Imports = append(file.Imports, imp)
 			}
 
@@ -393,11 +403,16 @@ loop:
 			file.Stms = append(file.Stms, stmt)
 
 		case ast.INTERFACE:
+			start := p.index
 			if err := p.ignoreInterface(); err != nil {
 				return nil, err
 			}
+			file.Types = append(file.Types, p.typeDecl(t, start, false))
 
 		case ast.EXPORT:
+			start := p.index
+			next := p.peekTwo()
+
 			// parseExportStmtOrNIL can return nil because there is no
 			// equivalent statement like "export interface"
 			exp, err := p.parseExportStmtOrNIL()
@@ -406,15 +421,19 @@ loop:
 			}
 			if exp != nil {
 				file.Stms = append(file.Stms, exp)
+			} else if next.Type == ast.INTERFACE || next.Str == "type" {
+				file.Types = append(file.Types, p.typeDecl(t, start, true))
 			}
 
 		case ast.IDENT:
 			switch t.Str {
 			case "type":
 				// type definitions like: type a = "foo" | "bar";
+				start := p.index
 				if err := p.ignoreTypeDefinition(); err != nil {
 					return nil, err
 				}
+				file.Types = append(file.Types, p.typeDecl(t, start, false))
 
 			case "declare":
 				stmts, err := p.parseDeclareGlobal()
@@ -468,10 +487,12 @@ func (p *context) parseComments() []*ast.Comment {
 	return cs
 }
 
-func (p *context) parseImport() (*ast.ImportStmt, error) {
+// parseImport returns true if the import is a type definition
+// file. They are not compiled.
+func (p *context) parseImport() (*ast.ImportStmt, bool, error) {
 	t, err := p.accept(ast.IMPORT)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
 	s := p.peek()
@@ -480,58 +501,50 @@ func (p *context) parseImport() (*ast.ImportStmt, error) {
 		// if is a source file import: import "foo"
 		p.next()
 		p.ignore(ast.SEMICOLON, 1)
-		if p.isTypeDefinitionFile(s.Str) {
-			// ignore imports to type definition files
-			return nil, nil
-		}
-		return &ast.ImportStmt{Pos: t.Pos, Path: s.Str}, nil
+		imp := &ast.ImportStmt{Pos: t.Pos, Path: s.Str}
+		return imp, p.isTypeDefinitionFile(s.Str), nil
 
 	case ast.LBRACE:
-		return nil, NewError(t.Pos, "Partial imports are not supported. Use import *")
+		return nil, false, NewError(t.Pos, "Partial imports are not supported. Use import *")
 	}
 
 	// it is a module import.
 	// Only full imports are allowed: import * as foo from "x"
 	if _, err := p.accept(ast.MUL); err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
 	a, err := p.acceptIdent()
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	if a.Str != "as" {
-		return nil, NewError(a.Pos, "Expected 'as'")
+		return nil, false, NewError(a.Pos, "Expected 'as'")
 	}
 
 	alias, err := p.accept(ast.IDENT)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
 	if i, err := p.accept(ast.IDENT); err != nil || i.Str != "from" {
-		return nil, err
+		return nil, false, err
 	}
 
 	path, err := p.accept(ast.STRING)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
 	p.ignore(ast.SEMICOLON, 1)
 
-	if p.isTypeDefinitionFile(path.Str) {
-		// ignore imports to type definition files
-		return nil, nil
-	}
-
 	imp := &ast.ImportStmt{
 		Pos:   t.Pos,
 		Alias: alias.Str,
 		Path:  path.Str,
 	}
 
-	return imp, nil
+	return imp, p.isTypeDefinitionFile(path.Str), nil
 }
 
 func (p *context) parseClassDeclStmt() (*ast.ClassDeclStmt, error) {
@@ -607,9 +620,11 @@ func (p *context) parseFuncDeclStmt(exported bool, t *ast.Token) (*ast.FuncDeclS
 	}
 	f.Name = t.Str
 
+	start := p.index
 	if err := p.ignoreGenericDecl(); err != nil {
 		return nil, err
 	}
+	f.TypeParams = p.sourceText(start)
 
 	args, variadic, err := p.parseArguments()
 	if err != nil {
@@ -619,6 +634,7 @@ func (p *context) parseFuncDeclStmt(exported bool, t *ast.Token) (*ast.FuncDeclS
 	f.Variadic = variadic
 	f.Exported = exported
 
+	start = p.index
 	if err := p.ignoreUnionTypeDecl(); err != nil {
 		return nil, err
 	}
@@ -626,6 +642,7 @@ func (p *context) parseFuncDeclStmt(exported bool, t *ast.Token) (*ast.FuncDeclS
 	if err := p.ignoreGenericDecl(); err != nil {
 		return nil, err
 	}
+	f.ReturnType = p.annotation(start)
 
 	body, err := p.parseBlockStmt()
 	if err != nil {
@@ -742,10 +759,15 @@ func (p *context) parseArguments() (*ast.Arguments, bool, error) {
 		}
 
 		t := p.next()
-		fields = append(fields, &ast.Field{Pos: t.Pos, Name: t.Str})
+		field := &ast.Field{Pos: t.Pos, Name: t.Str}
+		fields = append(fields, field)
 
-		p.ignore(ast.QUESTION, 1)
+		if p.peek().Type == ast.QUESTION {
+			p.next()
+			field.Optional = true
+		}
 
+		start := p.index
 		if err := p.ignoreUnionTypeDecl(); err != nil {
 			return nil, false, err
 		}
@@ -753,6 +775,7 @@ func (p *context) parseArguments() (*ast.Arguments, bool, error) {
 		if err := p.ignoreGenericDecl(); err != nil {
 			return nil, false, err
 		}
+		field.Type = p.annotation(start)
 
 		if variadic {
 			if p.peek().Type == ast.COMMA {
@@ -833,7 +856,12 @@ func (p *context) parseStmt() (ast.Stmt, error) {
 		return p.parseEnumDeclStmt()
 	case ast.LET, ast.VAR, ast.CONST:
 		p.next()
-		return p.parseVarDeclStmt()
+		v, err := p.parseVarDeclStmt()
+		if err != nil {
+			return nil, err
+		}
+		v.IsConst = t.Type == ast.CONST
+		return v, nil
 	case ast.NEW:
 		return p.parseNewInstanceStmt()
 	case ast.FOR:
@@ -1817,9 +1845,11 @@ func (p *context) parseVarDeclStmt() (*ast.VarDeclStmt, error) {
 		return nil, err
 	}
 
+	start := p.index
 	if err := p.ignoreUnionTypeDecl(); err != nil {
 		return nil, err
 	}
+	typ := p.annotation(start)
 
 	switch p.peek().Type {
 	case ast.ASSIGN:
@@ -1828,7 +1858,7 @@ func (p *context) parseVarDeclStmt() (*ast.VarDeclStmt, error) {
 	default:
 		p.ignore(ast.SEMICOLON, 1)
 		v := &ast.ConstantExpr{t.Pos, ast.UNDEFINED, "undefined"}
-		return &ast.VarDeclStmt{Pos: t.Pos, Name: t.Str, Value: v}, nil
+		return &ast.VarDeclStmt{Pos: t.Pos, Name: t.Str, Value: v, Type: typ}, nil
 	}
 
 	if _, err := p.accept(ast.ASSIGN); err != nil {
@@ -1841,7 +1871,7 @@ func (p *context) parseVarDeclStmt() (*ast.VarDeclStmt, error) {
 	}
 
 	p.ignore(ast.SEMICOLON, 1)
-	return &ast.VarDeclStmt{Pos: t.Pos, Name: t.Str, Value: right}, nil
+	return &ast.VarDeclStmt{Pos: t.Pos, Name: t.Str, Value: right, Type: typ}, nil
 }
 
 func (p *context) ignoreUnionTypeDecl() error {
@@ -2342,7 +2372,7 @@ func (p *context) parseCallExpr(exp ast.Expr) (*ast.CallExpr, error) {
 		return nil, err
 	}
 
-	args, spread, err := p.parseCallArgs()
+	args, err := p.parseCallArgs()
 	if err != nil {
 		return nil, err
 	}
@@ -2357,16 +2387,13 @@ func (p *context) parseCallExpr(exp ast.Expr) (*ast.CallExpr, error) {
 		Lparen: l.Pos,
 		Args:   args,
 		Rparen: r.Pos,
-		Spread: spread,
 	}
 	return call, nil
 }
 
-func (p *context) parseCallArgs() ([]ast.Expr, bool, error) {
+func (p *context) parseCallArgs() ([]ast.Expr, error) {
 	var args []ast.Expr
 
-	var spread bool
-
 loop:
 	for {
 		t := p.peek()
@@ -2379,32 +2406,38 @@ loop:
 			p.next()
 
 		case ast.PERIOD:
-			for i := 0; i < 3; i++ {
-				if _, err := p.accept(ast.PERIOD); err != nil {
-					return nil, false, NewError(t.Pos, "Expecting spread operator")
-				}
-			}
-			spread = true
-			exp, err := p.parseValueExpression()
+			exp, err := p.parseSpreadExpr()
 			if err != nil {
-				return nil, false, err
+				return nil, err
 			}
 			args = append(args, exp)
-			if p.peek().Type != ast.RPAREN {
-				return nil, false, NewError(t.Pos, "Spread argument must be the last")
-			}
-			break loop
 
 		default:
 			exp, err := p.parseValueExpression()
 			if err != nil {
-				return nil, false, err
+				return nil, err
 			}
 			args = append(args, exp)
 		}
 	}
 
-	return args, spread, nil
+	return args, nil
+}
+
+// parseSpreadExpr parses a spread operator and its value: ...values
+func (p *context) parseSpreadExpr() (*ast.SpreadExpr, error) {
+	t := p.peek()
+	for i := 0; i < 3; i++ {
+		if _, err := p.accept(ast.PERIOD); err != nil {
+			return nil, NewError(t.Pos, "Expecting spread operator")
+		}
+	}
+
+	exp, err := p.parseValueExpression()
+	if err != nil {
+		return nil, err
+	}
+	return &ast.SpreadExpr{Pos: t.Pos, Value: exp}, nil
 }
 
 // A value can be a function or a boolean expression.
@@ -2705,6 +2738,12 @@ loop:
 			break loop
 		case ast.COMMA:
 			p.next()
+		case ast.PERIOD:
+			exp, err := p.parseSpreadExpr()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, ast.KeyValue{Value: exp})
 		default:
 			key := p.next()
 			switch key.Type {
@@ -2738,6 +2777,12 @@ loop:
 			break loop
 		case ast.COMMA:
 			p.next()
+		case ast.PERIOD:
+			exp, err := p.parseSpreadExpr()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, exp)
 		default:
 			exp, err := p.parseValueExpression()
 			if err != nil {
@@ -2877,7 +2922,7 @@ func (p *context) parseNewInstanceExpr() (ast.Expr, error) {
 		return nil, err
 	}
 
-	args, spread, err := p.parseCallArgs()
+	args, err := p.parseCallArgs()
 	if err != nil {
 		return nil, err
 	}
@@ -2892,7 +2937,6 @@ func (p *context) parseNewInstanceExpr() (ast.Expr, error) {
 		Lparen: l.Pos,
 		Args:   args,
 		Rparen: r.Pos,
-		Spread: spread,
 	}
 
 	return n, nil
@@ -2917,6 +2961,11 @@ func (p *context) parseFactor() (ast.Expr, error) {
 		p.next()
 		return &ast.ConstantExpr{t.Pos, t.Type, t.Str}, nil
 
+	case ast.REGEX:
+		p.next()
+		// the methods can be called on the literal like /a+/.test(s)
+		return p.parseValueExpr(&ast.ConstantExpr{t.Pos, t.Type, t.Str})
+
 	case ast.NULL:
 		p.next()
 		// the compiler internally uses nil instead of null.z
@@ -3042,6 +3091,70 @@ func (p *context) peekToken(count int, comments bool) (*ast.Token, int) {
 	}
 }
 
+func (p *context) setCode(code string) {
+	p.code = code
+	p.lineOffsets = []int{0}
+	for i := 0; i < len(code); i++ {
+		if code[i] == '\n' {
+			p.lineOffsets = append(p.lineOffsets, i+1)
+		}
+	}
+}
+
+func (p *context) offset(pos ast.Position) int {
+	if pos.Line < 1 || pos.Line > len(p.lineOffsets) {
+		return -1
+	}
+	return p.lineOffsets[pos.Line-1] + pos.Column - 1
+}
+
+// sourceText returns the code of the tokens parsed since the index. It is
+// used to keep the type annotations that are parsed but not compiled.
+func (p *context) sourceText(from int) string {
+	first, last := -1, -1
+	for i := from; i < p.index && i < len(p.tokens); i++ {
+		if isComment(p.tokens[i]) {
+			continue
+		}
+		if first == -1 {
+			first = i
+		}
+		last = i
+	}
+
+	if first == -1 {
+		return ""
+	}
+
+	// the code ends where the next token starts
+	start := p.offset(p.tokens[first].Pos)
+	end := len(p.code)
+	if last+1 < len(p.tokens) {
+		end = p.offset(p.tokens[last+1].Pos)
+	}
+
+	if start < 0 || start > end || end > len(p.code) {
+		return ""
+	}
+
+	return strings.TrimSpace(p.code[start:end])
+}
+
+// annotation returns the type of a declaration like "a: string".
+func (p *context) annotation(from int) string {
+	s := p.sourceText(from)
+	return strings.TrimSpace(strings.TrimPrefix(s, ":"))
+}
+
+func (p *context) typeDecl(t *ast.Token, from int, exported bool) *ast.TypeDecl {
+	code := p.sourceText(from)
+	if exported {
+		code = strings.TrimSpace(strings.TrimPrefix(code, "export"))
+	}
+	code = strings.TrimSuffix(code, ";")
+	return &ast.TypeDecl{Pos: t.Pos, Exported: exported, Code: code}
+}
+
 func isComment(t *ast.Token) bool {
 	switch t.Type {
 	case ast.COMMENT, ast.MULTILINE_COMMENT: